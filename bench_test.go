@@ -0,0 +1,277 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"testing"
+
+	"github.com/mjibson/go-dsp/fft"
+)
+
+// The benchmarks of the hot paths run on a synthetic library (synthLibrary),
+// the same on each run, so the numbers are comparable between versions and machines.
+
+func BenchmarkImgFFT(b *testing.B) {
+	img := synthImage(0, Width, Width)
+	for _, bm := range []struct {
+		Name string
+		FFT  func(image.Image) *[Width * Width]complex128
+	}{
+		{Name: "pooled", FFT: imgFFT},
+		{Name: "unpooled", FFT: imgFFTUnpooled},
+	} {
+		// in parallel, as the indexing workers call it
+		b.Run(bm.Name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					bm.FFT(img)
+				}
+			})
+		})
+	}
+}
+
+// imgFFTUnpooled is imgFFT allocating its input matrix on each call, without the backingPool.
+func imgFFTUnpooled(img image.Image) *[Width * Width]complex128 {
+	gray := fftInput(img)
+	b := backingPool.New().(*backing)
+	for i, p := range gray.Pix {
+		b.Array[i] = float64(p)
+	}
+	mtx := fft.FFT2Real(b.Matrix)
+	carr := new([Width * Width]complex128)
+	for i, vv := range mtx {
+		for j, v := range vv {
+			carr[i*Width+j] = v
+		}
+	}
+	return carr
+}
+
+// BenchmarkDistances measures the distances of a needle from the whole library, by metric.
+func BenchmarkDistances(b *testing.B) {
+	lib, files := synthLibrary(256), synthKeys(256)
+	needle := synthImage(-1, Width, Width)
+	for _, metric := range []Metric{MetricFFT, MetricColor, MetricFFTColor, MetricPhase, MetricPHash, MetricBlocks, MetricHist} {
+		b.Run(metric.String(), func(b *testing.B) {
+			opts := MatchOptions{Metric: metric, ColorWeight: 1, TopM: 1}
+			thumbnails := lib
+			if name := opts.extraFeature(); name != "" {
+				thumbnails = withFeatures(lib, name)
+			}
+			m := newMatcher(thumbnails, files, opts)
+			f := m.features(needle)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				m.distances(f)
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(files)), "ns/distance")
+		})
+	}
+}
+
+// withFeatures returns the library with the feature computed for its entries.
+func withFeatures(lib map[string]Thumbnail, name string) map[string]Thumbnail {
+	out := make(map[string]Thumbnail, len(lib))
+	for i := 0; i < len(lib); i++ {
+		t := lib[synthKey(i)]
+		t.Features = computeFeatures(synthImage(int64(i), Width, Width), []string{name})
+		out[synthKey(i)] = t
+	}
+	return out
+}
+
+func BenchmarkBuild(b *testing.B) {
+	lib := synthLibrary(256)
+	for _, metric := range []Metric{MetricFFT, MetricColor, MetricFFTColor} {
+		b.Run(metric.String(), func(b *testing.B) {
+			benchBuild(b, lib, Grid{Cols: 16, Rows: 16}, metric, runtime.GOMAXPROCS(0))
+		})
+	}
+}
+
+// BenchmarkBuildWorkers shows the scaling of the parallel matching by the number of workers:
+// the cells/s should grow nearly linearly up to the number of physical cores.
+func BenchmarkBuildWorkers(b *testing.B) {
+	lib := synthLibrary(256)
+	for workers := 1; workers <= runtime.GOMAXPROCS(0); workers *= 2 {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			benchBuild(b, lib, Grid{Cols: 16, Rows: 16}, MetricFFT, workers)
+		})
+	}
+}
+
+// benchBuild matches the target to the library, with the match index already built.
+func benchBuild(b *testing.B, lib map[string]Thumbnail, grid Grid, metric Metric, workers int) {
+	// the Builder's messages would drown the results
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	var opts Options
+	opts.Grid, opts.Workers = grid, workers
+	opts.Match.Metric = metric
+	opts.Match.ColorWeight = 1
+	bld := NewBuilder(opts)
+	bld.thumbnails, bld.files = lib, synthKeys(len(lib))
+	target := synthImage(-1, grid.Cols*Width, grid.Rows*Width)
+	m := bld.getMatcher()
+	ctx := context.Background()
+	compared := m.compared.Load()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := bld.BuildImage(ctx, "synth", target); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(m.compared.Load()-compared)/float64(b.N), "distances/op")
+	b.ReportMetric(float64(b.N*grid.Cols*grid.Rows)/b.Elapsed().Seconds(), "cells/s")
+}
+
+// BenchmarkEntries copies the entries of the library into a map and sorts them by name,
+// as loading and building do: with the FFT coefficients by pointer (Thumbnail's),
+// and by value, as before.
+func BenchmarkEntries(b *testing.B) {
+	lib := synthLibrary(256)
+	type byValue struct {
+		Thumbnail
+		FFT [Width * Width]complex128
+	}
+	b.Run("pointer", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			m := make(map[string]Thumbnail, len(lib))
+			sorted := make([]Thumbnail, 0, len(lib))
+			for k, t := range lib {
+				m[k] = t
+				sorted = append(sorted, t)
+			}
+			sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+		}
+	})
+	b.Run("value", func(b *testing.B) {
+		values := make(map[string]byValue, len(lib))
+		for k, t := range lib {
+			values[k] = byValue{Thumbnail: t, FFT: *t.FFT}
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			m := make(map[string]byValue, len(values))
+			sorted := make([]byValue, 0, len(values))
+			for k, t := range values {
+				m[k] = t
+				sorted = append(sorted, t)
+			}
+			sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+		}
+	})
+}
+
+func BenchmarkDB(b *testing.B) {
+	lib := synthLibrary(256)
+	fn := filepath.Join(b.TempDir(), "mosaic.db")
+	if err := saveDB(fn, newDBHeader(), lib); err != nil {
+		b.Fatal(err)
+	}
+	fi, err := os.Stat(fn)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Run("save", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(fi.Size())
+		for i := 0; i < b.N; i++ {
+			if err := saveDB(fn, newDBHeader(), lib); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("load", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(fi.Size())
+		for i := 0; i < b.N; i++ {
+			if _, _, err := loadDB(fn); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func synthKey(i int) string { return fmt.Sprintf("synth/%04d.png", i) }
+
+// synthKeys returns the keys of the synthLibrary of n, in order.
+func synthKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = synthKey(i)
+	}
+	return keys
+}
+
+// synthLibrary returns the DB entries of n synthetic sources, keyed by synthKey.
+func synthLibrary(n int) map[string]Thumbnail {
+	lib := make(map[string]Thumbnail, n)
+	for i := 0; i < n; i++ {
+		img := synthImage(int64(i), Width, Width)
+		t := Thumbnail{Name: synthKey(i), Size: int64(len(img.Pix)), Params: currentParams(FitStretch)}
+		t.FFT = imgFFT(img)
+		t.Color = avgColor(img)
+		lib[synthKey(i)] = t
+	}
+	return lib
+}
+
+// synthImage returns a deterministic image of the seed: a color gradient
+// overlaid with a few waves of random direction and frequency, for some structure.
+func synthImage(seed int64, width, height int) *image.NRGBA {
+	rng := rand.New(rand.NewSource(seed))
+	from := color.NRGBA{R: uint8(rng.Intn(256)), G: uint8(rng.Intn(256)), B: uint8(rng.Intn(256)), A: 255}
+	to := color.NRGBA{R: uint8(rng.Intn(256)), G: uint8(rng.Intn(256)), B: uint8(rng.Intn(256)), A: 255}
+	type wave struct{ fx, fy, phase, amp float64 }
+	waves := make([]wave, 1+rng.Intn(3))
+	for i := range waves {
+		waves[i] = wave{fx: rng.Float64() * 8, fy: rng.Float64() * 8, phase: rng.Float64() * 2 * math.Pi, amp: 20 + rng.Float64()*40}
+	}
+	mix := func(a, b uint8, t, d float64) uint8 {
+		return uint8(math.Max(0, math.Min(255, float64(a)+(float64(b)-float64(a))*t+d)))
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			u, v := float64(x)/float64(width), float64(y)/float64(height)
+			var d float64
+			for _, w := range waves {
+				d += w.amp * math.Sin(2*math.Pi*(w.fx*u+w.fy*v)+w.phase)
+			}
+			img.SetNRGBA(x, y, color.NRGBA{R: mix(from.R, to.R, u, d), G: mix(from.G, to.G, v, d), B: mix(from.B, to.B, (u+v)/2, d), A: 255})
+		}
+	}
+	return img
+}
@@ -0,0 +1,338 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/disintegration/imaging"
+	"github.com/pkg/errors"
+)
+
+// Builder builds mosaics from a library of sources: the sources are indexed once,
+// by AddSources, and then any number of targets can be matched by Build.
+type Builder struct {
+	opts Options
+	// Timings of the phases.
+	Timings *Timings
+	// Indexed is the number of sources indexed (not found in the DB) so far.
+	Indexed int
+	// Explain receives the closest candidates of each cell, and why the source was chosen.
+	Explain io.Writer
+
+	files      []string
+	added      map[string]bool // of files
+	thumbnails map[string]Thumbnail
+	hdr        dbHeader // of the DB the thumbnails are loaded from
+	matcher    *matcher
+	mask       image.Image
+}
+
+// NewBuilder returns an empty Builder.
+func NewBuilder(opts Options) *Builder {
+	return &Builder{opts: opts, Timings: new(Timings), thumbnails: make(map[string]Thumbnail), added: make(map[string]bool)}
+}
+
+// explain writes the choice for the cell to Explain.
+func (b *Builder) explain(target string, row, col int, m *matcher, c choice) {
+	if c.Reason == "" {
+		fmt.Fprintf(b.Explain, "%s r%03d_c%03d: no sources left (-max-reuse=%d)\n\n", target, row, col, b.opts.Match.MaxReuse)
+		return
+	}
+	best := m.candidates[c.Best.Index]
+	var aliases string
+	if len(best.Aliases) != 0 {
+		aliases = " (same as " + strings.Join(best.Aliases, ", ") + ")"
+	}
+	fmt.Fprintf(b.Explain, "%s r%03d_c%03d: %s%s, %s\n", target, row, col, best.Path, aliases, c.Reason)
+	for i, t := range c.Top {
+		mark := ""
+		if t.Index == c.Best.Index {
+			mark = " *"
+		}
+		fmt.Fprintf(b.Explain, "  %d. %s %.4g%s\n", i+1, m.candidates[t.Index].Path, t.Dist, mark)
+	}
+	fmt.Fprintln(b.Explain)
+}
+
+// AddSources indexes the files, and adds them to the library.
+//
+// A *NotPersistedError means the sources are added, just not saved to the DB;
+// a *SourcesFailedError that some could not be indexed (by the best-effort Errors policy).
+func (b *Builder) AddSources(ctx context.Context, files []string) error {
+	files = append([]string(nil), files...)
+	hdr, thumbnails, indexed, err := prepareDB(ctx, b.opts, files, b.Timings)
+	b.Indexed += indexed
+	b.hdr = hdr
+	for k, t := range thumbnails {
+		b.thumbnails[k] = t
+	}
+	// the unusable ones, too: they have a cell in the default grid
+	for _, fn := range files {
+		// the same file under different names is added once
+		if !b.added[fn] {
+			b.added[fn] = true
+			b.files = append(b.files, fn)
+		}
+	}
+	b.matcher = nil
+	return err
+}
+
+// emptyPlan returns the plan without tiles for n files: of the Grid option,
+// or a square grid with a cell for each.
+func (b *Builder) emptyPlan(n int) Plan {
+	grid := b.opts.Grid
+	if grid.Cols == 0 || grid.Rows == 0 {
+		side := 3
+		for side*side < n {
+			side++
+		}
+		grid = Grid{Cols: side, Rows: side}
+	}
+	plan := Plan{Rows: grid.Rows, Cols: grid.Cols, TileSize: Width}
+	if b.opts.RenderSize > 0 {
+		plan.TileSize = b.opts.RenderSize
+	}
+	return plan
+}
+
+// getMatcher returns the matcher of the library, building it on the first call after AddSources.
+func (b *Builder) getMatcher() *matcher {
+	if b.matcher != nil {
+		return b.matcher
+	}
+	stop := b.Timings.Start("match index")
+	var built int
+	files := b.opts.Exif.filter(b.thumbnails, b.files)
+	if len(files) != len(b.files) {
+		log.Printf("using %d of the %d sources, by their EXIF", len(files), len(b.files))
+	}
+	opts := b.opts.Match.monoFallback(b.thumbnails, files)
+	if idxFn := matchIndexFile(b.opts.store()); idxFn != "" && b.opts.MatchIndex {
+		b.matcher, built = loadMatcher(idxFn, !b.opts.DBReadOnly, b.hdr, b.thumbnails, files, opts)
+	} else {
+		b.matcher = newMatcher(b.thumbnails, files, opts)
+		built = len(b.matcher.candidates)
+	}
+	stop(built)
+	return b.matcher
+}
+
+// cellMatch is a cell of the target, with the ranking of the candidates for it.
+type cellMatch struct {
+	Row, Col int
+	// Pinned is the source pinned to the cell, which is not ranked.
+	Pinned string
+	// Masked is whether the cell is left out by the mask.
+	Masked  bool
+	ranking ranking
+	err     error
+}
+
+// prepareCells computes the rankings of the cells on the workers.
+// The cells are left unprepared after ctx is canceled.
+func (b *Builder) prepareCells(ctx context.Context, m *matcher, tgt, mask *image.NRGBA, cells []cellMatch, top, workers int) {
+	next := make(chan *cellMatch)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for c := range next {
+				if ctx.Err() == nil {
+					b.prepareCell(m, tgt, mask, c, top)
+				}
+			}
+		}()
+	}
+	for i := range cells {
+		if cells[i].Pinned == "" {
+			next <- &cells[i]
+		}
+	}
+	close(next)
+	wg.Wait()
+}
+
+// prepareCell crops the cell from the target, and prepares its ranking, unless it's masked out.
+func (b *Builder) prepareCell(m *matcher, tgt, mask *image.NRGBA, c *cellMatch, top int) {
+	bounds := tgt.Bounds()
+	cell := image.Rect(c.Col*Width, c.Row*Width, (c.Col+1)*Width, (c.Row+1)*Width).Add(bounds.Min)
+	if mask != nil && isTransparent(mask, cell.Sub(bounds.Min)) {
+		c.Masked = true
+		return
+	}
+	crop := imaging.Crop(tgt, cell)
+	if dir := b.opts.DumpFeatures; dir != "" {
+		fn := filepath.Join(dir, fmt.Sprintf("r%03d_c%03d.png", c.Row, c.Col))
+		if err := imaging.Save(b.opts.Match.Prefilter.Apply(fftInputSize(crop, b.opts.Match.size())), fn); err != nil {
+			c.err = errors.Wrap(err, fn)
+			return
+		}
+	}
+	c.ranking = m.prepare(crop, top)
+}
+
+// Build matches the sources to the cells of the target.
+func (b *Builder) Build(ctx context.Context, targetFn string) (Plan, error) {
+	plan := b.emptyPlan(len(b.files))
+	if len(b.getMatcher().candidates) == 0 {
+		return Plan{}, ErrNoSources
+	}
+	target, err := openTarget(ctx, targetFn, plan.Cols*Width, plan.Rows*Width, b.opts.RasterizeCmd)
+	if err != nil {
+		return Plan{}, err
+	}
+	if target, err = b.opts.Region.crop(targetFn, target); err != nil {
+		return Plan{}, err
+	}
+	return b.BuildImage(ctx, targetFn, target)
+}
+
+// BuildImage is Build of the decoded target, named targetFn in the messages.
+func (b *Builder) BuildImage(ctx context.Context, targetFn string, target image.Image) (Plan, error) {
+	opts := b.opts
+	plan := b.emptyPlan(len(b.files))
+	m := b.getMatcher()
+	m.uses = nil // a new mosaic can use all the sources again
+	if len(m.candidates) == 0 {
+		return Plan{}, ErrNoSources
+	}
+	if opts.AllowSelf {
+		m.excluded = nil
+	} else if m.exclude(targetFn) == 0 {
+		return Plan{}, errors.Wrapf(ErrNoSources, "%s: the target is the only source (see -allow-self)", targetFn)
+	}
+
+	log.Printf("Will use %d*%d=%d files", plan.Cols, plan.Rows, plan.Cols*plan.Rows)
+
+	// The target is resized to whole cells, so there are no partial tiles on the edges.
+	tgt := imaging.Resize(target, plan.Cols*Width, plan.Rows*Width, imaging.Lanczos)
+	bounds := tgt.Bounds()
+	if bounds.Dx() != plan.Cols*Width || bounds.Dy() != plan.Rows*Width {
+		return Plan{}, errors.Errorf("%s: resized to %dx%d instead of %dx%d", targetFn,
+			bounds.Dx(), bounds.Dy(), plan.Cols*Width, plan.Rows*Width)
+	}
+	if opts.DumpFeatures != "" {
+		if err := os.MkdirAll(opts.DumpFeatures, 0755); err != nil {
+			return Plan{}, errors.Wrap(err, opts.DumpFeatures)
+		}
+	}
+	var mask *image.NRGBA
+	var err error
+	if opts.Mask != "" {
+		if b.mask == nil {
+			if b.mask, err = openImage(ctx, opts.Mask); err != nil {
+				return Plan{}, err
+			}
+		}
+		mask = imaging.Resize(b.mask, bounds.Dx(), bounds.Dy(), imaging.Linear)
+	}
+	pinned := make(map[image.Point]string, len(opts.Pins))
+	for _, p := range opts.Pins {
+		if p.Row >= plan.Rows || p.Col >= plan.Cols {
+			return Plan{}, errors.Errorf("pin %d,%d: outside of the %dx%d grid", p.Row, p.Col, plan.Cols, plan.Rows)
+		}
+		pinned[image.Pt(p.Col, p.Row)] = p.Source
+	}
+	// the distances computed show the throughput of the metric, independent of the grid
+	compared := m.compared.Load()
+	stop, stopDist := b.Timings.Start("matching"), b.Timings.StartNested("distances")
+	defer func() {
+		stop(len(plan.Tiles))
+		stopDist(int(m.compared.Load() - compared))
+	}()
+	var top int
+	if b.Explain != nil {
+		top = 3
+	}
+	// The cells are matched in two phases, a chunk of them at a time (to bound the memory):
+	// their features and rankings are computed by the workers, then the sources are picked
+	// in the order of the cells, as MaxReuse and Jitter depend on the choices before.
+	cells := make([]cellMatch, 0, plan.Rows*plan.Cols)
+	for row := 0; row < plan.Rows; row++ {
+		for col := 0; col < plan.Cols; col++ {
+			cells = append(cells, cellMatch{Row: row, Col: col, Pinned: pinned[image.Pt(col, row)]})
+		}
+	}
+	progress.Begin(phaseMatch, plan.Rows)
+	defer progress.End()
+	workers := max(opts.Workers, 1)
+	for start := 0; start < len(cells); start += 4 * workers {
+		chunk := cells[start:min(start+4*workers, len(cells))]
+		b.prepareCells(ctx, m, tgt, mask, chunk, top, workers)
+		for i := range chunk {
+			row, col := chunk[i].Row, chunk[i].Col
+			if err := ctx.Err(); err != nil {
+				if opts.Partial != "" {
+					if wErr := plan.WriteFile(opts.Partial); wErr != nil {
+						log.Println(wErr)
+					} else {
+						log.Printf("partial plan of %d tiles written to %q", len(plan.Tiles), opts.Partial)
+					}
+				}
+				return plan, errors.Wrap(err, "matching")
+			}
+			if src := chunk[i].Pinned; src != "" {
+				m.use(src)
+				if b.Explain != nil {
+					fmt.Fprintf(b.Explain, "%s r%03d_c%03d: %s, pinned (-pin)\n\n", targetFn, row, col, src)
+				}
+				plan.Tiles = append(plan.Tiles, Placement{Row: row, Col: col, Source: src})
+				continue
+			}
+			if chunk[i].Masked {
+				continue
+			}
+			if err := chunk[i].err; err != nil {
+				return plan, err
+			}
+			var found string
+			c, ok := m.pick(chunk[i].ranking)
+			if ok {
+				found = m.candidates[c.Best.Index].Path
+			}
+			if b.Explain != nil {
+				b.explain(targetFn, row, col, m, c)
+			}
+			if found == "" {
+				log.Printf("r%03d_c%03d: all sources are used up (-max-reuse=%d)", row, col, opts.Match.MaxReuse)
+				continue
+			}
+			if opts.Verbose {
+				log.Println(found)
+			}
+			plan.Tiles = append(plan.Tiles, Placement{Row: row, Col: col, Source: found})
+		}
+		progress.Update((start+len(chunk))/plan.Cols, 0, 0)
+	}
+	progress.End()
+	sources := make([]string, len(m.candidates))
+	for i, c := range m.candidates {
+		sources[i] = c.Path
+	}
+	log.Println(plan.Usage(sources))
+	return plan, nil
+}
@@ -0,0 +1,500 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/pkg/errors"
+)
+
+func TestNoSources(t *testing.T) {
+	for _, tc := range []struct {
+		Name    string
+		Garbage int
+		Valid   int
+		WantErr error
+	}{
+		{Name: "only the target", WantErr: ErrNoSources},
+		{Name: "undecodable", Garbage: 3, WantErr: ErrNoSources},
+		{Name: "one valid", Garbage: 3, Valid: 1},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			files := []string{writeImage(t, dir, "target.png", synthImage(-1, Width, Width))}
+			for i := 0; i < tc.Garbage; i++ {
+				fn := filepath.Join(dir, "garbage"+string(rune('a'+i))+".png")
+				if err := os.WriteFile(fn, []byte("not an image"), 0644); err != nil {
+					t.Fatal(err)
+				}
+				files = append(files, fn)
+			}
+			files = append(files, testLibrary(t, dir, tc.Valid)...)
+			opts := testOptions()
+			opts.Grid = Grid{Cols: 2, Rows: 2}
+			plan, _, err := buildPlan(context.Background(), opts, files, new(Timings))
+			if tc.WantErr != nil {
+				if !errors.Is(err, tc.WantErr) {
+					t.Errorf("got %v, wanted %v", err, tc.WantErr)
+				}
+				return
+			}
+			if err != nil && !isWarning(err) {
+				t.Fatal(err)
+			}
+			if len(plan.Tiles) != 4 {
+				t.Errorf("got %d tiles, wanted 4", len(plan.Tiles))
+			}
+		})
+	}
+}
+
+func TestEmptyBuilder(t *testing.T) {
+	target := writeImage(t, t.TempDir(), "target.png", synthImage(-1, Width, Width))
+	if _, err := NewBuilder(testOptions()).Build(context.Background(), target); !errors.Is(err, ErrNoSources) {
+		t.Errorf("got %v, wanted %v", err, ErrNoSources)
+	}
+	if got := newMatcher(nil, nil, MatchOptions{Metric: MetricFFT}).Nearest(synthImage(1, Width, Width)); got != "" {
+		t.Errorf("an empty matcher found %q", got)
+	}
+}
+
+func TestDumpFeatures(t *testing.T) {
+	dir := t.TempDir()
+	files := testLibrary(t, dir, 4)
+	for _, grid := range []Grid{{Cols: 1, Rows: 1}, {Cols: 3, Rows: 2}, {Cols: 2, Rows: 5}} {
+		t.Run(grid.String(), func(t *testing.T) {
+			opts := testOptions()
+			opts.Grid = grid
+			opts.DumpFeatures = filepath.Join(t.TempDir(), "features")
+			b := NewBuilder(opts)
+			ctx := context.Background()
+			if err := b.AddSources(ctx, files); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := b.BuildImage(ctx, "target", synthImage(-1, grid.Cols*Width, grid.Rows*Width)); err != nil {
+				t.Fatal(err)
+			}
+			dumps, err := os.ReadDir(opts.DumpFeatures)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(dumps) != grid.Cols*grid.Rows {
+				t.Errorf("got %d dumps, wanted %d", len(dumps), grid.Cols*grid.Rows)
+			}
+			last := fmt.Sprintf("r%03d_c%03d.png", grid.Rows-1, grid.Cols-1)
+			img, err := imaging.Open(filepath.Join(opts.DumpFeatures, last))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size := img.Bounds().Size(); size != image.Pt(Width, Width) {
+				t.Errorf("%s is %v, wanted %dx%d", last, size, Width, Width)
+			}
+		})
+	}
+}
+
+func TestCircularMask(t *testing.T) {
+	dir := t.TempDir()
+	const n = 4
+	// a circle of 1.3 cells radius, leaving the corner cells fully transparent
+	mask := image.NewNRGBA(image.Rect(0, 0, n*Width, n*Width))
+	for y := 0; y < n*Width; y++ {
+		for x := 0; x < n*Width; x++ {
+			if math.Hypot(float64(x)-n*Width/2, float64(y)-n*Width/2) < 1.3*Width {
+				mask.Pix[mask.PixOffset(x, y)+3] = 255
+			}
+		}
+	}
+	target := writeImage(t, dir, "target.png", synthImage(-1, n*Width, n*Width))
+	opts := testOptions()
+	opts.Grid = Grid{Cols: n, Rows: n}
+	opts.Mask = writeImage(t, dir, "mask.png", mask)
+	opts.Render.Background = color.NRGBA{R: 12, G: 34, B: 56, A: 255}
+	opts.Out = filepath.Join(dir, "out.png")
+	opts.Sidecar = filepath.Join(dir, "plan.json")
+	if err := Main(context.Background(), opts, append([]string{target}, testLibrary(t, dir, 4)...)); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := readPlan(opts.Sidecar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiled := make(map[image.Point]bool)
+	for _, p := range plan.Tiles {
+		tiled[image.Pt(p.Col, p.Row)] = true
+	}
+	out, err := imaging.Open(opts.Out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for row := 0; row < n; row++ {
+		for col := 0; col < n; col++ {
+			corner := (row == 0 || row == n-1) && (col == 0 || col == n-1)
+			if tiled[image.Pt(col, row)] == corner {
+				t.Errorf("r%d c%d: tiled is %t", row, col, !corner)
+			}
+			if !corner {
+				continue
+			}
+			cell := plan.Cell(Placement{Row: row, Col: col})
+			if d := meanAbsDiff(imaging.Crop(out, cell), solidImage(cell.Dx(), cell.Dy(), opts.Render.Background)); d != 0 {
+				t.Errorf("corner r%d c%d differs from the background by %g", row, col, d)
+			}
+		}
+	}
+}
+
+func TestBuildReusesSources(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for i := 0; i < 4; i++ {
+		fn := filepath.Join(dir, fmt.Sprintf("src%d.raw", i))
+		if err := os.WriteFile(fn, []byte{byte(i)}, 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, fn)
+	}
+	// the sources are counted by their decoding
+	var decoded atomic.Int32
+	fakeRawDecoder(t, func(ctx context.Context, fn string) (image.Image, error) {
+		decoded.Add(1)
+		b, err := os.ReadFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		return synthImage(int64(b[0]), Width, Width), nil
+	})
+
+	b := NewBuilder(testOptions())
+	ctx := context.Background()
+	if err := b.AddSources(ctx, files); err != nil {
+		t.Fatal(err)
+	}
+	if got := decoded.Load(); got != 4 {
+		t.Fatalf("decoded %d sources, wanted 4", got)
+	}
+	for i, seed := range []int64{-1, -2, -3} {
+		target := writeImage(t, dir, fmt.Sprintf("target%d.png", i), synthImage(seed, Width, Width))
+		if _, err := b.Build(ctx, target); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := decoded.Load(); got != 4 || b.Indexed != 4 {
+		t.Errorf("decoded %d sources, indexed %d, wanted 4 by AddSources only", got, b.Indexed)
+	}
+	phases := make(map[string]int)
+	for _, p := range b.Timings.Phases {
+		phases[p.Name]++
+	}
+	if phases["indexing"] != 1 || phases["match index"] != 1 {
+		t.Errorf("got the phases %v, wanted indexing and the match index once", phases)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for _, v := range []uint8{120, 124, 127, 131, 135} {
+		files = append(files, writeImage(t, dir, fmt.Sprintf("gray%d.png", v), solidImage(Width, Width, color.NRGBA{R: v, G: v, B: v, A: 255})))
+	}
+	// flat: the same cell everywhere
+	target := solidImage(4*Width, 4*Width, color.NRGBA{R: 128, G: 128, B: 128, A: 255})
+	ctx := context.Background()
+	build := func(jitter float64, seed int64) Plan {
+		opts := testOptions()
+		opts.Grid = Grid{Cols: 4, Rows: 4}
+		opts.Match.Metric = MetricColor
+		opts.Match.Jitter, opts.Match.Seed = jitter, seed
+		b := NewBuilder(opts)
+		if err := b.AddSources(ctx, files); err != nil {
+			t.Fatal(err)
+		}
+		plan, err := b.BuildImage(ctx, "target", target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return plan
+	}
+	for _, tc := range []struct {
+		Name        string
+		Jitter      float64
+		MinDistinct int
+		MaxDistinct int
+	}{
+		{Name: "none", MinDistinct: 1, MaxDistinct: 1},
+		{Name: "within all", Jitter: 10, MinDistinct: 2, MaxDistinct: len(files)},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			plan := build(tc.Jitter, 42)
+			if u := plan.Usage(files); u.Distinct < tc.MinDistinct || u.Distinct > tc.MaxDistinct {
+				t.Errorf("got %d distinct sources, wanted %d to %d", u.Distinct, tc.MinDistinct, tc.MaxDistinct)
+			}
+			// the same seed, the same choices
+			if again := build(tc.Jitter, 42); !reflect.DeepEqual(again.Tiles, plan.Tiles) {
+				t.Errorf("got %v, then %v with the same seed", plan.Tiles, again.Tiles)
+			}
+		})
+	}
+}
+
+func TestPartialCells(t *testing.T) {
+	dir := t.TempDir()
+	red, blue := color.NRGBA{R: 250, G: 10, B: 10, A: 255}, color.NRGBA{R: 10, G: 10, B: 250, A: 255}
+	files := []string{
+		writeImage(t, dir, "red.png", solidImage(Width, Width, red)),
+		writeImage(t, dir, "blue.png", solidImage(Width, Width, blue)),
+	}
+	opts := testOptions()
+	opts.Grid = Grid{Cols: 3, Rows: 2}
+	opts.Match.Metric = MetricColor
+	b := NewBuilder(opts)
+	ctx := context.Background()
+	if err := b.AddSources(ctx, files); err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []image.Point{{301, 170}, {97, 50}, {1000, 333}, {3 * Width, 2 * Width}} {
+		t.Run(fmt.Sprintf("%dx%d", size.X, size.Y), func(t *testing.T) {
+			// the last third blue: the last column, whatever the cell size in the target is
+			target := solidImage(size.X, size.Y, red)
+			draw.Draw(target, image.Rect(size.X*2/3+1, 0, size.X, size.Y), image.NewUniform(blue), image.Point{}, draw.Src)
+			plan, err := b.BuildImage(ctx, "target", target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(plan.Tiles) != 6 {
+				t.Fatalf("got %d tiles, wanted 6", len(plan.Tiles))
+			}
+			for _, p := range plan.Tiles {
+				want := "red.png"
+				if p.Col == 2 {
+					want = "blue.png"
+				}
+				if got := filepath.Base(p.Source); got != want {
+					t.Errorf("r%d_c%d: got %s, wanted %s", p.Row, p.Col, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestExplain(t *testing.T) {
+	files := testLibrary(t, t.TempDir(), 5)
+	opts := testOptions()
+	opts.Grid = Grid{Cols: 3, Rows: 2}
+	b := NewBuilder(opts)
+	var buf bytes.Buffer
+	b.Explain = &buf
+	ctx := context.Background()
+	if err := b.AddSources(ctx, files); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := b.BuildImage(ctx, "target", synthImage(-1, 3*Width, 2*Width))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the explanations of the cells are separated by empty lines
+	explained := strings.Split(strings.TrimSpace(buf.String()), "\n\n")
+	if len(explained) != len(plan.Tiles) {
+		t.Fatalf("got %d explanations for %d tiles:\n%s", len(explained), len(plan.Tiles), buf.String())
+	}
+	for i, p := range plan.Tiles {
+		lines := strings.Split(explained[i], "\n")
+		if want := fmt.Sprintf("target r%03d_c%03d: %s, ", p.Row, p.Col, p.Source); !strings.HasPrefix(lines[0], want) {
+			t.Errorf("got %q, wanted %q", lines[0], want)
+		}
+		if len(lines) != 4 {
+			t.Errorf("r%d_c%d: got %d candidates, wanted the top 3", p.Row, p.Col, len(lines)-1)
+			continue
+		}
+		// without constraints the chosen one is the closest
+		if first := "  1. " + p.Source + " "; !strings.HasPrefix(lines[1], first) || !strings.HasSuffix(lines[1], " *") {
+			t.Errorf("r%d_c%d: got %q, wanted %q as the first, marked", p.Row, p.Col, lines[1], p.Source)
+		}
+	}
+}
+
+func TestPin(t *testing.T) {
+	dir := t.TempDir()
+	red, blue := color.NRGBA{R: 250, G: 10, B: 10, A: 255}, color.NRGBA{R: 10, G: 10, B: 250, A: 255}
+	files := []string{
+		writeImage(t, dir, "red.png", solidImage(Width, Width, red)),
+		writeImage(t, dir, "blue.png", solidImage(Width, Width, blue)),
+	}
+	target := solidImage(3*Width, 3*Width, red)
+	for _, tc := range []struct {
+		Pin     string
+		Want    image.Point // of the blue cell
+		WantErr string
+	}{
+		{Pin: "1,1=" + files[1], Want: image.Pt(1, 1)},
+		{Pin: "0,2=" + files[1], Want: image.Pt(2, 0)},
+		{Pin: "3,0=" + files[1], WantErr: "outside of the 3x3 grid"},
+	} {
+		t.Run(tc.Pin[:3], func(t *testing.T) {
+			opts := testOptions()
+			opts.Grid = Grid{Cols: 3, Rows: 3}
+			opts.Match.Metric = MetricColor
+			if err := (*pinsFlag)(&opts.Pins).Set(tc.Pin); err != nil {
+				t.Fatal(err)
+			}
+			b := NewBuilder(opts)
+			ctx := context.Background()
+			if err := b.AddSources(ctx, files); err != nil {
+				t.Fatal(err)
+			}
+			plan, err := b.BuildImage(ctx, "target", target)
+			if tc.WantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.WantErr) {
+					t.Errorf("got %v, wanted %q", err, tc.WantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(plan.Tiles) != 9 {
+				t.Fatalf("got %d tiles, wanted 9", len(plan.Tiles))
+			}
+			for _, p := range plan.Tiles {
+				want := "red.png"
+				if image.Pt(p.Col, p.Row) == tc.Want {
+					want = "blue.png"
+				}
+				if got := filepath.Base(p.Source); got != want {
+					t.Errorf("r%d_c%d: got %s, wanted %s", p.Row, p.Col, got, want)
+				}
+			}
+
+			canvas, err := renderPlan(ctx, opts, plan, b.thumbnails)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer releaseCanvas(canvas)
+			size := canvas.Bounds().Dx() / 3
+			got := color.NRGBAModel.Convert(canvas.At(tc.Want.X*size+size/2, tc.Want.Y*size+size/2)).(color.NRGBA)
+			if absDiff(got.B, blue.B) > 16 || absDiff(got.R, blue.R) > 16 {
+				t.Errorf("the pinned cell is %v, wanted %v", got, blue)
+			}
+		})
+	}
+}
+
+func TestMonoFallbackStructure(t *testing.T) {
+	dir := t.TempDir()
+	dark, light := color.NRGBA{R: 60, G: 60, B: 60, A: 255}, color.NRGBA{R: 196, G: 196, B: 196, A: 255}
+	files := []string{
+		writeImage(t, dir, "flat.png", solidImage(Width, Width, color.NRGBA{R: 128, G: 128, B: 128, A: 255})),
+		writeImage(t, dir, "stripes.png", stripes(Width, Width, 8, dark, light)),
+	}
+	opts := testOptions()
+	opts.Grid = Grid{Cols: 1, Rows: 1}
+	opts.Match.Metric, opts.Match.MonoSpread = MetricColor, 2
+	b := NewBuilder(opts)
+	ctx := context.Background()
+	if err := b.AddSources(ctx, files); err != nil {
+		t.Fatal(err)
+	}
+	// the average colors are the same: only the structure tells them apart
+	plan, err := b.BuildImage(ctx, "target", stripes(Width, Width, 8, dark, light))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := b.getMatcher().opts.Metric; got != MetricFFTColor {
+		t.Errorf("matched by %s, wanted %s", got, MetricFFTColor)
+	}
+	if len(plan.Tiles) != 1 || filepath.Base(plan.Tiles[0].Source) != "stripes.png" {
+		t.Errorf("got %v, wanted stripes.png", plan.Tiles)
+	}
+}
+
+func TestExcludeSelf(t *testing.T) {
+	dir := t.TempDir()
+	target := synthImage(7, 2*Width, 2*Width)
+	targetFn := writeImage(t, dir, "target.png", target)
+	b, err := os.ReadFile(targetFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a copy of it is the same source, when both are
+	copyFn := filepath.Join(dir, "copy.png")
+	if err := os.WriteFile(copyFn, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	others := []string{
+		writeImage(t, dir, "a.png", synthImage(8, Width, Width)),
+		writeImage(t, dir, "b.png", synthImage(9, Width, Width)),
+	}
+	for _, tc := range []struct {
+		Name      string
+		Sources   []string
+		AllowSelf bool
+		// Self is whether the target is expected to be a tile of the mosaic
+		Self    bool
+		WantErr error
+	}{
+		// as "mosaic target.png *.png"
+		{Name: "glob", Sources: append([]string{targetFn}, others...)},
+		// and a copy of it, its alias
+		{Name: "copy", Sources: append([]string{copyFn, targetFn}, others...)},
+		{Name: "allow-self", Sources: append([]string{targetFn}, others...), AllowSelf: true, Self: true},
+		{Name: "only itself", Sources: []string{targetFn}, WantErr: ErrNoSources},
+		{Name: "only itself allowed", Sources: []string{targetFn}, AllowSelf: true, Self: true},
+	} {
+		for _, grid := range []Grid{{Cols: 1, Rows: 1}, {Cols: 2, Rows: 2}} {
+			t.Run(fmt.Sprintf("%s/%s", tc.Name, grid), func(t *testing.T) {
+				opts := testOptions()
+				opts.Grid = grid
+				opts.AllowSelf = tc.AllowSelf
+				b := NewBuilder(opts)
+				ctx := context.Background()
+				if err := b.AddSources(ctx, tc.Sources); err != nil {
+					t.Fatal(err)
+				}
+				plan, err := b.Build(ctx, targetFn)
+				if !errors.Is(err, tc.WantErr) {
+					t.Fatalf("got %v, wanted %v", err, tc.WantErr)
+				} else if err != nil {
+					return
+				}
+				var self int
+				for _, p := range plan.Tiles {
+					if p.Source == targetFn || p.Source == copyFn {
+						self++
+					}
+				}
+				if !tc.Self && self != 0 {
+					t.Errorf("the target is %d tiles of its mosaic: %v", self, plan.Tiles)
+				} else if tc.Self && grid.Cols == 1 && self != 1 {
+					t.Errorf("got %v, wanted the target itself, with -allow-self", plan.Tiles)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// cancelingWriter cancels on the first write.
+type cancelingWriter struct {
+	cancel context.CancelFunc
+	once   sync.Once
+}
+
+func (w *cancelingWriter) Write(p []byte) (int, error) {
+	w.once.Do(w.cancel)
+	return len(p), nil
+}
+
+// errAfterCtx is canceled after its Err has been called n times, in the middle of a loop checking it.
+type errAfterCtx struct {
+	context.Context
+	n atomic.Int32
+}
+
+func (c *errAfterCtx) Err() error {
+	if c.n.Add(-1) < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+// checkGoroutines fails the test if the number of goroutines doesn't return to before in a while.
+func checkGoroutines(t *testing.T, before int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		n := runtime.NumGoroutine()
+		if n <= before {
+			return
+		}
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Errorf("%d goroutines left running, %d before:\n%s", n, before, buf[:runtime.Stack(buf, true)])
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCancelPhases(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for i := 0; i < 16; i++ {
+		fn := filepath.Join(dir, "src"+string(rune('a'+i))+".raw")
+		if err := os.WriteFile(fn, []byte(fn), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, fn)
+	}
+	target := synthImage(-1, 8*Width, 8*Width)
+	// cancel is called by the decoder when cancelDecode is set
+	var cancelDecode atomic.Pointer[context.CancelFunc]
+	fakeRawDecoder(t, func(ctx context.Context, fn string) (image.Image, error) {
+		if cancel := cancelDecode.Load(); cancel != nil {
+			(*cancel)()
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return synthImage(int64(len(fn)), Width, Width), nil
+	})
+
+	for _, tc := range []struct {
+		Phase string
+		// Run runs the phase, canceling it with cancel in the middle.
+		Run func(ctx context.Context, cancel context.CancelFunc, opts Options) error
+	}{
+		{Phase: "indexing", Run: func(ctx context.Context, cancel context.CancelFunc, opts Options) error {
+			cancelDecode.Store(&cancel)
+			defer cancelDecode.Store(nil)
+			_, _, err := prepareThumbnails(ctx, opts, append([]string(nil), files...), new(Timings))
+			return err
+		}},
+		{Phase: "matching", Run: func(ctx context.Context, cancel context.CancelFunc, opts Options) error {
+			b := NewBuilder(opts)
+			if err := b.AddSources(context.Background(), files); err != nil {
+				return err
+			}
+			// after the first cell matched
+			b.Explain = &cancelingWriter{cancel: cancel}
+			_, err := b.BuildImage(ctx, "target", target)
+			return err
+		}},
+		{Phase: "rendering", Run: func(ctx context.Context, cancel context.CancelFunc, opts Options) error {
+			b := NewBuilder(opts)
+			if err := b.AddSources(context.Background(), files); err != nil {
+				return err
+			}
+			plan, err := b.BuildImage(context.Background(), "target", target)
+			if err != nil {
+				return err
+			}
+			cancelDecode.Store(&cancel)
+			defer cancelDecode.Store(nil)
+			canvas, err := renderPlan(ctx, opts, plan, b.thumbnails)
+			if canvas != nil {
+				releaseCanvas(canvas)
+			}
+			return err
+		}},
+		{Phase: "saving the DB", Run: func(ctx context.Context, cancel context.CancelFunc, opts Options) error {
+			thumbnails, _, err := prepareThumbnails(context.Background(), opts, append([]string(nil), files...), new(Timings))
+			if err != nil {
+				return err
+			}
+			before, err := os.ReadFile(opts.DB)
+			if err != nil {
+				return err
+			}
+			// after half of the entries
+			mid := &errAfterCtx{Context: ctx}
+			mid.n.Store(int32(len(thumbnails) / 2))
+			err = saveDBSubset(mid, opts.DB, newDBHeader(), thumbnails, func(string) bool { return true })
+			if after, _ := os.ReadFile(opts.DB); !bytes.Equal(after, before) {
+				t.Error("the DB is changed by the canceled save")
+			}
+			if tmps, _ := filepath.Glob(opts.DB + ".*.tmp"); len(tmps) != 0 {
+				t.Errorf("left temporary files behind: %q", tmps)
+			}
+			return err
+		}},
+	} {
+		t.Run(tc.Phase, func(t *testing.T) {
+			opts := testOptions()
+			opts.Workers = 4
+			opts.Grid = Grid{Cols: 8, Rows: 8}
+			opts.DB = filepath.Join(t.TempDir(), "mosaic.db")
+			before := runtime.NumGoroutine()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			start := time.Now()
+			err := tc.Run(ctx, cancel, opts)
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("got %v, wanted context.Canceled", err)
+			}
+			if !strings.Contains(err.Error(), tc.Phase) {
+				t.Errorf("got %q, wanted it of %s", err, tc.Phase)
+			}
+			if d := time.Since(start); d > 5*time.Second {
+				t.Errorf("returned after %v", d)
+			}
+			checkGoroutines(t, before)
+		})
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// canonicalKey returns the DB key of the file: its absolute path, with the symlinks
+// resolved, normalized by normalizeKey.
+func canonicalKey(fn string) (string, error) {
+	if isURL(fn) {
+		return fn, nil
+	}
+	abs, err := filepath.Abs(fn)
+	if err != nil {
+		return fn, err
+	}
+	if real, err := filepath.EvalSymlinks(abs); err == nil {
+		abs = real
+	}
+	return storedKey(abs), nil
+}
+
+// storedKey normalizes an absolute path, such as a key read from the DB,
+// without resolving the symlinks.
+//
+// The path is kept as is if the normalized one can't be opened:
+// as the keys are opened, too, an NFD name on a normalization-sensitive file system must stay NFD.
+func storedKey(abs string) string {
+	if isURL(abs) {
+		return abs
+	}
+	key := normalizeKey(abs, runtime.GOOS == "windows", caseInsensitive(filepath.Dir(abs)))
+	if key != abs {
+		if _, err := os.Stat(key); err != nil {
+			return abs
+		}
+	}
+	return key
+}
+
+// normalizeKey cleans the path, with Windows rules if windows is set: both separators
+// and `\` in the result, the drive letter in upper case, and the trailing dots and spaces
+// of the names dropped, as Windows ignores them. It case-folds the path if fold is set.
+// The result is in Unicode NFC, as macOS returns decomposed (NFD) names.
+func normalizeKey(p string, windows, fold bool) string {
+	p = norm.NFC.String(p)
+	if windows {
+		p = strings.ReplaceAll(p, `\`, "/")
+		if len(p) >= 2 && p[1] == ':' && p[0] >= 'a' && p[0] <= 'z' {
+			p = string(p[0]-'a'+'A') + p[1:]
+		}
+		parts := strings.Split(p, "/")
+		for i, name := range parts {
+			if name != "." && name != ".." {
+				parts[i] = strings.TrimRight(name, ". ")
+			}
+		}
+		p = strings.Join(parts, "/")
+	}
+	if strings.HasPrefix(p, "//") && windows {
+		p = "/" + path.Clean(p[1:]) // UNC: \\server\share
+	} else {
+		p = path.Clean(p)
+	}
+	if fold {
+		p = strings.ToLower(p)
+	}
+	if windows {
+		p = strings.ReplaceAll(p, "/", `\`)
+	}
+	return p
+}
+
+var (
+	caseMu  sync.Mutex
+	caseDir = make(map[string]bool)
+)
+
+// caseInsensitive reports whether the file system of dir is case-insensitive:
+// whether the nearest ancestor with letters in its name is found by the swapped case name, too.
+func caseInsensitive(dir string) bool {
+	caseMu.Lock()
+	defer caseMu.Unlock()
+	if ci, ok := caseDir[dir]; ok {
+		return ci
+	}
+	var ci bool
+	for d := dir; ; {
+		base := filepath.Base(d)
+		if swapped := swapCase(base); swapped != base {
+			fi1, err1 := os.Stat(d)
+			fi2, err2 := os.Stat(filepath.Join(filepath.Dir(d), swapped))
+			ci = err1 == nil && err2 == nil && os.SameFile(fi1, fi2)
+			break
+		}
+		parent := filepath.Dir(d)
+		if parent == d {
+			break
+		}
+		d = parent
+	}
+	caseDir[dir] = ci
+	return ci
+}
+
+func swapCase(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsUpper(r) {
+			return unicode.ToLower(r)
+		}
+		return unicode.ToUpper(r)
+	}, s)
+}
+
+// dedupKeys renames the entries of the DB to their normalized keys. Of the entries
+// becoming duplicates, the newest is kept. The number of merged entries is returned.
+func dedupKeys(thumbnails map[string]Thumbnail) int {
+	var merged int
+	for k, t := range thumbnails {
+		if !filepath.IsAbs(k) {
+			continue
+		}
+		nk := storedKey(k)
+		if nk == k {
+			continue
+		}
+		delete(thumbnails, k)
+		if old, ok := thumbnails[nk]; ok {
+			merged++
+			if !t.ModTime.After(old.ModTime) {
+				continue
+			}
+		}
+		thumbnails[nk] = t
+	}
+	return merged
+}
@@ -0,0 +1,122 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNormalizeKeyWindows(t *testing.T) {
+	for _, tc := range []struct {
+		Name string
+		Path string
+		Fold bool
+		Want string
+	}{
+		{Name: "clean", Path: `C:\Photos\a.jpg`, Want: `C:\Photos\a.jpg`},
+		{Name: "forward slashes", Path: `C:/Photos/a.jpg`, Want: `C:\Photos\a.jpg`},
+		{Name: "mixed separators", Path: `C:\Photos/sub\\a.jpg`, Want: `C:\Photos\sub\a.jpg`},
+		{Name: "drive letter", Path: `c:\Photos\a.jpg`, Want: `C:\Photos\a.jpg`},
+		{Name: "drive letter folded", Path: `C:\Photos\A.JPG`, Fold: true, Want: `c:\photos\a.jpg`},
+		{Name: "all variants folded", Path: `c:/photos/A.JPG`, Fold: true, Want: `c:\photos\a.jpg`},
+		{Name: "case kept", Path: `C:\Photos\A.JPG`, Want: `C:\Photos\A.JPG`},
+		{Name: "trailing dot", Path: `C:\Photos\a.jpg.`, Want: `C:\Photos\a.jpg`},
+		{Name: "trailing spaces and dots", Path: `C:\Photos. \a.jpg . `, Want: `C:\Photos\a.jpg`},
+		{Name: "dot dirs", Path: `C:\Photos\.\old\..\a.jpg`, Want: `C:\Photos\a.jpg`},
+		{Name: "UNC", Path: `\\server\share\a.jpg`, Want: `\\server\share\a.jpg`},
+		{Name: "UNC forward slashes", Path: `//server/share//a.jpg`, Want: `\\server\share\a.jpg`},
+		{Name: "UNC folded", Path: `\\Server\Share\A.jpg`, Fold: true, Want: `\\server\share\a.jpg`},
+		{Name: "UNC trailing dot", Path: `\\server\share\a.jpg.`, Want: `\\server\share\a.jpg`},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			if got := normalizeKey(tc.Path, true, tc.Fold); got != tc.Want {
+				t.Errorf("got %q, wanted %q", got, tc.Want)
+			}
+		})
+	}
+}
+
+func TestNormalizeKeyUnix(t *testing.T) {
+	for _, tc := range []struct {
+		Name string
+		Path string
+		Fold bool
+		Want string
+	}{
+		{Name: "clean", Path: "/photos/a.jpg", Want: "/photos/a.jpg"},
+		{Name: "backslash is a name", Path: `/photos/a\b.jpg`, Want: `/photos/a\b.jpg`},
+		{Name: "trailing dot kept", Path: "/photos/a.jpg.", Want: "/photos/a.jpg."},
+		{Name: "double slash", Path: "//photos//a.jpg", Want: "/photos/a.jpg"},
+		{Name: "folded", Path: "/Photos/A.JPG", Fold: true, Want: "/photos/a.jpg"},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			if got := normalizeKey(tc.Path, false, tc.Fold); got != tc.Want {
+				t.Errorf("got %q, wanted %q", got, tc.Want)
+			}
+		})
+	}
+}
+
+func TestNormalizeKeyUnicode(t *testing.T) {
+	const composed, decomposed = "caf\u00e9.jpg", "cafe\u0301.jpg"
+	dir := t.TempDir()
+	// created composed, as on Linux: the decomposed name is another file there
+	nfc := filepath.Join(dir, composed)
+	if err := os.WriteFile(nfc, []byte("not an image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	nfd := filepath.Join(dir, decomposed)
+	for _, tc := range []struct {
+		Name string
+		Path string
+	}{
+		{Name: "composed", Path: nfc},
+		{Name: "decomposed", Path: nfd},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			if got := normalizeKey(tc.Path, false, false); got != nfc {
+				t.Errorf("normalized to %q, wanted %q", got, nfc)
+			}
+			key, err := canonicalKey(tc.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := canonicalKey(nfc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key != want {
+				t.Errorf("got the key %q, wanted %q", key, want)
+			}
+		})
+	}
+
+	// the DB entries recorded by both names are merged, keeping the newer
+	now := time.Now()
+	thumbnails := map[string]Thumbnail{
+		nfc: {Name: composed, ModTime: now.Add(-time.Hour)},
+		nfd: {Name: decomposed, ModTime: now},
+	}
+	if n := dedupKeys(thumbnails); n != 1 {
+		t.Errorf("merged %d entries, wanted 1", n)
+	}
+	if len(thumbnails) != 1 || thumbnails[nfc].Name != decomposed {
+		t.Errorf("got %v, wanted the newer entry under %q", thumbnails, nfc)
+	}
+}
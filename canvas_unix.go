@@ -0,0 +1,47 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+//go:build unix
+
+package main
+
+import (
+	"image"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// newDiskCanvas returns an image with its pixels in a memory mapped temporary file,
+// paged out by the kernel as needed, and the function unmapping it.
+func newDiskCanvas(r image.Rectangle) (*image.NRGBA, func(), error) {
+	size := 4 * r.Dx() * r.Dy()
+	fh, err := os.CreateTemp("", "mosaic-canvas-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	// unlinked right away: the mapping keeps its pages until unmapped
+	defer fh.Close()
+	os.Remove(fh.Name())
+	if err := fh.Truncate(int64(size)); err != nil {
+		return nil, nil, errors.Wrap(err, fh.Name())
+	}
+	pix, err := syscall.Mmap(int(fh.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, fh.Name())
+	}
+	return &image.NRGBA{Pix: pix, Stride: 4 * r.Dx(), Rect: r}, func() { syscall.Munmap(pix) }, nil
+}
@@ -0,0 +1,188 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// applyConfig sets the flags not given on the command line from the config file:
+// a JSON object or a flat TOML table of flag names to values. An array sets a repeatable
+// flag (such as -target) once for each element.
+func applyConfig(fs *flag.FlagSet, fn string) error {
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	var cfg map[string][]string
+	if strings.EqualFold(filepath.Ext(fn), ".json") || bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		cfg, err = parseJSONConfig(b)
+	} else {
+		cfg, err = parseTOMLConfig(b)
+	}
+	if err != nil {
+		return errors.Wrap(err, fn)
+	}
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	names := make([]string, 0, len(cfg))
+	for k := range cfg {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "config" {
+			return errors.Errorf("%s: config can't be set from a config file", fn)
+		}
+		if fs.Lookup(name) == nil {
+			return errors.Errorf("%s: unknown flag %q", fn, name)
+		}
+		if given[name] {
+			continue // the command line wins
+		}
+		for _, v := range cfg[name] {
+			if err := fs.Set(name, v); err != nil {
+				return errors.Wrapf(err, "%s: %s", fn, name)
+			}
+		}
+	}
+	return nil
+}
+
+func parseJSONConfig(b []byte) (map[string][]string, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+	cfg := make(map[string][]string, len(raw))
+	for k, v := range raw {
+		if arr, ok := v.([]interface{}); ok {
+			for _, e := range arr {
+				cfg[k] = append(cfg[k], jsonScalar(e))
+			}
+			continue
+		}
+		cfg[k] = []string{jsonScalar(v)}
+	}
+	return cfg, nil
+}
+
+func jsonScalar(v interface{}) string {
+	if f, ok := v.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// parseTOMLConfig parses the subset of TOML a set of flags needs: key = value lines,
+// with strings, numbers, booleans and one-line arrays of them, and # comments.
+func parseTOMLConfig(b []byte) (map[string][]string, error) {
+	cfg := make(map[string][]string)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	var lineNo int
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if line[0] == '[' {
+			return nil, errors.Errorf("line %d: tables are not supported", lineNo)
+		}
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			return nil, errors.Errorf("line %d: key = value expected", lineNo)
+		}
+		key := strings.Trim(strings.TrimSpace(line[:i]), `"`)
+		rest := strings.TrimSpace(line[i+1:])
+		var values []string
+		if strings.HasPrefix(rest, "[") {
+			rest = rest[1:]
+			for {
+				rest = strings.TrimLeft(rest, " \t,")
+				if strings.HasPrefix(rest, "]") {
+					rest = rest[1:]
+					break
+				}
+				if rest == "" || rest[0] == '#' {
+					return nil, errors.Errorf("line %d: unterminated array", lineNo)
+				}
+				v, tail, err := tomlValue(rest)
+				if err != nil {
+					return nil, errors.Wrapf(err, "line %d", lineNo)
+				}
+				values, rest = append(values, v), tail
+			}
+		} else {
+			if rest == "" || rest[0] == '#' {
+				return nil, errors.Errorf("line %d: value expected", lineNo)
+			}
+			v, tail, err := tomlValue(rest)
+			if err != nil {
+				return nil, errors.Wrapf(err, "line %d", lineNo)
+			}
+			values, rest = []string{v}, tail
+		}
+		if rest = strings.TrimSpace(rest); rest != "" && rest[0] != '#' {
+			return nil, errors.Errorf("line %d: unexpected %q", lineNo, rest)
+		}
+		cfg[key] = values
+	}
+	return cfg, scanner.Err()
+}
+
+// tomlValue returns the first value of s, and the rest of s after it.
+func tomlValue(s string) (string, string, error) {
+	if s == "" {
+		return "", "", errors.New("value expected")
+	}
+	switch s[0] {
+	case '"':
+		// basic string, with escapes like Go's
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+			case '"':
+				v, err := strconv.Unquote(s[:i+1])
+				return v, s[i+1:], err
+			}
+		}
+		return "", "", errors.New("unterminated string")
+	case '\'':
+		// literal string
+		if i := strings.IndexByte(s[1:], '\''); i >= 0 {
+			return s[1 : i+1], s[i+2:], nil
+		}
+		return "", "", errors.New("unterminated string")
+	}
+	i := strings.IndexAny(s, " \t,]#")
+	if i < 0 {
+		i = len(s)
+	}
+	return s[:i], s[i:], nil
+}
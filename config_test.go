@@ -0,0 +1,87 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyConfig(t *testing.T) {
+	for _, tc := range []struct {
+		Name   string
+		Ext    string
+		Config string
+		Args   []string
+		// Want the values after the config.
+		Grid    Grid
+		Workers int
+		Targets []string
+		WantErr string
+	}{
+		{Name: "json", Ext: ".json", Config: `{"grid": "10x8", "workers": 3}`, Grid: Grid{Cols: 10, Rows: 8}, Workers: 3},
+		{Name: "toml", Ext: ".toml", Config: "# presets\ngrid = \"10x8\"\nworkers = 3 # cores\n", Grid: Grid{Cols: 10, Rows: 8}, Workers: 3},
+		{Name: "flag overrides json", Ext: ".json", Config: `{"grid": "10x8", "workers": 3}`, Args: []string{"-grid", "3x2"}, Grid: Grid{Cols: 3, Rows: 2}, Workers: 3},
+		{Name: "flag overrides toml", Ext: ".toml", Config: `grid = "10x8"`, Args: []string{"-grid=4x4"}, Grid: Grid{Cols: 4, Rows: 4}, Workers: 1},
+		{Name: "json array", Ext: ".json", Config: `{"target": ["a.png", "b.png"]}`, Workers: 1, Targets: []string{"a.png", "b.png"}},
+		{Name: "toml array", Ext: ".toml", Config: `target = ["a.png", "b.png"]`, Workers: 1, Targets: []string{"a.png", "b.png"}},
+		{Name: "array overridden", Ext: ".toml", Config: `target = ["a.png", "b.png"]`, Args: []string{"-target", "c.png"}, Workers: 1, Targets: []string{"c.png"}},
+		{Name: "unknown flag", Ext: ".json", Config: `{"gird": "10x8"}`, WantErr: `unknown flag "gird"`},
+		{Name: "invalid value", Ext: ".toml", Config: `grid = "tall"`, WantErr: "grid must be COLSxROWS"},
+		{Name: "config in config", Ext: ".json", Config: `{"config": "other.json"}`, WantErr: "config can't be set"},
+		{Name: "toml empty value", Ext: ".toml", Config: "workers = 3\ngrid =", WantErr: "line 2: value expected"},
+		{Name: "toml comment for value", Ext: ".toml", Config: "grid = # none", WantErr: "line 1: value expected"},
+		{Name: "toml unterminated array", Ext: ".toml", Config: `target = ["a.png",`, WantErr: "line 1: unterminated array"},
+		{Name: "toml table", Ext: ".toml", Config: "[match]\nmetric = \"fft\"", WantErr: "tables are not supported"},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "mosaic"+tc.Ext)
+			if err := os.WriteFile(fn, []byte(tc.Config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			fs := flag.NewFlagSet("mosaic", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			var grid Grid
+			var targets []string
+			fs.Var(&grid, "grid", "")
+			workers := fs.Int("workers", 1, "")
+			fs.Var((*stringsFlag)(&targets), "target", "")
+			fs.String("config", "", "")
+			if err := fs.Parse(tc.Args); err != nil {
+				t.Fatal(err)
+			}
+			err := applyConfig(fs, fn)
+			if tc.WantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.WantErr) {
+					t.Fatalf("got %v, wanted %q", err, tc.WantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if grid != tc.Grid || *workers != tc.Workers || !reflect.DeepEqual(targets, tc.Targets) {
+				t.Errorf("got -grid=%s -workers=%d -target=%q, wanted -grid=%s -workers=%d -target=%q",
+					grid, *workers, targets, tc.Grid, tc.Workers, tc.Targets)
+			}
+		})
+	}
+}
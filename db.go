@@ -0,0 +1,557 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CorruptDBError is returned when the DB file exists, but can't be decoded.
+type CorruptDBError struct {
+	Path string
+	Err  error
+}
+
+func (e *CorruptDBError) Error() string {
+	if e.Path == "" {
+		return "corrupt DB: " + e.Err.Error()
+	}
+	return "corrupt DB " + e.Path + ": " + e.Err.Error()
+}
+func (e *CorruptDBError) Unwrap() error { return e.Err }
+
+// loadDB reads the thumbnails from the DB file.
+//
+// A missing file is an empty DB, an undecodable one is a *CorruptDBError.
+func loadDB(dbFn string) (dbHeader, map[string]Thumbnail, error) {
+	return loadDBSubset(dbFn, nil)
+}
+
+// loadDBSubset reads only the entries of the DB file for which keep returns true;
+// a nil keep reads all. The other entries are decoded one by one and dropped,
+// so the memory needed is proportional to the kept entries only (for version 6+ DBs).
+//
+// The entries of the journal are replayed over the file's, in memory: loading never writes,
+// the journal is folded into the file by the saves (see compactJournal).
+func loadDBSubset(dbFn string, keep func(key string) bool) (dbHeader, map[string]Thumbnail, error) {
+	hdr, thumbnails := newDBHeader(), make(map[string]Thumbnail)
+	dbFh, err := os.Open(dbFn)
+	if err != nil && !os.IsNotExist(err) {
+		return dbHeader{}, nil, errors.Wrap(err, dbFn)
+	}
+	if err == nil {
+		hdr, err = scanDB(dbFh, func(k string, t Thumbnail) error {
+			if keep == nil || keep(k) {
+				thumbnails[k] = t
+			}
+			return nil
+		})
+		dbFh.Close()
+		if err != nil {
+			if ce, ok := err.(*CorruptDBError); ok {
+				ce.Path = dbFn
+			}
+			return hdr, nil, err
+		}
+	}
+	if _, err := replayJournal(dbFn, func(k string, t Thumbnail) {
+		if keep == nil || keep(k) {
+			thumbnails[k] = t
+		}
+	}); err != nil {
+		return hdr, nil, err
+	}
+	return hdr, thumbnails, nil
+}
+
+// The DB starts with dbMagic, followed by the gob encoded dbHeader and the entries:
+// since version 6 a stream of dbRecords (or quantRecords), ended by one with an empty Key,
+// before that one gob encoded map.
+// Version 1 DBs are just the gob encoded map, without magic and header.
+const (
+	dbMagic = "mosaic-db\n"
+	// dbVersion 2 added Thumbnail.Size, 3 Thumbnail.Params, 4 dbHeader.Precision, 5 Thumbnail.Pix,
+	// 6 the stream of records, 7 Thumbnail.LastUsed, 8 Thumbnail.Features,
+	// 9 Thumbnail.Exif, 10 Thumbnail.Failed, 11 Thumbnail.AliasOf, 12 Exif.Width and Height
+	dbVersion = 12
+)
+
+// dbHeader is the beginning of the DB.
+type dbHeader struct {
+	Version int
+	// Precision of the stored FFT coefficients.
+	Precision Precision
+}
+
+func newDBHeader() dbHeader { return dbHeader{Version: dbVersion, Precision: PrecisionFull} }
+
+// dbRecord is one entry of a full precision DB.
+type dbRecord struct {
+	Key   string
+	Entry Thumbnail
+}
+
+// quantRecord is one entry of a quantized DB.
+type quantRecord struct {
+	Key   string
+	Entry quantThumbnail
+}
+
+// readDB reads the thumbnails from a DB stream, such as a file or a network download.
+// Undecodable data is reported as a *CorruptDBError.
+func readDB(r io.Reader) (dbHeader, map[string]Thumbnail, error) {
+	thumbnails := make(map[string]Thumbnail)
+	hdr, err := scanDB(r, func(k string, t Thumbnail) error {
+		thumbnails[k] = t
+		return nil
+	})
+	if err != nil {
+		return hdr, nil, err
+	}
+	return hdr, thumbnails, nil
+}
+
+// scanDB calls fn with each entry of the DB stream, in the order they are stored.
+// An error returned by fn stops the scan, and is returned as is.
+func scanDB(r io.Reader, fn func(key string, t Thumbnail) error) (dbHeader, error) {
+	hdr := dbHeader{Version: 1, Precision: PrecisionFull}
+	br := bufio.NewReader(r)
+	dec := gob.NewDecoder(br)
+	if magic, _ := br.Peek(len(dbMagic)); string(magic) == dbMagic {
+		br.Discard(len(dbMagic))
+		if err := dec.Decode(&hdr); err != nil {
+			return hdr, &CorruptDBError{Err: errors.Wrap(err, "header")}
+		}
+		if hdr.Version > dbVersion {
+			return hdr, errors.Errorf("DB version %d is newer than the supported %d", hdr.Version, dbVersion)
+		}
+		if hdr.Precision == "" {
+			hdr.Precision = PrecisionFull
+		}
+	}
+	if hdr.Version < 6 {
+		return hdr, scanDBMap(dec, hdr, fn)
+	}
+	// A zero-length or truncated stream gives io.EOF / io.ErrUnexpectedEOF,
+	// a wrong type some gob error - all of them are corruption.
+	for {
+		var k string
+		var t Thumbnail
+		if hdr.Precision == PrecisionFull {
+			var rec dbRecord
+			if err := dec.Decode(&rec); err != nil {
+				return hdr, &CorruptDBError{Err: err}
+			}
+			k, t = rec.Key, rec.Entry
+		} else {
+			var rec quantRecord
+			if err := dec.Decode(&rec); err != nil {
+				return hdr, &CorruptDBError{Err: err}
+			}
+			if rec.Key == "" {
+				return hdr, nil
+			}
+			var err error
+			if t, err = rec.Entry.thumbnail(); err != nil {
+				return hdr, &CorruptDBError{Err: errors.Wrap(err, rec.Key)}
+			}
+			k = rec.Key
+		}
+		if k == "" {
+			return hdr, nil
+		}
+		if err := fn(k, t); err != nil {
+			return hdr, err
+		}
+	}
+}
+
+// scanDBMap reads the entries of a pre-6 DB, stored as one map.
+func scanDBMap(dec *gob.Decoder, hdr dbHeader, fn func(key string, t Thumbnail) error) error {
+	if hdr.Precision == PrecisionFull {
+		thumbnails := make(map[string]Thumbnail)
+		if err := dec.Decode(&thumbnails); err != nil {
+			return &CorruptDBError{Err: err}
+		}
+		for k, t := range thumbnails {
+			if err := fn(k, t); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	quantized := make(map[string]quantThumbnail)
+	if err := dec.Decode(&quantized); err != nil {
+		return &CorruptDBError{Err: err}
+	}
+	for k, q := range quantized {
+		t, err := q.thumbnail()
+		if err != nil {
+			return &CorruptDBError{Err: errors.Wrap(err, k)}
+		}
+		if err := fn(k, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeDB writes the thumbnails as a DB stream, readable by readDB,
+// with the precision of the header.
+// It stops when ctx is canceled.
+func writeDB(ctx context.Context, w io.Writer, hdr dbHeader, thumbnails map[string]Thumbnail) error {
+	dw, err := newDBWriter(w, hdr)
+	if err != nil {
+		return err
+	}
+	keys, _ := sortedKeys(thumbnails, "")
+	for _, k := range keys {
+		if err := ctx.Err(); err != nil {
+			return errors.Wrap(err, "saving the DB")
+		}
+		if err := dw.Write(k, thumbnails[k]); err != nil {
+			return err
+		}
+	}
+	return dw.Close()
+}
+
+// dbWriter writes a DB stream entry by entry.
+type dbWriter struct {
+	enc       *gob.Encoder
+	precision Precision
+	// relative is set after the first entry, if its key is a relative path.
+	relative *bool
+}
+
+// newDBWriter writes the magic and the header.
+func newDBWriter(w io.Writer, hdr dbHeader) (*dbWriter, error) {
+	if _, err := io.WriteString(w, dbMagic); err != nil {
+		return nil, err
+	}
+	hdr.Version = dbVersion
+	if hdr.Precision == "" {
+		hdr.Precision = PrecisionFull
+	}
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(hdr); err != nil {
+		return nil, err
+	}
+	return &dbWriter{enc: enc, precision: hdr.Precision}, nil
+}
+
+// Write one entry, with the precision of the header.
+func (dw *dbWriter) Write(key string, t Thumbnail) error {
+	if key == "" {
+		return errors.New("empty key")
+	}
+	// a URL is absolute, too
+	rel := !filepath.IsAbs(key) && !isURL(key)
+	if dw.relative == nil {
+		dw.relative = &rel
+	} else if *dw.relative != rel {
+		return errors.Errorf("%q: a DB can't mix relative and absolute keys", key)
+	}
+	if dw.precision == PrecisionFull {
+		return dw.enc.Encode(dbRecord{Key: key, Entry: t})
+	}
+	return dw.enc.Encode(quantRecord{Key: key, Entry: quantize(t, dw.precision)})
+}
+
+// Close writes the end of the entries. It does not close the underlying writer.
+func (dw *dbWriter) Close() error {
+	if dw.precision == PrecisionFull {
+		return dw.enc.Encode(dbRecord{})
+	}
+	return dw.enc.Encode(quantRecord{})
+}
+
+// sortedKeys returns the keys of the DB, the paths of the files, in order.
+// A non-empty glob filters the keys with filepath.Match.
+func sortedKeys(thumbnails map[string]Thumbnail, glob string) ([]string, error) {
+	keys := make([]string, 0, len(thumbnails))
+	for k := range thumbnails {
+		if glob != "" {
+			if ok, err := filepath.Match(glob, k); err != nil {
+				return nil, errors.Wrap(err, glob)
+			} else if !ok {
+				continue
+			}
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// entryStatus compares the entry with the file on disk: "fresh", "stale", "missing",
+// "failed" (an unchanged undecodable file), or the error of os.Stat.
+func entryStatus(path string, t Thumbnail) string {
+	fi, err := statSource(context.Background(), path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "missing"
+		}
+		return err.Error()
+	}
+	if t.failedUpToDate(fi) {
+		return "failed"
+	}
+	if t.upToDate(fi) {
+		return "fresh"
+	}
+	return "stale"
+}
+
+// saveDB atomically replaces the DB file with the thumbnails:
+// it writes a temporary file next to it, and renames it over the old one.
+func saveDB(dbFn string, hdr dbHeader, thumbnails map[string]Thumbnail) error {
+	return saveDBSubset(context.Background(), dbFn, hdr, thumbnails, nil)
+}
+
+// probeDB checks that saveDB could replace the DB file, by creating (and removing)
+// a temporary file next to it; the DB file itself is not touched.
+func probeDB(dbFn string) error {
+	dir, base := filepath.Split(dbFn)
+	if dir == "" {
+		dir = "."
+	}
+	fh, err := os.CreateTemp(dir, base+".*.probe")
+	if err != nil {
+		return errors.Wrap(err, dbFn)
+	}
+	tmp := fh.Name()
+	fh.Close()
+	return errors.Wrap(os.Remove(tmp), dbFn)
+}
+
+// saveDBSubset is saveDB for thumbnails loaded by loadDBSubset with the loaded func:
+// the entries of the old file which were not loaded are carried over -
+// the loaded ones are replaced by the thumbnails, so the removed ones stay removed.
+// A nil loaded means the thumbnails are the whole DB.
+func saveDBSubset(ctx context.Context, dbFn string, hdr dbHeader, thumbnails map[string]Thumbnail, loaded func(key string) bool) error {
+	dir, base := filepath.Split(dbFn)
+	if dir == "" {
+		dir = "."
+	}
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(dbFn); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	dbFh, err := os.CreateTemp(dir, base+".*.tmp")
+	if err != nil {
+		return errors.Wrap(err, dbFn)
+	}
+	tmp := dbFh.Name()
+	bw := bufio.NewWriter(dbFh)
+	if loaded == nil {
+		err = writeDB(ctx, bw, hdr, thumbnails)
+	} else {
+		err = writeDBSubset(ctx, bw, dbFn, hdr, thumbnails, loaded)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = dbFh.Sync()
+	}
+	if closeErr := dbFh.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, mode)
+	}
+	if err == nil {
+		err = os.Rename(tmp, dbFn)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, dbFn)
+	}
+	// The file has all the entries of the journal now.
+	if err := os.Remove(dbFn + journalExt); err != nil && !os.IsNotExist(err) {
+		log.Println(err)
+	}
+	return nil
+}
+
+// writeDBSubset writes the thumbnails, and the entries of the old DB file (and its journal)
+// which were not loaded. It stops when ctx is canceled.
+func writeDBSubset(ctx context.Context, w io.Writer, dbFn string, hdr dbHeader, thumbnails map[string]Thumbnail, loaded func(key string) bool) error {
+	dw, err := newDBWriter(w, hdr)
+	if err != nil {
+		return err
+	}
+	keys, _ := sortedKeys(thumbnails, "")
+	for _, k := range keys {
+		if err := ctx.Err(); err != nil {
+			return errors.Wrap(err, "saving the DB")
+		}
+		if err := dw.Write(k, thumbnails[k]); err != nil {
+			return err
+		}
+	}
+	// The journal's entries are newer than the file's.
+	journaled := make(map[string]Thumbnail)
+	if _, err := replayJournal(dbFn, func(k string, t Thumbnail) {
+		if _, ok := thumbnails[k]; !ok && !loaded(k) {
+			journaled[k] = t
+		}
+	}); err != nil {
+		return err
+	}
+	old, err := os.Open(dbFn)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		defer old.Close()
+		if _, err := scanDB(old, func(k string, t Thumbnail) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if loaded(k) {
+				return nil
+			}
+			if _, ok := thumbnails[k]; ok {
+				return nil
+			}
+			if _, ok := journaled[k]; ok {
+				return nil
+			}
+			return dw.Write(k, t)
+		}); err != nil {
+			return errors.Wrap(err, "carry over the entries not loaded")
+		}
+	}
+	keys, _ = sortedKeys(journaled, "")
+	for _, k := range keys {
+		if err := dw.Write(k, journaled[k]); err != nil {
+			return err
+		}
+	}
+	return dw.Close()
+}
+
+// Checkpoint says when to save the DB during indexing:
+// after Every time, or after N newly indexed files, whichever comes first.
+type Checkpoint struct {
+	Every time.Duration
+	N     int
+}
+
+func (c Checkpoint) String() string {
+	if c.N > 0 {
+		return strconv.Itoa(c.N)
+	}
+	if c.Every > 0 {
+		return c.Every.String()
+	}
+	return ""
+}
+
+// Set parses a duration ("5m") or a file count ("1000").
+func (c *Checkpoint) Set(s string) error {
+	if s == "" || s == "0" {
+		*c = Checkpoint{}
+		return nil
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		*c = Checkpoint{N: n}
+		return nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return errors.Errorf("%q: checkpoint must be a duration or a file count", s)
+	}
+	*c = Checkpoint{Every: d}
+	return nil
+}
+
+// checkpointer saves the DB periodically, as configured by Checkpoint.
+//
+// As a gob DB is rewritten fully on each save, the interval is stretched
+// to keep the time spent saving under a tenth of the indexing time.
+type checkpointer struct {
+	Checkpoint
+	ctx    context.Context
+	store  store
+	hdr    dbHeader
+	loaded func(key string) bool
+	// journal the entries as they are added, if the store is a journaler
+	journal bool
+	// readOnly is set when the DB can't be written
+	readOnly bool
+	last     time.Time
+	lastCost time.Duration
+	pending  int
+}
+
+// newCheckpointer returns a checkpointer saving the DB with st.Save(ctx, hdr, ..., loaded).
+func newCheckpointer(ctx context.Context, st store, hdr dbHeader, loaded func(key string) bool, c Checkpoint) *checkpointer {
+	return &checkpointer{ctx: ctx, Checkpoint: c, store: st, hdr: hdr, loaded: loaded, last: time.Now()}
+}
+
+// Added registers a newly indexed file, journals it, and saves the DB if a checkpoint is due.
+func (c *checkpointer) Added(thumbnails map[string]Thumbnail, key string) {
+	if j, ok := c.store.(journaler); ok && c.journal {
+		if err := j.Append(key, thumbnails[key]); err != nil {
+			log.Printf("WARNING: journal: %v - not journaling anymore", err)
+			c.journal = false
+		}
+	}
+	c.pending++
+	if !c.due() {
+		return
+	}
+	start := time.Now()
+	if err := c.store.Save(c.ctx, c.hdr, thumbnails, c.loaded); err != nil {
+		if isReadOnly(err) {
+			log.Printf("WARNING: checkpoint: %v - not saving anymore", err)
+			c.readOnly, c.Checkpoint = true, Checkpoint{}
+			return
+		}
+		if c.ctx.Err() != nil {
+			return // the final save flushes them
+		}
+		log.Printf("checkpoint: %+v", err)
+	} else {
+		log.Printf("checkpoint: saved %d entries to %q", len(thumbnails), c.store)
+	}
+	c.last, c.lastCost, c.pending = time.Now(), time.Since(start), 0
+}
+
+func (c *checkpointer) due() bool {
+	if c.Every <= 0 && c.N <= 0 {
+		return false
+	}
+	since := time.Since(c.last)
+	if since < 10*c.lastCost {
+		return false
+	}
+	return (c.N > 0 && c.pending >= c.N) || (c.Every > 0 && since >= c.Every)
+}
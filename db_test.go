@@ -0,0 +1,350 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// testDB returns the content of a DB of the library.
+func testDB(t testing.TB, lib map[string]Thumbnail) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := writeDB(context.Background(), &buf, newDBHeader(), lib); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestLoadCorruptDB(t *testing.T) {
+	valid := testDB(t, synthLibrary(3))
+	var wrongType bytes.Buffer
+	if err := gob.NewEncoder(&wrongType).Encode([]int{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	var wrongRecord bytes.Buffer
+	wrongRecord.WriteString(dbMagic)
+	enc := gob.NewEncoder(&wrongRecord)
+	if err := enc.Encode(newDBHeader()); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Encode("not a record"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		Name    string
+		Content []byte // nil: no file
+		Corrupt bool
+		Entries int
+	}{
+		{Name: "missing", Content: nil},
+		{Name: "valid", Content: valid, Entries: 3},
+		{Name: "zero-length", Content: []byte{}, Corrupt: true},
+		{Name: "truncated", Content: valid[:len(valid)/2], Corrupt: true},
+		{Name: "truncated header", Content: valid[:len(dbMagic)+2], Corrupt: true},
+		{Name: "wrong type", Content: wrongType.Bytes(), Corrupt: true},
+		{Name: "wrong record type", Content: wrongRecord.Bytes(), Corrupt: true},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "mosaic.db")
+			if tc.Content != nil {
+				if err := os.WriteFile(fn, tc.Content, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, thumbnails, err := loadDB(fn)
+			var ce *CorruptDBError
+			if tc.Corrupt {
+				if !errors.As(err, &ce) {
+					t.Fatalf("got %v, wanted a CorruptDBError", err)
+				}
+				if ce.Path != fn {
+					t.Errorf("got path %q, wanted %q", ce.Path, fn)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(thumbnails) != tc.Entries {
+				t.Errorf("got %d entries, wanted %d", len(thumbnails), tc.Entries)
+			}
+		})
+	}
+}
+
+func TestRebuildCorruptDB(t *testing.T) {
+	for _, tc := range []struct {
+		Name     string
+		Rebuild  bool
+		ReadOnly bool
+		WantErr  bool
+	}{
+		{Name: "refused", WantErr: true},
+		{Name: "rebuilt", Rebuild: true},
+		{Name: "read-only", ReadOnly: true},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			src := writeImage(t, dir, "a.png", synthImage(1, Width, Width))
+			corrupt := testDB(t, synthLibrary(2))
+			corrupt = corrupt[:len(corrupt)-10]
+			opts := testOptions()
+			opts.DB = filepath.Join(dir, "mosaic.db")
+			opts.RebuildDB, opts.DBReadOnly = tc.Rebuild, tc.ReadOnly
+			if err := os.WriteFile(opts.DB, corrupt, 0644); err != nil {
+				t.Fatal(err)
+			}
+			thumbnails, _, err := prepareThumbnails(context.Background(), opts, []string{src}, new(Timings))
+			if tc.WantErr {
+				var ce *CorruptDBError
+				if !errors.As(err, &ce) {
+					t.Fatalf("got %v, wanted a CorruptDBError", err)
+				}
+			} else if err != nil && !isWarning(err) {
+				t.Fatal(err)
+			} else if thumbnails[src].FFT == nil {
+				t.Error("the source is not indexed")
+			}
+			bak, err := os.ReadFile(opts.DB + ".bak")
+			if tc.Rebuild {
+				if !bytes.Equal(bak, corrupt) {
+					t.Errorf("the .bak is not the corrupt DB: %v", err)
+				}
+				if _, thumbnails, err := loadDB(opts.DB); err != nil || thumbnails[src].FFT == nil {
+					t.Errorf("the rebuilt DB lacks the source: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Error("a .bak is written")
+			}
+			if b, _ := os.ReadFile(opts.DB); !bytes.Equal(b, corrupt) {
+				t.Error("the corrupt DB is overwritten")
+			}
+		})
+	}
+}
+
+func TestReadDBFromReader(t *testing.T) {
+	lib := synthLibrary(4)
+	for _, prec := range []Precision{PrecisionFull, PrecisionFloat32, PrecisionInt16} {
+		t.Run(string(prec), func(t *testing.T) {
+			hdr := newDBHeader()
+			hdr.Precision = prec
+			var buf bytes.Buffer
+			if err := writeDB(context.Background(), &buf, hdr, lib); err != nil {
+				t.Fatal(err)
+			}
+			got, thumbnails, err := readDB(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Precision != prec || got.Version != dbVersion {
+				t.Errorf("got header %+v, wanted %s version %d", got, prec, dbVersion)
+			}
+			if len(thumbnails) != len(lib) {
+				t.Fatalf("got %d entries, wanted %d", len(thumbnails), len(lib))
+			}
+			for k, want := range lib {
+				if got := thumbnails[k]; got.Name != want.Name || got.Color != want.Color || got.FFT == nil {
+					t.Errorf("%s: got %+v", k, got)
+				}
+			}
+			// the spectra survive the quantization
+			a, b := synthKey(0), synthKey(1)
+			if d, far := spectrumDistance(logPower(thumbnails[a].FFT), logPower(lib[a].FFT)), spectrumDistance(logPower(lib[a].FFT), logPower(lib[b].FFT)); d > far/100 {
+				t.Errorf("the spectrum of %s changed by %g, of the %g to %s", a, d, far, b)
+			}
+		})
+	}
+}
+
+func TestNoopRunKeepsDB(t *testing.T) {
+	dir := t.TempDir()
+	files := testLibrary(t, dir, 3)
+	opts := testOptions()
+	opts.DB = filepath.Join(dir, "mosaic.db")
+	ctx := context.Background()
+	if _, indexed, err := prepareThumbnails(ctx, opts, append([]string(nil), files...), new(Timings)); err != nil || indexed != 3 {
+		t.Fatalf("indexed %d: %v", indexed, err)
+	}
+	// an old mtime, so a rewrite would surely change it
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(opts.DB, old, old); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(opts.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		Name  string
+		Files []string
+	}{
+		{Name: "all cached", Files: files},
+		{Name: "subset cached", Files: files[1:]},
+	} {
+		if _, indexed, err := prepareThumbnails(ctx, opts, append([]string(nil), tc.Files...), new(Timings)); err != nil || indexed != 0 {
+			t.Fatalf("%s: indexed %d: %v", tc.Name, indexed, err)
+		}
+		after, err := os.Stat(opts.DB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !after.ModTime().Equal(before.ModTime()) || after.Size() != before.Size() || !os.SameFile(before, after) {
+			t.Errorf("%s: the DB is rewritten: %s/%d, was %s/%d", tc.Name, after.ModTime(), after.Size(), before.ModTime(), before.Size())
+		}
+	}
+}
+
+func TestRelativeDBMoved(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "root")
+	lib := filepath.Join(root, "lib")
+	if err := os.MkdirAll(lib, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := testLibrary(t, lib, 2)
+	content, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	files = append(files, filepath.Join(lib, "copy.png"))
+	if err := os.WriteFile(files[2], content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := testOptions()
+	opts.DB, opts.DBRelativeTo = filepath.Join(root, "mosaic.db"), lib
+	ctx := context.Background()
+	if _, indexed, err := prepareThumbnails(ctx, opts, append([]string(nil), files...), new(Timings)); err != nil || indexed != 2 {
+		t.Fatalf("indexed %d: %v", indexed, err)
+	}
+	_, stored, err := fileStore(opts.DB).Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stored["copy.png"].AliasOf; got != "src000.png" {
+		t.Errorf("stored alias of copy.png: got %q, wanted the relative src000.png", got)
+	}
+
+	// move the library with the DB
+	moved := filepath.Join(t.TempDir(), "moved")
+	if err := os.Rename(root, moved); err != nil {
+		t.Fatal(err)
+	}
+	lib = filepath.Join(moved, "lib")
+	for i, fn := range files {
+		files[i] = filepath.Join(lib, filepath.Base(fn))
+	}
+	opts.DB, opts.DBRelativeTo = filepath.Join(moved, "mosaic.db"), lib
+	thumbnails, indexed, err := prepareThumbnails(ctx, opts, append([]string(nil), files...), new(Timings))
+	if err != nil || indexed != 0 {
+		t.Fatalf("after the move: indexed %d: %v", indexed, err)
+	}
+	src, err := canonicalKey(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp, err := canonicalKey(files[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := thumbnails[cp].AliasOf; got != src {
+		t.Errorf("after the move: alias of %s: got %q, wanted %q", cp, got, src)
+	}
+}
+
+func TestUnwritableDB(t *testing.T) {
+	for _, tc := range []struct {
+		Name string
+		// DB returns the unwritable DB path in dir.
+		DB       func(t *testing.T, dir string) string
+		Fallback bool
+	}{
+		{Name: "missing parent directory", DB: func(t *testing.T, dir string) string {
+			return filepath.Join(dir, "missing", "mosaic.db")
+		}},
+		{Name: "missing parent directory fallback", Fallback: true, DB: func(t *testing.T, dir string) string {
+			return filepath.Join(dir, "missing", "mosaic.db")
+		}},
+		{Name: "permission denied", DB: deniedDB},
+		{Name: "permission denied fallback", Fallback: true, DB: deniedDB},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			dbFn := tc.DB(t, dir)
+			existing, _ := os.ReadFile(dbFn)
+			// the indexing is counted by the decoding
+			var decoded atomic.Int32
+			fakeRawDecoder(t, func(ctx context.Context, fn string) (image.Image, error) {
+				decoded.Add(1)
+				return synthImage(1, Width, Width), nil
+			})
+			src := filepath.Join(dir, "src.raw")
+			if err := os.WriteFile(src, []byte("raw"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			opts := testOptions()
+			opts.DB, opts.DBFallbackReadOnly = dbFn, tc.Fallback
+			_, indexed, err := prepareThumbnails(context.Background(), opts, []string{src}, new(Timings))
+			if tc.Fallback {
+				var npe *NotPersistedError
+				if !errors.As(err, &npe) || indexed != 1 {
+					t.Errorf("indexed %d: got %v, wanted a NotPersistedError", indexed, err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), "can't be written") || decoded.Load() != 0 {
+				t.Errorf("decoded %d: got %v, wanted to fail before indexing", decoded.Load(), err)
+			}
+			if got, _ := os.ReadFile(dbFn); !bytes.Equal(got, existing) {
+				t.Error("the existing DB is changed")
+			}
+		})
+	}
+}
+
+// deniedDB returns an existing DB in a directory which can't be written.
+func deniedDB(t *testing.T, dir string) string {
+	sub := filepath.Join(dir, "ro")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	dbFn := filepath.Join(sub, "mosaic.db")
+	if err := os.WriteFile(dbFn, testDB(t, synthLibrary(2)), 0444); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(sub, 0555); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(sub, 0755) })
+	if fh, err := os.CreateTemp(sub, "probe"); err == nil {
+		fh.Close()
+		os.Remove(fh.Name())
+		t.Skip("the permissions are not enforced (running as root?)")
+	}
+	return dbFn
+}
@@ -0,0 +1,795 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image/color"
+	"math"
+	"math/cmplx"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// dbMain runs the "mosaic db <command>" subcommands.
+func dbMain(args []string) error {
+	commands := map[string]func([]string) error{
+		"export":  dbExport,
+		"import":  dbImport,
+		"inspect": dbInspect,
+		"merge":   dbMerge,
+		"prune":   dbPrune,
+		"stats":   dbStats,
+		"verify":  dbVerify,
+	}
+	var cmd func([]string) error
+	if len(args) != 0 {
+		cmd = commands[args[0]]
+	}
+	if cmd == nil {
+		names := make([]string, 0, len(commands))
+		for k := range commands {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		return errors.Errorf("usage: mosaic db {%s} [flags]", strings.Join(names, "|"))
+	}
+	return cmd(args[1:])
+}
+
+// entryInfo is the summary of a DB entry, as listed by "db inspect".
+type entryInfo struct {
+	Path     string
+	Name     string
+	ModTime  time.Time
+	Features []string
+	Status   string
+	Failed   string       `json:",omitempty"`
+	AliasOf  string       `json:",omitempty"`
+	Exif     *Exif        `json:",omitempty"`
+	Color    string       `json:",omitempty"`
+	FFT      [][2]float64 `json:",omitempty"`
+}
+
+func newEntryInfo(path string, t Thumbnail) entryInfo {
+	return entryInfo{
+		Path: path, Name: t.Name, ModTime: t.ModTime,
+		Features: t.features(),
+		Status:   entryStatus(path, t),
+		Failed:   t.Failed,
+		AliasOf:  t.AliasOf,
+		Exif:     t.Exif,
+	}
+}
+
+// features returns the names of the features the entry has.
+func (t Thumbnail) features() []string {
+	if t.Failed != "" || t.AliasOf != "" {
+		return nil
+	}
+	fs := []string{fmt.Sprintf("fft:%dx%d", Width, Width), "color"}
+	if len(t.Pix) != 0 {
+		fs = append(fs, "pixels")
+	}
+	return append(fs, t.featureNames()...)
+}
+
+func dbInspect(args []string) error {
+	fs := flag.NewFlagSet("db inspect", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: mosaic db inspect [flags] [path-glob]")
+		fs.PrintDefaults()
+	}
+	flagDB := fs.String("db", defaultDB(), "DB file for thumbnails")
+	flagJSON := fs.Bool("json", false, "JSON output")
+	flagN := fs.Int("n", 8, "number of feature values to print for a single entry")
+	flagFailed := fs.Bool("failed", false, "list only the entries of the files which could not be decoded, with the error")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	_, thumbnails, err := loadDB(*flagDB)
+	if err != nil {
+		return err
+	}
+	glob := fs.Arg(0)
+
+	if t, ok := thumbnails[glob]; ok {
+		info := newEntryInfo(glob, t)
+		info.Color = fmt.Sprintf("#%02x%02x%02x", t.Color.R, t.Color.G, t.Color.B)
+		n := *flagN
+		if n > len(t.FFT) {
+			n = len(t.FFT)
+		}
+		for _, c := range t.coeffs()[:n] {
+			info.FFT = append(info.FFT, [2]float64{real(c), imag(c)})
+		}
+		if *flagJSON {
+			return printJSON(info)
+		}
+		fmt.Printf("Path:     %s\nName:     %s\nModTime:  %s\nFeatures: %s\nStatus:   %s\n",
+			info.Path, info.Name, info.ModTime.Format(time.RFC3339), strings.Join(info.Features, " "), info.Status)
+		if info.Failed != "" {
+			fmt.Printf("Failed:   %s\n", info.Failed)
+		}
+		if info.AliasOf != "" {
+			fmt.Printf("Alias of: %s\n", info.AliasOf)
+		}
+		if e := info.Exif; e != nil {
+			var taken string
+			if !e.Taken.IsZero() {
+				taken = e.Taken.Format(time.RFC3339)
+			}
+			fmt.Printf("Taken:    %s\nCamera:   %s\nOrient.:  %d\nPixels:   %dx%d\n", taken, e.Camera(), e.Orientation, e.Width, e.Height)
+		}
+		fmt.Printf("Color:    %s\nFFT:     ", info.Color)
+		for _, c := range info.FFT {
+			fmt.Printf(" %g%+gi", c[0], c[1])
+		}
+		fmt.Println()
+		return nil
+	}
+
+	keys, err := sortedKeys(thumbnails, glob)
+	if err != nil {
+		return err
+	}
+	infos := make([]entryInfo, 0, len(keys))
+	for _, k := range keys {
+		if t := thumbnails[k]; !*flagFailed || t.Failed != "" {
+			infos = append(infos, newEntryInfo(k, t))
+		}
+	}
+	if *flagJSON {
+		return printJSON(infos)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	if *flagFailed {
+		fmt.Fprintln(tw, "PATH\tMODTIME\tSTATUS\tERROR")
+		for _, info := range infos {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", info.Path, info.ModTime.Format(time.RFC3339), info.Status, info.Failed)
+		}
+		return tw.Flush()
+	}
+	fmt.Fprintln(tw, "PATH\tNAME\tMODTIME\tFEATURES\tSTATUS")
+	for _, info := range infos {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+			info.Path, info.Name, info.ModTime.Format(time.RFC3339), strings.Join(info.Features, ","), info.Status)
+	}
+	return tw.Flush()
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// dbStatistics is the summary printed by "db stats".
+type dbStatistics struct {
+	Path         string
+	Entries      int
+	FileSize     int64
+	MemoryNeeded int64
+	Oldest       time.Time
+	Newest       time.Time
+	Fresh        int
+	Stale        int
+	Missing      int
+	Unreadable   int
+	// Failed are the entries of unchanged files which could not be decoded.
+	Failed int
+	// Aliases are the entries of files with the same content as another's,
+	// AliasSaved the size of the features they don't repeat in the DB (at full precision).
+	Aliases      int
+	AliasSaved   int64
+	Features     map[string]int
+	PerDirectory map[string]int
+	// PixelBytes is the size of the stored pixels.
+	PixelBytes int64
+	// Shards are the entries per shard, with -shards.
+	Shards map[string]int
+	// Layers are the entries used from -db and each -db-ro, in order.
+	Layers []layerStats
+	// SpectrumBytes is the size of the spectra by thumbnail size (in memory, at full precision).
+	SpectrumBytes map[int]int64
+}
+
+// layerStats is the number of entries used from a layer (see layerStore).
+type layerStats struct {
+	DB      string
+	Entries int
+}
+
+func collectStats(dbFn string, thumbnails map[string]Thumbnail) dbStatistics {
+	st := dbStatistics{
+		Path: dbFn, Entries: len(thumbnails),
+		Features: make(map[string]int), PerDirectory: make(map[string]int),
+		SpectrumBytes: make(map[int]int64),
+	}
+	if fi, err := os.Stat(dbFn); err == nil {
+		st.FileSize = fi.Size()
+	}
+	for k, t := range thumbnails {
+		// key and value of the map, plus the map's bookkeeping
+		st.MemoryNeeded += int64(unsafe.Sizeof(t)) + int64(len(k)+len(t.Name)+len(t.Pix)) + 32
+		st.PixelBytes += int64(len(t.Pix))
+		if t.FFT != nil {
+			st.SpectrumBytes[Width] += int64(unsafe.Sizeof(*t.FFT))
+		}
+		for name, payload := range t.Features {
+			if size, ok := featureSize(name); ok {
+				st.SpectrumBytes[size] += int64(len(payload))
+			}
+		}
+		if st.Oldest.IsZero() || t.ModTime.Before(st.Oldest) {
+			st.Oldest = t.ModTime
+		}
+		if t.ModTime.After(st.Newest) {
+			st.Newest = t.ModTime
+		}
+		st.PerDirectory[filepath.Dir(k)]++
+		if t.AliasOf != "" {
+			st.Aliases++
+			if c, ok := resolveAlias(thumbnails, k); ok {
+				if c.FFT != nil {
+					st.AliasSaved += int64(unsafe.Sizeof(*c.FFT))
+				}
+				st.AliasSaved += int64(len(c.Pix))
+				for _, payload := range c.Features {
+					st.AliasSaved += int64(len(payload))
+				}
+			}
+		}
+		for _, f := range newEntryInfo(k, t).Features {
+			st.Features[f]++
+		}
+		switch entryStatus(k, t) {
+		case "fresh":
+			st.Fresh++
+		case "stale":
+			st.Stale++
+		case "missing":
+			st.Missing++
+		case "failed":
+			st.Failed++
+		default:
+			st.Unreadable++
+		}
+	}
+	return st
+}
+
+func dbStats(args []string) error {
+	fs := flag.NewFlagSet("db stats", flag.ContinueOnError)
+	flagDB := fs.String("db", defaultDB(), "DB file for thumbnails")
+	flagJSON := fs.Bool("json", false, "JSON output")
+	flagShards := fs.Bool("shards", false, "combined statistics of the "+shardFile+" shards (of -db-shard-by-dir) found under the directories given as arguments, instead of -db")
+	var flagRO stringsFlag
+	fs.Var(&flagRO, "db-ro", "read-only DB layered under -db, as consulted by mosaic -db-ro (repeatable)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var st dbStatistics
+	if len(flagRO) != 0 {
+		ls := newLayerStore(fileStore(*flagDB), flagRO, "")
+		_, thumbnails, err := ls.Load(nil)
+		if err != nil {
+			return err
+		}
+		st = collectStats(*flagDB, thumbnails)
+		// the primary first
+		st.Layers = make([]layerStats, 1+len(ls.layers))
+		st.Layers[0].DB = ls.primary.String()
+		for i, l := range ls.layers {
+			st.Layers[1+i].DB = l.String()
+			if fi, err := os.Stat(l.String()); err == nil {
+				st.FileSize += fi.Size()
+			}
+		}
+		for k := range thumbnails {
+			if s, ok := ls.stamps[k]; ok {
+				st.Layers[1+s.Layer].Entries++
+			} else {
+				st.Layers[0].Entries++
+			}
+		}
+	} else if *flagShards {
+		shards, err := discoverShards(fs.Args())
+		if err != nil {
+			return err
+		}
+		_, thumbnails, err := shards.Load(nil)
+		if err != nil {
+			return err
+		}
+		st = collectStats(shards.String(), thumbnails)
+		st.Shards = make(map[string]int, len(shards.shards))
+		for _, sh := range shards.shards {
+			if fi, err := os.Stat(string(sh.fileStore)); err == nil {
+				st.FileSize += fi.Size()
+			}
+		}
+		for k := range thumbnails {
+			st.Shards[shards.shards[shards.shardOf(k)].String()]++
+		}
+	} else {
+		_, thumbnails, err := loadDB(*flagDB)
+		if err != nil {
+			return err
+		}
+		st = collectStats(*flagDB, thumbnails)
+	}
+	if *flagJSON {
+		return printJSON(st)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(tw, "DB\t%s\n", st.Path)
+	fmt.Fprintf(tw, "entries\t%d\n", st.Entries)
+	fmt.Fprintf(tw, "file size\t%d\n", st.FileSize)
+	fmt.Fprintf(tw, "memory needed\t%d\n", st.MemoryNeeded)
+	fmt.Fprintf(tw, "stored pixels\t%d\n", st.PixelBytes)
+	if st.Entries != 0 {
+		fmt.Fprintf(tw, "oldest\t%s\n", st.Oldest.Format(time.RFC3339))
+		fmt.Fprintf(tw, "newest\t%s\n", st.Newest.Format(time.RFC3339))
+	}
+	fmt.Fprintf(tw, "fresh\t%d\n", st.Fresh)
+	fmt.Fprintf(tw, "stale\t%d\n", st.Stale)
+	fmt.Fprintf(tw, "missing\t%d\n", st.Missing)
+	fmt.Fprintf(tw, "unreadable\t%d\n", st.Unreadable)
+	fmt.Fprintf(tw, "failed\t%d\n", st.Failed)
+	fmt.Fprintf(tw, "aliases\t%d\n", st.Aliases)
+	fmt.Fprintf(tw, "saved by aliases\t%d\n", st.AliasSaved)
+	for _, k := range sortedNames(st.Features) {
+		fmt.Fprintf(tw, "feature %s\t%d\n", k, st.Features[k])
+	}
+	for _, k := range sortedNames(st.PerDirectory) {
+		fmt.Fprintf(tw, "dir %s\t%d\n", k, st.PerDirectory[k])
+	}
+	sizes := make([]int, 0, len(st.SpectrumBytes))
+	for size := range st.SpectrumBytes {
+		sizes = append(sizes, size)
+	}
+	sort.Ints(sizes)
+	for _, size := range sizes {
+		fmt.Fprintf(tw, "spectra %dx%d\t%d\n", size, size, st.SpectrumBytes[size])
+	}
+	for _, l := range st.Layers {
+		fmt.Fprintf(tw, "layer %s\t%d\n", l.DB, l.Entries)
+	}
+	for _, k := range sortedNames(st.Shards) {
+		fmt.Fprintf(tw, "shard %s\t%d\n", k, st.Shards[k])
+	}
+	return tw.Flush()
+}
+
+func sortedNames(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// verifyEntry returns the problems of the entry itself.
+// With needPixels, missing stored pixels are a problem, too.
+// The entries of failed files and the aliases have no features to check.
+func verifyEntry(t Thumbnail, needPixels bool) []string {
+	var problems []string
+	if t.Name == "" {
+		problems = append(problems, "empty name")
+	}
+	if t.ModTime.IsZero() {
+		problems = append(problems, "zero modtime")
+	}
+	if t.Failed != "" || t.AliasOf != "" {
+		return problems
+	}
+	// the fit is an option, not a problem
+	if reason := currentParams(entryFit(t)).mismatch(t.Params); reason != "" {
+		problems = append(problems, "params "+reason)
+	}
+	if needPixels && len(t.Pix) == 0 {
+		problems = append(problems, "no pixels stored")
+	}
+	for _, c := range t.coeffs() {
+		if !isFinite(real(c)) || !isFinite(imag(c)) {
+			problems = append(problems, "non-finite fft value")
+			break
+		}
+	}
+	if t.Color == (color.NRGBA{}) {
+		problems = append(problems, "missing color")
+	}
+	return problems
+}
+
+// entryFit returns the fit the features of the entry were computed on.
+func entryFit(t Thumbnail) Fit { return Fit(t.Params.orLegacy().Anchor) }
+
+func isFinite(f float64) bool { return !math.IsNaN(f) && !math.IsInf(f, 0) }
+
+// verifyDeep recomputes the features of the file, and compares them with the stored ones.
+func verifyDeep(ctx context.Context, path string, t Thumbnail) []string {
+	if t.Failed != "" || t.AliasOf != "" {
+		return nil
+	}
+	img, err := openImage(ctx, path)
+	if err != nil {
+		return []string{"unreadable source"}
+	}
+	if fit := entryFit(t); fit != FitStretch {
+		img = fit.Apply(img, Width, color.NRGBA{})
+	}
+	var problems []string
+	fft := imgFFT(img)
+	var maxAbs, maxDiff float64
+	stored := t.coeffs()
+	// Compare only the magnitudes, as quantized DBs store only those.
+	for i, c := range fft {
+		a := cmplx.Abs(c)
+		maxAbs = math.Max(maxAbs, a)
+		maxDiff = math.Max(maxDiff, math.Abs(a-cmplx.Abs(stored[i])))
+	}
+	if maxDiff > 1e-3*maxAbs {
+		problems = append(problems, "fft differs from the source")
+	}
+	if c := avgColor(img); absDiff(c.R, t.Color.R) > 1 || absDiff(c.G, t.Color.G) > 1 || absDiff(c.B, t.Color.B) > 1 {
+		problems = append(problems, "color differs from the source")
+	}
+	return problems
+}
+
+func absDiff(a, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+func dbVerify(args []string) error {
+	fs := flag.NewFlagSet("db verify", flag.ContinueOnError)
+	flagDB := fs.String("db", defaultDB(), "DB file for thumbnails")
+	flagStat := fs.Bool("stat", false, "check the source files, too")
+	flagDeep := fs.Bool("deep", false, "recompute the features of a sample of the entries, and compare them")
+	flagSample := fs.Int("sample", 10, "number of entries to recompute with -deep")
+	flagPixels := fs.Bool("pixels", false, "report the entries without stored pixels")
+	flagFix := fs.Bool("fix", false, "re-index the entries with problems, and prune those whose source is missing or unreadable")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	hdr, thumbnails, err := loadDB(*flagDB)
+	if err != nil {
+		return err
+	}
+	keys, err := sortedKeys(thumbnails, "")
+	if err != nil {
+		return err
+	}
+	every := len(keys) + 1
+	if *flagDeep && *flagSample > 0 {
+		every = (len(keys) + *flagSample - 1) / *flagSample
+		if every == 0 {
+			every = 1
+		}
+	}
+	ctx := context.Background()
+	summary := make(map[string]int)
+	var bad, fixed, pruned int
+	for i, k := range keys {
+		t := thumbnails[k]
+		problems := verifyEntry(t, *flagPixels)
+		if *flagStat {
+			if st := entryStatus(k, t); st != "fresh" {
+				problems = append(problems, "source "+st)
+			}
+		}
+		if i%every == 0 {
+			problems = append(problems, verifyDeep(ctx, k, t)...)
+		}
+		if len(problems) == 0 {
+			continue
+		}
+		bad++
+		fmt.Printf("%s: %s\n", k, strings.Join(problems, ", "))
+		for _, p := range problems {
+			summary[p]++
+		}
+		if *flagFix {
+			if fixEntry(ctx, thumbnails, k, *flagPixels) {
+				fixed++
+			} else {
+				pruned++
+			}
+		}
+	}
+	for _, p := range sortedNames(summary) {
+		fmt.Printf("%6d %s\n", summary[p], p)
+	}
+	if *flagFix && bad != 0 {
+		if err := saveDB(*flagDB, hdr, thumbnails); err != nil {
+			return err
+		}
+		fmt.Printf("fixed %d of %d entries: %d re-indexed, %d pruned\n", bad, len(keys), fixed, pruned)
+		return nil
+	}
+	if bad != 0 {
+		return errors.Errorf("%d of %d entries have problems", bad, len(keys))
+	}
+	fmt.Printf("all %d entries are OK\n", len(keys))
+	return nil
+}
+
+// fixEntry re-indexes the entry of the DB, keeping its hash and stored pixels (if any),
+// or deletes it if its source is missing or unreadable; and reports whether it has been re-indexed.
+func fixEntry(ctx context.Context, thumbnails map[string]Thumbnail, k string, needPixels bool) bool {
+	old := thumbnails[k]
+	fi, err := os.Stat(k)
+	if err != nil {
+		delete(thumbnails, k)
+		return false
+	}
+	hash := old.Hash
+	if hash != "" {
+		if hash, err = contentHash(k); err != nil {
+			hash = ""
+		}
+	}
+	t, err := indexFile(ctx, k, fi, hash, needPixels || len(old.Pix) != 0, old.featureNames(), entryFit(old), 0)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		delete(thumbnails, k)
+		return false
+	}
+	thumbnails[k] = t
+	return true
+}
+
+func dbMerge(args []string) error {
+	fs := flag.NewFlagSet("db merge", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: mosaic db merge -o combined.db a.db b.db...")
+		fmt.Fprintln(fs.Output(), "       mosaic db merge -shards -o combined.db dir...")
+		fs.PrintDefaults()
+	}
+	flagOut := fs.String("o", "", "output DB")
+	flagStrategy := fs.String("strategy", "newest", "resolution of key collisions: newest (ModTime), first or last (DB on the command line)")
+	flagShards := fs.Bool("shards", false, "consolidate the "+shardFile+" shards (of -db-shard-by-dir) found under the directories")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *flagOut == "" || fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("an output and at least one input DB is needed")
+	}
+	var keep func(old, new Thumbnail) bool
+	switch *flagStrategy {
+	case "newest":
+		keep = func(old, new Thumbnail) bool { return new.ModTime.After(old.ModTime) }
+	case "first":
+		keep = func(old, new Thumbnail) bool { return false }
+	case "last":
+		keep = func(old, new Thumbnail) bool { return true }
+	default:
+		return errors.Errorf("unknown strategy %q", *flagStrategy)
+	}
+
+	var inputs []store
+	if *flagShards {
+		shards, err := discoverShards(fs.Args())
+		if err != nil {
+			return err
+		}
+		for _, sh := range shards.shards {
+			inputs = append(inputs, sh)
+		}
+	} else {
+		for _, fn := range fs.Args() {
+			if _, err := os.Stat(fn); err != nil {
+				return errors.Wrap(err, fn)
+			}
+			inputs = append(inputs, fileStore(fn))
+		}
+	}
+
+	merged := make(map[string]Thumbnail)
+	var hdr dbHeader
+	var collisions int
+	// The inputs are loaded one by one, so only the merged DB and one input are in memory.
+	for _, in := range inputs {
+		h, thumbnails, err := in.Load(nil)
+		if err != nil {
+			// An incompatible DB can't be decoded into the current entry format.
+			return err
+		}
+		if hdr.Version == 0 {
+			hdr = h // the output gets the precision of the first input
+		}
+		var added, replaced int
+		for k, t := range thumbnails {
+			old, ok := merged[k]
+			if !ok {
+				merged[k] = t
+				added++
+				continue
+			}
+			collisions++
+			if keep(old, t) {
+				merged[k] = t
+				replaced++
+			}
+		}
+		fmt.Fprintf(os.Stderr, "%s: %d entries, %d new, %d replaced\n", in, len(thumbnails), added, replaced)
+	}
+	if err := saveDB(*flagOut, hdr, merged); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "merged %d entries into %q, %d collisions resolved by %s\n",
+		len(merged), *flagOut, collisions, *flagStrategy)
+	return nil
+}
+
+func dbPrune(args []string) error {
+	fs := flag.NewFlagSet("db prune", flag.ContinueOnError)
+	flagDB := fs.String("db", defaultDB(), "DB file for thumbnails")
+	flagDryRun := fs.Bool("dry-run", false, "just list the entries to be pruned")
+	flagUnder := fs.String("only-under", "", "prune only entries under this directory")
+	flagSize := fs.Int("size", 0, "instead of the entries of missing files, drop the spectra of this thumbnail size (see -size) from all entries")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *flagSize == Width {
+		return errors.Errorf("the spectra of size %d are the entries' own, they can't be dropped", Width)
+	}
+	hdr, thumbnails, err := loadDB(*flagDB)
+	if err != nil {
+		return err
+	}
+	var removed []string
+	if *flagSize > 0 {
+		under := *flagUnder
+		if under != "" {
+			if under, err = filepath.Abs(under); err != nil {
+				return errors.Wrap(err, under)
+			}
+		}
+		removed = dropFeature(thumbnails, sizedFeature(*flagSize, PrefilterNone), under, *flagDryRun)
+	} else if removed, err = pruneDB(thumbnails, *flagUnder, *flagDryRun); err != nil {
+		return err
+	}
+	if *flagDryRun {
+		for _, k := range removed {
+			fmt.Println(k)
+		}
+		fmt.Printf("%d of %d entries would be pruned\n", len(removed), len(thumbnails))
+		return nil
+	}
+	if len(removed) == 0 {
+		fmt.Println("nothing to prune")
+		return nil
+	}
+	var before int64
+	if fi, err := os.Stat(*flagDB); err == nil {
+		before = fi.Size()
+	}
+	if err := saveDB(*flagDB, hdr, thumbnails); err != nil {
+		return err
+	}
+	var after int64
+	if fi, err := os.Stat(*flagDB); err == nil {
+		after = fi.Size()
+	}
+	if *flagSize > 0 {
+		fmt.Printf("dropped the %dx%d spectra of %d entries; DB shrank from %d to %d bytes\n",
+			*flagSize, *flagSize, len(removed), before, after)
+		return nil
+	}
+	fmt.Printf("pruned %d entries, %d remained; DB shrank from %d to %d bytes\n",
+		len(removed), len(thumbnails), before, after)
+	return nil
+}
+
+// pruneDB removes the entries whose files do not exist anymore,
+// and returns their keys in order.
+// With a non-empty under, only the entries under that directory are checked.
+//
+// Only non-existence counts: entries that can't be stat'ed for another reason are kept.
+func pruneDB(thumbnails map[string]Thumbnail, under string, dryRun bool) ([]string, error) {
+	if under != "" {
+		var err error
+		if under, err = filepath.Abs(under); err != nil {
+			return nil, errors.Wrap(err, under)
+		}
+	}
+	var removed []string
+	for k := range thumbnails {
+		if under != "" && !isUnder(k, under) || isURL(k) {
+			continue // the URLs are not checked
+		}
+		if _, err := os.Stat(k); err != nil && os.IsNotExist(err) {
+			removed = append(removed, k)
+		}
+	}
+	sort.Strings(removed)
+	if !dryRun {
+		for _, k := range removed {
+			delete(thumbnails, k)
+		}
+	}
+	return removed, nil
+}
+
+// dropFeature removes the extra feature from the entries (under the directory, if not empty),
+// and returns the keys of the entries which had it, in order. With dryRun, it just returns the keys.
+func dropFeature(thumbnails map[string]Thumbnail, name, under string, dryRun bool) []string {
+	var changed []string
+	for k, t := range thumbnails {
+		if _, ok := t.Features[name]; !ok || under != "" && !isUnder(k, under) {
+			continue
+		}
+		changed = append(changed, k)
+		if dryRun {
+			continue
+		}
+		features := make(map[string][]byte, len(t.Features)-1)
+		for f, v := range t.Features {
+			if f != name {
+				features[f] = v
+			}
+		}
+		t.Features = features
+		thumbnails[k] = t
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// gcDB removes the entries of missing files not used since the cutoff (or never),
+// and returns their keys in order. With dryRun, it just returns the keys.
+func gcDB(thumbnails map[string]Thumbnail, cutoff time.Time, dryRun bool) []string {
+	var removed []string
+	for k, t := range thumbnails {
+		if !t.LastUsed.Before(cutoff) || isURL(k) {
+			continue
+		}
+		if _, err := os.Stat(k); err != nil && os.IsNotExist(err) {
+			removed = append(removed, k)
+		}
+	}
+	sort.Strings(removed)
+	if !dryRun {
+		for _, k := range removed {
+			delete(thumbnails, k)
+		}
+	}
+	return removed
+}
+
+// isUnder reports whether path is dir or is in dir.
+func isUnder(path, dir string) bool {
+	dir = filepath.Clean(dir)
+	return path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+}
@@ -0,0 +1,106 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyFix(t *testing.T) {
+	for _, tc := range []struct {
+		Name    string
+		Problem string
+		// Break the entry, or its source.
+		Break func(t *testing.T, fn string, entry *Thumbnail)
+		// Pruned is whether the entry is removed by -fix, not re-indexed.
+		Pruned bool
+	}{
+		{Name: "wrong size", Problem: "params size 64 != 128", Break: func(_ *testing.T, _ string, entry *Thumbnail) {
+			entry.Params.Size = 64
+			entry.FFT = new([Width * Width]complex128)
+		}},
+		{Name: "non-finite", Problem: "non-finite fft value", Break: func(_ *testing.T, _ string, entry *Thumbnail) {
+			fft := *entry.FFT
+			fft[Width+1] = complex(math.NaN(), 0)
+			entry.FFT = &fft
+		}},
+		{Name: "missing source", Problem: "source missing", Pruned: true, Break: func(t *testing.T, fn string, _ *Thumbnail) {
+			if err := os.Remove(fn); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			files := testLibrary(t, dir, 3)
+			opts := testOptions()
+			opts.DB = filepath.Join(dir, "mosaic.db")
+			if _, _, err := prepareThumbnails(context.Background(), opts, append([]string(nil), files...), new(Timings)); err != nil {
+				t.Fatal(err)
+			}
+			hdr, thumbnails, err := loadDB(opts.DB)
+			if err != nil {
+				t.Fatal(err)
+			}
+			broken := files[1]
+			entry := thumbnails[broken]
+			tc.Break(t, broken, &entry)
+			thumbnails[broken] = entry
+			if err := saveDB(opts.DB, hdr, thumbnails); err != nil {
+				t.Fatal(err)
+			}
+
+			args := []string{"-db", opts.DB, "-stat"}
+			if err := dbVerify(args); err == nil || !strings.Contains(err.Error(), "1 of 3 entries") {
+				t.Fatalf("got %v, wanted the problem detected", err)
+			}
+			if problems := append(verifyEntry(entry, false), "source "+entryStatus(broken, entry)); !contains(problems, tc.Problem) {
+				t.Errorf("got %q, wanted %q", problems, tc.Problem)
+			}
+			if err := dbVerify(append(args, "-fix")); err != nil {
+				t.Fatal(err)
+			}
+			if err := dbVerify(args); err != nil {
+				t.Errorf("after -fix: %v", err)
+			}
+			_, thumbnails, err = loadDB(opts.DB)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fixed, ok := thumbnails[broken]
+			if ok == tc.Pruned {
+				t.Fatalf("found %t, wanted pruned %t", ok, tc.Pruned)
+			}
+			if ok && (fixed.Params != currentParams(FitStretch) || *fixed.FFT != *imgFFT(synthImage(1, Width, Width))) {
+				t.Errorf("re-indexed as %+v", fixed.Params)
+			}
+		})
+	}
+}
+
+func contains(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
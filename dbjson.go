@@ -0,0 +1,351 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image/color"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The JSON export of the DB is
+//
+//	{"Format": "mosaic-db", "Version": 1, "Params": {...}, "Entries": [{...}, ...]}
+//
+// with the FFT coefficients as base64 of little-endian (real, imag) pairs,
+// as float64 or float32, as Params.Encoding says.
+const (
+	jsonFormat  = "mosaic-db"
+	jsonVersion = 1
+)
+
+// jsonHeader is the beginning of the JSON export.
+type jsonHeader struct {
+	Format  string
+	Version int
+	Params  jsonParams
+}
+
+// jsonParams are the parameters all the entries were computed with.
+type jsonParams struct {
+	// Width of the grayscale thumbnail the FFT is computed on.
+	Width int
+	// Encoding of the FFT coefficients: f64 or f32.
+	Encoding string
+}
+
+// jsonEntry is one DB entry.
+type jsonEntry struct {
+	Path    string
+	Name    string
+	ModTime time.Time
+	Size    int64  `json:",omitempty"`
+	Hash    string `json:",omitempty"`
+	Params  FeatureParams
+	Color   [4]uint8
+	FFT     string
+	Pix     []byte `json:",omitempty"`
+	// LastUsed is zero if the entry has not been used since it has been recorded.
+	LastUsed time.Time `json:",omitempty"`
+	// Features are the extra features, by name.
+	Features map[string][]byte `json:",omitempty"`
+	// Exif is the metadata of the source, missing if it has not been read.
+	Exif *Exif `json:",omitempty"`
+	// Failed is the error of decoding the file: the entry has no features.
+	Failed string `json:",omitempty"`
+	// AliasOf is the path of the entry with the same content: the entry has no features.
+	AliasOf string `json:",omitempty"`
+}
+
+func exportJSON(w io.Writer, thumbnails map[string]Thumbnail, encoding string) error {
+	if encoding != "f64" && encoding != "f32" {
+		return errors.Errorf("unknown encoding %q", encoding)
+	}
+	keys, err := sortedKeys(thumbnails, "")
+	if err != nil {
+		return err
+	}
+	hdr, err := json.Marshal(jsonHeader{
+		Format: jsonFormat, Version: jsonVersion,
+		Params: jsonParams{Width: Width, Encoding: encoding},
+	})
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	// Stream the entries, instead of marshaling the whole DB at once.
+	bw.Write(hdr[:len(hdr)-1])
+	bw.WriteString(`,"Entries":[`)
+	buf := make([]byte, 0, Width*Width*16)
+	for i, k := range keys {
+		t := thumbnails[k]
+		buf = buf[:0]
+		// none for the entries without features
+		for i := 0; t.FFT != nil && i < len(t.FFT); i++ {
+			c := t.FFT[i]
+			if encoding == "f32" {
+				buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(real(c))))
+				buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(imag(c))))
+			} else {
+				buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(real(c)))
+				buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(imag(c)))
+			}
+		}
+		b, err := json.Marshal(jsonEntry{
+			Path: k, Name: t.Name, ModTime: t.ModTime, Size: t.Size, Hash: t.Hash, Params: t.Params, Pix: t.Pix, LastUsed: t.LastUsed, Features: t.Features, Exif: t.Exif, Failed: t.Failed, AliasOf: t.AliasOf,
+			Color: [4]uint8{t.Color.R, t.Color.G, t.Color.B, t.Color.A},
+			FFT:   base64.StdEncoding.EncodeToString(buf),
+		})
+		if err != nil {
+			return errors.Wrap(err, k)
+		}
+		if i != 0 {
+			bw.WriteByte(',')
+		}
+		bw.WriteString("\n")
+		if _, err := bw.Write(b); err != nil {
+			return err
+		}
+	}
+	bw.WriteString("\n]}\n")
+	return bw.Flush()
+}
+
+func importJSON(r io.Reader) (map[string]Thumbnail, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	expect := func(want json.Delim) error {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if d, ok := tok.(json.Delim); !ok || d != want {
+			return errors.Errorf("got %v, wanted %v", tok, want)
+		}
+		return nil
+	}
+	if err := expect('{'); err != nil {
+		return nil, err
+	}
+	var hdr jsonHeader
+	thumbnails := make(map[string]Thumbnail)
+	var seenEntries, seenParams bool
+	var params FeatureParams
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch key, _ := tok.(string); key {
+		case "Format":
+			err = dec.Decode(&hdr.Format)
+		case "Version":
+			err = dec.Decode(&hdr.Version)
+		case "Params":
+			err = dec.Decode(&hdr.Params)
+		case "Entries":
+			if err = checkJSONHeader(hdr); err != nil {
+				return nil, err
+			}
+			seenEntries = true
+			if err = expect('['); err != nil {
+				return nil, err
+			}
+			for dec.More() {
+				var e jsonEntry
+				if err = dec.Decode(&e); err != nil {
+					return nil, err
+				}
+				t, err := e.thumbnail(hdr.Params.Encoding)
+				if err != nil {
+					return nil, errors.Wrap(err, e.Path)
+				}
+				if t.Failed != "" || t.AliasOf != "" {
+					// no features, no params
+				} else if !seenParams {
+					params, seenParams = t.Params, true
+				} else if reason := params.mismatch(t.Params); reason != "" {
+					return nil, errors.Errorf("%s: mixed parameters: %s", e.Path, reason)
+				}
+				thumbnails[e.Path] = t
+			}
+			err = expect(']')
+		default:
+			var skip json.RawMessage
+			err = dec.Decode(&skip)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !seenEntries {
+		return nil, errors.New("no entries")
+	}
+	return thumbnails, nil
+}
+
+func checkJSONHeader(hdr jsonHeader) error {
+	if hdr.Format != jsonFormat {
+		return errors.Errorf("format is %q, not %q", hdr.Format, jsonFormat)
+	}
+	if hdr.Version != jsonVersion {
+		return errors.Errorf("unsupported version %d", hdr.Version)
+	}
+	if hdr.Params.Width != Width {
+		return errors.Errorf("entries are of width %d, this program uses %d", hdr.Params.Width, Width)
+	}
+	if e := hdr.Params.Encoding; e != "f64" && e != "f32" {
+		return errors.Errorf("unknown encoding %q", e)
+	}
+	return nil
+}
+
+func (e jsonEntry) thumbnail(encoding string) (Thumbnail, error) {
+	t := Thumbnail{
+		Name: e.Name, ModTime: e.ModTime, Size: e.Size, Hash: e.Hash, Params: e.Params, Pix: e.Pix, LastUsed: e.LastUsed, Features: e.Features, Exif: e.Exif, Failed: e.Failed, AliasOf: e.AliasOf,
+		Color: color.NRGBA{R: e.Color[0], G: e.Color[1], B: e.Color[2], A: e.Color[3]},
+	}
+	b, err := base64.StdEncoding.DecodeString(e.FFT)
+	if err != nil {
+		return t, err
+	}
+	size := 16
+	if encoding == "f32" {
+		size = 8
+	}
+	if len(b) == 0 {
+		return t, nil
+	}
+	if len(b) != size*len(t.FFT) {
+		return t, errors.Errorf("FFT has %d coefficients, wanted %d", len(b)/size, len(t.FFT))
+	}
+	t.FFT = new([Width * Width]complex128)
+	for i := range t.FFT {
+		if encoding == "f32" {
+			t.FFT[i] = complex(
+				float64(math.Float32frombits(binary.LittleEndian.Uint32(b[i*8:]))),
+				float64(math.Float32frombits(binary.LittleEndian.Uint32(b[i*8+4:]))))
+		} else {
+			t.FFT[i] = complex(
+				math.Float64frombits(binary.LittleEndian.Uint64(b[i*16:])),
+				math.Float64frombits(binary.LittleEndian.Uint64(b[i*16+8:])))
+		}
+	}
+	return t, nil
+}
+
+func dbExport(args []string) error {
+	fs := flag.NewFlagSet("db export", flag.ContinueOnError)
+	flagDB := fs.String("db", defaultDB(), "DB file for thumbnails")
+	flagOut := fs.String("o", "-", "output JSON file, gzipped if ends with .gz")
+	flagEncoding := fs.String("encoding", "f64", "encoding of FFT coefficients: f64 (exact) or f32 (compact)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	_, thumbnails, err := loadDB(*flagDB)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = os.Stdout
+	var fh *os.File
+	if *flagOut != "" && *flagOut != "-" {
+		if fh, err = os.Create(*flagOut); err != nil {
+			return errors.Wrap(err, *flagOut)
+		}
+		defer fh.Close()
+		w = fh
+	}
+	var gw *gzip.Writer
+	if strings.HasSuffix(*flagOut, ".gz") {
+		gw = gzip.NewWriter(w)
+		w = gw
+	}
+	if err = exportJSON(w, thumbnails, *flagEncoding); err == nil && gw != nil {
+		err = gw.Close()
+	}
+	if err == nil && fh != nil {
+		err = fh.Close()
+	}
+	if err != nil {
+		return errors.Wrap(err, *flagOut)
+	}
+	if fh != nil {
+		fmt.Fprintf(os.Stderr, "exported %d entries to %q\n", len(thumbnails), *flagOut)
+	}
+	return nil
+}
+
+func dbImport(args []string) error {
+	fs := flag.NewFlagSet("db import", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: mosaic db import [flags] dump.json[.gz]")
+		fs.PrintDefaults()
+	}
+	flagDB := fs.String("db", defaultDB(), "DB file for thumbnails")
+	flagForce := fs.Bool("force", false, "overwrite an existing DB")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("exactly one JSON file is needed")
+	}
+	if _, err := os.Stat(*flagDB); err == nil && !*flagForce {
+		return errors.Errorf("%s: already exists, use -force to overwrite", *flagDB)
+	}
+	fn := fs.Arg(0)
+	var r io.Reader = os.Stdin
+	if fn != "-" {
+		fh, err := os.Open(fn)
+		if err != nil {
+			return errors.Wrap(err, fn)
+		}
+		defer fh.Close()
+		r = fh
+	}
+	if strings.HasSuffix(fn, ".gz") {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return errors.Wrap(err, fn)
+		}
+		defer gr.Close()
+		r = gr
+	}
+	thumbnails, err := importJSON(r)
+	if err != nil {
+		return errors.Wrap(err, fn)
+	}
+	if err := os.MkdirAll(filepath.Dir(*flagDB), 0755); err != nil {
+		return err
+	}
+	if err := saveDB(*flagDB, newDBHeader(), thumbnails); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "imported %d entries into %q\n", len(thumbnails), *flagDB)
+	return nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+	lib := synthLibrary(8)
+	lib["failed.png"] = Thumbnail{Name: "failed.png", Size: 10, Failed: "unknown format"}
+	lib["copy.png"] = Thumbnail{Name: "copy.png", Hash: "h", AliasOf: synthKey(0)}
+	t0 := lib[synthKey(0)]
+	t0.Hash = "h"
+	lib[synthKey(0)] = t0
+	files := make([]string, 0, len(lib))
+	for k := range lib {
+		files = append(files, k)
+	}
+	sort.Strings(files)
+	for _, encoding := range []string{"f64", "f32"} {
+		t.Run(encoding, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := exportJSON(&buf, lib, encoding); err != nil {
+				t.Fatal(err)
+			}
+			imported, err := importJSON(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(imported) != len(lib) {
+				t.Fatalf("got %d entries, wanted %d", len(imported), len(lib))
+			}
+			for k, want := range lib {
+				got := imported[k]
+				if got.Name != want.Name || got.Color != want.Color || got.Failed != want.Failed || got.AliasOf != want.AliasOf ||
+					(got.FFT == nil) != (want.FFT == nil) || got.Params != want.Params {
+					t.Errorf("%s: got %+v, wanted %+v", k, got, want)
+				}
+				if encoding == "f64" && want.FFT != nil && *got.FFT != *want.FFT {
+					t.Errorf("%s: the FFT changed", k)
+				}
+			}
+			// the same matches for a test target
+			opts := MatchOptions{Metric: MetricFFT}
+			before, after := newMatcher(lib, files, opts), newMatcher(imported, files, opts)
+			for i := int64(0); i < 16; i++ {
+				cell := synthImage(100+i, Width, Width)
+				if a, b := before.Nearest(cell), after.Nearest(cell); a != b {
+					t.Errorf("cell %d: got %q after the round trip, %q before", i, b, a)
+				}
+			}
+		})
+	}
+}
+
+func TestJSONImportInvalid(t *testing.T) {
+	lib := synthLibrary(2)
+	odd := lib[synthKey(1)]
+	odd.Params.Size = 64
+	lib[synthKey(1)] = odd
+	var mixed bytes.Buffer
+	if err := exportJSON(&mixed, lib, "f64"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		Name, JSON, Want string
+	}{
+		{Name: "mixed params", JSON: mixed.String(), Want: "mixed parameters"},
+		{Name: "format", JSON: `{"Format":"other","Version":1,"Params":{"Width":128,"Encoding":"f64"},"Entries":[]}`, Want: "format"},
+		{Name: "width", JSON: `{"Format":"mosaic-db","Version":1,"Params":{"Width":64,"Encoding":"f64"},"Entries":[]}`, Want: "64"},
+		{Name: "FFT size", JSON: `{"Format":"mosaic-db","Version":1,"Params":{"Width":128,"Encoding":"f64"},"Entries":[{"Path":"/a","FFT":"AAAA"}]}`, Want: "/a"},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			_, err := importJSON(strings.NewReader(tc.JSON))
+			if err == nil || !strings.Contains(err.Error(), tc.Want) {
+				t.Errorf("got %v, wanted an error of %q", err, tc.Want)
+			}
+		})
+	}
+}
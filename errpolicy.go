@@ -0,0 +1,171 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrorPolicy tells what to do when sources can't be indexed;
+// the zero value is best-effort: skip them, and warn at the end of the run.
+type ErrorPolicy struct {
+	// FailFast aborts the run on the first failing source.
+	FailFast bool
+	// Threshold aborts the run when more than this fraction of the sources fail; 0 means no limit.
+	Threshold float64
+}
+
+func (p ErrorPolicy) String() string {
+	switch {
+	case p.FailFast:
+		return "fail-fast"
+	case p.Threshold > 0:
+		return "threshold:" + strconv.FormatFloat(100*p.Threshold, 'g', -1, 64) + "%"
+	}
+	return "best-effort"
+}
+
+// Set parses "best-effort", "fail-fast", or "threshold:" and a percentage (such as 5%) or fraction.
+func (p *ErrorPolicy) Set(s string) error {
+	switch s {
+	case "", "best-effort":
+		*p = ErrorPolicy{}
+		return nil
+	case "fail-fast":
+		*p = ErrorPolicy{FailFast: true}
+		return nil
+	}
+	v, ok := strings.CutPrefix(s, "threshold:")
+	if !ok {
+		return errors.Errorf("%q: must be best-effort, fail-fast or threshold:PERCENT", s)
+	}
+	pct := strings.HasSuffix(v, "%")
+	f, err := strconv.ParseFloat(strings.TrimSuffix(v, "%"), 64)
+	if err != nil {
+		return errors.Wrap(err, s)
+	}
+	if pct {
+		f /= 100
+	}
+	if f <= 0 || f >= 1 {
+		return errors.Errorf("%q: the threshold must be between 0 and 100%%", s)
+	}
+	*p = ErrorPolicy{Threshold: f}
+	return nil
+}
+
+// SourcesFailedError is returned, after completing a best-effort run, when N of the
+// Total sources could not be indexed.
+type SourcesFailedError struct {
+	N, Total int
+	// Warning is the other warning of the run, a *NotPersistedError, or nil.
+	Warning error
+}
+
+func (e *SourcesFailedError) Error() string {
+	msg := fmt.Sprintf("%d of the %d sources could not be indexed", e.N, e.Total)
+	if e.Warning != nil {
+		msg += "; " + e.Warning.Error()
+	}
+	return msg
+}
+
+func (e *SourcesFailedError) Unwrap() error { return e.Warning }
+
+// exitSourcesFailed is the exit code of a successful best-effort run with sources which could not be indexed.
+const exitSourcesFailed = 4
+
+// isWarning reports whether the error is just a warning of a completed run.
+func isWarning(err error) bool {
+	var npe *NotPersistedError
+	var sfe *SourcesFailedError
+	return errors.As(err, &npe) || errors.As(err, &sfe)
+}
+
+// sourceFailures collects the sources failing to index, by their reason, applying the ErrorPolicy.
+type sourceFailures struct {
+	policy ErrorPolicy
+	total  int
+	n      int
+	// the number and the first file of each reason
+	reasons map[string]int
+	first   map[string]string
+}
+
+func newSourceFailures(policy ErrorPolicy, total int) *sourceFailures {
+	return &sourceFailures{policy: policy, total: total, reasons: make(map[string]int), first: make(map[string]string)}
+}
+
+// Add the failure of the source, returning the error aborting the run, if the policy says so.
+func (f *sourceFailures) Add(fn string, err error) error {
+	log.Println(err)
+	f.n++
+	reason := failureReason(err)
+	if f.reasons[reason]++; f.reasons[reason] == 1 {
+		f.first[reason] = fn
+	}
+	if f.policy.FailFast {
+		return errors.Wrap(err, "indexing (-errors fail-fast)")
+	}
+	if t := f.policy.Threshold; t > 0 && float64(f.n) > t*float64(f.total) {
+		return errors.Errorf("indexing: %d of the %d sources could not be indexed, more than -errors %s", f.n, f.total, f.policy)
+	}
+	return nil
+}
+
+// failureReason of the error, without the file names, to group the failures by.
+func failureReason(err error) string {
+	var pe *os.PathError
+	if errors.As(err, &pe) {
+		return pe.Op + ": " + pe.Err.Error()
+	}
+	return errors.Cause(err).Error()
+}
+
+// Summary logs the failures, grouped by reason, the most frequent first.
+func (f *sourceFailures) Summary() {
+	if f.n == 0 {
+		return
+	}
+	log.Printf("%d of the %d sources could not be indexed:", f.n, f.total)
+	reasons := make([]string, 0, len(f.reasons))
+	for r := range f.reasons {
+		reasons = append(reasons, r)
+	}
+	sort.Slice(reasons, func(i, j int) bool {
+		a, b := reasons[i], reasons[j]
+		return f.reasons[a] > f.reasons[b] || f.reasons[a] == f.reasons[b] && a < b
+	})
+	for _, r := range reasons {
+		log.Printf("  %d× %s (such as %s)", f.reasons[r], r, f.first[r])
+	}
+}
+
+// Warning returns the warning of the completed run: w, or a *SourcesFailedError
+// wrapping it if there were failures and the policy is best-effort.
+func (f *sourceFailures) Warning(w error) error {
+	if f.n == 0 || f.policy != (ErrorPolicy{}) {
+		return w
+	}
+	return &SourcesFailedError{N: f.n, Total: f.total, Warning: w}
+}
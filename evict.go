@@ -0,0 +1,139 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Evict is the order of evicting the entries over -db-max-size.
+type Evict string
+
+const (
+	// EvictLRU evicts the least recently used entries first.
+	EvictLRU = Evict("lru")
+	// EvictLargest evicts the largest entries (with stored pixels, extra features) first.
+	EvictLargest = Evict("largest")
+)
+
+func (e Evict) String() string { return string(e) }
+func (e *Evict) Set(s string) error {
+	switch x := Evict(s); x {
+	case EvictLRU, EvictLargest:
+		*e = x
+		return nil
+	}
+	return errors.Errorf("unknown eviction policy %q", s)
+}
+
+// storeSize returns the size of the files of the store, or -1 if it has none.
+func storeSize(st store) int64 {
+	var files []string
+	switch st := st.(type) {
+	case fileStore:
+		files = []string{string(st)}
+	case relStore:
+		files = []string{string(st.fileStore)}
+	case shardStore:
+		for _, sh := range st.shards {
+			files = append(files, string(sh.fileStore))
+		}
+	default:
+		return -1
+	}
+	var size int64
+	for _, fn := range files {
+		for _, fn := range []string{fn, fn + journalExt} {
+			if fi, err := os.Stat(fn); err == nil {
+				size += fi.Size()
+			}
+		}
+	}
+	return size
+}
+
+// entryWeight is the estimated relative size of the entry in the DB file.
+func entryWeight(key string, t Thumbnail, prec Precision) int64 {
+	w := int64(len(key) + len(t.Name) + len(t.Hash) + len(t.Pix) + 64)
+	switch prec {
+	case PrecisionFloat32:
+		w += 4 * Width * Width
+	case PrecisionInt16:
+		w += 2 * Width * Width
+	default:
+		w += 16 * Width * Width
+	}
+	for _, payload := range t.Features {
+		w += int64(len(payload))
+	}
+	return w
+}
+
+// capStore evicts entries from the store, in the order of the policy, until its files
+// are under max. It costs just a stat while they are under it.
+func capStore(ctx context.Context, st store, max ByteSize, policy Evict) error {
+	for attempt := 0; attempt < 3; attempt++ {
+		size := storeSize(st)
+		if size < 0 || size <= int64(max) {
+			return nil
+		}
+		hdr, thumbnails, err := st.Load(nil)
+		if err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(thumbnails))
+		weights := make(map[string]int64, len(thumbnails))
+		var total int64
+		for k, t := range thumbnails {
+			keys = append(keys, k)
+			weights[k] = entryWeight(k, t, hdr.Precision)
+			total += weights[k]
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			a, b := keys[i], keys[j]
+			if policy == EvictLargest && weights[a] != weights[b] {
+				return weights[a] > weights[b]
+			}
+			if ta, tb := thumbnails[a].LastUsed, thumbnails[b].LastUsed; !ta.Equal(tb) {
+				return ta.Before(tb)
+			}
+			return a < b
+		})
+		// The file size is distributed among the entries by their weights.
+		scale := float64(size) / float64(total)
+		var evicted int
+		for _, k := range keys {
+			if float64(total)*scale <= float64(max) {
+				break
+			}
+			total -= weights[k]
+			delete(thumbnails, k)
+			log.Printf("evicted %s", k)
+			evicted++
+		}
+		if err := st.Save(ctx, hdr, thumbnails, nil); err != nil {
+			return err
+		}
+		log.Printf("evicted %d entries (%s first) to keep %q under -db-max-size=%s, %d remained",
+			evicted, policy, st, max, len(thumbnails))
+	}
+	return nil
+}
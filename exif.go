@@ -0,0 +1,360 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Exif is the metadata of a source read from its EXIF, zero where it is missing.
+type Exif struct {
+	// Taken is the capture time (DateTimeOriginal, or DateTime), in the local time zone.
+	Taken       time.Time `json:",omitzero"`
+	Make        string    `json:",omitempty"`
+	Model       string    `json:",omitempty"`
+	Orientation int       `json:",omitempty"`
+	// Width and Height are the pixel dimensions of the image as stored, before the Orientation
+	// (since DB version 12): of the EXIF, or else of the image itself.
+	Width  int `json:",omitempty"`
+	Height int `json:",omitempty"`
+}
+
+// Camera is the make and model, without repeating the make.
+func (e Exif) Camera() string {
+	if e.Make == "" || strings.HasPrefix(strings.ToLower(e.Model), strings.ToLower(e.Make)) {
+		return e.Model
+	}
+	return strings.TrimSpace(e.Make + " " + e.Model)
+}
+
+// Aspect is the shape of the image as displayed (after the EXIF Orientation),
+// empty if its dimensions are unknown.
+func (e Exif) Aspect() Aspect {
+	w, h := e.Width, e.Height
+	if e.Orientation >= 5 && e.Orientation <= 8 { // rotated by 90°
+		w, h = h, w
+	}
+	switch {
+	case w <= 0 || h <= 0:
+		return ""
+	case w > h:
+		return AspectLandscape
+	case w < h:
+		return AspectPortrait
+	default:
+		return AspectSquare
+	}
+}
+
+// readExif returns the EXIF metadata of the JPEG or TIFF-based (such as most RAW) file,
+// reading just its head: its dimensions, if not in the EXIF, are of the image header.
+// The errors are only logged: a source without EXIF has a zero Exif.
+func readExif(ctx context.Context, fn string) Exif {
+	var r io.ReadSeeker
+	if isURL(fn) {
+		b, err := fetchURL(ctx, fn)
+		if err != nil {
+			return Exif{}
+		}
+		r = bytes.NewReader(b)
+	} else {
+		fh, err := os.Open(fn)
+		if err != nil {
+			return Exif{}
+		}
+		defer fh.Close()
+		r = fh
+	}
+	e, err := parseExif(bufio.NewReader(r))
+	if err != nil {
+		log.Printf("%s: EXIF: %v", fn, err)
+	}
+	if e.Width == 0 || e.Height == 0 {
+		if _, err := r.Seek(0, io.SeekStart); err == nil {
+			if cfg, _, err := image.DecodeConfig(r); err == nil {
+				e.Width, e.Height = cfg.Width, cfg.Height
+			}
+		}
+	}
+	return e
+}
+
+// addExif reads the EXIF of the entries of the files which have not been read yet (from before DB version 9),
+// calling added with their keys. It returns their number.
+// The EXIF without the dimensions (from before DB version 12) is read again, too.
+func addExif(ctx context.Context, thumbnails map[string]Thumbnail, files []string, added func(key string)) int {
+	var n int
+	for _, fn := range files {
+		if ctx.Err() != nil {
+			break
+		}
+		t, ok := thumbnails[fn]
+		if !ok || t.Failed != "" || t.Exif != nil && t.Exif.Width != 0 {
+			continue
+		}
+		e := readExif(ctx, fn)
+		if e.Width == 0 || e.Height == 0 {
+			// such as of a RAW file: decoded, as by indexFile
+			if img, err := openImage(ctx, fn); err == nil {
+				e.Width, e.Height = img.Bounds().Dx(), img.Bounds().Dy()
+			}
+		}
+		t.Exif = &e
+		thumbnails[fn] = t
+		added(fn)
+		n++
+	}
+	return n
+}
+
+// EXIF tags read by parseExif.
+const (
+	tagMake             = 0x010f
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagDateTime         = 0x0132
+	tagExifIFD          = 0x8769
+	tagDateTimeOriginal = 0x9003
+	tagPixelXDimension  = 0xa002
+	tagPixelYDimension  = 0xa003
+)
+
+// exifTime is the format of the EXIF date and time tags.
+const exifTime = "2006:01:02 15:04:05"
+
+// parseExif reads the EXIF of a JPEG (the APP1 segment) or a TIFF file.
+// No EXIF is not an error.
+func parseExif(br *bufio.Reader) (Exif, error) {
+	head, err := br.Peek(4)
+	if err != nil {
+		return Exif{}, nil
+	}
+	if string(head) == "II*\x00" || string(head) == "MM\x00*" {
+		// the IFDs may be anywhere, but these are usually in the first MiB
+		b, err := io.ReadAll(io.LimitReader(br, 1<<20))
+		if err != nil {
+			return Exif{}, err
+		}
+		return parseTIFF(b)
+	}
+	if head[0] != 0xff || head[1] != markerSOI {
+		return Exif{}, nil
+	}
+	br.Discard(2)
+	for {
+		var m [4]byte
+		if _, err := io.ReadFull(br, m[:]); err != nil {
+			return Exif{}, nil
+		}
+		if m[0] != 0xff || m[1] == markerSOS || m[1] == markerEOI {
+			return Exif{}, nil
+		}
+		n := int(binary.BigEndian.Uint16(m[2:]))
+		if n < 2 {
+			return Exif{}, errMalformedExif
+		}
+		if m[1] != 0xe1 { // APP1
+			if _, err := br.Discard(n - 2); err != nil {
+				return Exif{}, nil
+			}
+			continue
+		}
+		b := make([]byte, n-2)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return Exif{}, err
+		}
+		if tiff, ok := bytes.CutPrefix(b, []byte("Exif\x00\x00")); ok {
+			return parseTIFF(tiff)
+		}
+		// such as XMP
+	}
+}
+
+// parseTIFF reads the tags of IFD0 and the EXIF IFD.
+func parseTIFF(b []byte) (Exif, error) {
+	var e Exif
+	if len(b) < 8 {
+		return e, errMalformedExif
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if b[0] == 'M' {
+		order = binary.BigEndian
+	}
+	var original, dateTime string
+	var walk func(off uint32, depth int) error
+	walk = func(off uint32, depth int) error {
+		if depth > 1 {
+			return nil // only IFD0 and the EXIF IFD
+		}
+		if int64(off)+2 > int64(len(b)) {
+			return errMalformedExif
+		}
+		n := int(order.Uint16(b[off:]))
+		entries := b[off+2:]
+		if len(entries) < 12*n {
+			return errMalformedExif
+		}
+		for i := 0; i < n; i++ {
+			ent := entries[12*i : 12*i+12]
+			tag, typ, count := order.Uint16(ent), order.Uint16(ent[2:]), order.Uint32(ent[4:])
+			switch tag {
+			case tagMake, tagModel, tagDateTime, tagDateTimeOriginal:
+				if typ != 2 { // ASCII
+					continue
+				}
+				v := ent[8:12]
+				if count > 4 {
+					o := order.Uint32(v)
+					if int64(o)+int64(count) > int64(len(b)) {
+						return errMalformedExif
+					}
+					v = b[o : o+count]
+				} else {
+					v = v[:count]
+				}
+				s := strings.TrimSpace(strings.TrimRight(string(v), "\x00"))
+				switch tag {
+				case tagMake:
+					e.Make = s
+				case tagModel:
+					e.Model = s
+				case tagDateTime:
+					dateTime = s
+				default:
+					original = s
+				}
+			case tagOrientation:
+				if typ == 3 { // SHORT
+					e.Orientation = int(order.Uint16(ent[8:]))
+				}
+			case tagPixelXDimension, tagPixelYDimension:
+				var v int
+				switch typ {
+				case 3: // SHORT
+					v = int(order.Uint16(ent[8:]))
+				case 4: // LONG
+					v = int(order.Uint32(ent[8:]))
+				default:
+					continue
+				}
+				if tag == tagPixelXDimension {
+					e.Width = v
+				} else {
+					e.Height = v
+				}
+			case tagExifIFD:
+				if err := walk(order.Uint32(ent[8:]), depth+1); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	err := walk(order.Uint32(b[4:]), 0)
+	if original == "" {
+		original = dateTime
+	}
+	if t, tErr := time.ParseInLocation(exifTime, original, time.Local); tErr == nil {
+		e.Taken = t
+	}
+	return e, err
+}
+
+// Aspect is a shape of the images, for ExifFilter.
+type Aspect string
+
+const (
+	AspectLandscape = Aspect("landscape")
+	AspectPortrait  = Aspect("portrait")
+	AspectSquare    = Aspect("square")
+)
+
+func (a *Aspect) String() string {
+	if a == nil {
+		return ""
+	}
+	return string(*a)
+}
+
+func (a *Aspect) Set(s string) error {
+	switch v := Aspect(strings.ToLower(s)); v {
+	case "", AspectLandscape, AspectPortrait, AspectSquare:
+		*a = v
+		return nil
+	}
+	return errors.Errorf("%q: orientation must be landscape, portrait or square", s)
+}
+
+// ExifFilter restricts the sources used as tiles by their EXIF metadata;
+// a source missing the metadata of a set criterion is left out.
+type ExifFilter struct {
+	// After and Before bound the capture time, if not zero: [After, Before).
+	After, Before time.Time
+	// Aspect is the shape of the image as displayed.
+	Aspect Aspect
+	// Camera is a case-insensitive substring of the make and model.
+	Camera string
+}
+
+func (f ExifFilter) isZero() bool { return f == ExifFilter{} }
+
+// Match tells whether the source of the metadata passes the filter.
+func (f ExifFilter) Match(e *Exif) bool {
+	if f.isZero() {
+		return true
+	}
+	if e == nil {
+		return false
+	}
+	if !f.After.IsZero() || !f.Before.IsZero() {
+		if e.Taken.IsZero() || e.Taken.Before(f.After) || !f.Before.IsZero() && !e.Taken.Before(f.Before) {
+			return false
+		}
+	}
+	if f.Aspect != "" && e.Aspect() != f.Aspect {
+		return false
+	}
+	return f.Camera == "" || strings.Contains(strings.ToLower(e.Make+" "+e.Model), strings.ToLower(f.Camera))
+}
+
+// filter returns the files whose entries pass the filter:
+// all of them with a zero filter, none of the failed or missing ones otherwise.
+func (f ExifFilter) filter(thumbnails map[string]Thumbnail, files []string) []string {
+	if f.isZero() {
+		return files
+	}
+	kept := make([]string, 0, len(files))
+	for _, fn := range files {
+		if t, ok := thumbnails[fn]; ok && t.Failed == "" && f.Match(t.Exif) {
+			kept = append(kept, fn)
+		}
+	}
+	return kept
+}
+
+// errMalformedExif is returned by parseTIFF for offsets outside of the EXIF.
+var errMalformedExif = errors.New("malformed EXIF")
@@ -0,0 +1,193 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// exifJPEG writes the image as a JPEG with an EXIF of the metadata into dir.
+func exifJPEG(t testing.TB, dir, name string, img image.Image, e Exif) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	tiff := exifTIFF(e)
+	app1 := append([]byte{0xff, 0xe1, 0, 0}, "Exif\x00\x00"...)
+	app1 = append(app1, tiff...)
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(app1)-2))
+	b := append(append(buf.Bytes()[:2:2], app1...), buf.Bytes()[2:]...)
+	fn := filepath.Join(dir, name)
+	if err := os.WriteFile(fn, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+// exifTIFF returns the little endian TIFF of the EXIF: an IFD0 of the make, model and orientation,
+// and an EXIF IFD of the capture time.
+func exifTIFF(e Exif) []byte {
+	le := binary.LittleEndian
+	type entry struct {
+		tag, typ uint16
+		value    []byte // ASCII, or the SHORT or LONG value
+	}
+	ascii := func(s string) []byte { return append([]byte(s), 0) }
+	short := func(v int) []byte { return le.AppendUint16(nil, uint16(v)) }
+	long := func(v int) []byte { return le.AppendUint32(nil, uint32(v)) }
+	ifd0 := []entry{
+		{tagMake, 2, ascii(e.Make)},
+		{tagModel, 2, ascii(e.Model)},
+		{tagOrientation, 3, short(e.Orientation)},
+		{tagExifIFD, 4, nil}, // the offset, set below
+	}
+	exifIFD := []entry{{tagDateTimeOriginal, 2, ascii(e.Taken.Format(exifTime))}}
+	// the IFDs follow the header, the values which don't fit into the entries the IFDs
+	ifdSize := func(entries []entry) int { return 2 + 12*len(entries) + 4 }
+	exifOff := 8 + ifdSize(ifd0)
+	dataOff := exifOff + ifdSize(exifIFD)
+	ifd0[3].value = long(exifOff)
+	var data []byte
+	write := func(b []byte, entries []entry) []byte {
+		b = le.AppendUint16(b, uint16(len(entries)))
+		for _, ent := range entries {
+			b = le.AppendUint16(b, ent.tag)
+			b = le.AppendUint16(b, ent.typ)
+			count := 1
+			if ent.typ == 2 {
+				count = len(ent.value)
+			}
+			b = le.AppendUint32(b, uint32(count))
+			if len(ent.value) > 4 {
+				b = le.AppendUint32(b, uint32(dataOff+len(data)))
+				data = append(data, ent.value...)
+			} else {
+				var v [4]byte
+				copy(v[:], ent.value)
+				b = append(b, v[:]...)
+			}
+		}
+		return le.AppendUint32(b, 0) // no next IFD
+	}
+	b := append([]byte("II*\x00"), long(8)...)
+	b = write(b, ifd0)
+	b = write(b, exifIFD)
+	return append(b, data...)
+}
+
+func TestParseExif(t *testing.T) {
+	want := Exif{
+		Taken: time.Date(2023, 6, 7, 8, 9, 10, 0, time.Local),
+		Make:  "Canon", Model: "Canon EOS 5D", Orientation: 6,
+		Width: 48, Height: 32,
+	}
+	fn := exifJPEG(t, t.TempDir(), "exif.jpg", synthImage(1, 48, 32), want)
+	got := readExif(context.Background(), fn)
+	if got != want {
+		t.Errorf("got %+v, wanted %+v", got, want)
+	}
+	if got.Camera() != "Canon EOS 5D" {
+		t.Errorf("camera %q", got.Camera())
+	}
+	// rotated by 90°
+	if got.Aspect() != AspectPortrait {
+		t.Errorf("got %s, wanted %s", got.Aspect(), AspectPortrait)
+	}
+	// a TIFF file
+	tiff, err := parseExif(bufio.NewReader(bytes.NewReader(exifTIFF(want))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tiff.Taken != want.Taken || tiff.Camera() != want.Camera() {
+		t.Errorf("TIFF: got %+v, wanted %+v", tiff, want)
+	}
+}
+
+func TestExifFilterMatch(t *testing.T) {
+	day := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 12, 0, 0, 0, time.Local) }
+	e := &Exif{Taken: day(2023, 5, 1), Make: "NIKON", Model: "D750", Width: 600, Height: 400}
+	for _, tc := range []struct {
+		Name   string
+		Filter ExifFilter
+		Exif   *Exif
+		Want   bool
+	}{
+		{Name: "zero", Exif: e, Want: true},
+		{Name: "zero without EXIF", Exif: nil, Want: true},
+		{Name: "after", Filter: ExifFilter{After: day(2023, 1, 1)}, Exif: e, Want: true},
+		{Name: "before the after", Filter: ExifFilter{After: day(2023, 6, 1)}, Exif: e},
+		{Name: "within", Filter: ExifFilter{After: day(2023, 1, 1), Before: day(2024, 1, 1)}, Exif: e, Want: true},
+		{Name: "at the before", Filter: ExifFilter{Before: e.Taken}, Exif: e},
+		{Name: "at the after", Filter: ExifFilter{After: e.Taken}, Exif: e, Want: true},
+		{Name: "no date", Filter: ExifFilter{After: day(2000, 1, 1)}, Exif: &Exif{Make: "NIKON"}},
+		{Name: "without EXIF", Filter: ExifFilter{After: day(2000, 1, 1)}},
+		{Name: "landscape", Filter: ExifFilter{Aspect: AspectLandscape}, Exif: e, Want: true},
+		{Name: "portrait", Filter: ExifFilter{Aspect: AspectPortrait}, Exif: e},
+		{Name: "camera", Filter: ExifFilter{Camera: "nikon d7"}, Exif: e, Want: true},
+		{Name: "other camera", Filter: ExifFilter{Camera: "canon"}, Exif: e},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			if got := tc.Filter.Match(tc.Exif); got != tc.Want {
+				t.Errorf("got %t, wanted %t", got, tc.Want)
+			}
+		})
+	}
+}
+
+func TestExifDateFilter(t *testing.T) {
+	dir := t.TempDir()
+	year := func(y int) Exif { return Exif{Taken: time.Date(y, 7, 1, 12, 0, 0, 0, time.Local)} }
+	red, orange := color.NRGBA{R: 250, G: 10, B: 10, A: 255}, color.NRGBA{R: 250, G: 140, B: 10, A: 255}
+	// the best match is out of the range
+	files := []string{
+		exifJPEG(t, dir, "red2022.jpg", solidImage(Width, Width, red), year(2022)),
+		exifJPEG(t, dir, "orange2023.jpg", solidImage(Width, Width, orange), year(2023)),
+		exifJPEG(t, dir, "red2024.jpg", solidImage(Width, Width, red), year(2024)),
+	}
+	opts := testOptions()
+	opts.Grid = Grid{Cols: 2, Rows: 2}
+	opts.Match.Metric = MetricColor
+	opts.Exif.After = time.Date(2023, 1, 1, 0, 0, 0, 0, time.Local)
+	opts.Exif.Before = time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+	b := NewBuilder(opts)
+	ctx := context.Background()
+	if err := b.AddSources(ctx, files); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := b.BuildImage(ctx, "target", solidImage(2*Width, 2*Width, red))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Tiles) != 4 {
+		t.Fatalf("got %d tiles, wanted 4", len(plan.Tiles))
+	}
+	for _, p := range plan.Tiles {
+		if got := filepath.Base(p.Source); got != "orange2023.jpg" {
+			t.Errorf("r%d_c%d: got %s, wanted orange2023.jpg", p.Row, p.Col, got)
+		}
+	}
+}
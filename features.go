@@ -0,0 +1,371 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"log"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/mjibson/go-dsp/fft"
+	"github.com/pkg/errors"
+)
+
+// extraFeatures compute the optional features of the entries, stored in Thumbnail.Features
+// by name, when the metric of the same name needs them (RegisterMetric adds its own).
+// They are computed on the image fitted into the tile.
+var extraFeatures = map[string]func(img image.Image) []byte{
+	"phash":  pHash,
+	"blocks": blockColors,
+	"hist":   hsvHistogram,
+}
+
+// sizedPrefix starts the name of the extra feature of the log power spectrum computed
+// on a size*size thumbnail, other than Width (the Thumbnail.FFT's): "fft@64".
+// A size not a power of two is padded to one (see fftSize), which is in the name: "fft@100:128";
+// a Prefilter is after a "+": "fft@128+sobel".
+// Its payload is the little endian float32 coefficients.
+const sizedPrefix = "fft@"
+
+// sizedFeature returns the name of the sized spectrum feature of the size and prefilter.
+func sizedFeature(size int, pf Prefilter) string {
+	name := sizedPrefix + strconv.Itoa(size)
+	if p := fftSize(size); p != size {
+		name += ":" + strconv.Itoa(p)
+	}
+	if !pf.isNone() {
+		name += "+" + string(pf)
+	}
+	return name
+}
+
+// fftSize returns the size the size*size thumbnail is padded to for the FFT:
+// the next power of two, which the FFT is fast for (an arbitrary size is several times slower).
+func fftSize(size int) int {
+	p := 1
+	for p < size {
+		p <<= 1
+	}
+	return p
+}
+
+// extraFeature returns the name of the optional feature the metric (and size) needs, or "".
+func (o MatchOptions) extraFeature() string {
+	if _, ok := extraFeatures[string(o.Metric)]; ok {
+		return string(o.Metric)
+	}
+	if (o.size() != Width || !o.Prefilter.isNone()) && o.Metric.usesFFT() {
+		return sizedFeature(o.size(), o.Prefilter)
+	}
+	return ""
+}
+
+// featureFunc returns the function computing the extra feature.
+func featureFunc(name string) (func(img image.Image) []byte, bool) {
+	if f, ok := extraFeatures[name]; ok {
+		return f, true
+	}
+	if size, ok := featureSize(name); ok {
+		_, pf, _ := strings.Cut(name, "+")
+		return func(img image.Image) []byte { return encodeSpectrum(sizedSpectrum(img, size, Prefilter(pf))) }, true
+	}
+	return nil, false
+}
+
+// featureSize returns the size of the sized spectrum feature (not the padded one).
+func featureSize(name string) (int, bool) {
+	if !strings.HasPrefix(name, sizedPrefix) {
+		return 0, false
+	}
+	s, _, _ := strings.Cut(strings.TrimPrefix(name, sizedPrefix), "+")
+	s, _, _ = strings.Cut(s, ":")
+	size, err := strconv.Atoi(s)
+	return size, err == nil && size > 0
+}
+
+// sizedSpectrum returns the log power spectrum of the size*size grayscale thumbnail, like logPower's.
+// The thumbnail is prefiltered by pf, and padded with black to fftSize,
+// so the spectrum has fftSize*fftSize coefficients.
+func sizedSpectrum(img image.Image, size int, pf Prefilter) []float64 {
+	gray := pf.Apply(fftInputSize(img, size))
+	p := fftSize(size)
+	mtx := make([][]float64, p)
+	for i := range mtx {
+		mtx[i] = make([]float64, p)
+		if i >= size {
+			continue
+		}
+		for j := 0; j < size; j++ {
+			mtx[i][j] = float64(gray.Pix[i*size+j])
+		}
+	}
+	s := make([]float64, 0, p*p)
+	for _, row := range fft.FFT2Real(mtx) {
+		for _, c := range row {
+			s = append(s, math.Log1p(R(c)))
+		}
+	}
+	return s
+}
+
+func encodeSpectrum(s []float64) []byte {
+	b := make([]byte, 0, 4*len(s))
+	for _, f := range s {
+		b = binary.LittleEndian.AppendUint32(b, math.Float32bits(float32(f)))
+	}
+	return b
+}
+
+func decodeSpectrum(b []byte) []float64 {
+	s := make([]float64, len(b)/4)
+	for i := range s {
+		s[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(b[4*i:])))
+	}
+	return s
+}
+
+// computeFeatures returns the named extra features of the image; unknown names are skipped.
+func computeFeatures(img image.Image, names []string) map[string][]byte {
+	if len(names) == 0 {
+		return nil
+	}
+	fs := make(map[string][]byte, len(names))
+	for _, name := range names {
+		if f, ok := featureFunc(name); ok {
+			fs[name] = f(img)
+		}
+	}
+	return fs
+}
+
+// featureNames returns the names of the extra features of the entry, in order.
+func (t Thumbnail) featureNames() []string {
+	names := make([]string, 0, len(t.Features))
+	for k := range t.Features {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// addFeature computes the named feature of the entries of the files which lack it:
+// from their stored pixels if they have them, from the original otherwise.
+// The number of entries updated is returned; each of them is passed to added.
+func addFeature(ctx context.Context, thumbnails map[string]Thumbnail, files []string, name string, timeout time.Duration, added func(key string)) int {
+	var n int
+	for _, fn := range files {
+		if ctx.Err() != nil {
+			break
+		}
+		t, ok := thumbnails[fn]
+		if !ok || t.Failed != "" || t.AliasOf != "" || len(t.Features[name]) != 0 {
+			continue
+		}
+		var img image.Image
+		if len(t.Pix) != 0 {
+			var err error
+			if img, err = jpeg.Decode(bytes.NewReader(t.Pix)); err != nil {
+				log.Println(errors.Wrapf(err, "%s: stored pixels", fn))
+			}
+		}
+		if img == nil {
+			src, err := openImageTimeout(ctx, fn, timeout)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			if fit := entryFit(t); fit != FitStretch {
+				src = fit.Apply(src, Width, color.NRGBA{})
+			}
+			img = src
+		}
+		features := make(map[string][]byte, len(t.Features)+1)
+		for k, v := range t.Features {
+			features[k] = v
+		}
+		f, ok := featureFunc(name)
+		if !ok {
+			return n
+		}
+		features[name] = f(img)
+		t.Features = features
+		thumbnails[fn] = t
+		added(fn)
+		n++
+	}
+	return n
+}
+
+// pHash is the perceptual hash of the image: the signs of the 8x8 lowest frequency
+// DCT coefficients (but the DC) of its 32x32 grayscale version, compared to their median.
+func pHash(img image.Image) []byte {
+	const n = 32
+	small := imaging.Grayscale(imaging.Resize(img, n, n, imaging.Box))
+	var px [n][n]float64
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			px[y][x] = float64(small.Pix[small.PixOffset(x, y)])
+		}
+	}
+	var cos [8][n]float64
+	for u := range cos {
+		for x := 0; x < n; x++ {
+			cos[u][x] = math.Cos(float64((2*x+1)*u) * math.Pi / (2 * n))
+		}
+	}
+	coeffs := make([]float64, 0, 64)
+	for v := 0; v < 8; v++ {
+		for u := 0; u < 8; u++ {
+			var sum float64
+			for y := 0; y < n; y++ {
+				for x := 0; x < n; x++ {
+					sum += px[y][x] * cos[u][x] * cos[v][y]
+				}
+			}
+			coeffs = append(coeffs, sum)
+		}
+	}
+	sorted := append([]float64(nil), coeffs[1:]...)
+	sort.Float64s(sorted)
+	median := (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+	var h uint64
+	for i, c := range coeffs[1:] {
+		if c > median {
+			h |= 1 << uint(i)
+		}
+	}
+	return binary.LittleEndian.AppendUint64(nil, h)
+}
+
+// hashDistance is the Hamming distance of the pHashes.
+func hashDistance(a, b uint64) float64 { return float64(bits.OnesCount64(a ^ b)) }
+
+// blocksPerSide is the number of the blocks of blockColors along a side.
+const blocksPerSide = 4
+
+// blockColors returns the average colors of the blocksPerSide² blocks of the image, row by row,
+// as R, G, B, A bytes.
+func blockColors(img image.Image) []byte {
+	return append([]byte(nil), imaging.Resize(img, blocksPerSide, blocksPerSide, imaging.Box).Pix...)
+}
+
+// blockLabs returns the colors of the blockColors payload.
+func blockLabs(b []byte) []lab {
+	labs := make([]lab, len(b)/4)
+	for i := range labs {
+		labs[i] = toLab(color.NRGBA{R: b[4*i], G: b[4*i+1], B: b[4*i+2], A: b[4*i+3]})
+	}
+	return labs
+}
+
+// blocksDistance is the mean ΔE of the corresponding blocks.
+func blocksDistance(a, b []lab) float64 {
+	var sum float64
+	for i, c := range a {
+		sum += deltaE(c, b[i])
+	}
+	return sum / float64(len(a))
+}
+
+// The HSV histogram of hsvHistogram has histHues*histSats*histVals bins.
+const (
+	histHues = 8
+	histSats = 3
+	histVals = 3
+	histBins = histHues * histSats * histVals
+	// histSide is the size the image is reduced to before counting its pixels.
+	histSide = 32
+)
+
+// hsvHistogram returns the HSV histogram of the image, each bin the fraction
+// of the pixels in it, scaled to a byte. The hue bins are centered on red, yellow...
+func hsvHistogram(img image.Image) []byte {
+	small := imaging.Resize(img, histSide, histSide, imaging.Box)
+	var counts [histBins]int
+	for i := 0; i < len(small.Pix); i += 4 {
+		h, s, v := toHSV(small.Pix[i], small.Pix[i+1], small.Pix[i+2])
+		hb := int(h/360*histHues+0.5) % histHues
+		sb, vb := min(int(s*histSats), histSats-1), min(int(v*histVals), histVals-1)
+		counts[(hb*histSats+sb)*histVals+vb]++
+	}
+	n := len(small.Pix) / 4
+	b := make([]byte, histBins)
+	for i, c := range counts {
+		b[i] = uint8((255*c + n/2) / n)
+	}
+	return b
+}
+
+// toHSV returns the hue in degrees, the saturation and the value in [0,1].
+func toHSV(r, g, b uint8) (h, s, v float64) {
+	hi, lo := max(r, g, b), min(r, g, b)
+	v = float64(hi) / 255
+	if hi == 0 || hi == lo {
+		return 0, 0, v
+	}
+	d := float64(hi - lo)
+	s = d / float64(hi)
+	switch hi {
+	case r:
+		h = 60 * (float64(g) - float64(b)) / d
+	case g:
+		h = 60 * (2 + (float64(b)-float64(r))/d)
+	default:
+		h = 60 * (4 + (float64(r)-float64(g))/d)
+	}
+	if h < 0 {
+		h += 360
+	}
+	return h, s, v
+}
+
+// histWeights returns the bins of the hsvHistogram payload, summing to 1.
+func histWeights(b []byte) []float64 {
+	var sum float64
+	for _, c := range b {
+		sum += float64(c)
+	}
+	w := make([]float64, len(b))
+	if sum == 0 {
+		return w
+	}
+	for i, c := range b {
+		w[i] = float64(c) / sum
+	}
+	return w
+}
+
+// histDistance is the chi-square distance of the histograms, between 0 and 1.
+func histDistance(a, b []float64) float64 {
+	var d float64
+	for i, x := range a {
+		if s := x + b[i]; s > 0 {
+			d += (x - b[i]) * (x - b[i]) / s
+		}
+	}
+	return d / 2
+}
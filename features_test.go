@@ -0,0 +1,85 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"image/color"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestSizedFeature(t *testing.T) {
+	for _, tc := range []struct {
+		Size, FFTSize int
+		Name          string
+	}{
+		{Size: 64, FFTSize: 64, Name: "fft@64"},
+		{Size: 100, FFTSize: 128, Name: "fft@100:128"},
+		{Size: 129, FFTSize: 256, Name: "fft@129:256"},
+		{Size: 1, FFTSize: 1, Name: "fft@1"},
+	} {
+		t.Run(strconv.Itoa(tc.Size), func(t *testing.T) {
+			if got := fftSize(tc.Size); got != tc.FFTSize {
+				t.Errorf("fftSize: got %d, wanted %d", got, tc.FFTSize)
+			}
+			name := sizedFeature(tc.Size, PrefilterNone)
+			if name != tc.Name {
+				t.Errorf("got %q, wanted %q", name, tc.Name)
+			}
+			if size, ok := featureSize(name); !ok || size != tc.Size {
+				t.Errorf("featureSize: got %d, %t", size, ok)
+			}
+		})
+	}
+}
+
+func TestBuildSize(t *testing.T) {
+	dir := t.TempDir()
+	dark, light := color.NRGBA{R: 60, G: 60, B: 60, A: 255}, color.NRGBA{R: 196, G: 196, B: 196, A: 255}
+	files := []string{
+		writeImage(t, dir, "flat.png", solidImage(Width, Width, color.NRGBA{R: 128, G: 128, B: 128, A: 255})),
+		writeImage(t, dir, "fine.png", stripes(Width, Width, 8, dark, light)),
+		writeImage(t, dir, "coarse.png", stripes(Width, Width, 32, dark, light)),
+	}
+	for _, size := range []int{100, 64} {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			opts := testOptions()
+			opts.Grid = Grid{Cols: 1, Rows: 1}
+			opts.Match.Size = size
+			b := NewBuilder(opts)
+			ctx := context.Background()
+			if err := b.AddSources(ctx, files); err != nil {
+				t.Fatal(err)
+			}
+			p := fftSize(size)
+			for _, fn := range files {
+				spec := b.thumbnails[fn].Features[opts.Match.extraFeature()]
+				if len(spec) != 4*p*p {
+					t.Fatalf("%s: got %d bytes of %s, wanted %d", fn, len(spec), opts.Match.extraFeature(), 4*p*p)
+				}
+			}
+			plan, err := b.BuildImage(ctx, "target", stripes(2*Width, 2*Width, 64, dark, light))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(plan.Tiles) != 1 || filepath.Base(plan.Tiles[0].Source) != "coarse.png" {
+				t.Errorf("got %v, wanted coarse.png", plan.Tiles)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// globPattern is a path.Match pattern, where a "**" element matches any number of directories.
+// A relative pattern matches the end of the path, from any directory on.
+type globPattern []string
+
+// compileGlob checks the syntax of the pattern.
+func compileGlob(pattern string) (globPattern, error) {
+	p := filepath.ToSlash(pattern)
+	elems := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	for _, e := range elems {
+		if _, err := path.Match(e, ""); err != nil {
+			return nil, errors.Wrap(err, pattern)
+		}
+	}
+	if strings.HasPrefix(p, "/") {
+		elems = append([]string{""}, elems...)
+	}
+	return globPattern(elems), nil
+}
+
+// Match reports whether the path matches the pattern.
+func (g globPattern) Match(name string) bool {
+	elems := strings.Split(filepath.ToSlash(name), "/")
+	if len(g) != 0 && g[0] == "" {
+		return matchElems(g, elems)
+	}
+	for i := range elems {
+		if matchElems(g, elems[i:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchElems(pattern, elems []string) bool {
+	for len(pattern) != 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(elems); i++ {
+				if matchElems(pattern[1:], elems[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(elems) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], elems[0]); !ok {
+			return false
+		}
+		pattern, elems = pattern[1:], elems[1:]
+	}
+	return len(elems) == 0
+}
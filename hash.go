@@ -0,0 +1,87 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// hashSample is the size of the head and the tail of the file contentHash reads.
+const hashSample = 64 << 10
+
+// contentHash returns a fast hash of the file's content:
+// of its size, and its first and last 64KiB. A URL is fetched for it.
+func contentHash(fn string) (string, error) {
+	if isURL(fn) {
+		b, err := fetchURL(context.Background(), fn)
+		if err != nil {
+			return "", errors.Wrap(err, fn)
+		}
+		h, err := hashContent(bytes.NewReader(b), int64(len(b)))
+		return h, errors.Wrap(err, fn)
+	}
+	fh, err := os.Open(fn)
+	if err != nil {
+		return "", errors.Wrap(err, fn)
+	}
+	defer fh.Close()
+	fi, err := fh.Stat()
+	if err != nil {
+		return "", errors.Wrap(err, fn)
+	}
+	h, err := hashContent(fh, fi.Size())
+	return h, errors.Wrap(err, fn)
+}
+
+// hashContent is contentHash of the content of r, of the given size.
+func hashContent(r interface {
+	io.Reader
+	io.ReaderAt
+}, size int64) (string, error) {
+	h := sha256.New()
+	var a [8]byte
+	binary.LittleEndian.PutUint64(a[:], uint64(size))
+	h.Write(a[:])
+	var err error
+	if size <= 2*hashSample {
+		_, err = io.Copy(h, r)
+	} else if _, err = io.CopyN(h, r, hashSample); err == nil {
+		_, err = io.Copy(h, io.NewSectionReader(r, size-hashSample, hashSample))
+	}
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashIndex maps the content hashes of the entries with features (not aliases) to their keys.
+func hashIndex(thumbnails map[string]Thumbnail) map[string]string {
+	m := make(map[string]string)
+	for k, t := range thumbnails {
+		if t.Hash != "" && t.AliasOf == "" && t.Failed == "" {
+			m[t.Hash] = k
+		}
+	}
+	return m
+}
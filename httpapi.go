@@ -0,0 +1,386 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"image"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// jobRetention is how long the result of a finished job is kept.
+const jobRetention = 10 * time.Minute
+
+// jobsPerSlot bounds the jobs kept, running or finished, by the slots (-max-requests):
+// at most one running job per slot, and jobsPerSlot jobs per slot in all.
+const jobsPerSlot = 16
+
+// errBusy is the error of starting a job while each slot has one running.
+var errBusy = errors.New("all the slots are taken by the jobs running, retry later")
+
+// httpAPI is the HTTP interface of the server:
+//
+//	POST /mosaic?grid=COLSxROWS&metric=...&format=png|jpeg|plan   with the "target" image as multipart
+//	GET /jobs/{id}   the result, or the state of the job of a POST with "Accept: application/json"
+//	GET /healthz
+//	GET /stats
+//	GET /sources?q=...   the sources with q in their path, to be POSTed as ?source=; only to localhost
+//	GET /   the web UI
+type httpAPI struct {
+	*server
+	// ctx is the server's, for the jobs, which outlive their request.
+	ctx     context.Context
+	maxBody int64
+
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+// job is a mosaic built in the background, for a client polling it.
+type job struct {
+	ID    string
+	State string // running, done or failed
+	Error string `json:",omitempty"`
+
+	req      serveRequest
+	resp     serveResponse
+	finished time.Time
+}
+
+// serveHTTP serves the API on the listener, until ctx is canceled.
+func (s *server) serveHTTP(ctx context.Context, ln net.Listener, maxBody int64) {
+	api := &httpAPI{server: s, ctx: ctx, maxBody: maxBody, jobs: make(map[string]*job)}
+	srv := &http.Server{Handler: api.handler(), BaseContext: func(net.Listener) context.Context { return ctx }}
+	go func() {
+		// forget the jobs finished long ago, even if no new ones are started
+		tick := time.NewTicker(jobRetention / 10)
+		defer tick.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				srv.Shutdown(context.Background())
+				return
+			case now := <-tick.C:
+				api.mu.Lock()
+				api.prune(now)
+				api.mu.Unlock()
+			}
+		}
+	}()
+	if err := srv.Serve(ln); err != http.ErrServerClosed {
+		log.Println(errors.Wrap(err, "HTTP API"))
+	}
+}
+
+// handler routes the requests of the API.
+func (api *httpAPI) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /mosaic", api.handleMosaic)
+	mux.HandleFunc("GET /jobs/{id}", api.handleJob)
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "ok\n") })
+	mux.HandleFunc("GET /stats", api.handleStats)
+	// the paths of the sources are not for everyone's eyes
+	mux.HandleFunc("GET /sources", localOnly(api.handleSources))
+	mux.Handle("GET /", uiHandler())
+	return mux
+}
+
+// localOnly answers 403 Forbidden to the requests not from the loopback (nor a unix socket).
+func localOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+				http.Error(w, "only served to localhost", http.StatusForbidden)
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+// handleMosaic builds the mosaic of the posted target, and answers it - or, with
+// "Accept: application/json", the job building it, to be polled at /jobs/{id}.
+func (api *httpAPI) handleMosaic(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, api.maxBody)
+	req, err := api.parseMosaicRequest(r)
+	if err != nil {
+		status := http.StatusBadRequest
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if accepts(r, "application/json") {
+		j, err := api.start(req)
+		if err != nil {
+			w.Header().Set("Retry-After", "10")
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Location", "/jobs/"+j.ID)
+		writeJSON(w, http.StatusAccepted, j)
+		return
+	}
+	var resp serveResponse
+	if err := api.serve(r.Context(), req, &resp); err != nil {
+		if r.Context().Err() == nil {
+			http.Error(w, err.Error(), errorStatus(err))
+		}
+		return
+	}
+	writeResult(w, req, resp)
+}
+
+// parseMosaicRequest returns the request of the target image of the form - or of the source
+// of the query, which must be one of the server's -, with the options of the query:
+// those of the flags of the same name.
+func (api *httpAPI) parseMosaicRequest(r *http.Request) (serveRequest, error) {
+	var req serveRequest
+	q := r.URL.Query()
+	if src := q.Get("source"); src != "" {
+		// only the server's sources, not just any file
+		if !api.builder.added[src] {
+			return req, errors.Errorf("source %q: not one of the sources", src)
+		}
+		req.Target = src
+	} else {
+		fh, _, err := r.FormFile("target")
+		if err != nil {
+			return req, errors.Wrap(err, "target")
+		}
+		defer fh.Close()
+		if req.Image, err = io.ReadAll(fh); err != nil {
+			return req, errors.Wrap(err, "target")
+		}
+	}
+	if req.Output = q.Get("format"); req.Output == "" {
+		req.Output = "png"
+	}
+	if err := parseQueryValue(q, "metric", req.Metric.Set); err != nil {
+		return req, err
+	}
+	if err := parseQueryValue(q, "grid", req.Grid.Set); err != nil {
+		return req, err
+	}
+	if err := parseQueryValue(q, "render-size", func(v string) (err error) { req.TileSize, err = strconv.Atoi(v); return err }); err != nil {
+		return req, err
+	}
+	if err := parseQueryValue(q, "max-reuse", func(v string) (err error) { req.MaxReuse, err = strconv.Atoi(v); return err }); err != nil {
+		return req, err
+	}
+	if err := parseQueryValue(q, "jitter", func(v string) (err error) { req.Jitter, err = strconv.ParseFloat(v, 64); return err }); err != nil {
+		return req, err
+	}
+	if err := parseQueryValue(q, "seed", func(v string) (err error) { req.Seed, err = strconv.ParseInt(v, 10, 64); return err }); err != nil {
+		return req, err
+	}
+	if err := parseQueryValue(q, "tile-border", func(v string) (err error) { req.Border, err = strconv.Atoi(v); return err }); err != nil {
+		return req, err
+	}
+	if err := parseQueryValue(q, "tile-vignette", func(v string) (err error) { req.Vignette, err = strconv.ParseFloat(v, 64); return err }); err != nil {
+		return req, err
+	}
+	if err := parseQueryValue(q, "tint", func(v string) (err error) { req.Tint, err = parseFraction("tint", v); return err }); err != nil {
+		return req, err
+	}
+	if err := parseQueryValue(q, "overlay", func(v string) (err error) { req.Overlay, err = parseFraction("overlay", v); return err }); err != nil {
+		return req, err
+	}
+	if err := parseQueryValue(q, "preview", func(v string) (err error) { req.Preview, err = strconv.ParseBool(v); return err }); err != nil {
+		return req, err
+	}
+	return req, nil
+}
+
+// parseQueryValue calls parse with the value of the query parameter, if it's given.
+func parseQueryValue(q url.Values, name string, parse func(string) error) error {
+	if v := q.Get(name); v != "" {
+		return errors.Wrap(parse(v), name)
+	}
+	return nil
+}
+
+// parseFraction parses the value of the parameter, between 0 and 1.
+func parseFraction(name, v string) (float64, error) {
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, err
+	}
+	return f, checkFraction(name, f)
+}
+
+// accepts reports whether the request's Accept header lists the media type.
+func accepts(r *http.Request, mediaType string) bool {
+	for _, v := range strings.Split(r.Header.Get("Accept"), ",") {
+		if t, _, err := mime.ParseMediaType(strings.TrimSpace(v)); err == nil && t == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// errorStatus is the HTTP status of the error of serve: a bad or too large target,
+// or a metric without sources, is the client's.
+func errorStatus(err error) int {
+	if errors.Is(err, image.ErrFormat) {
+		return http.StatusBadRequest
+	} else if errors.Is(err, ErrNoSources) {
+		return http.StatusUnprocessableEntity
+	} else if errors.Is(err, ErrTargetTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
+
+// writeResult writes the plan or the image of the response.
+func writeResult(w http.ResponseWriter, req serveRequest, resp serveResponse) {
+	if resp.Plan != nil {
+		writeJSON(w, http.StatusOK, resp.Plan)
+		return
+	}
+	w.Header().Set("Content-Type", "image/"+req.output())
+	w.Header().Set("Content-Length", strconv.Itoa(len(resp.Image)))
+	w.Write(resp.Image)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(errors.Wrap(err, "writing the response"))
+	}
+}
+
+// start the job of the request, in the background, and return it - or errBusy,
+// if a job is running on each slot. Beyond jobsPerSlot jobs per slot, the one
+// finished first is forgotten.
+func (api *httpAPI) start(req serveRequest) (*job, error) {
+	var id [8]byte
+	rand.Read(id[:])
+	j := &job{ID: hex.EncodeToString(id[:]), State: "running", req: req}
+	api.mu.Lock()
+	api.prune(time.Now())
+	var running int
+	for _, old := range api.jobs {
+		if old.finished.IsZero() {
+			running++
+		}
+	}
+	if running >= cap(api.slots) {
+		api.mu.Unlock()
+		return nil, errBusy
+	}
+	for len(api.jobs) >= jobsPerSlot*cap(api.slots) {
+		var oldest *job
+		for _, old := range api.jobs {
+			if !old.finished.IsZero() && (oldest == nil || old.finished.Before(oldest.finished)) {
+				oldest = old
+			}
+		}
+		delete(api.jobs, oldest.ID)
+	}
+	api.jobs[j.ID] = j
+	api.mu.Unlock()
+	api.wg.Add(1)
+	go func() {
+		defer api.wg.Done()
+		var resp serveResponse
+		err := api.serve(api.ctx, req, &resp)
+		api.mu.Lock()
+		defer api.mu.Unlock()
+		j.finished = time.Now()
+		if err != nil {
+			j.State, j.Error = "failed", err.Error()
+		} else {
+			j.State, j.resp = "done", resp
+		}
+	}()
+	return j, nil
+}
+
+// prune forgets the jobs finished more than jobRetention before now. The caller must hold mu.
+func (api *httpAPI) prune(now time.Time) {
+	for id, j := range api.jobs {
+		if !j.finished.IsZero() && now.Sub(j.finished) > jobRetention {
+			delete(api.jobs, id)
+		}
+	}
+}
+
+// handleJob answers the result of the job if it's done, else its state
+// (with 202 Accepted while it's running).
+func (api *httpAPI) handleJob(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	j, ok := api.jobs[r.PathValue("id")]
+	var state job
+	if ok {
+		state = *j
+	}
+	api.mu.Unlock()
+	switch {
+	case !ok:
+		http.Error(w, "no such job", http.StatusNotFound)
+	case state.State == "running":
+		writeJSON(w, http.StatusAccepted, state)
+	case state.State == "failed":
+		writeJSON(w, http.StatusOK, state)
+	default:
+		writeResult(w, state.req, state.resp)
+	}
+}
+
+// serverStats are the answer of /stats.
+type serverStats struct {
+	Sources                 int
+	Metric                  Metric
+	Uptime                  string
+	Served, Failed, Running int64
+	Jobs                    int
+	CacheHits, CacheMisses  int
+	// Metrics are those registered, which can be requested.
+	Metrics []string
+}
+
+func (api *httpAPI) handleStats(w http.ResponseWriter, r *http.Request) {
+	st := serverStats{
+		Sources: len(api.builder.matcher.candidates),
+		Metric:  api.builder.opts.Match.Metric,
+		Uptime:  time.Since(api.started).Round(time.Second).String(),
+		Served:  api.served.Load(), Failed: api.failed.Load(), Running: api.running.Load(),
+		Metrics: metricNames(),
+	}
+	api.mu.Lock()
+	st.Jobs = len(api.jobs)
+	api.mu.Unlock()
+	st.CacheHits, st.CacheMisses = composeCache.Stats()
+	writeJSON(w, http.StatusOK, st)
+}
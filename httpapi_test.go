@@ -0,0 +1,289 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testAPI returns the HTTP API of a server of the sources, with one slot, and its test server.
+func testAPI(t *testing.T, opts Options, maxBody int64, files []string) (*httpAPI, *httptest.Server) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	b := NewBuilder(opts)
+	if err := b.AddSources(ctx, files); err != nil {
+		t.Fatal(err)
+	}
+	s := &server{builder: b, memory: newMemSemaphore(0), slots: make(chan struct{}, 1), started: time.Now()}
+	api := &httpAPI{server: s, ctx: ctx, maxBody: maxBody, jobs: make(map[string]*job)}
+	ts := httptest.NewServer(api.handler())
+	t.Cleanup(func() {
+		ts.Close()
+		cancel()
+		s.wg.Wait()
+	})
+	return api, ts
+}
+
+// postTarget posts the target image to the URL as multipart, answering json if asked.
+func postTarget(t *testing.T, url string, target []byte, json bool) *http.Response {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("target", "target.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(target)
+	mw.Close()
+	req, err := http.NewRequest("POST", url, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	if json {
+		req.Header.Set("Accept", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func pngBytes(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// httpSources returns the sources of the HTTP API tests.
+func httpSources(t *testing.T) []string {
+	dir := t.TempDir()
+	var files []string
+	for i, c := range []color.NRGBA{{R: 250, A: 255}, {G: 250, A: 255}, {B: 250, A: 255}} {
+		files = append(files, writeImage(t, dir, fmt.Sprintf("%d.png", i), solidImage(Width, Width, c)))
+	}
+	return files
+}
+
+func TestHTTPMosaic(t *testing.T) {
+	opts := testOptions()
+	opts.Grid = Grid{Cols: 2, Rows: 2}
+	opts.MaxMem = 1 << 20
+	_, ts := testAPI(t, opts, 64<<10, httpSources(t))
+	noise := make([]byte, 128<<10)
+	rand.New(rand.NewSource(1)).Read(noise)
+	for _, tc := range []struct {
+		Name   string
+		Query  string
+		Target []byte
+		Status int
+	}{
+		{Name: "png", Target: pngBytes(t, synthImage(1, 200, 200)), Status: http.StatusOK},
+		{Name: "plan", Query: "?format=plan", Target: pngBytes(t, synthImage(1, 200, 200)), Status: http.StatusOK},
+		{Name: "not an image", Target: []byte("not an image"), Status: http.StatusBadRequest},
+		{Name: "tint and overlay", Query: "?tint=0.5&overlay=0.3", Target: pngBytes(t, synthImage(1, 200, 200)), Status: http.StatusOK},
+		{Name: "bad tint", Query: "?tint=2", Target: pngBytes(t, synthImage(1, 200, 200)), Status: http.StatusBadRequest},
+		{Name: "bad overlay", Query: "?overlay=-0.1", Target: pngBytes(t, synthImage(1, 200, 200)), Status: http.StatusBadRequest},
+		{Name: "bad grid", Query: "?grid=2by2", Target: pngBytes(t, synthImage(1, 200, 200)), Status: http.StatusBadRequest},
+		// larger than the maximal body
+		{Name: "large body", Target: noise, Status: http.StatusRequestEntityTooLarge},
+		// small, but decoded larger than -max-mem
+		{Name: "large image", Target: pngBytes(t, solidImage(1000, 1000, color.NRGBA{A: 255})), Status: http.StatusRequestEntityTooLarge},
+		// the sources were indexed without its features
+		{Name: "metric without sources", Query: "?metric=phash", Target: pngBytes(t, synthImage(1, 200, 200)), Status: http.StatusUnprocessableEntity},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			resp := postTarget(t, ts.URL+"/mosaic"+tc.Query, tc.Target, false)
+			if resp.StatusCode != tc.Status {
+				b, _ := io.ReadAll(resp.Body)
+				t.Fatalf("got %s (%s), wanted %d", resp.Status, bytes.TrimSpace(b), tc.Status)
+			}
+			if resp.StatusCode != http.StatusOK {
+				return
+			}
+			if tc.Query == "?format=plan" {
+				var plan Plan
+				if err := json.NewDecoder(resp.Body).Decode(&plan); err != nil {
+					t.Fatal(err)
+				}
+				if len(plan.Tiles) != 4 {
+					t.Errorf("got %d tiles, wanted 4", len(plan.Tiles))
+				}
+				return
+			}
+			img, err := png.Decode(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := img.Bounds().Size(), image.Pt(2*Width, 2*Width); got != want {
+				t.Errorf("got a mosaic of %v, wanted %v", got, want)
+			}
+		})
+	}
+}
+
+func TestHTTPJobs(t *testing.T) {
+	opts := testOptions()
+	opts.Grid = Grid{Cols: 2, Rows: 2}
+	api, ts := testAPI(t, opts, 1<<20, httpSources(t))
+	target := pngBytes(t, synthImage(1, 200, 200))
+
+	resp := postTarget(t, ts.URL+"/mosaic", target, true)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("got %s, wanted 202 Accepted", resp.Status)
+	}
+	var j job
+	if err := json.NewDecoder(resp.Body).Decode(&j); err != nil {
+		t.Fatal(err)
+	}
+	if loc := resp.Header.Get("Location"); loc != "/jobs/"+j.ID {
+		t.Errorf("got the Location %q, wanted /jobs/%s", loc, j.ID)
+	}
+	// poll it until it's done
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		resp, err := http.Get(ts.URL + "/jobs/" + j.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusAccepted {
+			if time.Now().After(deadline) {
+				t.Fatal("the job is still running")
+			}
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/png" {
+			t.Fatalf("got %s of %s: %s", resp.Status, resp.Header.Get("Content-Type"), b)
+		}
+		if _, err := png.Decode(bytes.NewReader(b)); err != nil {
+			t.Fatal(err)
+		}
+		break
+	}
+
+	if resp, err := http.Get(ts.URL + "/jobs/nosuchjob"); err != nil {
+		t.Fatal(err)
+	} else if resp.Body.Close(); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got %s for an unknown job, wanted 404 Not Found", resp.Status)
+	}
+
+	// a job running on the only slot
+	api.mu.Lock()
+	api.jobs["running"] = &job{ID: "running", State: "running"}
+	api.mu.Unlock()
+	if resp := postTarget(t, ts.URL+"/mosaic", target, true); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got %s with the slots taken, wanted 503 Service Unavailable", resp.Status)
+	}
+
+	// the finished jobs beyond jobsPerSlot, or jobRetention, are forgotten
+	api.mu.Lock()
+	delete(api.jobs, "running")
+	now := time.Now()
+	for i := 0; i < 2*jobsPerSlot; i++ {
+		api.jobs[fmt.Sprintf("old%d", i)] = &job{ID: fmt.Sprintf("old%d", i), State: "done", finished: now.Add(-jobRetention - time.Duration(i)*time.Second)}
+	}
+	for i := 0; i < jobsPerSlot; i++ {
+		api.jobs[fmt.Sprintf("new%d", i)] = &job{ID: fmt.Sprintf("new%d", i), State: "done", finished: now.Add(-time.Duration(i) * time.Second)}
+	}
+	api.mu.Unlock()
+	if resp := postTarget(t, ts.URL+"/mosaic", target, true); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("got %s, wanted 202 Accepted", resp.Status)
+	}
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if len(api.jobs) != jobsPerSlot {
+		t.Errorf("got %d jobs, wanted %d", len(api.jobs), jobsPerSlot)
+	}
+	for id := range api.jobs {
+		// the first one, and the new ones but the two finished first, with the last one
+		if strings.HasPrefix(id, "old") || id == fmt.Sprintf("new%d", jobsPerSlot-1) || id == fmt.Sprintf("new%d", jobsPerSlot-2) {
+			t.Errorf("job %s is kept", id)
+		}
+	}
+}
+
+func TestHTTPSources(t *testing.T) {
+	api, ts := testAPI(t, testOptions(), 1<<20, httpSources(t))
+	resp, err := http.Get(ts.URL + "/sources?q=1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var sources []string
+	if err := json.NewDecoder(resp.Body).Decode(&sources); err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 1 || !strings.HasSuffix(sources[0], "1.png") {
+		t.Errorf("got %q, wanted 1.png", sources)
+	}
+	// from another host
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/sources", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	api.handler().ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got %d from another host, wanted 403 Forbidden", w.Code)
+	}
+}
+
+func TestHTTPNetwork(t *testing.T) {
+	for _, tc := range []struct {
+		Addr    string
+		Public  bool
+		Want    string
+		WantErr bool
+	}{
+		{Addr: "localhost:8080", Want: "tcp"},
+		{Addr: "127.0.0.1:8080", Want: "tcp"},
+		{Addr: "[::1]:8080", Want: "tcp"},
+		{Addr: "/tmp/mosaic-http.sock", Want: "unix"},
+		{Addr: ":8080", WantErr: true},
+		{Addr: "0.0.0.0:8080", WantErr: true},
+		{Addr: "192.0.2.1:8080", WantErr: true},
+		{Addr: ":8080", Public: true, Want: "tcp"},
+		{Addr: "0.0.0.0:8080", Public: true, Want: "tcp"},
+	} {
+		t.Run(fmt.Sprintf("%s public=%t", tc.Addr, tc.Public), func(t *testing.T) {
+			got, err := ServeOptions{HTTP: tc.Addr, HTTPPublic: tc.Public}.httpNetwork()
+			if (err != nil) != tc.WantErr || got != tc.Want {
+				t.Errorf("got %q, %v; wanted %q (an error: %t)", got, err, tc.Want, tc.WantErr)
+			}
+		})
+	}
+}
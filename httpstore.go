@@ -0,0 +1,217 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// httpStore is a read-only DB downloaded from an HTTP(S) URL into the cache directory,
+// and reused while the server says it's not modified.
+type httpStore string
+
+func isURL(db string) bool {
+	return strings.HasPrefix(db, "http://") || strings.HasPrefix(db, "https://")
+}
+
+func (s httpStore) String() string { return string(s) }
+
+func (s httpStore) Save(context.Context, dbHeader, map[string]Thumbnail, func(string) bool) error {
+	return errors.Errorf("%s: an HTTP DB is read-only", s)
+}
+
+func (s httpStore) Load(keep func(key string) bool) (dbHeader, map[string]Thumbnail, error) {
+	fn, err := s.fetch()
+	if err != nil {
+		return dbHeader{}, nil, err
+	}
+	return loadDBSubset(fn, keep)
+}
+
+// httpMeta is the state of the cached download.
+type httpMeta struct {
+	ETag, LastModified string
+	// PartETag is the ETag of the partial download in the .part file.
+	PartETag string
+}
+
+// fetch brings the cached copy of the DB up to date, and returns its file name.
+//
+// An interrupted download is resumed if the server supports ranges and the DB hasn't changed.
+// The download is checked against the URL's .sha256 sidecar, if exists.
+func (s httpStore) fetch() (string, error) {
+	url := string(s)
+	dir := filepath.Join(filepath.Dir(defaultDB()), "http")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	h := sha256.Sum256([]byte(url))
+	fn := filepath.Join(dir, hex.EncodeToString(h[:8])+".db")
+	metaFn, part := fn+".json", fn+".part"
+	var meta httpMeta
+	if b, err := os.ReadFile(metaFn); err == nil {
+		_ = json.Unmarshal(b, &meta)
+	}
+	saveMeta := func() error {
+		b, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		return errors.Wrap(os.WriteFile(metaFn, b, 0644), metaFn)
+	}
+	_, err := os.Stat(fn)
+	cached := err == nil
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", errors.Wrap(err, url)
+	}
+	if cached {
+		if meta.ETag != "" {
+			req.Header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+	var offset int64
+	if fi, err := os.Stat(part); err == nil && fi.Size() > 0 && meta.PartETag != "" {
+		offset = fi.Size()
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", meta.PartETag)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		if cached {
+			log.Printf("%v - using the cached %q", err, fn)
+			return fn, nil
+		}
+		return "", errors.Wrap(err, url)
+	}
+	defer resp.Body.Close()
+	flags := os.O_WRONLY | os.O_CREATE
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return fn, nil
+	case http.StatusPartialContent:
+		log.Printf("%s: resuming the download at %d", url, offset)
+		flags |= os.O_APPEND
+	case http.StatusOK:
+		offset = 0
+		flags |= os.O_TRUNC
+	default:
+		if cached {
+			log.Printf("%s: %s - using the cached %q", url, resp.Status, fn)
+			return fn, nil
+		}
+		return "", errors.Errorf("%s: %s", url, resp.Status)
+	}
+	meta.PartETag = resp.Header.Get("ETag")
+	if err := saveMeta(); err != nil {
+		return "", err
+	}
+
+	fh, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		return "", errors.Wrap(err, part)
+	}
+	total := offset + resp.ContentLength
+	pw := &progressWriter{name: url, n: offset, total: total, last: time.Now()}
+	_, err = io.Copy(fh, io.TeeReader(resp.Body, pw))
+	if closeErr := fh.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "%s: downloading (%d bytes so far, resumable)", url, pw.n)
+	}
+	log.Printf("%s: downloaded %d bytes", url, pw.n)
+
+	if err := verifySHA256(url+".sha256", part); err != nil {
+		os.Remove(part)
+		return "", err
+	}
+	if err := os.Rename(part, fn); err != nil {
+		return "", err
+	}
+	meta = httpMeta{ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+	return fn, saveMeta()
+}
+
+// verifySHA256 compares the checksum of the file with the one at the URL, if there's one.
+func verifySHA256(url, fn string) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return errors.Wrap(err, url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil // no checksum published
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+	if err != nil {
+		return errors.Wrap(err, url)
+	}
+	fields := strings.Fields(string(b)) // "<hex>  <name>", as written by sha256sum
+	if len(fields) == 0 {
+		return errors.Errorf("%s: empty checksum", url)
+	}
+	fh, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, fh); err != nil {
+		return errors.Wrap(err, fn)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(got, fields[0]) {
+		return errors.Errorf("%s: checksum mismatch: got %s, wanted %s", fn, got, fields[0])
+	}
+	return nil
+}
+
+// progressWriter logs the progress of a download every few seconds.
+type progressWriter struct {
+	name     string
+	n, total int64
+	last     time.Time
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	if time.Since(w.last) >= 2*time.Second {
+		w.last = time.Now()
+		if w.total > 0 {
+			log.Printf("%s: %d of %d bytes (%.0f%%)", w.name, w.n, w.total, 100*float64(w.n)/float64(w.total))
+		} else {
+			log.Printf("%s: %d bytes", w.name, w.n)
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"container/list"
+	"image"
+	"sync"
+)
+
+// composeCache keeps the sources decoded for rendering, so a tile used many times
+// (or with several transforms) is decoded once. Nil caches nothing.
+var composeCache *imageCache
+
+// imageCache is an LRU cache of decoded images by path, bounded by their size in bytes.
+// It is safe for concurrent use. The methods of a nil *imageCache just load the images.
+type imageCache struct {
+	mu           sync.Mutex
+	max, size    int64
+	lru          *list.List // of *cachedImage, the most recently used first
+	byPath       map[string]*list.Element
+	hits, misses int
+}
+
+type cachedImage struct {
+	path string
+	img  image.Image
+	size int64
+}
+
+func newImageCache(max int64) *imageCache {
+	if max <= 0 {
+		return nil
+	}
+	return &imageCache{max: max, lru: list.New(), byPath: make(map[string]*list.Element)}
+}
+
+// Get returns the image of path from the cache, or loads it with load, and caches it.
+// An image larger than the whole cache is not cached; the least recently used ones
+// are evicted to make room for a new one.
+//
+// Concurrent misses of the same path load it concurrently, too.
+func (c *imageCache) Get(path string, load func() (image.Image, error)) (image.Image, error) {
+	if c == nil {
+		return load()
+	}
+	c.mu.Lock()
+	if e, ok := c.byPath[path]; ok {
+		c.lru.MoveToFront(e)
+		c.hits++
+		c.mu.Unlock()
+		return e.Value.(*cachedImage).img, nil
+	}
+	c.misses++
+	c.mu.Unlock()
+
+	img, err := load()
+	if err != nil {
+		return nil, err
+	}
+	n := imageBytes(img)
+	if n > c.max {
+		return img, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.byPath[path]; ok {
+		return img, nil // loaded concurrently
+	}
+	for c.size+n > c.max {
+		e := c.lru.Back()
+		ci := e.Value.(*cachedImage)
+		c.lru.Remove(e)
+		delete(c.byPath, ci.path)
+		c.size -= ci.size
+	}
+	c.byPath[path] = c.lru.PushFront(&cachedImage{path: path, img: img, size: n})
+	c.size += n
+	return img, nil
+}
+
+// Stats returns the number of the hits and the misses.
+func (c *imageCache) Stats() (hits, misses int) {
+	if c == nil {
+		return 0, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+// imageBytes returns the memory of the pixels of the image.
+func imageBytes(img image.Image) int64 {
+	switch img := img.(type) {
+	case *image.YCbCr:
+		return int64(len(img.Y) + len(img.Cb) + len(img.Cr))
+	case *image.NRGBA:
+		return int64(len(img.Pix))
+	case *image.RGBA:
+		return int64(len(img.Pix))
+	case *image.Gray:
+		return int64(len(img.Pix))
+	case *image.NRGBA64:
+		return int64(len(img.Pix))
+	case *image.RGBA64:
+		return int64(len(img.Pix))
+	case *image.Gray16:
+		return int64(len(img.Pix))
+	case *image.Paletted:
+		return int64(len(img.Pix))
+	}
+	b := img.Bounds()
+	return int64(b.Dx()) * int64(b.Dy()) * 4
+}
@@ -0,0 +1,161 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// matchIndex is the persisted candidate list of a matcher, to skip computing
+// the spectra on the next run if the sources haven't changed.
+type matchIndex struct {
+	// Fingerprint of the sources and options the candidates were computed from.
+	Fingerprint string
+	Candidates  []indexCandidate
+}
+
+// indexCandidate is the gob encodable candidate: the embedded features are unexported.
+type indexCandidate struct {
+	Path     string
+	Aliases  []string
+	Spectrum []float64
+	Lab      lab
+	Coeffs   []complex128
+	PHash    uint64
+	Blocks   []lab
+	Hist     []float64
+	Custom   []byte
+}
+
+// indexFingerprint identifies the candidates newMatcher would build:
+// the DB header (the precision of the coefficients), the sources' entries by their metadata,
+// and the features the options need (of the metric, and its size and prefilter). The features themselves are not hashed:
+// they change only with the metadata, and hashing them would cost as much as the index saves.
+func indexFingerprint(hdr dbHeader, thumbnails map[string]Thumbnail, files []string, opts MatchOptions) string {
+	h := sha256.New()
+	var a [8]byte
+	putInt := func(i int64) {
+		binary.LittleEndian.PutUint64(a[:], uint64(i))
+		h.Write(a[:])
+	}
+	h.Write([]byte(strconv.Itoa(hdr.Version) + "\x00" + string(hdr.Precision) + "\x00" + string(opts.Metric) + "\x00" + opts.extraFeature()))
+	if opts.usesColor() {
+		h.Write([]byte("+lab"))
+	}
+	for _, fn := range files {
+		t, ok := thumbnails[fn]
+		if !ok {
+			continue
+		}
+		p := t.Params.orLegacy()
+		h.Write([]byte("\x00" + fn + "\x00" + t.AliasOf + "\x00" + t.Hash + "\x00" + t.Failed + "\x00" + strconv.Itoa(p.Size) + p.Colorspace + p.Window + p.Anchor + p.Alpha))
+		putInt(t.ModTime.UnixNano())
+		putInt(t.Size)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// loadMatcher returns the matcher of the index file if it has been built
+// from the same sources and options, or builds a new one, and saves it to the index file if save is set.
+// The number of candidates built (zero if the index could be used) is returned, too.
+func loadMatcher(indexFn string, save bool, hdr dbHeader, thumbnails map[string]Thumbnail, files []string, opts MatchOptions) (*matcher, int) {
+	fp := indexFingerprint(hdr, thumbnails, files, opts)
+	if fh, err := os.Open(indexFn); err == nil {
+		var idx matchIndex
+		err = gob.NewDecoder(fh).Decode(&idx)
+		fh.Close()
+		if err == nil && idx.Fingerprint == fp && !idx.spectraOf(opts) {
+			err = errors.New("the spectra of the candidates are not of the -size")
+		}
+		if err == nil && idx.Fingerprint == fp {
+			log.Printf("match index of %d candidates loaded from %q", len(idx.Candidates), indexFn)
+			m := &matcher{opts: opts, candidates: make([]candidate, len(idx.Candidates))}
+			for i, c := range idx.Candidates {
+				m.candidates[i] = candidate{Path: c.Path, Aliases: c.Aliases, features: features{Spectrum: c.Spectrum, Lab: c.Lab, Coeffs: c.Coeffs, PHash: c.PHash, Blocks: c.Blocks, Hist: c.Hist, Custom: c.Custom}}
+			}
+			m.bucketize()
+			return m, 0
+		}
+		if err != nil {
+			log.Println(errors.Wrap(err, indexFn))
+		}
+	}
+	m := newMatcher(thumbnails, files, opts)
+	if !save {
+		return m, len(m.candidates)
+	}
+	idx := matchIndex{Fingerprint: fp, Candidates: make([]indexCandidate, len(m.candidates))}
+	for i, c := range m.candidates {
+		idx.Candidates[i] = indexCandidate{Path: c.Path, Aliases: c.Aliases, Spectrum: c.Spectrum, Lab: c.Lab, Coeffs: c.Coeffs, PHash: c.PHash, Blocks: c.Blocks, Hist: c.Hist, Custom: c.Custom}
+	}
+	if err := saveMatchIndex(indexFn, idx); err != nil {
+		log.Println(err)
+	}
+	return m, len(m.candidates)
+}
+
+// spectraOf reports whether the spectra of the candidates are of the length the options need.
+func (idx matchIndex) spectraOf(opts MatchOptions) bool {
+	if !opts.Metric.usesFFT() {
+		return true
+	}
+	n := Width * Width
+	if opts.extraFeature() != "" {
+		n = fftSize(opts.size()) * fftSize(opts.size())
+	}
+	for _, c := range idx.Candidates {
+		if len(c.Spectrum) != n {
+			return false
+		}
+	}
+	return true
+}
+
+// saveMatchIndex atomically replaces the index file, like saveDB.
+func saveMatchIndex(fn string, idx matchIndex) error {
+	dir, base := filepath.Split(fn)
+	if dir == "" {
+		dir = "."
+	}
+	fh, err := os.CreateTemp(dir, base+".*.tmp")
+	if err != nil {
+		return errors.Wrap(err, fn)
+	}
+	tmp := fh.Name()
+	err = gob.NewEncoder(fh).Encode(idx)
+	if closeErr := fh.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, fn)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return errors.Wrap(err, fn)
+}
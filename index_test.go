@@ -0,0 +1,96 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// indexBuilt returns the number of candidates the Builder computed for its match index.
+func indexBuilt(t *testing.T, opts Options, files []string) int {
+	t.Helper()
+	b := NewBuilder(opts)
+	if err := b.AddSources(context.Background(), files); err != nil {
+		t.Fatal(err)
+	}
+	b.getMatcher()
+	for _, p := range b.Timings.Phases {
+		if p.Name == "match index" {
+			return p.Items
+		}
+	}
+	t.Fatal("no match index phase")
+	return 0
+}
+
+func TestMatchIndexReused(t *testing.T) {
+	dir := t.TempDir()
+	files := testLibrary(t, dir, 4)
+	opts := testOptions()
+	opts.DB = filepath.Join(dir, "mosaic.db")
+	opts.MatchIndex = true
+	for _, tc := range []struct {
+		Name string
+		// Change the DB or the sources before the run.
+		Change func(t *testing.T)
+		Want   int
+	}{
+		{Name: "first", Want: 4},
+		{Name: "unchanged", Want: 0},
+		{Name: "source changed", Change: func(t *testing.T) {
+			writeImage(t, dir, "src001.png", synthImage(101, 2*Width, Width))
+		}, Want: 4},
+		{Name: "unchanged after the change", Want: 0},
+		{Name: "precision changed", Change: func(*testing.T) { opts.DBPrecision = PrecisionInt16 }, Want: 4},
+		{Name: "unchanged quantized", Want: 0},
+		{Name: "size changed", Change: func(*testing.T) { opts.Match.Size = 64 }, Want: 4},
+		{Name: "unchanged sized", Want: 0},
+		{Name: "size changed back", Change: func(*testing.T) { opts.Match.Size = Width }, Want: 4},
+		{Name: "prefilter changed", Change: func(*testing.T) { opts.Match.Prefilter = PrefilterSobel }, Want: 4},
+		{Name: "unchanged prefiltered", Want: 0},
+		// an index of the fingerprint, but of other spectra
+		{Name: "spectra truncated", Change: func(t *testing.T) {
+			fn := opts.DB + ".idx"
+			fh, err := os.Open(fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var idx matchIndex
+			err = gob.NewDecoder(fh).Decode(&idx)
+			fh.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, c := range idx.Candidates {
+				idx.Candidates[i].Spectrum = c.Spectrum[:len(c.Spectrum)/4]
+			}
+			if err := saveMatchIndex(fn, idx); err != nil {
+				t.Fatal(err)
+			}
+		}, Want: 4},
+	} {
+		if tc.Change != nil {
+			tc.Change(t)
+		}
+		if got := indexBuilt(t, opts, files); got != tc.Want {
+			t.Errorf("%s: built %d candidates, wanted %d", tc.Name, got, tc.Want)
+		}
+	}
+}
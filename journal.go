@@ -0,0 +1,174 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// The journal of a DB file, dbFn+journalExt, holds the entries indexed since the last save,
+// appended one by one as they are produced, so a crash loses at most the entry being written.
+//
+// Each record is the uint32 length and the CRC-32 (IEEE) of the payload, then the payload:
+// a dbRecord, gob encoded on its own. A torn (short or mismatching) record ends the journal.
+const journalExt = ".journal"
+
+// maxJournalRecord limits the length of a record, to detect garbage.
+const maxJournalRecord = 64 << 20
+
+// journaler is a store which can journal the entries as they are indexed.
+type journaler interface {
+	Append(key string, t Thumbnail) error
+	// JournalSize is the size of the journal files, left by an interrupted run.
+	JournalSize() int64
+}
+
+func (s fileStore) Append(key string, t Thumbnail) error { return appendJournal(string(s), key, t) }
+func (s fileStore) JournalSize() int64 {
+	fi, err := os.Stat(string(s) + journalExt)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+func (s relStore) Append(key string, t Thumbnail) error {
+	rel, ok := s.rel(key)
+	if !ok {
+		return nil // not stored
+	}
+	return s.fileStore.Append(rel, t)
+}
+
+func (s shardStore) Append(key string, t Thumbnail) error {
+	i := s.shardOf(key)
+	if i < 0 {
+		return nil // not stored
+	}
+	return s.shards[i].Append(key, t)
+}
+func (s shardStore) JournalSize() int64 {
+	var size int64
+	for _, sh := range s.shards {
+		size += sh.JournalSize()
+	}
+	return size
+}
+
+// appendJournal appends the entry to the journal of the DB file, synced to the disk.
+func appendJournal(dbFn, key string, t Thumbnail) error {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 8))
+	if err := gob.NewEncoder(&buf).Encode(dbRecord{Key: key, Entry: t}); err != nil {
+		return errors.Wrap(err, key)
+	}
+	b := buf.Bytes()
+	binary.LittleEndian.PutUint32(b[0:4], uint32(len(b)-8))
+	binary.LittleEndian.PutUint32(b[4:8], crc32.ChecksumIEEE(b[8:]))
+	fn := dbFn + journalExt
+	fh, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrap(err, fn)
+	}
+	_, err = fh.Write(b)
+	if err == nil {
+		err = fh.Sync()
+	}
+	if closeErr := fh.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return errors.Wrap(err, fn)
+}
+
+// replayJournal calls fn with the entries of the journal of the DB file, in order.
+// A torn record at the end is ignored; the journal is only read, it is dropped by the next save.
+// The size of the good records is returned.
+func replayJournal(dbFn string, fn func(key string, t Thumbnail)) (int64, error) {
+	jFn := dbFn + journalExt
+	fh, err := os.Open(jFn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, errors.Wrap(err, jFn)
+	}
+	defer fh.Close()
+	br := bufio.NewReader(fh)
+	var good int64
+	var hdr [8]byte
+	var payload []byte
+	for {
+		if _, err = io.ReadFull(br, hdr[:]); err == io.EOF {
+			return good, nil
+		} else if err != nil {
+			break
+		}
+		n := binary.LittleEndian.Uint32(hdr[0:4])
+		if n > maxJournalRecord {
+			err = errors.Errorf("record of %d bytes", n)
+			break
+		}
+		if cap(payload) < int(n) {
+			payload = make([]byte, n)
+		}
+		payload = payload[:n]
+		if _, err = io.ReadFull(br, payload); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(hdr[4:8]) {
+			err = errors.New("checksum mismatch")
+			break
+		}
+		var rec dbRecord
+		if err = gob.NewDecoder(bytes.NewReader(payload)).Decode(&rec); err != nil {
+			break
+		}
+		fn(rec.Key, rec.Entry)
+		good += 8 + int64(n)
+	}
+	log.Printf("%s: ignoring the torn record at %d: %v", jFn, good, err)
+	return good, nil
+}
+
+// compactJournal folds the journal left by an interrupted run into the store's DB files,
+// removing it. It is for the writers, before appending to the journal:
+// after a torn record, the appended ones would be lost.
+func compactJournal(ctx context.Context, st store, hdr dbHeader) error {
+	j, ok := st.(journaler)
+	if !ok {
+		return nil
+	}
+	size := j.JournalSize()
+	if size == 0 {
+		return nil
+	}
+	// Nothing loaded: all the entries of the files and their journals are carried over.
+	if err := st.Save(ctx, hdr, map[string]Thumbnail{}, func(string) bool { return false }); err != nil {
+		return err
+	}
+	log.Printf("compacted the journal of %d bytes into %s", size, st)
+	return nil
+}
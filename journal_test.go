@@ -0,0 +1,142 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// journaledDB writes a DB of the first source's entry into dir, with the rest in its journal,
+// followed by the tail of garbage (a torn record); it returns the DB's file name.
+func journaledDB(t *testing.T, dir string, files []string, tail []byte) string {
+	t.Helper()
+	opts := testOptions()
+	opts.DB = filepath.Join(dir, "mosaic.db")
+	thumbnails, _, err := prepareThumbnails(context.Background(), opts, append([]string(nil), files...), new(Timings))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saveDB(opts.DB, newDBHeader(), map[string]Thumbnail{files[0]: thumbnails[files[0]]}); err != nil {
+		t.Fatal(err)
+	}
+	for _, fn := range files[1:] {
+		if err := appendJournal(opts.DB, fn, thumbnails[fn]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(tail) != 0 {
+		fh, err := os.OpenFile(opts.DB+journalExt, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = fh.Write(tail)
+		if closeErr := fh.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return opts.DB
+}
+
+// readFiles returns the contents of the files, nil for the missing ones.
+func readFiles(t *testing.T, fns ...string) [][]byte {
+	t.Helper()
+	contents := make([][]byte, len(fns))
+	for i, fn := range fns {
+		b, err := os.ReadFile(fn)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		contents[i] = b
+	}
+	return contents
+}
+
+var journalTails = []struct {
+	Name string
+	Tail []byte
+}{
+	{Name: "complete"},
+	{Name: "torn header", Tail: []byte{1, 2, 3}},
+	{Name: "torn record", Tail: []byte{100, 0, 0, 0, 1, 2, 3, 4, 'g', 'a', 'r', 'b', 'a', 'g', 'e'}},
+}
+
+func TestReadOnlyJournal(t *testing.T) {
+	for _, tc := range journalTails {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			files := testLibrary(t, dir, 3)
+			dbFn := journaledDB(t, dir, files, tc.Tail)
+			before := readFiles(t, dbFn, dbFn+journalExt)
+
+			_, thumbnails, err := loadDB(dbFn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(thumbnails) != len(files) {
+				t.Errorf("loaded %d entries, wanted %d with the journaled ones", len(thumbnails), len(files))
+			}
+			opts := testOptions()
+			opts.DB, opts.DBReadOnly = dbFn, true
+			if _, indexed, err := prepareThumbnails(context.Background(), opts, append([]string(nil), files...), new(Timings)); err != nil || indexed != 0 {
+				t.Errorf("read-only run indexed %d: %v", indexed, err)
+			}
+
+			for i, after := range readFiles(t, dbFn, dbFn+journalExt) {
+				if !bytes.Equal(after, before[i]) {
+					t.Errorf("file %d changed by the read-only loads", i)
+				}
+			}
+		})
+	}
+}
+
+func TestWriterCompactsJournal(t *testing.T) {
+	for _, tc := range journalTails {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			files := testLibrary(t, dir, 3)
+			dbFn := journaledDB(t, dir, files, tc.Tail)
+			opts := testOptions()
+			opts.DB = dbFn
+			if _, indexed, err := prepareThumbnails(context.Background(), opts, append([]string(nil), files...), new(Timings)); err != nil || indexed != 0 {
+				t.Errorf("indexed %d: %v", indexed, err)
+			}
+			if _, err := os.Stat(dbFn + journalExt); !os.IsNotExist(err) {
+				t.Errorf("the journal is kept: %v", err)
+			}
+			// all in the file now
+			fh, err := os.Open(dbFn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer fh.Close()
+			_, thumbnails, err := readDB(fh)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(thumbnails) != len(files) {
+				t.Errorf("got %d entries in the file, wanted %d", len(thumbnails), len(files))
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// layerStore is a writable primary store, with read-only stores consulted after it, in order:
+// the newly indexed (or updated) entries are saved to the primary only.
+type layerStore struct {
+	primary store
+	layers  []store
+	// stamps of the entries loaded from the layers, to tell the changed ones at saving
+	stamps map[string]entryStamp
+}
+
+// newLayerStore returns the primary store layered over the read-only DB files.
+func newLayerStore(primary store, readOnly []string, relativeTo string) *layerStore {
+	s := &layerStore{primary: primary, layers: make([]store, len(readOnly))}
+	for i, db := range readOnly {
+		s.layers[i] = openStore(db, relativeTo)
+	}
+	return s
+}
+
+// entryStamp summarizes an entry, to tell whether it has been changed since loading.
+// LastUsed is left out: just using an entry of a layer doesn't copy it to the primary.
+type entryStamp struct {
+	// Layer the entry has been loaded from
+	Layer           int
+	ModTime         time.Time
+	Size            int64
+	Hash            string
+	Params          FeatureParams
+	Pix, Features   int
+	Exif            bool
+	Failed, AliasOf string
+}
+
+func stampOf(layer int, t Thumbnail) entryStamp {
+	return entryStamp{
+		Layer: layer, ModTime: t.ModTime, Size: t.Size, Hash: t.Hash, Params: t.Params,
+		Pix: len(t.Pix), Features: len(t.Features), Exif: t.Exif != nil, Failed: t.Failed, AliasOf: t.AliasOf,
+	}
+}
+
+// Load the entries of the primary, and of the layers those which are not in the primary
+// (or in a layer before). The entries of a layer computed with different parameters are
+// recomputed (and saved to the primary), as any outdated entry.
+func (s *layerStore) Load(keep func(key string) bool) (dbHeader, map[string]Thumbnail, error) {
+	hdr, thumbnails, err := s.primary.Load(keep)
+	if err != nil {
+		return hdr, nil, err
+	}
+	firstParams, hasParams := entryParams(thumbnails)
+	s.stamps = make(map[string]entryStamp)
+	for i, l := range s.layers {
+		if fs, ok := l.(fileStore); ok {
+			if _, err := os.Stat(string(fs)); err != nil {
+				return hdr, nil, errors.Wrap(err, "read-only DB")
+			}
+		}
+		_, stored, err := l.Load(func(k string) bool {
+			if _, ok := thumbnails[k]; ok {
+				return false
+			}
+			return keep == nil || keep(k)
+		})
+		if err != nil {
+			var ce *CorruptDBError
+			if errors.As(err, &ce) {
+				// not to be rebuilt by -rebuild-db
+				return hdr, nil, errors.Errorf("read-only %v", err)
+			}
+			return hdr, nil, err
+		}
+		if params, ok := entryParams(stored); ok && hasParams {
+			if reason := firstParams.mismatch(params); reason != "" {
+				log.Printf("WARNING: read-only DB %s: incompatible with %s (%s), its entries are recomputed", l, s.primary, reason)
+			}
+		} else if ok {
+			firstParams, hasParams = params, true
+		}
+		for k, t := range stored {
+			thumbnails[k] = t
+			s.stamps[k] = stampOf(i, t)
+		}
+	}
+	return hdr, thumbnails, nil
+}
+
+// entryParams returns the parameters of an entry with features.
+func entryParams(thumbnails map[string]Thumbnail) (FeatureParams, bool) {
+	for _, t := range thumbnails {
+		if t.Failed == "" && t.AliasOf == "" {
+			return t.Params, true
+		}
+	}
+	return FeatureParams{}, false
+}
+
+// Save the entries to the primary, but those loaded from a layer unchanged.
+func (s *layerStore) Save(ctx context.Context, hdr dbHeader, thumbnails map[string]Thumbnail, loaded func(key string) bool) error {
+	own := make(map[string]Thumbnail, len(thumbnails))
+	for k, t := range thumbnails {
+		if st, ok := s.stamps[k]; ok && st == stampOf(st.Layer, t) {
+			continue
+		}
+		own[k] = t
+	}
+	return s.primary.Save(ctx, hdr, own, loaded)
+}
+
+func (s *layerStore) String() string { return s.primary.String() }
+
+func (s *layerStore) Append(key string, t Thumbnail) error {
+	if j, ok := s.primary.(journaler); ok {
+		return j.Append(key, t)
+	}
+	return nil
+}
+
+func (s *layerStore) JournalSize() int64 {
+	if j, ok := s.primary.(journaler); ok {
+		return j.JournalSize()
+	}
+	return 0
+}
+
+func (s *layerStore) Probe() error {
+	if p, ok := s.primary.(prober); ok {
+		return p.Probe()
+	}
+	return nil
+}
+
+// writable returns the store the entries are written to: the primary of a layerStore.
+func writable(st store) store {
+	if s, ok := st.(*layerStore); ok {
+		return s.primary
+	}
+	return st
+}
@@ -16,15 +16,23 @@
 package main
 
 import (
-	"encoding/gob"
+	"bufio"
+	"bytes"
+	"context"
 	"flag"
+	"fmt"
 	"image"
 	"image/color"
+	"image/draw"
+	"image/jpeg"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"sort"
+	"runtime"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/disintegration/imaging"
@@ -35,150 +43,1326 @@ import (
 const Width = 128
 
 func main() {
-	flagDB := flag.String("db", "mosaic.db", "DB file for thumbnails")
-	flagOut := flag.String("o", "-", "output")
+	if len(os.Args) > 1 && os.Args[1] == "db" {
+		if err := dbMain(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "client" {
+		if err := clientMain(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	// mosaic serve takes the same flags, with -listen; mosaic ui is serve with the HTTP API only
+	serve := len(os.Args) > 1 && (os.Args[1] == "serve" || os.Args[1] == "ui")
+	ui := serve && os.Args[1] == "ui"
+	if serve {
+		os.Args = append(os.Args[:1:1], os.Args[2:]...)
+	}
+
+	var opts Options
+	flag.StringVar(&opts.DB, "db", defaultDB(), "DB file for thumbnails (empty or none: keep the thumbnails in memory only; an http(s) URL: use a remote DB read-only)")
+	flag.StringVar(&opts.Out, "o", "-", "output")
+	flag.StringVar(&opts.TilesDir, "tiles-dir", "", "write each tile as a PNG into this directory, with their layout.json - instead of the mosaic, when -o is not given")
+	flag.StringVar(&opts.Stream, "stream", "", "read the targets as a stream of JPEG frames (such as MJPEG) from this file (- for stdin), and write a JPEG mosaic of each frame to -o; all the arguments are sources")
+	var sopts ServeOptions
+	flag.StringVar(&sopts.Listen, "listen", defaultSocket(), "for mosaic serve: listen on this unix socket, or localhost host:port (empty: don't)")
+	flag.StringVar(&sopts.HTTP, "http", "", "for mosaic serve: serve the HTTP API (and the web UI) on this localhost host:port (any one with -http-public); mosaic ui defaults to "+defaultUIAddr)
+	flag.BoolVar(&sopts.HTTPPublic, "http-public", false, "for mosaic serve: allow an -http address reachable from other hosts (the sources are listed only to localhost)")
+	sopts.MaxBody = 32 << 20
+	flag.Var(&sopts.MaxBody, "http-max-body", "for mosaic serve: refuse the HTTP requests larger than this")
+	flag.IntVar(&sopts.MaxRequests, "max-requests", 4, "for mosaic serve: build at most this many mosaics at once, the other requests wait")
+	flag.DurationVar(&opts.DecodeTimeout, "decode-timeout", time.Minute, "skip source images whose decoding (or fetching, for URLs) takes longer than this (0 means no limit)")
+	flag.StringVar(&urlSources.CacheDir, "http-cache", "", "keep the images of the sources given as http(s) URLs in this directory, revalidated on each run")
+	flagFetches := flag.Int("http-fetches", 4, "fetch at most this many source URLs at once")
+	flag.BoolVar(&opts.RebuildDB, "rebuild-db", false, "rebuild a corrupt DB from scratch (the old one is kept as .bak)")
+	flag.BoolVar(&opts.DBReadOnly, "db-readonly", false, "never write the DB: sources missing from it are indexed in memory only")
+	flag.BoolVar(&opts.DBFallbackReadOnly, "db-fallback-readonly", false, "continue with -db-readonly if the DB can't be written (default: exit before indexing)")
+	flag.Var((*stringsFlag)(&opts.DBLayers), "db-ro", "read-only DB, consulted after -db for the sources missing from it (repeatable, in order); the new entries are written to -db")
+	flag.StringVar(&opts.DBRelativeTo, "db-relative-to", "", "store the paths in the DB relative to this directory, to make the DB usable after moving (or mounting elsewhere) the sources and the DB together")
+	flag.BoolVar(&opts.DBShardByDir, "db-shard-by-dir", false, "instead of -db, keep a "+shardFile+" in each directory given as a source, for the images under it (and in the directory of each file given), consolidated with \"db merge -shards\"")
+	flag.Var(&opts.Errors, "errors", "on the sources which can't be indexed: best-effort (skip them, and exit with 4 at the end), fail-fast (abort on the first), or threshold:PERCENT (abort when more than this many fail, such as threshold:5%)")
+	flag.IntVar(&opts.Retries, "retries", 2, "retry reading a source this many times after a transient (I/O, network) error, with a growing wait")
+	flag.BoolVar(&opts.RetryFailed, "retry-failed", false, "retry decoding the sources which failed before, even if they haven't changed")
+	flag.BoolVar(&opts.Reindex, "reindex", false, "recompute the DB entries of all sources, even the up-to-date ones")
+	flag.Var((*sinceFlag)(&opts.Exif.After), "exif-after", "use only the sources taken (by their EXIF) at or after this time (as 2006-01-02, RFC 3339) or duration ago (as 72h)")
+	flag.Var((*sinceFlag)(&opts.Exif.Before), "exif-before", "use only the sources taken (by their EXIF) before this time (as 2006-01-02, RFC 3339) or duration ago (as 72h)")
+	flag.Var(&opts.Exif.Aspect, "orientation", "use only the sources of this shape as displayed: landscape, portrait or square")
+	flag.StringVar(&opts.Exif.Camera, "camera", "", "use only the sources taken by this camera (a case-insensitive part of the EXIF make and model)")
+	flag.Var((*sinceFlag)(&opts.Since), "since", "index only the sources modified since this time (as 2006-01-02, RFC 3339) or duration ago (as 72h); the older ones are used by their DB entries, if any")
+	flag.StringVar(&opts.ReindexGlob, "reindex-glob", "", "recompute the DB entries of the sources matching this pattern (** matches any directories), even the up-to-date ones")
+	flag.BoolVar(&opts.Prune, "prune", false, "remove DB entries whose files do not exist anymore")
+	flag.BoolVar(&opts.GC, "gc", false, "remove the DB entries of missing files which have not been used for -gc-days")
+	flag.IntVar(&opts.GCDays, "gc-days", 90, "with -gc, remove the entries unused for this many days")
+	flag.BoolVar(&opts.GCDryRun, "gc-dry-run", false, "just list what -gc would remove")
+	flag.StringVar(&opts.PruneUnder, "prune-under", "", "with -prune, check only the entries under this directory")
+	flag.BoolVar(&opts.ContentHash, "content-hash", false, "record a content hash of the files, and find the entries of moved or renamed files by it")
+	flag.BoolVar(&opts.VerifyHash, "verify-hash", false, "check the content hash of the files, too, before using their DB entries")
+	flag.BoolVar(&opts.TrustMTime, "trust-mtime", true, "consider files with changed modification time changed (false: compare their content hash)")
+	flag.Var(&opts.DBPrecision, "db-precision", "precision of the FFT coefficients stored in the DB: full, float32 or int16 (default: keep the DB's)")
+	flag.BoolVar(&opts.StorePixels, "store-pixels", false, "store a small JPEG of each source in the DB, for rendering without the originals")
+	flag.BoolVar(&opts.Render.HiRes, "hires", false, "render from the original sources, even if their pixels are stored in the DB")
+	flag.BoolVar(&opts.MatchIndex, "match-index", false, "keep the prebuilt match index in the DB's .idx file, to reuse it while the sources don't change")
+	flag.Var(&opts.DBMaxSize, "db-max-size", "evict DB entries when saving it would make it larger than this (such as 2G; 0: no limit)")
+	opts.DBEvict = EvictLRU
+	flag.Var(&opts.DBEvict, "db-evict", "the entries evicted first over -db-max-size: lru (least recently used) or largest")
+	flag.BoolVar(&opts.DBJournal, "db-journal", false, "append each newly indexed entry to the DB's "+journalExt+" file right away, so a crash loses at most one entry")
+	flag.Var(&opts.Checkpoint, "checkpoint", "save the DB periodically while indexing: after this duration (5m) or number of new files (1000)")
+	opts.Match.Metric = MetricFFT
+	flag.Var(&opts.Match.Metric, "metric", "distance metric: fft (structure), color (average color), fft+color, or fft-phase (structure with the phase, slower), phash (perceptual hash), blocks (4x4 block colors), hist (HSV color histogram), or a registered custom one")
+	flag.Func("metric-plugin", "load the Go plugin (built with -buildmode=plugin) registering its exported Metric, to be selected by name with a -metric after this (repeatable)", loadMetricPlugin)
+	flag.Float64Var(&opts.Match.ColorWeight, "color-weight", 1, "weight of the color distance relative to the structural one, for -metric=fft+color")
+	flag.Float64Var(&opts.Match.MonoSpread, "mono-spread", 2, "with -metric=color, match by fft+color if the average colors of the sources spread less than this (in ΔE of their chroma), as of sepia or monochrome libraries (0: never)")
+	flag.Float64Var(&opts.Match.BucketSize, "color-buckets", 0, "compare only the sources with average color in the buckets (of this size, in ΔE) near the cell's; 0 compares all")
+	flag.IntVar(&opts.Match.Size, "size", Width, "size of the grayscale thumbnails the structure is compared on, for -metric fft and fft+color; the spectra of each size are kept in the DB; other than a power of two, it is padded to one")
+	opts.Match.Prefilter = PrefilterNone
+	flag.Var(&opts.Match.Prefilter, "prefilter", "filter of the grayscale thumbnails before the FFT, for -metric fft and fft+color: none, or sobel or laplacian to match by the edges (as of line art); the spectra of each are kept in the DB")
+	flag.IntVar(&opts.Match.MaxReuse, "max-reuse", 0, "use each source at most this many times (0: no limit)")
+	flag.Float64Var(&opts.Match.Jitter, "jitter", 0, "choose randomly among the sources within this distance of the best match, for variety (overrides -topm)")
+	flag.Int64Var(&opts.Match.Seed, "seed", 0, "seed of -jitter's choices (0: random, logged)")
+	flag.IntVar(&opts.Match.TopM, "topm", 1, "choose the one with the closest brightness from this many best matches")
+	flag.IntVar(&opts.Render.Supersample, "supersample", 1, "render the mosaic at this many times the size, then downsample it (Lanczos), for smoother tile edges and borders; best with -hires, as the stored pixels are small")
+	flag.IntVar(&opts.Render.Border, "tile-border", 0, "border width of each tile, in pixels")
+	opts.Render.BorderColor = color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+	flag.Var((*colorFlag)(&opts.Render.BorderColor), "tile-border-color", "color of the tile border (#rrggbb)")
+	flag.Var((*colorFlag)(&opts.Render.Background), "bg", "background color of the cells without tile (#rrggbbaa)")
+	flag.StringVar(&rawCmd, "raw-cmd", "", "command to decode a camera RAW source to TIFF (PNG or JPEG) on its standard output or {out}, such as \"dcraw -c -w -T {in}\" (default: the libraw build tag's decoder)")
+	flag.StringVar(&opts.RasterizeCmd, "rasterize-cmd", "", "command to render an SVG or PDF target to PNG, such as \"rsvg-convert -w {w} -h {h} -o {out} {in}\"")
+	opts.Render.Fit = FitStretch
+	flag.Var(&opts.Render.Fit, "tile-fit", "fitting the sources into the tiles: stretch, cover (center crop) or contain (pad with -bg)")
+	flag.BoolVar(&opts.AllowSelf, "allow-self", false, "let the target be a tile of its own mosaic, when it is among the sources, too")
+	flag.Var((*stringsFlag)(&opts.Targets), "target", "target image; can be repeated, to mosaic several targets onto one output, then all the files are sources")
+	flag.Var(&opts.Region, "region", "mosaic only this rectangle of the target, X,Y,W,H in its pixels, leaving the rest of it as it was: the output is of the size of the target")
+	flag.Var(&opts.Layout, "layout", "arrangement of the -targets: ROWSxCOLS (default: side by side)")
+	flag.StringVar(&opts.Mask, "mask", "", "place tiles only where this image is not fully transparent")
+	flag.Float64Var(&opts.Render.Vignette, "tile-vignette", 0, "darken the corners of each tile by this factor (0-1)")
+	flag.Float64Var(&opts.Render.Tint, "tint", 0, "shift the colors of each tile towards the average color of its cell of the target by this factor (0-1)")
+	flag.Float64Var(&opts.Render.Overlay, "overlay", 0, "blend the target over the mosaic with this opacity (0-1)")
+	flag.StringVar(&opts.Proof, "proof", "", fmt.Sprintf("write the target and the mosaic side by side (stacked, if wider than tall), downscaled to %dpx, to this image file, to compare them", proofSize))
+	flag.StringVar(&opts.Sidecar, "sidecar", "", "write the plan (the source and transform of each tile) to this JSON file")
+	flag.StringVar(&opts.Apply, "apply", "", "render the plan read from this JSON file, instead of matching")
+	flag.StringVar(&opts.DumpFeatures, "dump-features", "", "write the grayscale matrix matched for each target cell into this directory, for debugging")
+	flag.BoolVar(&opts.Preview, "preview", false, fmt.Sprintf("render the mosaic quickly, with %dpx tiles from the stored pixels, to judge the composition; the plan is the same as the full render's (save it with -sidecar to -apply it)", previewTileSize))
+	flag.IntVar(&opts.DPI, "dpi", 0, "resolution to tag the output with, for printing (PNG and JPEG only)")
+	flag.BoolVar(&opts.Progressive, "progressive", false, "write a progressive JPEG output (and -stream frames), loading coarse to fine; by the built-in encoder (the standard library's is baseline only), without chroma subsampling, so larger")
+	flag.IntVar(&opts.Workers, "jobs", runtime.GOMAXPROCS(0), "number of sources decoded and indexed, and of cells matched in parallel, by default GOMAXPROCS (the CPUs usable)")
+	flag.IntVar(&opts.Workers, "j", runtime.GOMAXPROCS(0), "short for -jobs")
+	flag.BoolVar(&opts.Verbose, "v", false, "verbose: log the source of each tile, and print the timings of the phases at the end")
+	flag.StringVar(&opts.BenchReport, "bench-report", "", "write the timings and the throughput of the phases as JSON to this file (- for stderr) at the end")
+	flag.Var(&opts.Grid, "grid", "columns and rows of the mosaic: COLSxROWS (default: a square grid with a cell for each file)")
+	flag.Var((*pinsFlag)(&opts.Pins), "pin", "put this source onto a cell, instead of the matching one: ROW,COL=PATH, numbered from 0 (repeatable)")
+	flag.IntVar(&opts.RenderSize, "render-size", 0, "size of the tiles in the output, in pixels (default: the matching size)")
+	opts.MaxMem = 4 << 30
+	flag.Var(&opts.MaxMem, "max-mem", "refuse to render an output image needing more memory than this")
+	flag.StringVar(&opts.Explain, "explain", "", "write the 3 closest sources of each tile, with their distances, and why the chosen one was chosen to this file")
+	var flagMaxMemory ByteSize
+	flag.Var(&flagMaxMemory, "max-memory", "fit the DB entries, the parallel decoding (-decode-memory), the compose cache (-compose-cache) and the mosaic image into this much memory, keeping the mosaic in a temporary file if it doesn't fit (0: no limit)")
+	flagDecodeMem := ByteSize(4 << 30)
+	flag.Var(&flagDecodeMem, "decode-memory", "decode images concurrently only while their pixels (estimated from their headers) fit in this much memory; a larger one is decoded alone")
+	flagComposeCache := ByteSize(1 << 30)
+	flag.Var(&flagComposeCache, "compose-cache", "keep this much of the sources decoded for rendering (by -hires, or without stored pixels), the least recently used are dropped; 0 decodes each tile's anew")
+	flag.StringVar(&opts.Partial, "partial", "", "when interrupted, write the tiles matched so far to this JSON file")
+	flagProgress := progressAuto
+	flag.Var(&flagProgress, "progress", "progress of the long phases on stderr: auto (a status line on a terminal, log lines every 10s otherwise), json (a JSON object per line, see progressEvent) or none")
+	flagProgressFD := flag.Int("progress-fd", 0, "write the -progress json lines to this file descriptor, such as of a named pipe, instead of stderr")
+	flagPprof := flag.String("pprof", "", "serve the net/http/pprof profiles on this address (such as localhost:6060) while running")
+	flagCPUProfile := flag.String("cpuprofile", "", "write a CPU profile of each phase: cpu.prof is written as cpu.indexing.prof, cpu.matching.prof...")
+	flagMemProfile := flag.String("memprofile", "", "write a heap profile at the end of each phase, named like -cpuprofile's")
+	flagTrace := flag.String("trace", "", "write the execution trace of the run to this file, with the phases as its regions (see go tool trace)")
+	flagConfig := flag.String("config", "", "JSON or TOML file of flag values (the flags given on the command line override them)")
 	flag.Parse()
+	if *flagConfig != "" {
+		if err := applyConfig(flag.CommandLine, *flagConfig); err != nil {
+			log.Fatal(err)
+		}
+	}
+	setURLFetches(*flagFetches)
+	urlSources.StatTimeout = opts.DecodeTimeout
+	if ui {
+		given := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+		if !given["http"] {
+			sopts.HTTP = defaultUIAddr
+		}
+		if !given["listen"] {
+			sopts.Listen = ""
+		}
+	}
+	if *flagProgressFD != 0 && flagProgress != progressJSON {
+		log.Fatal("-progress-fd works with -progress json only")
+	}
+	if opts.Match.Size != Width && !opts.Match.Metric.usesFFT() {
+		log.Fatalf("-size works with -metric %s and %s only", MetricFFT, MetricFFTColor)
+	} else if !opts.Match.Prefilter.isNone() && !opts.Match.Metric.usesFFT() {
+		log.Fatalf("-prefilter works with -metric %s and %s only", MetricFFT, MetricFFTColor)
+	} else if opts.Match.Size < 2 {
+		log.Fatalf("-size must be at least 2, got %d", opts.Match.Size)
+	} else if opts.Workers < 1 {
+		log.Fatalf("-jobs must be at least 1, got %d", opts.Workers)
+	} else if opts.Render.Supersample < 1 {
+		log.Fatalf("-supersample must be at least 1, got %d", opts.Render.Supersample)
+	} else if !opts.Region.isZero() && (len(opts.Targets) > 1 || opts.Apply != "" || opts.Stream != "") {
+		log.Fatal("-region works with a single target only, not with -apply or -stream")
+	} else if opts.Proof != "" && (len(opts.Targets) > 1 || opts.Apply != "" || opts.Stream != "") {
+		log.Fatal("-proof works with a single target only, not with -apply or -stream")
+	} else if opts.Render.needsTarget() && (len(opts.Targets) > 1 || opts.Apply != "" || opts.Stream != "") {
+		log.Fatal("-tint and -overlay work with a single target only, not with -apply or -stream")
+	} else if err := checkFraction("tint", opts.Render.Tint); err != nil {
+		log.Fatal(err)
+	} else if err := checkFraction("overlay", opts.Render.Overlay); err != nil {
+		log.Fatal(err)
+	}
+	if opts.Match.Jitter > 0 && opts.Match.Seed == 0 {
+		opts.Match.Seed = time.Now().UnixNano()
+		log.Printf("jitter seed: %d", opts.Match.Seed)
+	}
+	if opts.DB == defaultDB() && !opts.DBShardByDir {
+		if opts.Verbose {
+			log.Printf("DB: %s", opts.DB)
+		}
+		if _, err := os.Stat(legacyDB); err == nil && opts.DB != legacyDB {
+			log.Printf("%s is not used anymore by default: use -db %s, or move it to %s", legacyDB, legacyDB, opts.DB)
+		}
+		if !opts.DBReadOnly {
+			if err := os.MkdirAll(filepath.Dir(opts.DB), 0755); err != nil {
+				log.Println(err)
+			}
+		}
+	}
 
-	if err := Main(*flagOut, *flagDB, flag.Args()); err != nil {
+	switch flagProgress {
+	case progressJSON:
+		w := os.Stderr
+		if fd := *flagProgressFD; fd != 0 {
+			if w = os.NewFile(uintptr(fd), "progress-fd"); w == nil {
+				log.Fatalf("-progress-fd %d: invalid file descriptor", fd)
+			}
+		}
+		progress = newJSONProgress(w)
+	case progressAuto:
+		progress = newProgressMeter(os.Stderr, isTerminal(os.Stderr))
+		log.SetOutput(progress)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		cause := context.Cause(ctx)
+		if cause == context.Canceled {
+			return // stopped, not signaled
+		}
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+		log.Printf("%v, saving progress - repeat it to exit immediately", cause)
+		<-sigCh
+		log.Println("exiting immediately")
+		profiler.Close()
+		os.Exit(exitForced)
+	}()
+
+	if *flagPprof != "" {
+		servePprof(*flagPprof)
+	}
+	var err error
+	if profiler, err = newPhaseProfiler(*flagCPUProfile, *flagMemProfile, *flagTrace); err != nil {
+		log.Fatal(err)
+	}
+	files, err := expandSources(flag.Args())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if flagMaxMemory > 0 {
+		given := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+		decode, cache := int64(-1), int64(-1)
+		if given["decode-memory"] {
+			decode = int64(flagDecodeMem)
+		}
+		if given["compose-cache"] {
+			cache = int64(flagComposeCache)
+		}
+		var sources int
+		if opts.Apply == "" {
+			sources = len(files)
+		}
+		budget, err := splitMemory(int64(flagMaxMemory), sources, opts.Match, decode, cache)
+		if err != nil {
+			log.Fatal(err)
+		}
+		flagDecodeMem, flagComposeCache, opts.CanvasMemory = ByteSize(budget.Decode), ByteSize(budget.Cache), ByteSize(max(budget.Canvas, 1))
+		if opts.Verbose {
+			log.Printf("-max-memory=%s: %s for the DB entries, %s for decoding, %s for the compose cache, %s for the mosaic",
+				flagMaxMemory, ByteSize(budget.DB).human(), flagDecodeMem.human(), flagComposeCache.human(), ByteSize(budget.Canvas).human())
+		}
+	}
+	decodeMemory = newMemSemaphore(int64(flagDecodeMem))
+	composeCache = newImageCache(int64(flagComposeCache))
+	if serve {
+		err = serveMain(ctx, opts, sopts, files)
+	} else {
+		err = Main(ctx, opts, files)
+	}
+	// before any exit, so the profiles are complete
+	profiler.Close()
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			log.Println(err)
+			os.Exit(exitInterrupted)
+		}
+		var sfe *SourcesFailedError
+		if errors.As(err, &sfe) {
+			log.Println(err)
+			os.Exit(exitSourcesFailed)
+		}
+		var npe *NotPersistedError
+		if errors.As(err, &npe) {
+			log.Println(err)
+			os.Exit(exitNotPersisted)
+		}
 		log.Fatal(err)
 	}
 }
 
-func Main(outFn, dbFn string, files []string) error {
+// stringsFlag is a repeatable flag.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	if s == nil {
+		return ""
+	}
+	return strings.Join(*s, ",")
+}
+func (s *stringsFlag) Set(v string) error { *s = append(*s, v); return nil }
+
+// sinceFlag is a flag.Value of a point in time: a timestamp, or a duration before now.
+type sinceFlag time.Time
+
+func (s *sinceFlag) String() string {
+	if s == nil || time.Time(*s).IsZero() {
+		return ""
+	}
+	return time.Time(*s).Format(time.RFC3339)
+}
+
+func (s *sinceFlag) Set(v string) error {
+	if v == "" {
+		*s = sinceFlag{}
+		return nil
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		*s = sinceFlag(time.Now().Add(-d))
+		return nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, v, time.Local); err == nil {
+			*s = sinceFlag(t)
+			return nil
+		}
+	}
+	return errors.Errorf("%q: must be a duration (as 72h) or a time (as 2006-01-02 or RFC 3339)", v)
+}
+
+// Exit codes after a signal.
+const (
+	exitInterrupted = 130 // progress has been saved
+	exitForced      = 137 // second signal, nothing saved
+)
+
+// exitNotPersisted is the exit code of a successful run which could not save its new DB entries.
+const exitNotPersisted = 3
+
+// store returns the store of the thumbnails; with DBShardByDir, the shards of the files -
+// layered over the DBLayers.
+func (opts Options) store(files ...string) store {
+	var st store
+	if opts.DBShardByDir {
+		st = newShardStore(shardDirs(files))
+	} else {
+		st = openStore(opts.DB, opts.DBRelativeTo)
+	}
+	if len(opts.DBLayers) != 0 {
+		return newLayerStore(st, opts.DBLayers, opts.DBRelativeTo)
+	}
+	return st
+}
+
+// NotPersistedError is returned, after completing the run, when N newly indexed entries
+// were not saved to the read-only DB.
+type NotPersistedError struct {
+	DB string
+	N  int
+}
+
+func (e *NotPersistedError) Error() string {
+	return fmt.Sprintf("%d new entries were not saved to the read-only DB %q", e.N, e.DB)
+}
+
+// isReadOnly reports whether the error is of writing to a read-only or not owned file.
+func isReadOnly(err error) bool {
+	return errors.Is(err, os.ErrPermission) || errors.Is(err, syscall.EROFS)
+}
+
+// Options of a mosaic run.
+type Options struct {
+	DB, Out       string
+	Sidecar       string
+	Proof         string
+	Apply         string
+	Partial       string
+	Explain       string
+	TilesDir      string
+	Stream        string
+	DumpFeatures  string
+	Mask          string
+	DPI           int
+	Progressive   bool
+	Preview       bool
+	Verbose       bool
+	BenchReport   string
+	Workers       int
+	DecodeTimeout time.Duration
+	Retries       int
+	RebuildDB     bool
+	Prune         bool
+	PruneUnder    string
+	// GC removes the entries of missing files unused for GCDays; GCDryRun just lists them.
+	GC          bool
+	GCDays      int
+	GCDryRun    bool
+	ContentHash bool
+	VerifyHash  bool
+	TrustMTime  bool
+	Checkpoint  Checkpoint
+	DBPrecision Precision
+	StorePixels bool
+	MatchIndex  bool
+	DBReadOnly  bool
+	// DBLayers are the read-only DBs consulted after DB, in order.
+	DBLayers []string
+	// DBFallbackReadOnly sets DBReadOnly if the DB can't be written, instead of failing.
+	DBFallbackReadOnly bool
+	DBRelativeTo       string
+	// DBMaxSize is the limit of the DB's size, kept by evicting entries by DBEvict.
+	DBMaxSize ByteSize
+	DBEvict   Evict
+	// DBJournal appends the new entries to the DB's journal as they are indexed.
+	DBJournal bool
+	// Reindex recomputes the up-to-date entries, too: all, or those matching ReindexGlob.
+	Reindex     bool
+	ReindexGlob string
+	// RetryFailed decodes the sources again whose decoding failed before.
+	RetryFailed bool
+	// Since skips indexing the sources modified before it; their DB entries are used as they are.
+	Since time.Time
+	// Errors is what to do with the sources which can't be indexed.
+	Errors ErrorPolicy
+	// Exif restricts the sources used as tiles.
+	Exif ExifFilter
+	// DBShardByDir keeps the DB in a shardFile in each directory of the sources, instead of DB.
+	DBShardByDir bool
+	// Targets to mosaic onto one output, arranged by Layout; without them, the first file is the target.
+	Targets []string
+	Layout  Layout
+	// AllowSelf lets the target be a tile of its mosaic, when it is a source too.
+	AllowSelf bool
+	// RasterizeCmd renders a vector (SVG, PDF) target: {in} is replaced by the target,
+	// {out} by the PNG to write, {w} and {h} by its size.
+	RasterizeCmd string
+	// Region of the target to mosaic; the rest of the target is kept as it is, at its size.
+	Region Region
+	// Grid of the mosaic; the zero value is a square grid with a cell for each file.
+	Grid Grid
+	// Pins are the sources forced onto cells, the others are matched around them.
+	Pins []Pin
+	// RenderSize is the size of the tiles in the output; zero is the matching size, Width.
+	RenderSize int
+	// MaxMem is the limit of the memory the output image may need.
+	MaxMem ByteSize
+	// CanvasMemory is the memory the mosaic image may take (of -max-memory); a larger one is backed by a file.
+	// Zero means no limit.
+	CanvasMemory ByteSize
+	Match        MatchOptions
+	Render       RenderOptions
+}
+
+func Main(ctx context.Context, opts Options, files []string) (err error) {
 	out := os.Stdout
-	if !(outFn == "" || outFn == "-") {
-		var err error
+	if outFn := opts.Out; !(outFn == "" || outFn == "-") {
 		if out, err = os.Create(outFn); err != nil {
 			return errors.Wrap(err, outFn)
 		}
 	}
 	defer out.Close()
 
-	thumbnails, err := prepareThumbnails(dbFn, files)
+	var tm Timings
+	var plan Plan
+	defer func() {
+		stats := runStats{Rows: plan.Rows, Cols: plan.Cols, Tiles: len(plan.Tiles), Sources: plan.Usage(nil).Distinct}
+		stats.CacheHits, stats.CacheMisses = composeCache.Stats()
+		if err != nil {
+			stats.Error = err.Error()
+		}
+		progress.Summary(&tm, stats)
+	}()
+	if opts.Verbose {
+		defer func() { tm.Print(os.Stderr, isTerminal(os.Stderr)) }()
+	}
+	if fn := opts.BenchReport; fn != "" {
+		defer func() {
+			w := os.Stderr
+			if fn != "-" {
+				fh, err := os.Create(fn)
+				if err != nil {
+					log.Println(err)
+					return
+				}
+				defer fh.Close()
+				w = fh
+			}
+			if err := tm.WriteReport(w); err != nil {
+				log.Println(errors.Wrap(err, fn))
+			}
+		}()
+	}
+	if opts.Stream != "" {
+		in := os.Stdin
+		if opts.Stream != "-" {
+			if in, err = os.Open(opts.Stream); err != nil {
+				return err
+			}
+			defer in.Close()
+		}
+		if err := streamMosaics(ctx, opts, files, in, out, &tm); err != nil {
+			return err
+		}
+		return out.Close()
+	}
+	var thumbnails map[string]Thumbnail
+	// a warning, returned at the end of a successful run
+	var warning error
+	if opts.Apply != "" {
+		if plan, err = readPlan(opts.Apply); err != nil {
+			return err
+		}
+		if opts.RenderSize > 0 {
+			plan.TileSize = opts.RenderSize
+		}
+		if !opts.Render.HiRes {
+			// for the stored pixels
+			sources := make(map[string]bool, len(plan.Tiles))
+			var files []string
+			for _, p := range plan.Tiles {
+				if !sources[p.Source] {
+					files = append(files, p.Source)
+				}
+				sources[p.Source] = true
+			}
+			if _, thumbnails, err = opts.store(files...).Load(func(k string) bool { return sources[k] }); err != nil {
+				log.Println(err)
+			}
+		}
+	} else if plan, thumbnails, err = buildPlan(ctx, opts, files, &tm); err != nil {
+		if !isWarning(err) {
+			return err
+		}
+		warning = err
+	}
+	if opts.Sidecar != "" {
+		if err := plan.WriteFile(opts.Sidecar); err != nil {
+			return err
+		}
+	}
+
+	if opts.TilesDir != "" {
+		stop := tm.Start("tiles")
+		err := writeTiles(ctx, opts, plan, thumbnails, opts.TilesDir)
+		stop(len(plan.Tiles))
+		if err != nil {
+			return err
+		}
+		if opts.Out == "" || opts.Out == "-" {
+			return warning
+		}
+	}
+
+	if opts.Preview {
+		opts, plan = opts.preview(plan)
+	}
+	stop := tm.Start("rendering")
+	canvas, err := renderPlan(ctx, opts, plan, thumbnails)
+	stop(len(plan.Tiles))
 	if err != nil {
 		return err
 	}
-	sortedThumbs := newSortedThumbnails(thumbnails, files)
-	for i, t := range sortedThumbs {
-		log.Printf("%d. %s %#v=%v", i, t.Name, t.FFT[0], R(t.FFT[0]))
+	defer func() { releaseCanvas(canvas) }()
+	if opts.Render.needsTarget() {
+		stop := tm.Start("blending")
+		err := blendTarget(ctx, opts, opts.target(files), plan, canvas)
+		stop(1)
+		if err != nil {
+			return err
+		}
+	}
+	if !opts.Region.isZero() {
+		mosaic := canvas
+		canvas, err = compositeRegion(ctx, opts, opts.target(files), plan, mosaic)
+		releaseCanvas(mosaic)
+		if err != nil {
+			return err
+		}
+	}
+	if opts.Proof != "" {
+		stop := tm.Start("proof")
+		err := writeProof(ctx, opts, opts.target(files), canvas)
+		stop(1)
+		if err != nil {
+			return err
+		}
 	}
 
-	target, err := imaging.Open(files[0])
+	format := imaging.PNG
+	if out != os.Stdout {
+		if format, err = imaging.FormatFromFilename(opts.Out); err != nil {
+			return errors.Wrap(err, opts.Out)
+		}
+	}
+	stop = tm.Start("encoding")
+	err = encodeImage(out, canvas, format, opts.DPI, opts.Progressive)
+	stop(1)
 	if err != nil {
-		return errors.Wrap(err, files[0])
+		return errors.Wrap(err, opts.Out)
 	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	return warning
+}
 
-	n := 3
-	for n*n < len(files) {
-		n++
+// target returns the (first) target: of Targets, or files[0].
+func (opts Options) target(files []string) string {
+	if len(opts.Targets) != 0 {
+		return opts.Targets[0]
 	}
-	log.Printf("Will use %d*%d=%d files", n, n, n*n)
+	return files[0]
+}
 
-	//b := target.Bounds()
-	//W, H := b.Max.X-b.Min.X, b.Max.Y-b.Min.Y
-	tgt := imaging.Resize(target, n*Width, n*Width, imaging.Lanczos)
-	b := tgt.Bounds()
-	for i := b.Min.Y; i < b.Max.Y; i += Width {
-		for j := b.Min.X; j < b.Max.X; j += Width {
-			found := sortedThumbs.FindImg(
-				imaging.Crop(
-					tgt,
-					image.Rectangle{
-						Min: image.Point{X: b.Min.X + i, Y: b.Min.Y + j},
-						Max: image.Point{X: b.Min.X + i + Width, Y: b.Min.Y + j + Width},
-					},
-				),
-			)
-			log.Println(found)
+// buildPlan indexes the sources, and matches them to the cells of the target, files[0]
+// (which is a source, too) - or of the Targets, if given, arranged by the Layout.
+// It returns the DB entries, too.
+//
+// A *NotPersistedError or *SourcesFailedError is returned with the complete plan.
+func buildPlan(ctx context.Context, opts Options, files []string, tm *Timings) (Plan, map[string]Thumbnail, error) {
+	targets := opts.Targets
+	if len(targets) == 0 && len(files) != 0 {
+		targets = files[:1]
+	}
+	if len(targets) == 0 || len(files) == 0 {
+		return Plan{}, nil, errors.New("usage: mosaic [flags] target source... | mosaic [flags] -target=target... source...")
+	}
+	layout := opts.Layout
+	if layout.Rows == 0 || layout.Cols == 0 {
+		layout = Layout{Rows: 1, Cols: len(targets)}
+	}
+	if len(targets) > layout.Rows*layout.Cols {
+		return Plan{}, nil, errors.Errorf("%d targets don't fit in the %s layout", len(targets), layout)
+	}
+	b := NewBuilder(opts)
+	b.Timings = tm
+	if opts.Explain != "" {
+		fh, err := os.Create(opts.Explain)
+		if err != nil {
+			return Plan{}, nil, err
 		}
+		bw := bufio.NewWriter(fh)
+		defer func() {
+			if err := bw.Flush(); err != nil {
+				log.Println(errors.Wrap(err, opts.Explain))
+			}
+			fh.Close()
+		}()
+		b.Explain = bw
 	}
-
-	return out.Close()
+	// Fail before the long indexing, not at rendering.
+	empty := b.emptyPlan(len(files))
+	if err := checkMemory(Plan{Rows: layout.Rows * empty.Rows, Cols: layout.Cols * empty.Cols, TileSize: empty.TileSize}, opts.MaxMem); err != nil {
+		return Plan{}, nil, err
+	}
+	// a warning, returned with the complete plan
+	warning := b.AddSources(ctx, files)
+	if warning != nil && !isWarning(warning) {
+		return Plan{}, nil, warning
+	}
+	plans := make([]Plan, 0, len(targets))
+	for _, target := range targets {
+		plan, err := b.Build(ctx, target)
+		plans = append(plans, plan)
+		if err != nil {
+			return combinePlans(layout, plans), b.thumbnails, err
+		}
+	}
+	return combinePlans(layout, plans), b.thumbnails, warning
 }
 
-func R(c complex128) float64 { return real(c)*real(c) + imag(c)*imag(c) }
-
-func thumbLess(a, b [Width * Width]complex128) bool {
-	for i, va := range a {
-		vb := b[i]
-		if ra, rb := R(va), R(vb); ra > rb {
-			return false
+// isTransparent reports whether the mask is fully transparent in the rectangle.
+func isTransparent(mask *image.NRGBA, r image.Rectangle) bool {
+	r = r.Intersect(mask.Bounds())
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if mask.Pix[mask.PixOffset(x, y)+3] != 0 {
+				return false
+			}
 		}
 	}
 	return true
 }
 
-type sortedThumbnails []Thumbnail
-
-func newSortedThumbnails(thumbnails map[string]Thumbnail, files []string) sortedThumbnails {
-	sorted := make([]Thumbnail, len(files))
-	for i, fn := range files {
-		sorted[i] = thumbnails[fn]
+// renderPlan pastes the sources onto the mosaic, as planned.
+//
+// The pixels stored in the DB entries are used when present, unless HiRes is set.
+// With Supersample, the mosaic is rendered that many times larger, then downsampled.
+func renderPlan(ctx context.Context, opts Options, plan Plan, thumbnails map[string]Thumbnail) (*image.NRGBA, error) {
+	if n := opts.Render.Supersample; n > 1 {
+		large, largeOpts := plan, opts
+		large.TileSize *= n
+		largeOpts.Render.Supersample, largeOpts.Render.Border = 1, n*opts.Render.Border
+		canvas, err := renderPlan(ctx, largeOpts, large, thumbnails)
+		if err != nil {
+			return nil, err
+		}
+		defer releaseCanvas(canvas)
+		return imaging.Resize(canvas, plan.Cols*plan.TileSize, plan.Rows*plan.TileSize, imaging.Lanczos), nil
+	}
+	if err := checkMemory(plan, opts.MaxMem); err != nil {
+		return nil, err
 	}
-	sort.Slice(
-		sorted,
-		func(i, j int) bool { return thumbLess(sorted[i].FFT, sorted[j].FFT) },
-	)
-	return sorted
+	canvas := newCanvas(image.Rect(0, 0, plan.Cols*plan.TileSize, plan.Rows*plan.TileSize), opts.CanvasMemory)
+	if bg := opts.Render.Background; bg != (color.NRGBA{}) {
+		draw.Draw(canvas, canvas.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+	}
+	rnd := newRenderer(ctx, opts, plan.TileSize, thumbnails)
+	progress.Begin(phaseCompose, len(plan.Tiles))
+	defer progress.End()
+	for i, p := range bySource(plan.Tiles) {
+		if err := ctx.Err(); err != nil {
+			return canvas, errors.Wrap(err, "rendering")
+		}
+		progress.Update(i, 0, 0)
+		tile, err := rnd.Tile(p)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		draw.Draw(canvas, plan.Cell(p), tile, image.Point{}, draw.Src)
+	}
+	progress.Update(len(plan.Tiles), 0, 0)
+	log.Printf("rendered %d tiles %s", len(plan.Tiles), rnd.readStats())
+	return canvas, nil
 }
 
-func (s sortedThumbnails) FindImg(img image.Image) string {
-	needle := imgFFT(img)
-	log.Printf("needle[0]=%#v=%v", needle[0], R(needle[0]))
-	i := sort.Search(len(s), func(i int) bool { return thumbLess(needle, s[i].FFT) })
-	if i < 0 {
-		i = 0
-	} else if i >= len(s) {
-		i = len(s) - 1
-	}
-	return s[i].Name
+// ErrNoSources is returned when none of the sources could be indexed.
+var ErrNoSources = errors.New("no usable source images")
+
+func R(c complex128) float64 { return real(c)*real(c) + imag(c)*imag(c) }
+
+func prepareThumbnails(ctx context.Context, opts Options, files []string, tm *Timings) (map[string]Thumbnail, int, error) {
+	_, thumbnails, indexed, err := prepareDB(ctx, opts, files, tm)
+	return thumbnails, indexed, err
 }
 
-func prepareThumbnails(dbFn string, files []string) (map[string]Thumbnail, error) {
-	thumbnails := make(map[string]Thumbnail, len(files))
-	if dbFh, err := os.Open(dbFn); err == nil {
-		gob.NewDecoder(dbFh).Decode(&thumbnails)
+// prepareDB is prepareThumbnails, returning the header of the DB, too.
+func prepareDB(ctx context.Context, opts Options, files []string, tm *Timings) (dbHeader, map[string]Thumbnail, int, error) {
+	st := opts.store(files...)
+	if _, ok := writable(st).(httpStore); ok && !opts.DBReadOnly {
+		log.Printf("%s: an HTTP DB is read-only, the missing sources are indexed in memory", st)
+		opts.DBReadOnly = true
+	}
+	if p, ok := st.(prober); ok && !opts.DBReadOnly {
+		if err := p.Probe(); err != nil {
+			if !opts.DBFallbackReadOnly {
+				return dbHeader{}, nil, 0, errors.Wrap(err, "the DB can't be written (use -db-readonly or -db-fallback-readonly)")
+			}
+			log.Printf("!!! WARNING: %v: continuing read-only, the newly indexed sources are NOT saved", err)
+			opts.DBReadOnly = true
+		}
+	}
+	// Load only the entries of the files, unless all are needed:
+	// for pruning, or for finding moved files by their content hash.
+	var loaded func(string) bool
+	if !opts.Prune && !opts.ContentHash && !opts.GC && !opts.GCDryRun {
+		wanted := make(map[string]bool, len(files))
+		for _, fn := range files {
+			if key, err := canonicalKey(fn); err == nil {
+				wanted[key] = true
+			}
+		}
+		loaded = func(k string) bool { return wanted[storedKey(k)] }
+	}
+	hdr, thumbnails, err := st.Load(loaded)
+	if err != nil {
+		var ce *CorruptDBError
+		if !errors.As(err, &ce) {
+			return dbHeader{}, nil, 0, err
+		}
+		log.Printf("!!! %v", err)
+		if opts.DBReadOnly {
+			log.Println("!!! indexing all sources in memory")
+		} else {
+			if !opts.RebuildDB {
+				return dbHeader{}, nil, 0, errors.Wrap(err, "refusing to overwrite it without -rebuild-db")
+			}
+			// only a file can be corrupt
+			dbFn := opts.DB
+			if ce.Path != "" {
+				dbFn = ce.Path // a shard
+			}
+			bak := dbFn + ".bak"
+			if err := os.Rename(dbFn, bak); err != nil {
+				return dbHeader{}, nil, 0, errors.Wrap(err, bak)
+			}
+			log.Printf("!!! corrupt DB moved to %q, rebuilding from scratch", bak)
+		}
+		hdr, thumbnails = newDBHeader(), make(map[string]Thumbnail, len(files))
+	}
+	if !opts.DBReadOnly {
+		if err := compactJournal(ctx, st, hdr); err != nil {
+			return dbHeader{}, nil, 0, err
+		}
+	}
+	// changed tells whether the DB has to be rewritten: an old version is upgraded.
+	changed := hdr.Version != dbVersion
+	loadAliased(st, thumbnails)
+	if n := dedupKeys(thumbnails); n != 0 {
+		changed = true
+		log.Printf("merged %d DB entries of the same files under different paths", n)
+	}
+	if opts.Prune {
+		removed, err := pruneDB(thumbnails, opts.PruneUnder, false)
+		if err != nil {
+			return dbHeader{}, nil, 0, err
+		}
+		log.Printf("pruned %d entries of missing files", len(removed))
+		changed = changed || len(removed) != 0
+	}
+	if opts.GC || opts.GCDryRun {
+		removed := gcDB(thumbnails, time.Now().AddDate(0, 0, -opts.GCDays), opts.GCDryRun)
+		if opts.GCDryRun {
+			for _, k := range removed {
+				log.Printf("gc: %s would be removed", k)
+			}
+			log.Printf("gc: %d of %d entries would be removed", len(removed), len(thumbnails))
+		} else {
+			log.Printf("gc: removed %d entries of missing files unused for %d days", len(removed), opts.GCDays)
+			changed = changed || len(removed) != 0
+		}
+	}
+	// for aliasing the same content (and finding the moved files, with ContentHash)
+	byHash := hashIndex(thumbnails)
+	// the loaded entries have no phase, even if the DB is converted to full precision
+	if err := opts.Match.Metric.checkPrecision(hdr.Precision); err != nil {
+		return dbHeader{}, nil, 0, err
+	}
+	if opts.DBPrecision != "" && opts.DBPrecision != hdr.Precision {
+		if err := opts.Match.Metric.checkPrecision(opts.DBPrecision); err != nil {
+			return dbHeader{}, nil, 0, err
+		}
+		hdr.Precision, changed = opts.DBPrecision, true
+	}
+	checkpoint := opts.Checkpoint
+	if opts.DBReadOnly {
+		checkpoint = Checkpoint{}
+	}
+	cp := newCheckpointer(ctx, st, hdr, loaded, checkpoint)
+	cp.journal = opts.DBJournal && !opts.DBReadOnly
+	var indexed int
+	stop := tm.Start("indexing")
+	defer func() { stop(indexed) }()
+	params := currentParams(opts.Render.Fit)
+	// the extra feature of the metric, computed while indexing, and for the old entries lacking it
+	var extra []string
+	if name := opts.Match.extraFeature(); name != "" {
+		extra = []string{name}
+	}
+	var reindex globPattern
+	if opts.ReindexGlob != "" {
+		if reindex, err = compileGlob(opts.ReindexGlob); err != nil {
+			return dbHeader{}, nil, 0, err
+		}
+	}
+	invalidated := make(map[string]int)
+	var forced, knownFailed, aliased, older int
+	fails := newSourceFailures(opts.Errors, len(files))
+	// abort is the error stopping the indexing, by the ErrorPolicy
+	var abort error
+	failed := func(fn string, err error) {
+		if err := fails.Add(fn, err); err != nil && abort == nil {
+			abort = err
+		}
+	}
+	defer func() {
+		if older != 0 {
+			log.Printf("skipped indexing %d sources modified before %s (-since)", older, opts.Since.Format(time.RFC3339))
+		}
+		fails.Summary()
+		if aliased != 0 {
+			log.Printf("%d sources are aliases of others with the same content", aliased)
+		}
+		if knownFailed != 0 {
+			log.Printf("skipped %d sources which could not be decoded before (see \"db inspect -failed\"; retry them with -retry-failed)", knownFailed)
+		}
+		for _, reason := range sortedNames(invalidated) {
+			log.Printf("%d entries invalidated: %s", invalidated[reason], reason)
+		}
+		if opts.Reindex || reindex != nil {
+			log.Printf("recomputed %d entries: %d forced by -reindex, %d new or changed", indexed, forced, indexed-forced)
+		}
+	}()
+	// The sources are decoded and their features computed by the workers,
+	// the rest (the cache hits, hashing, aliasing, saving) is done here.
+	pool := newIndexPool(opts.Workers,
+		func(job indexJob) (Thumbnail, error) {
+			var thumb Thumbnail
+			err := retryTransient(ctx, opts.Retries, func() error {
+				var err error
+				thumb, err = indexFile(ctx, job.fn, job.fi, job.hash, opts.StorePixels, extra, opts.Render.Fit, opts.DecodeTimeout)
+				return err
+			})
+			return thumb, err
+		},
+		func(r *indexResult) {
+			fn, fi := r.fn, r.fi
+			// The entries done are kept after a cancellation, too, to be saved;
+			// the jobs interrupted by it did not fail.
+			if err := r.err; err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				failed(fn, err)
+				// a timeout, or a file which can't be read (yet) may succeed next time
+				if !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, os.ErrPermission) && !errors.Is(err, os.ErrNotExist) &&
+					!errors.Is(err, errNoRawDecoder) && !isTransient(err) {
+					thumbnails[fn] = Thumbnail{Name: fi.Name(), ModTime: fi.ModTime(), Size: fi.Size(), Failed: err.Error()}
+					changed = true
+					cp.Added(thumbnails, fn)
+				}
+				return
+			}
+			thumbnails[fn] = r.thumb
+			if r.hash != "" {
+				byHash[r.hash] = fn
+			}
+			indexed++
+			if r.isForced {
+				forced++
+			}
+			cp.Added(thumbnails, fn)
+		})
+	// the sequence numbers of the jobs by content hash, for aliasing the copies when they're done
+	inFlight := make(map[string]int)
+	// a source given twice is indexed only once
+	queued := make(map[string]bool)
+	progress.Begin(phaseIndex, len(files))
+	defer progress.End()
+	showProgress := func(examined int) {
+		progress.Update(examined-pool.InFlight(), knownFailed+older, fails.n)
 	}
 	for i, fn := range files {
-		fn, err := filepath.Abs(fn)
+		if ctx.Err() != nil || abort != nil {
+			break
+		}
+		showProgress(i)
+		fn, err := canonicalKey(fn)
 		if err != nil {
-			log.Println(errors.Wrap(err, fn))
+			failed(fn, errors.Wrap(err, fn))
 			continue
 		}
 		files[i] = fn
-		fi, err := os.Stat(fn)
+		if queued[fn] {
+			continue
+		}
+		fi, err := sourceInfo(ctx, fn)
 		if err != nil {
-			log.Println(errors.Wrap(err, fn))
+			failed(fn, errors.Wrap(err, fn))
 			continue
 		}
-		if old := thumbnails[fn]; old.Name == fi.Name() && old.ModTime.Equal(fi.ModTime()) {
+		if fi.ModTime().Before(opts.Since) {
+			if _, ok := thumbnails[fn]; !ok {
+				older++
+			}
 			continue
 		}
-		thumb := Thumbnail{Name: fi.Name(), ModTime: fi.ModTime()}
-		img, err := imaging.Open(fn)
+		// forced is counted only if the entry is up to date
+		force, isForced := opts.Reindex || reindex != nil && reindex.Match(fn), false
+		if old, ok := thumbnails[fn]; ok && old.Failed != "" {
+			if old.failedUpToDate(fi) && !opts.RetryFailed {
+				knownFailed++
+				continue
+			}
+		} else if ok && old.AliasOf != "" {
+			if _, ok := resolveAlias(thumbnails, fn); ok && old.sameFile(fi) && !force {
+				continue
+			}
+		} else if ok {
+			if reason := params.mismatch(old.Params); reason != "" {
+				invalidated[reason]++
+			} else if opts.StorePixels && len(old.Pix) == 0 {
+				invalidated["no pixels stored"]++
+			} else if opts.cacheHit(&old, fn, fi) {
+				if !force {
+					thumbnails[fn] = old
+					continue
+				}
+				isForced = true
+			}
+		}
+		var hash string
+		if !isURL(fn) || opts.needHash() {
+			if hash, err = contentHash(fn); err != nil {
+				log.Println(err)
+			}
+		}
+		if seq, ok := inFlight[hash]; hash != "" && ok {
+			pool.WaitFor(seq)
+		}
+		if k, ok := byHash[hash]; hash != "" && ok && k != fn && !force {
+			t := thumbnails[k]
+			if params.mismatch(t.Params) == "" && !(opts.StorePixels && len(t.Pix) == 0) {
+				if _, err := os.Stat(k); opts.ContentHash && err != nil && os.IsNotExist(err) && !isURL(k) {
+					// Same content under a new path: move the entry.
+					t.Name, t.ModTime, t.Size = fi.Name(), fi.ModTime(), fi.Size()
+					thumbnails[fn] = t
+					byHash[hash] = fn
+					delete(thumbnails, k)
+					log.Printf("%s: moved from %s", fn, k)
+				} else {
+					// a copy: just refer to the entry
+					thumbnails[fn] = Thumbnail{Name: fi.Name(), ModTime: fi.ModTime(), Size: fi.Size(), Hash: hash, Exif: t.Exif, AliasOf: k}
+					aliased++
+				}
+				changed = true
+				cp.Added(thumbnails, fn)
+				continue
+			}
+		}
+		seq := pool.Submit(indexJob{fn: fn, fi: fi, hash: hash, isForced: isForced})
+		queued[fn] = true
+		if hash != "" {
+			inFlight[hash] = seq
+		}
+	}
+	pool.Close()
+	showProgress(len(files))
+	progress.End()
+
+	if len(extra) != 0 && ctx.Err() == nil && abort == nil {
+		if n := addFeature(ctx, thumbnails, files, extra[0], opts.DecodeTimeout, func(k string) { cp.Added(thumbnails, k) }); n != 0 {
+			log.Printf("computed the %s feature of %d entries", extra[0], n)
+			changed = true
+		}
+	}
+
+	if ctx.Err() == nil && abort == nil {
+		if n := addExif(ctx, thumbnails, files, func(k string) { cp.Added(thumbnails, k) }); n != 0 {
+			log.Printf("read the EXIF of %d entries", n)
+			changed = true
+		}
+	}
+
+	// Mark the sources used, once a day at most, so that -gc keeps their entries.
+	now := time.Now()
+	for _, fn := range files {
+		if t, ok := thumbnails[fn]; ok && now.Sub(t.LastUsed) >= 24*time.Hour {
+			t.LastUsed = now
+			thumbnails[fn] = t
+			changed = true
+		}
+	}
+
+	// stopped returns why the indexing stopped early: canceled, or aborted by the ErrorPolicy.
+	stopped := func() error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return errors.Wrap(ctxErr, "indexing")
+		}
+		return abort
+	}
+	notSaved := func() error {
+		if err := stopped(); err != nil {
+			return err
+		}
+		if indexed == 0 {
+			return fails.Warning(nil)
+		}
+		return fails.Warning(&NotPersistedError{DB: st.String(), N: indexed})
+	}
+	if opts.DBReadOnly || cp.readOnly {
+		return hdr, thumbnails, indexed, notSaved()
+	}
+	if !changed && indexed == 0 {
+		log.Println("DB unchanged, not rewritten")
+		if err := stopped(); err != nil {
+			return hdr, thumbnails, indexed, err
+		}
+		return hdr, thumbnails, indexed, fails.Warning(nil)
+	}
+	// Flush what's done even when stopped, so an interrupted run is not lost.
+	err = st.Save(context.WithoutCancel(ctx), hdr, thumbnails, loaded)
+	if err != nil && isReadOnly(err) {
+		log.Printf("WARNING: %v", err)
+		return hdr, thumbnails, indexed, notSaved()
+	}
+	if err == nil && opts.DBMaxSize > 0 {
+		err = capStore(context.WithoutCancel(ctx), writable(st), opts.DBMaxSize, opts.DBEvict)
+	}
+	if stopErr := stopped(); stopErr != nil {
 		if err != nil {
+			log.Println(err)
+		} else {
+			log.Printf("saved %d entries to %q", len(thumbnails), st)
+		}
+		return hdr, thumbnails, indexed, stopErr
+	}
+	if err != nil {
+		return hdr, thumbnails, indexed, err
+	}
+	return hdr, thumbnails, indexed, fails.Warning(nil)
+}
+
+// indexFile computes the DB entry of the file, with the given content hash,
+// on the image fitted into the tile. A failure to store the pixels is just logged.
+func indexFile(ctx context.Context, fn string, fi os.FileInfo, hash string, storePixels bool, extra []string, fit Fit, timeout time.Duration) (Thumbnail, error) {
+	thumb := Thumbnail{Name: fi.Name(), ModTime: fi.ModTime(), Size: fi.Size(), Hash: hash, Params: currentParams(fit)}
+	img, err := openImageTimeout(ctx, fn, timeout)
+	if err != nil {
+		return thumb, err
+	}
+	size := img.Bounds().Size()
+	if fit != FitStretch {
+		// stretching is left to fftInput and encodePixels
+		img = fit.Apply(img, Width, color.NRGBA{})
+	}
+	thumb.FFT = imgFFT(img)
+	thumb.Color = avgColor(img)
+	thumb.Features = computeFeatures(img, extra)
+	exif := readExif(ctx, fn)
+	if exif.Width == 0 || exif.Height == 0 {
+		exif.Width, exif.Height = size.X, size.Y
+	}
+	thumb.Exif = &exif
+	if storePixels {
+		if thumb.Pix, err = encodePixels(img); err != nil {
 			log.Println(errors.Wrap(err, fn))
-			continue
 		}
-		thumb.FFT = imgFFT(img)
-		thumbnails[fn] = thumb
 	}
+	return thumb, nil
+}
 
-	dbFh, err := os.Create(dbFn)
+// openImageTimeout is openImage, giving up after timeout (if positive).
+// The time waiting for the decoding memory (see decodeMemory) does not count.
+func openImageTimeout(ctx context.Context, fn string, timeout time.Duration) (image.Image, error) {
+	release, err := decodeMemory.Acquire(ctx, fn)
 	if err != nil {
-		return thumbnails, errors.Wrap(err, dbFn)
+		return nil, errors.Wrap(err, fn)
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return decodeImage(ctx, fn, release)
+}
+
+// openImage opens and decodes the image file, returning early when ctx is done.
+//
+// A decoder can't be interrupted, so a stalled one is left behind to finish in the background.
+func openImage(ctx context.Context, fn string) (image.Image, error) {
+	return openImageTimeout(ctx, fn, 0)
+}
+
+// decodeImage is openImage, calling done when the decoding ends.
+func decodeImage(ctx context.Context, fn string, done func()) (image.Image, error) {
+	type result struct {
+		img image.Image
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		defer done()
+		var img image.Image
+		var err error
+		if isURL(fn) {
+			img, err = openURL(ctx, fn)
+		} else if isRaw(fn) {
+			img, err = openRaw(ctx, fn)
+		} else {
+			img, err = imaging.Open(fn)
+		}
+		if err == nil {
+			img = normalizeImage(img)
+		}
+		ch <- result{img: img, err: err}
+	}()
+	select {
+	case <-ctx.Done():
+		return nil, errors.Wrap(ctx.Err(), fn)
+	case res := <-ch:
+		return res.img, errors.Wrap(res.err, fn)
 	}
-	err = gob.NewEncoder(dbFh).Encode(thumbnails)
-	if closeErr := dbFh.Close(); closeErr != nil && err == nil {
-		err = closeErr
+}
+
+// normalizeImage converts the color models the image processing is not prepared for,
+// such as the *image.CMYK of print-origin JPEGs, to NRGBA.
+func normalizeImage(img image.Image) image.Image {
+	cmyk, ok := img.(*image.CMYK)
+	if !ok {
+		return img
 	}
-	return thumbnails, errors.Wrap(err, dbFn)
+	b := cmyk.Bounds()
+	nrgba := image.NewNRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			i := cmyk.PixOffset(x, y)
+			r, g, bl := color.CMYKToRGB(cmyk.Pix[i], cmyk.Pix[i+1], cmyk.Pix[i+2], cmyk.Pix[i+3])
+			j := nrgba.PixOffset(x, y)
+			nrgba.Pix[j], nrgba.Pix[j+1], nrgba.Pix[j+2], nrgba.Pix[j+3] = r, g, bl, 0xff
+		}
+	}
+	return nrgba
 }
 
 type Thumbnail struct {
 	Name    string
 	ModTime time.Time
-	FFT     [Width * Width]complex128
+	Size    int64
+	// FFT coefficients, by reference, as they are large: copying the entries must not copy them.
+	// Nil means all zero, as of the entries without features, see coeffs.
+	FFT *[Width * Width]complex128
+	// Color is the average color of the image.
+	Color color.NRGBA
+	// Hash of the file's content, for finding moved files (see contentHash).
+	Hash string
+	// Params the features were computed with.
+	Params FeatureParams
+	// Pix is the JPEG of the image fitted into Width*Width, for rendering.
+	Pix []byte
+	// LastUsed is when the entry was last used for a run, with a day's resolution, for -gc.
+	// It is zero for entries not used since DB version 7.
+	LastUsed time.Time
+	// Features are the extraFeatures computed for the entry, by name.
+	Features map[string][]byte
+	// Exif is the metadata of the source, nil if it has not been read (before DB version 9).
+	Exif *Exif
+	// Failed is the error of decoding the file (since DB version 10): such an entry has no features,
+	// it just spares the next runs from retrying the file, while it doesn't change.
+	Failed string
+	// AliasOf is the key of the entry with the same content (since DB version 11):
+	// such an entry has no features, they are that entry's (see resolveAlias).
+	AliasOf string
+}
+
+// resolveAlias returns the entry with the features of the key: its own,
+// or the one of the entry it is an alias of - if that still has the same content.
+func resolveAlias(thumbnails map[string]Thumbnail, key string) (Thumbnail, bool) {
+	t, ok := thumbnails[key]
+	if !ok || t.AliasOf == "" {
+		return t, ok
+	}
+	c, ok := thumbnails[t.AliasOf]
+	if !ok || c.AliasOf != "" || c.Hash != t.Hash {
+		return Thumbnail{}, false
+	}
+	return c, true
+}
+
+// loadAliased loads the entries the aliases among the thumbnails refer to, if they are not there.
+func loadAliased(st store, thumbnails map[string]Thumbnail) {
+	missing := make(map[string]bool)
+	for _, t := range thumbnails {
+		if _, ok := thumbnails[t.AliasOf]; t.AliasOf != "" && !ok {
+			missing[t.AliasOf] = true
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+	_, aliased, err := st.Load(func(k string) bool { return missing[k] })
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for k, t := range aliased {
+		thumbnails[k] = t
+	}
+}
+
+// encodePixels returns the JPEG of the image resized to Width*Width, for Thumbnail.Pix.
+// The image should be already fitted, to keep its aspect.
+func encodePixels(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, imaging.Resize(img, Width, Width, imaging.Lanczos), &jpeg.Options{Quality: 85})
+	return buf.Bytes(), err
+}
+
+// zeroFFT is the coefficients of the entries without them; it is never written.
+var zeroFFT [Width * Width]complex128
+
+// coeffs returns the FFT coefficients of the entry, for reading only.
+func (t Thumbnail) coeffs() *[Width * Width]complex128 {
+	if t.FFT == nil {
+		return &zeroFFT
+	}
+	return t.FFT
+}
+
+// upToDate reports whether the thumbnail is still valid for the file, judging by its metadata.
+//
+// Entries of version 1 DBs have no Size recorded.
+func (t Thumbnail) upToDate(fi os.FileInfo) bool {
+	return t.Name == fi.Name() && t.ModTime.Equal(fi.ModTime()) &&
+		(t.Size == 0 || t.Size == fi.Size()) &&
+		t.Color != (color.NRGBA{})
+}
+
+// sameFile reports whether the file is still the same the entry has been recorded for, by its metadata.
+func (t Thumbnail) sameFile(fi os.FileInfo) bool {
+	return t.Name == fi.Name() && t.ModTime.Equal(fi.ModTime()) && t.Size == fi.Size()
+}
+
+// failedUpToDate reports whether the file is still the same whose decoding failed.
+func (t Thumbnail) failedUpToDate(fi os.FileInfo) bool {
+	return t.Failed != "" && t.sameFile(fi)
+}
+
+// needHash reports whether the content hash of the files is needed.
+func (opts Options) needHash() bool {
+	return opts.ContentHash || opts.VerifyHash || !opts.TrustMTime
+}
+
+// cacheHit reports whether the DB entry t can be used for the file fn.
+//
+// With VerifyHash the content hash must match, too;
+// without TrustMTime a matching content hash makes a different ModTime acceptable.
+// The metadata of t is refreshed on a hit.
+func (opts Options) cacheHit(t *Thumbnail, fn string, fi os.FileInfo) bool {
+	if t.Name != fi.Name() || t.Color == (color.NRGBA{}) || (t.Size != 0 && t.Size != fi.Size()) {
+		return false
+	}
+	sameTime := t.ModTime.Equal(fi.ModTime())
+	if !opts.VerifyHash && (sameTime || opts.TrustMTime) {
+		if sameTime {
+			t.Size = fi.Size()
+		}
+		return sameTime
+	}
+	if t.Hash == "" {
+		return false
+	}
+	if hash, err := contentHash(fn); err != nil || hash != t.Hash {
+		return false
+	}
+	t.ModTime, t.Size = fi.ModTime(), fi.Size()
+	return true
 }
 
 type backing struct {
@@ -186,6 +1370,8 @@ type backing struct {
 	Matrix [][]float64
 }
 
+// backingPool keeps the input matrices of imgFFT: each call gets its own,
+// so the concurrent indexing workers don't share them, and puts it back when done.
 var backingPool = sync.Pool{New: func() interface{} {
 	var b backing
 	b.Matrix = make([][]float64, Width)
@@ -195,24 +1381,53 @@ var backingPool = sync.Pool{New: func() interface{} {
 	return &b
 }}
 
-func imgFFT(img image.Image) [Width * Width]complex128 {
+// fftInput returns the grayscale Width*Width matrix imgFFT transforms, as an image.
+func fftInput(img image.Image) *image.Gray { return fftInputSize(img, Width) }
+
+// fftInputSize is fftInput for a size*size matrix.
+func fftInputSize(img image.Image, size int) *image.Gray {
 	nrgba, _ := img.(*image.NRGBA)
 	if nrgba == nil || img.ColorModel() != color.GrayModel {
 		nrgba = imaging.Grayscale(img)
 	}
-	if b := nrgba.Bounds(); b.Max.X-b.Min.X > Width || b.Max.Y-b.Min.Y > Width {
-		nrgba = imaging.Resize(nrgba, Width, Width, imaging.Lanczos)
+	if b := nrgba.Bounds(); b.Dx() != size || b.Dy() != size {
+		nrgba = imaging.Resize(nrgba, size, size, imaging.Lanczos)
 	}
 
-	b := backingPool.Get().(*backing)
+	// The transparent pixels are composited over the alpha-weighted mean of the visible ones,
+	// so that they don't add the edges of a black background to the spectrum.
+	var sum, alpha uint64
+	for off := 0; off < len(nrgba.Pix); off += 4 {
+		a := uint64(nrgba.Pix[off+3])
+		sum += uint64(nrgba.Pix[off]) * a
+		alpha += a
+	}
+	var mean uint32
+	if alpha != 0 {
+		mean = uint32((sum + alpha/2) / alpha)
+	}
+	gray := image.NewGray(image.Rect(0, 0, size, size))
 	// TODO(tgulacsi): spiral from the center
-	for i := 0; i < Width; i++ {
-		for j := 0; j < Width; j++ {
-			b.Array[i*Width+j] = float64(nrgba.Pix[nrgba.PixOffset(i, j)])
+	for i := 0; i < size; i++ {
+		for j := 0; j < size; j++ {
+			off := nrgba.PixOffset(i, j)
+			a := uint32(nrgba.Pix[off+3])
+			gray.Pix[i*size+j] = uint8((uint32(nrgba.Pix[off])*a + mean*(255-a) + 127) / 255)
 		}
 	}
+	return gray
+}
+
+func imgFFT(img image.Image) *[Width * Width]complex128 {
+	gray := fftInput(img)
+	b := backingPool.Get().(*backing)
+	for i, p := range gray.Pix {
+		b.Array[i] = float64(p)
+	}
+	// FFT2Real copies the input into a new complex matrix, it doesn't keep b's
 	mtx := fft.FFT2Real(b.Matrix)
-	var carr [Width * Width]complex128
+	backingPool.Put(b)
+	carr := new([Width * Width]complex128)
 	for i, vv := range mtx {
 		for j, v := range vv {
 			carr[i*Width+j] = v
@@ -0,0 +1,350 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/pkg/errors"
+)
+
+// testOptions returns the Options of the flags' defaults, keeping the DB in memory.
+func testOptions() Options {
+	var opts Options
+	opts.Workers = 2
+	opts.TrustMTime = true
+	opts.Retries = 0
+	opts.MaxMem = 4 << 30
+	opts.DBEvict = EvictLRU
+	opts.Match.Metric = MetricFFT
+	opts.Match.ColorWeight = 1
+	opts.Match.Size = Width
+	opts.Match.Prefilter = PrefilterNone
+	opts.Match.TopM = 1
+	opts.Render.Fit = FitStretch
+	opts.Render.Supersample = 1
+	opts.Render.BorderColor = color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+	return opts
+}
+
+// writeImage saves the image into dir, returning its DB key.
+func writeImage(t testing.TB, dir, name string, img image.Image) string {
+	t.Helper()
+	fn := filepath.Join(dir, name)
+	if err := imaging.Save(img, fn); err != nil {
+		t.Fatal(err)
+	}
+	key, err := canonicalKey(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// testLibrary writes n synthetic sources into dir, returning their DB keys.
+func testLibrary(t testing.TB, dir string, n int) []string {
+	t.Helper()
+	files := make([]string, n)
+	for i := range files {
+		files[i] = writeImage(t, dir, fmt.Sprintf("src%03d.png", i), synthImage(int64(i), Width, Width))
+	}
+	return files
+}
+
+// fakeRawDecoder decodes the .raw files with decode until the end of the test.
+func fakeRawDecoder(t testing.TB, decode rawDecodeFunc) {
+	t.Helper()
+	rawDecoders[".raw"] = decode
+	t.Cleanup(func() { delete(rawDecoders, ".raw") })
+}
+
+// solidImage returns a width*height image of the color.
+func solidImage(width, height int, c color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+	return img
+}
+
+func TestDecodeTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		Name        string
+		Timeout     time.Duration
+		Stall       bool
+		WantIndexed int
+	}{
+		{Name: "no limit", Timeout: 0, WantIndexed: 2},
+		{Name: "within", Timeout: time.Minute, WantIndexed: 2},
+		{Name: "stalled", Timeout: 50 * time.Millisecond, Stall: true, WantIndexed: 1},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			good := writeImage(t, dir, "good.png", synthImage(1, Width, Width))
+			slow := filepath.Join(dir, "slow.raw")
+			if err := os.WriteFile(slow, []byte("not really raw"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			// the fake decoder ignores ctx, as a spinning decoder would
+			release := make(chan struct{})
+			defer close(release)
+			fakeRawDecoder(t, func(ctx context.Context, fn string) (image.Image, error) {
+				if tc.Stall {
+					<-release
+					return nil, errors.New("released")
+				}
+				return synthImage(2, Width, Width), nil
+			})
+
+			opts := testOptions()
+			opts.DecodeTimeout = tc.Timeout
+			start := time.Now()
+			thumbnails, indexed, err := prepareThumbnails(context.Background(), opts, []string{good, slow}, new(Timings))
+			if elapsed := time.Since(start); elapsed > 10*time.Second {
+				t.Errorf("took %s", elapsed)
+			}
+			if indexed != tc.WantIndexed {
+				t.Errorf("indexed %d, wanted %d", indexed, tc.WantIndexed)
+			}
+			slowKey, _ := canonicalKey(slow)
+			if tc.Stall {
+				var sfe *SourcesFailedError
+				if !errors.As(err, &sfe) || sfe.N != 1 {
+					t.Errorf("got %v, wanted a SourcesFailedError of 1 source", err)
+				}
+				// a timeout may not happen next time: it is not recorded as a failure
+				if thumb, ok := thumbnails[slowKey]; ok {
+					t.Errorf("the stalled source has an entry: %+v", thumb)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if thumb := thumbnails[slowKey]; thumb.FFT == nil {
+				t.Error("the source has no features")
+			}
+			if thumb := thumbnails[good]; thumb.FFT == nil {
+				t.Error("the good source has no features")
+			}
+		})
+	}
+}
+
+func TestCancelKeepsIndexed(t *testing.T) {
+	for _, tc := range []struct {
+		Name  string
+		Jobs  int
+		Files int
+	}{
+		{Name: "one done", Jobs: 2, Files: 1},
+		{Name: "more done", Jobs: 4, Files: 3},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			// The first source is canceled after the others are decoded: as the results
+			// are collected in order, theirs are collected after the cancellation.
+			var decoded sync.WaitGroup
+			decoded.Add(tc.Files)
+			fakeRawDecoder(t, func(ctx context.Context, fn string) (image.Image, error) {
+				if filepath.Base(fn) == "interrupted.raw" {
+					decoded.Wait()
+					time.Sleep(50 * time.Millisecond)
+					cancel()
+					<-ctx.Done()
+					return nil, ctx.Err()
+				}
+				defer decoded.Done()
+				return synthImage(int64(len(fn)), Width, Width), nil
+			})
+			files := []string{filepath.Join(dir, "interrupted.raw")}
+			for i := 0; i < tc.Files; i++ {
+				files = append(files, filepath.Join(dir, fmt.Sprintf("done%d.raw", i)))
+			}
+			for _, fn := range files {
+				if err := os.WriteFile(fn, []byte(fn), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			opts := testOptions()
+			opts.Workers = tc.Jobs
+			opts.DB = filepath.Join(dir, "mosaic.db")
+			_, indexed, err := prepareThumbnails(ctx, opts, append([]string(nil), files...), new(Timings))
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("got %v, wanted context.Canceled", err)
+			}
+			var sfe *SourcesFailedError
+			if errors.As(err, &sfe) {
+				t.Errorf("the interrupted source is counted as failed: %v", err)
+			}
+			if indexed != tc.Files {
+				t.Errorf("indexed %d, wanted %d", indexed, tc.Files)
+			}
+			_, saved, err := loadDB(opts.DB)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, fn := range files[1:] {
+				key, _ := canonicalKey(fn)
+				if saved[key].FFT == nil {
+					t.Errorf("%s is not saved", key)
+				}
+			}
+		})
+	}
+}
+
+func TestCacheHit(t *testing.T) {
+	const content = "the content of the source"
+	for _, tc := range []struct {
+		Name string
+		// Change the file after recording it: its content (if not empty), and its mtime by the offset
+		Content string
+		MTime   time.Duration
+		Verify  bool
+		Trust   bool
+		Want    bool
+	}{
+		{Name: "unchanged", Trust: true, Want: true},
+		{Name: "unchanged verified", Trust: true, Verify: true, Want: true},
+		{Name: "same mtime different size", Content: content + " and more", Trust: true},
+		{Name: "same mtime same size different content", Content: "THE CONTENT OF THE SOURCE", Trust: true, Want: true},
+		{Name: "same mtime same size different content verified", Content: "THE CONTENT OF THE SOURCE", Trust: true, Verify: true},
+		{Name: "different mtime same content", MTime: time.Hour, Trust: true},
+		{Name: "different mtime same content by hash", MTime: time.Hour, Want: true},
+		{Name: "different mtime different content by hash", Content: "THE CONTENT OF THE SOURCE", MTime: time.Hour},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "a.png")
+			if err := os.WriteFile(fn, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			mtime := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+			if err := os.Chtimes(fn, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+			hash, err := contentHash(fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			old := Thumbnail{Name: "a.png", ModTime: mtime, Size: int64(len(content)), Hash: hash, Color: color.NRGBA{R: 1, A: 255}}
+
+			if tc.Content != "" {
+				if err := os.WriteFile(fn, []byte(tc.Content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.Chtimes(fn, mtime.Add(tc.MTime), mtime.Add(tc.MTime)); err != nil {
+				t.Fatal(err)
+			}
+			fi, err := os.Stat(fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts := Options{VerifyHash: tc.Verify, TrustMTime: tc.Trust}
+			entry := old
+			if got := opts.cacheHit(&entry, fn, fi); got != tc.Want {
+				t.Errorf("got %t, wanted %t", got, tc.Want)
+			}
+			if tc.Want && !entry.ModTime.Equal(fi.ModTime()) {
+				t.Errorf("the ModTime of the hit is %s, not refreshed to %s", entry.ModTime, fi.ModTime())
+			}
+		})
+	}
+}
+
+// cmykImage returns the CMYK conversion of img, as a print-origin JPEG decodes.
+func cmykImage(img *image.NRGBA) *image.CMYK {
+	b := img.Bounds()
+	cmyk := image.NewCMYK(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := img.NRGBAAt(x, y)
+			cc, m, yy, k := color.RGBToCMYK(c.R, c.G, c.B)
+			cmyk.SetCMYK(x, y, color.CMYK{C: cc, M: m, Y: yy, K: k})
+		}
+	}
+	return cmyk
+}
+
+func TestNormalizeCMYK(t *testing.T) {
+	for _, tc := range []struct {
+		Name string
+		Img  *image.NRGBA
+	}{
+		{Name: "white", Img: solidImage(Width, Width, color.NRGBA{R: 255, G: 255, B: 255, A: 255})},
+		{Name: "black", Img: solidImage(Width, Width, color.NRGBA{A: 255})},
+		{Name: "red", Img: solidImage(Width, Width, color.NRGBA{R: 200, G: 30, B: 10, A: 255})},
+		{Name: "synth", Img: synthImage(7, 2*Width, Width)},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			img := normalizeImage(cmykImage(tc.Img))
+			got, ok := img.(*image.NRGBA)
+			if !ok {
+				t.Fatalf("got %T, wanted *image.NRGBA", img)
+			}
+			if d := meanAbsDiff(got, tc.Img); d > 2 {
+				t.Errorf("mean difference %.2f from the RGB original", d)
+			}
+			if gc, wc := avgColor(got), avgColor(tc.Img); absDiff(gc.R, wc.R) > 2 || absDiff(gc.G, wc.G) > 2 || absDiff(gc.B, wc.B) > 2 || gc.A != 255 {
+				t.Errorf("average color %v, wanted %v", gc, wc)
+			}
+			// the signature is the RGB original's, not another source's
+			m := testMatcher(map[string]image.Image{"original.png": tc.Img, "other.png": synthImage(99, Width, Width)}, MatchOptions{Metric: MetricFFT, ColorWeight: 1, TopM: 1})
+			if got := m.Nearest(got); got != "original.png" {
+				t.Errorf("matched %q, wanted the RGB original", got)
+			}
+		})
+	}
+}
+
+// onBackground returns the shape drawn over the background, in the middle of a Width*Width image.
+func onBackground(shape image.Image, bg color.NRGBA) *image.NRGBA {
+	img := solidImage(Width, Width, bg)
+	return imaging.Overlay(img, shape, image.Pt((Width-shape.Bounds().Dx())/2, (Width-shape.Bounds().Dy())/2), 1)
+}
+
+func TestTransparentBackground(t *testing.T) {
+	gray := func(v uint8) color.NRGBA { return color.NRGBA{R: v, G: v, B: v, A: 255} }
+	for _, tc := range []struct {
+		Name  string
+		Shape image.Image
+	}{
+		{Name: "stripes", Shape: stripes(Width/2, Width/2, 8, gray(200), gray(60))},
+		{Name: "gray square", Shape: solidImage(Width/3, Width/2, gray(128))},
+		{Name: "synth", Shape: synthImage(3, Width/2, Width/3)},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			m := newMatcher(nil, nil, MatchOptions{Metric: MetricFFT})
+			spectrum := func(bg color.NRGBA) []float64 { return m.features(onBackground(tc.Shape, bg)).Spectrum }
+			transparent, black, white := spectrum(color.NRGBA{}), spectrum(gray(0)), spectrum(gray(255))
+			toBlack, toWhite := spectrumDistance(transparent, black), spectrumDistance(transparent, white)
+			// The transparent background is neither black nor white: it's not much nearer to either.
+			if toBlack < toWhite/2 || toWhite < toBlack/2 {
+				t.Errorf("distance to black %.4g, to white %.4g", toBlack, toWhite)
+			}
+		})
+	}
+}
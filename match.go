@@ -0,0 +1,591 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"math"
+	"math/cmplx"
+	"math/rand"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/disintegration/imaging"
+	"github.com/pkg/errors"
+)
+
+// Metric is the distance used for finding the source closest to a target cell.
+type Metric string
+
+const (
+	// MetricFFT compares the structure: the power spectra of the grayscale images.
+	MetricFFT = Metric("fft")
+	// MetricColor compares the average colors (CIE76 ΔE).
+	MetricColor = Metric("color")
+	// MetricFFTColor is the weighted sum of the normalized fft and color distances.
+	MetricFFTColor = Metric("fft+color")
+	// MetricPhase compares the full FFT coefficients, the phase too (the spatial arrangement),
+	// not just the power spectra. It is slower than MetricFFT.
+	MetricPhase = Metric("fft-phase")
+	// MetricPHash compares the perceptual hashes (Hamming distance).
+	MetricPHash = Metric("phash")
+	// MetricBlocks compares the average colors of 4x4 blocks (mean ΔE).
+	MetricBlocks = Metric("blocks")
+	// MetricHist compares the HSV histograms (chi-square): the mix of the colors,
+	// which the average color of a multicolored image does not tell.
+	MetricHist = Metric("hist")
+)
+
+func (m Metric) String() string { return string(m) }
+func (m *Metric) Set(s string) error {
+	if _, ok := metrics[Metric(s)]; ok {
+		*m = Metric(s)
+		return nil
+	}
+	return errors.Errorf("unknown metric %q (of %s; a -metric-plugin must come before)", s, strings.Join(metricNames(), ", "))
+}
+
+func (m Metric) usesFFT() bool   { return m == MetricFFT || m == MetricFFTColor }
+func (m Metric) usesColor() bool { return m == MetricColor || m == MetricFFTColor }
+func (m Metric) usesPhase() bool { return m == MetricPhase }
+
+// MatchOptions tune the matching of target cells to sources.
+type MatchOptions struct {
+	Metric Metric
+	// ColorWeight is multiplier of the color distance for MetricFFTColor.
+	ColorWeight float64
+	// BucketSize is the edge of the average color buckets, in ΔE:
+	// only the candidates in the buckets near the target cell's are compared.
+	// Zero means comparing all candidates.
+	BucketSize float64
+	// TopM is the number of best matches re-ranked by brightness:
+	// the one closest to the cell's is chosen.
+	TopM int
+	// MaxReuse is the number of times a source may be used; zero means no limit.
+	MaxReuse int
+	// Size of the grayscale thumbnail the spectra are compared on, for MetricFFT and MetricFFTColor;
+	// zero means Width, the others are stored as extra features.
+	Size int
+	// Prefilter of the grayscale thumbnails, for MetricFFT and MetricFFTColor;
+	// the spectra of each are stored as extra features, too.
+	Prefilter Prefilter
+	// Jitter is the distance from the best match, in the units of the Metric, within which
+	// a candidate is chosen randomly (by Seed) instead of the best, for variety. It overrides TopM.
+	Jitter float64
+	Seed   int64
+	// MonoSpread is the chroma spread of the sources' average colors, in ΔE, under which
+	// MetricColor falls back to MetricFFTColor, as the colors can't tell the sources apart
+	// (of a sepia or monochrome library); zero means never.
+	MonoSpread float64
+}
+
+// size returns the Size, or Width if it's zero.
+func (o MatchOptions) size() int {
+	if o.Size == 0 {
+		return Width
+	}
+	return o.Size
+}
+
+func (o MatchOptions) usesColor() bool {
+	return o.Metric.usesColor() || o.BucketSize > 0 || o.TopM > 1
+}
+
+// monoFallback returns the options with MetricFFTColor instead of MetricColor
+// if the sources' average colors spread less than MonoSpread, with a warning.
+func (o MatchOptions) monoFallback(thumbnails map[string]Thumbnail, files []string) MatchOptions {
+	if o.Metric != MetricColor || o.MonoSpread <= 0 {
+		return o
+	}
+	if spread, n := chromaSpread(thumbnails, files); n > 1 && spread < o.MonoSpread {
+		log.Printf("WARNING: the colors of the sources hardly differ (chroma spread %.2f < -mono-spread=%g ΔE): matching by %s instead of %s",
+			spread, o.MonoSpread, MetricFFTColor, o.Metric)
+		o.Metric = MetricFFTColor
+	}
+	return o
+}
+
+// chromaSpread returns the standard deviation of the a*b* chroma of the average colors
+// of the files' entries, and the number of entries.
+func chromaSpread(thumbnails map[string]Thumbnail, files []string) (float64, int) {
+	var n int
+	var sumA, sumB, sumA2, sumB2 float64
+	for _, fn := range files {
+		t, ok := resolveAlias(thumbnails, fn)
+		if !ok || t.Failed != "" {
+			continue
+		}
+		c := toLab(t.Color)
+		n++
+		sumA, sumB = sumA+c.A, sumB+c.B
+		sumA2, sumB2 = sumA2+c.A*c.A, sumB2+c.B*c.B
+	}
+	if n == 0 {
+		return 0, 0
+	}
+	k := float64(n)
+	v := sumA2/k - (sumA/k)*(sumA/k) + sumB2/k - (sumB/k)*(sumB/k)
+	return math.Sqrt(math.Max(v, 0)), n
+}
+
+// features of an image used for matching.
+type features struct {
+	Spectrum []float64    // log power spectrum, for MetricFFT
+	Lab      lab          // average color, for MetricColor
+	Coeffs   []complex128 // log magnitude coefficients with their phase, for MetricPhase
+	PHash    uint64       // perceptual hash, for MetricPHash
+	Blocks   []lab        // block colors, for MetricBlocks
+	Hist     []float64    // HSV histogram, for MetricHist
+	Custom   []byte       // feature of a RegisterMetric metric
+}
+
+type candidate struct {
+	Path string
+	// Aliases are the other sources with the same content: for MaxReuse, they are the same.
+	Aliases []string
+	features
+}
+
+type matcher struct {
+	opts       MatchOptions
+	candidates []candidate
+	buckets    map[bucketKey][]int
+	// uses of the candidates, for MaxReuse
+	uses []int
+	// excluded are the candidates left out of the pool: the target's own (see exclude)
+	excluded map[int]bool
+	// rng chooses among the near matches, for Jitter
+	rng *rand.Rand
+	// compared is the number of distances computed, for the throughput
+	compared atomic.Int64
+}
+
+// fork returns a matcher of the same candidates for a build in parallel,
+// with the MaxReuse, Jitter and Seed of opts.
+func (m *matcher) fork(opts MatchOptions) *matcher {
+	o := m.opts
+	o.MaxReuse, o.Jitter, o.Seed = opts.MaxReuse, opts.Jitter, opts.Seed
+	return &matcher{opts: o, candidates: m.candidates, buckets: m.buckets}
+}
+
+// exclude the candidate of the target file (of any of its aliases) from the pool,
+// instead of the one excluded before. It returns the number of the candidates left.
+func (m *matcher) exclude(target string) int {
+	m.excluded = nil
+	key, err := canonicalKey(target)
+	if err != nil {
+		return len(m.candidates)
+	}
+	for i, c := range m.candidates {
+		if c.Path == key || slices.Contains(c.Aliases, key) {
+			m.excluded = map[int]bool{i: true}
+			return len(m.candidates) - 1
+		}
+	}
+	return len(m.candidates)
+}
+
+// exhausted reports whether the candidate has been used MaxReuse times.
+func (m *matcher) exhausted(i int) bool {
+	return m.opts.MaxReuse > 0 && i < len(m.uses) && m.uses[i] >= m.opts.MaxReuse
+}
+
+// use counts a use of the source outside of the matching (a pinned one) for MaxReuse.
+func (m *matcher) use(path string) {
+	if m.opts.MaxReuse <= 0 {
+		return
+	}
+	for i, c := range m.candidates {
+		if c.Path == path {
+			if m.uses == nil {
+				m.uses = make([]int, len(m.candidates))
+			}
+			m.uses[i]++
+			return
+		}
+	}
+}
+
+// bucketKey is the position of a color bucket in the L*a*b* space.
+type bucketKey struct{ L, A, B int }
+
+func (m *matcher) bucketOf(c lab) bucketKey {
+	q := func(f float64) int { return int(math.Floor(f / m.opts.BucketSize)) }
+	return bucketKey{L: q(c.L), A: q(c.A), B: q(c.B)}
+}
+
+// pool returns the indexes of the candidates to compare with the needle:
+// those in the buckets around the needle's, on the lowest distance where there is any.
+// Without buckets, all candidates are returned. The exhausted and excluded candidates are never returned.
+func (m *matcher) pool(needle features) []int {
+	if m.buckets == nil {
+		idx := make([]int, 0, len(m.candidates))
+		for i := range m.candidates {
+			if !m.exhausted(i) && !m.excluded[i] {
+				idx = append(idx, i)
+			}
+		}
+		return idx
+	}
+	k := m.bucketOf(needle.Lab)
+	var idx []int
+	// Buckets of at most r steps away in each dimension; the L*a*b* gamut is ~260 wide.
+	maxR := int(260/m.opts.BucketSize) + 1
+	for r := 1; len(idx) == 0 && r <= maxR; r++ {
+		for l := k.L - r; l <= k.L+r; l++ {
+			for a := k.A - r; a <= k.A+r; a++ {
+				for b := k.B - r; b <= k.B+r; b++ {
+					for _, i := range m.buckets[bucketKey{L: l, A: a, B: b}] {
+						if !m.exhausted(i) && !m.excluded[i] {
+							idx = append(idx, i)
+						}
+					}
+				}
+			}
+		}
+	}
+	return idx
+}
+
+func newMatcher(thumbnails map[string]Thumbnail, files []string, opts MatchOptions) *matcher {
+	m := matcher{opts: opts, candidates: make([]candidate, 0, len(files))}
+	metric := metrics[opts.Metric]
+	// the candidates by the key of the entry with their features
+	byEntry := make(map[string]int, len(files))
+	for _, fn := range files {
+		t, ok := resolveAlias(thumbnails, fn)
+		if !ok || t.Failed != "" {
+			continue
+		}
+		key := fn
+		if alias := thumbnails[fn].AliasOf; alias != "" {
+			key = alias
+		}
+		if i, ok := byEntry[key]; ok {
+			m.candidates[i].Aliases = append(m.candidates[i].Aliases, fn)
+			continue
+		}
+		c := candidate{Path: fn}
+		if !metric.Entry(&c.features, t, opts) {
+			continue
+		}
+		if opts.usesColor() {
+			c.Lab = toLab(t.Color)
+		}
+		byEntry[key] = len(m.candidates)
+		m.candidates = append(m.candidates, c)
+	}
+	m.bucketize()
+	return &m
+}
+
+// bucketize fills the color buckets of the candidates, if BucketSize is set.
+func (m *matcher) bucketize() {
+	if m.opts.BucketSize <= 0 {
+		return
+	}
+	m.buckets = make(map[bucketKey][]int)
+	for i, c := range m.candidates {
+		k := m.bucketOf(c.Lab)
+		m.buckets[k] = append(m.buckets[k], i)
+	}
+}
+
+func (m *matcher) features(img image.Image) features {
+	var f features
+	metrics[m.opts.Metric].Image(&f, img, m.opts)
+	if m.opts.usesColor() {
+		f.Lab = toLab(avgColor(img))
+	}
+	return f
+}
+
+// Nearest returns the path of the source closest to img,
+// or "" if there is none (left, with MaxReuse).
+func (m *matcher) Nearest(img image.Image) string {
+	c, ok := m.choose(img, 0)
+	if !ok {
+		return ""
+	}
+	return m.candidates[c.Best.Index].Path
+}
+
+// choice is the candidate chosen for a cell, and why.
+type choice struct {
+	Best match
+	// Top are the closest candidates, closest first.
+	Top    []match
+	Reason string
+}
+
+// choose returns the candidate for img, with the top closest ones (at least),
+// and counts its use. It returns false if there is none (left, with MaxReuse).
+func (m *matcher) choose(img image.Image, top int) (choice, bool) {
+	if len(m.candidates) == 0 {
+		return choice{}, false
+	}
+	return m.pick(m.prepare(img, top))
+}
+
+// ranking is the closest candidates of a needle, to pick from.
+type ranking struct {
+	needle features
+	top    int
+	// ranked are the candidates to choose from, and Top the closest for the explanation,
+	// if done: the ranking can't be done ahead with MaxReuse, as it depends on the uses so far.
+	ranked, Top []match
+	done        bool
+}
+
+// prepare computes the features of img, and ranks the candidates for it if that does not
+// depend on the other cells. It only reads the matcher, so it may run concurrently, unlike pick.
+func (m *matcher) prepare(img image.Image, top int) ranking {
+	r := ranking{needle: m.features(img), top: top}
+	if m.opts.MaxReuse <= 0 {
+		m.rankNeedle(&r)
+	}
+	return r
+}
+
+// rankNeedle fills the ranked and Top candidates of the ranking.
+// Only the average color of the needle is kept, for TopM.
+func (m *matcher) rankNeedle(r *ranking) {
+	k := 1
+	if m.opts.TopM > 1 {
+		k = m.opts.TopM
+	}
+	if m.opts.Jitter > 0 {
+		r.ranked = m.near(r.needle, m.opts.Jitter)
+		if r.top > 0 {
+			r.Top = m.rank(r.needle, max(k, r.top))
+		}
+	} else {
+		// the first k of the closest are the same
+		r.Top = m.rank(r.needle, max(k, r.top))
+		r.ranked = r.Top[:min(k, len(r.Top))]
+		if r.top <= 0 {
+			r.Top = nil
+		}
+	}
+	r.needle, r.done = features{Lab: r.needle.Lab}, true
+}
+
+// pick the candidate of the ranking, and count its use.
+// It returns false if there is none (left, with MaxReuse).
+func (m *matcher) pick(r ranking) (choice, bool) {
+	if !r.done {
+		m.rankNeedle(&r)
+	}
+	ranked, needle := r.ranked, r.needle
+	if len(ranked) == 0 {
+		return choice{}, false
+	}
+	c := choice{Best: ranked[0], Top: r.Top, Reason: "closest"}
+	if m.opts.Jitter > 0 {
+		if m.rng == nil {
+			m.rng = rand.New(rand.NewSource(m.opts.Seed))
+		}
+		c.Best = ranked[m.rng.Intn(len(ranked))]
+		c.Reason = fmt.Sprintf("random among the %d within %g of the closest (-jitter)", len(ranked), m.opts.Jitter)
+	} else if m.opts.TopM > 1 {
+		// Re-rank by brightness: prefer the closest in L*, the first on ties.
+		dL := math.Inf(1)
+		for _, r := range ranked {
+			if d := math.Abs(m.candidates[r.Index].Lab.L - needle.Lab.L); d < dL {
+				c.Best, dL = r, d
+			}
+		}
+		c.Reason = fmt.Sprintf("closest brightness (ΔL*=%.1f) among the %d closest (-topm)", dL, len(ranked))
+	}
+	if m.opts.MaxReuse > 0 {
+		if m.uses == nil {
+			m.uses = make([]int, len(m.candidates))
+		}
+		var exhausted int
+		for i := range m.candidates {
+			if m.exhausted(i) {
+				exhausted++
+			}
+		}
+		if exhausted != 0 {
+			c.Reason += fmt.Sprintf(", %d sources used up (-max-reuse=%d)", exhausted, m.opts.MaxReuse)
+		}
+		m.uses[c.Best.Index]++
+	}
+	return c, true
+}
+
+// match is a scored candidate.
+type match struct {
+	Index int // of the candidate
+	Dist  float64
+}
+
+// rank returns the k candidates closest to the needle, closest first.
+func (m *matcher) rank(needle features, k int) []match {
+	pool, dists := m.distances(needle)
+
+	// Keep the k best in order, by insertion.
+	best := make([]match, 0, k+1)
+	for i, d := range dists {
+		if len(best) == k && d >= best[k-1].Dist {
+			continue
+		}
+		j := len(best)
+		for j > 0 && best[j-1].Dist > d {
+			j--
+		}
+		best = append(best, match{})
+		copy(best[j+1:], best[j:])
+		best[j] = match{Index: pool[i], Dist: d}
+		if len(best) > k {
+			best = best[:k]
+		}
+	}
+	return best
+}
+
+// near returns the candidates within d of the closest to the needle, in pool order.
+func (m *matcher) near(needle features, d float64) []match {
+	pool, dists := m.distances(needle)
+	if len(pool) == 0 {
+		return nil
+	}
+	min := math.Inf(1)
+	for _, dist := range dists {
+		min = math.Min(min, dist)
+	}
+	var near []match
+	for i, dist := range dists {
+		if dist <= min+d {
+			near = append(near, match{Index: pool[i], Dist: dist})
+		}
+	}
+	return near
+}
+
+// distances returns the candidates of the pool of the needle, and their distances from it.
+func (m *matcher) distances(needle features) ([]int, []float64) {
+	pool := m.pool(needle)
+	m.compared.Add(int64(len(pool)))
+	dists := make([]float64, len(pool))
+	metrics[m.opts.Metric].Distances(dists, needle, m.candidates, pool, m.opts)
+	return pool, dists
+}
+
+func logPower(fft *[Width * Width]complex128) []float64 {
+	s := make([]float64, len(fft))
+	for i, c := range fft {
+		s[i] = math.Log1p(R(c))
+	}
+	return s
+}
+
+// logCoeffs returns the coefficients with their magnitude compressed like logPower's,
+// keeping their phase.
+func logCoeffs(fft *[Width * Width]complex128) []complex128 {
+	s := make([]complex128, len(fft))
+	for i, c := range fft {
+		if abs := cmplx.Abs(c); abs != 0 {
+			s[i] = c * complex(math.Log1p(abs*abs)/abs, 0)
+		}
+	}
+	return s
+}
+
+// coeffDistance is the Euclidean distance of the complex coefficients:
+// images with the same power spectrum but different spatial arrangement differ in their phases.
+func coeffDistance(a, b []complex128) float64 {
+	var sum float64
+	for i, va := range a {
+		sum += R(va - b[i])
+	}
+	return math.Sqrt(sum)
+}
+
+// spectrumDistance is the Euclidean distance of the spectra.
+//
+// This is the hot loop of matching: it is unrolled into four independent sums,
+// which the CPU can pipeline, and the bounds checks are hoisted out of it.
+// spectrumDistanceRef is the plain version, for checking it.
+func spectrumDistance(a, b []float64) float64 {
+	b = b[:len(a)]
+	var s0, s1, s2, s3 float64
+	i := 0
+	for ; i+4 <= len(a); i += 4 {
+		aa, bb := a[i:i+4:i+4], b[i:i+4:i+4]
+		d0, d1, d2, d3 := aa[0]-bb[0], aa[1]-bb[1], aa[2]-bb[2], aa[3]-bb[3]
+		s0 += d0 * d0
+		s1 += d1 * d1
+		s2 += d2 * d2
+		s3 += d3 * d3
+	}
+	for ; i < len(a); i++ {
+		d := a[i] - b[i]
+		s0 += d * d
+	}
+	return math.Sqrt((s0 + s1) + (s2 + s3))
+}
+
+// spectrumDistanceRef is the reference implementation of spectrumDistance.
+// The results differ only by the rounding of the summation order.
+func spectrumDistanceRef(a, b []float64) float64 {
+	var sum float64
+	for i, va := range a {
+		d := va - b[i]
+		sum += d * d
+	}
+	return math.Sqrt(sum)
+}
+
+func avgColor(img image.Image) color.NRGBA {
+	return imaging.Resize(img, 1, 1, imaging.Box).NRGBAAt(0, 0)
+}
+
+// lab is a color in the CIE L*a*b* space.
+type lab struct{ L, A, B float64 }
+
+// toLab converts the sRGB color to CIE L*a*b* (D65).
+func toLab(c color.NRGBA) lab {
+	lin := func(v uint8) float64 {
+		f := float64(v) / 255
+		if f <= 0.04045 {
+			return f / 12.92
+		}
+		return math.Pow((f+0.055)/1.055, 2.4)
+	}
+	r, g, b := lin(c.R), lin(c.G), lin(c.B)
+	x := (0.4124*r + 0.3576*g + 0.1805*b) / 0.95047
+	y := 0.2126*r + 0.7152*g + 0.0722*b
+	z := (0.0193*r + 0.1192*g + 0.9505*b) / 1.08883
+	f := func(t float64) float64 {
+		if t > 216.0/24389 {
+			return math.Cbrt(t)
+		}
+		return (24389.0/27*t + 16) / 116
+	}
+	fx, fy, fz := f(x), f(y), f(z)
+	return lab{L: 116*fy - 16, A: 500 * (fx - fy), B: 200 * (fy - fz)}
+}
+
+// deltaE is the CIE76 color difference.
+func deltaE(a, b lab) float64 {
+	return math.Sqrt((a.L-b.L)*(a.L-b.L) + (a.A-b.A)*(a.A-b.A) + (a.B-b.B)*(a.B-b.B))
+}
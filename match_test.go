@@ -0,0 +1,320 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// testEntry returns the DB entry of the image, as indexFile computes it.
+func testEntry(img image.Image) Thumbnail {
+	return Thumbnail{Name: "test.png", FFT: imgFFT(img), Color: avgColor(img), Params: currentParams(FitStretch)}
+}
+
+// testMatcher returns the matcher of the images, as sources named by their keys.
+func testMatcher(sources map[string]image.Image, opts MatchOptions) *matcher {
+	thumbnails, files := testEntries(sources, opts)
+	return newMatcher(thumbnails, files, opts)
+}
+
+// testEntries returns the DB entries of the images, with the extra feature of opts, and their keys in order.
+func testEntries(sources map[string]image.Image, opts MatchOptions) (map[string]Thumbnail, []string) {
+	thumbnails := make(map[string]Thumbnail, len(sources))
+	files := make([]string, 0, len(sources))
+	for k, img := range sources {
+		t := testEntry(img)
+		if name := opts.extraFeature(); name != "" {
+			t.Features = computeFeatures(img, []string{name})
+		}
+		thumbnails[k] = t
+		files = append(files, k)
+	}
+	sort.Strings(files)
+	return thumbnails, files
+}
+
+// stripes returns a width*height image of vertical stripes of fg and bg,
+// each period/2 wide.
+func stripes(width, height, period int, fg, bg color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := bg
+			if x%period < period/2 {
+				c = fg
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestColorWeight(t *testing.T) {
+	black := color.NRGBA{A: 255}
+	// the same gray stripes as the target (0.299*200 = 0.587*102), but green
+	target := stripes(Width, Width, 16, color.NRGBA{R: 200, A: 255}, black)
+	sources := map[string]image.Image{
+		"structure.png": stripes(Width, Width, 16, color.NRGBA{G: 102, A: 255}, black),
+		"color.png":     solidImage(Width, Width, avgColor(target)),
+	}
+	for _, tc := range []struct {
+		Weight float64
+		Want   string
+	}{
+		{Weight: 0, Want: "structure.png"},
+		{Weight: 0.5, Want: "structure.png"},
+		{Weight: 2, Want: "color.png"},
+		{Weight: 10, Want: "color.png"},
+	} {
+		m := testMatcher(sources, MatchOptions{Metric: MetricFFTColor, ColorWeight: tc.Weight})
+		if got := m.Nearest(target); got != tc.Want {
+			t.Errorf("-color-weight=%g: got %q, wanted %q", tc.Weight, got, tc.Want)
+		}
+	}
+}
+
+func TestColorBuckets(t *testing.T) {
+	sources := make(map[string]image.Image, 200)
+	for i := 0; i < 200; i++ {
+		sources[synthKey(i)] = synthImage(int64(i), Width/4, Width/4)
+	}
+	thumbnails, files := testEntries(sources, MatchOptions{})
+	cells := make([]image.Image, 100)
+	for i := range cells {
+		cells[i] = synthImage(int64(1000+i), Width/4, Width/4)
+	}
+	for _, tc := range []struct {
+		Metric     Metric
+		BucketSize float64
+		// MinAgree is the percentage of the Cells matched the same as by brute force
+		MinAgree, Cells int
+	}{
+		{Metric: MetricColor, BucketSize: 5, MinAgree: 85, Cells: 100},
+		{Metric: MetricColor, BucketSize: 10, MinAgree: 95, Cells: 100},
+		{Metric: MetricColor, BucketSize: 20, MinAgree: 95, Cells: 100},
+		// one bucket of all
+		{Metric: MetricColor, BucketSize: 300, MinAgree: 100, Cells: 100},
+		{Metric: MetricFFT, BucketSize: 300, MinAgree: 100, Cells: 10},
+		{Metric: MetricFFTColor, BucketSize: 300, MinAgree: 100, Cells: 10},
+	} {
+		t.Run(fmt.Sprintf("%s %g", tc.Metric, tc.BucketSize), func(t *testing.T) {
+			opts := MatchOptions{Metric: tc.Metric, ColorWeight: 1}
+			brute := newMatcher(thumbnails, files, opts)
+			opts.BucketSize = tc.BucketSize
+			bucketed := newMatcher(thumbnails, files, opts)
+			var agree int
+			for _, cell := range cells[:tc.Cells] {
+				if bucketed.Nearest(cell) == brute.Nearest(cell) {
+					agree++
+				}
+			}
+			if pct := 100 * agree / tc.Cells; pct < tc.MinAgree {
+				t.Errorf("%d%% agree with brute force, wanted at least %d%%", pct, tc.MinAgree)
+			}
+			if b, all := bucketed.compared.Load(), brute.compared.Load(); b > all {
+				t.Errorf("compared %d with the buckets, more than the %d of brute force", b, all)
+			} else if tc.BucketSize < 100 && b >= all {
+				t.Errorf("compared all the %d with the buckets", all)
+			}
+		})
+	}
+}
+
+func TestTopMBrightness(t *testing.T) {
+	gray := func(v uint8) color.NRGBA { return color.NRGBA{R: v, G: v, B: v, A: 255} }
+	// structurally equal: the same spectrum, of different average brightness
+	fft := imgFFT(stripes(Width, Width, 16, gray(160), gray(100)))
+	thumbnails := map[string]Thumbnail{
+		"bright.png": {FFT: fft, Color: gray(210)},
+		"dark.png":   {FFT: fft, Color: gray(20)},
+		"mid.png":    {FFT: fft, Color: gray(110)},
+	}
+	files := []string{"bright.png", "dark.png", "mid.png"}
+	for _, tc := range []struct {
+		Target uint8
+		TopM   int
+		Want   string
+	}{
+		{Target: 10, TopM: 3, Want: "dark.png"},
+		{Target: 40, TopM: 3, Want: "dark.png"},
+		{Target: 100, TopM: 3, Want: "mid.png"},
+		{Target: 200, TopM: 3, Want: "bright.png"},
+		// among the 2 closest only: the first of the ties
+		{Target: 120, TopM: 2, Want: "bright.png"},
+		// the first of the ties, without -topm
+		{Target: 10, TopM: 1, Want: "bright.png"},
+	} {
+		m := newMatcher(thumbnails, files, MatchOptions{Metric: MetricFFT, TopM: tc.TopM})
+		target := solidImage(Width, Width, gray(tc.Target))
+		if got := m.Nearest(target); got != tc.Want {
+			t.Errorf("%d of -topm=%d: got %q, wanted %q", tc.Target, tc.TopM, got, tc.Want)
+		}
+	}
+}
+
+// shifted returns the image circularly shifted right by dx: of the same magnitude spectrum.
+func shifted(img *image.NRGBA, dx int) *image.NRGBA {
+	b := img.Bounds()
+	out := image.NewNRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			out.SetNRGBA(b.Min.X+(x-b.Min.X+dx)%b.Dx(), y, img.NRGBAAt(x, y))
+		}
+	}
+	return out
+}
+
+func TestPhaseMetric(t *testing.T) {
+	img := synthImage(5, Width, Width)
+	sources := map[string]image.Image{"original.png": img, "shifted.png": shifted(img, Width/3)}
+	fa, fb := imgFFT(sources["original.png"]), imgFFT(sources["shifted.png"])
+	if d := spectrumDistance(logPower(fa), logPower(fb)); d > 1e-6 {
+		t.Fatalf("the magnitudes differ by %g", d)
+	}
+	if d := coeffDistance(logCoeffs(fa), logCoeffs(fb)); d < 1 {
+		t.Errorf("the phases differ only by %g", d)
+	}
+	m := testMatcher(sources, MatchOptions{Metric: MetricPhase, TopM: 1})
+	for name, target := range sources {
+		if got := m.Nearest(target); got != name {
+			t.Errorf("%s matched %s", name, got)
+		}
+	}
+}
+
+func TestSpectrumDistance(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := func(n int) []float64 {
+		v := make([]float64, n)
+		for i := range v {
+			v[i] = rng.NormFloat64() * 10
+		}
+		return v
+	}
+	spectrum := logPower(imgFFT(synthImage(1, Width, Width)))
+	for _, tc := range []struct {
+		Name string
+		A, B []float64
+	}{
+		{Name: "empty", A: []float64{}, B: []float64{}},
+		{Name: "1", A: random(1), B: random(1)},
+		{Name: "3", A: random(3), B: random(3)},
+		{Name: "4", A: random(4), B: random(4)},
+		{Name: "7", A: random(7), B: random(7)},
+		{Name: "longer b", A: random(9), B: random(12)},
+		{Name: "same", A: spectrum, B: spectrum},
+		{Name: "spectra", A: spectrum, B: logPower(imgFFT(synthImage(2, Width, Width)))},
+		{Name: "random spectrum", A: random(len(spectrum)), B: random(len(spectrum))},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			got, want := spectrumDistance(tc.A, tc.B), spectrumDistanceRef(tc.A, tc.B)
+			if math.Abs(got-want) > 1e-12*math.Max(1, want) {
+				t.Errorf("got %g, wanted %g", got, want)
+			}
+		})
+	}
+}
+
+func BenchmarkSpectrumDistance(b *testing.B) {
+	specA := logPower(imgFFT(synthImage(1, Width, Width)))
+	specB := logPower(imgFFT(synthImage(2, Width, Width)))
+	for _, bm := range []struct {
+		Name     string
+		Distance func(a, b []float64) float64
+	}{
+		{Name: "unrolled", Distance: spectrumDistance},
+		{Name: "reference", Distance: spectrumDistanceRef},
+	} {
+		b.Run(bm.Name, func(b *testing.B) {
+			b.ReportAllocs()
+			var d float64
+			for i := 0; i < b.N; i++ {
+				d += bm.Distance(specA, specB)
+			}
+			if d < 0 {
+				b.Fatal(d)
+			}
+		})
+	}
+}
+
+func TestMonoFallback(t *testing.T) {
+	gray := func(v uint8) color.NRGBA { return color.NRGBA{R: v, G: v, B: v, A: 255} }
+	grays := map[string]image.Image{
+		"dark.png":    solidImage(Width, Width, gray(40)),
+		"mid.png":     solidImage(Width, Width, gray(120)),
+		"light.png":   solidImage(Width, Width, gray(200)),
+		"stripes.png": stripes(Width, Width, 8, gray(60), gray(180)),
+	}
+	colors := map[string]image.Image{
+		"red.png":   solidImage(Width, Width, color.NRGBA{R: 250, G: 10, B: 10, A: 255}),
+		"green.png": solidImage(Width, Width, color.NRGBA{R: 10, G: 250, B: 10, A: 255}),
+		"blue.png":  solidImage(Width, Width, color.NRGBA{R: 10, G: 10, B: 250, A: 255}),
+	}
+	for _, tc := range []struct {
+		Name       string
+		Sources    map[string]image.Image
+		Metric     Metric
+		MonoSpread float64
+		Want       Metric
+	}{
+		{Name: "grayscale", Sources: grays, Metric: MetricColor, MonoSpread: 2, Want: MetricFFTColor},
+		{Name: "colored", Sources: colors, Metric: MetricColor, MonoSpread: 2, Want: MetricColor},
+		{Name: "grayscale, never", Sources: grays, Metric: MetricColor, Want: MetricColor},
+		{Name: "grayscale by fft", Sources: grays, Metric: MetricFFT, MonoSpread: 2, Want: MetricFFT},
+		{Name: "one source", Sources: map[string]image.Image{"mid.png": grays["mid.png"]}, Metric: MetricColor, MonoSpread: 2, Want: MetricColor},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			opts := MatchOptions{Metric: tc.Metric, MonoSpread: tc.MonoSpread, TopM: 1}
+			thumbnails, files := testEntries(tc.Sources, opts)
+			if got := opts.monoFallback(thumbnails, files).Metric; got != tc.Want {
+				t.Errorf("got %s, wanted %s", got, tc.Want)
+			}
+		})
+	}
+}
+
+func TestHistMetric(t *testing.T) {
+	red, blue := color.NRGBA{R: 255, A: 255}, color.NRGBA{B: 255, A: 255}
+	// half red, half blue, the halves on top of each other
+	target := solidImage(Width, Width, red)
+	for i := len(target.Pix) / 2; i < len(target.Pix); i += 4 {
+		target.Pix[i], target.Pix[i+2] = 0, 255
+	}
+	sources := map[string]image.Image{
+		// the same two colors, in another layout
+		"bimodal.png": stripes(Width, Width, 32, red, blue),
+		// the average color of the target
+		"purple.png": solidImage(Width, Width, avgColor(target)),
+	}
+	// the average color can't tell them apart
+	if a, b := avgColor(sources["bimodal.png"]), avgColor(sources["purple.png"]); a != b {
+		t.Fatalf("the averages differ: %v and %v", a, b)
+	}
+	m := testMatcher(sources, MatchOptions{Metric: MetricHist, TopM: 1})
+	if got := m.Nearest(target); got != "bimodal.png" {
+		t.Errorf("got %s, wanted bimodal.png", got)
+	}
+	if d := histDistance(histWeights(hsvHistogram(target)), histWeights(hsvHistogram(sources["bimodal.png"]))); d > 0.01 {
+		t.Errorf("the bimodal histograms differ by %g", d)
+	}
+}
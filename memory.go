@@ -0,0 +1,300 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ByteSize is an amount of memory, settable with a K, M, G or T (1024-based) suffix.
+type ByteSize int64
+
+func (b ByteSize) String() string {
+	for _, u := range []string{"T", "G", "M", "K"} {
+		if unit := byteUnits[u]; b >= unit && b%unit == 0 {
+			return strconv.FormatInt(int64(b/unit), 10) + u
+		}
+	}
+	return strconv.FormatInt(int64(b), 10)
+}
+
+var byteUnits = map[string]ByteSize{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+
+func (b *ByteSize) Set(s string) error {
+	t := strings.TrimSuffix(strings.ToUpper(s), "B")
+	unit := ByteSize(1)
+	if n := len(t); n != 0 {
+		if u, ok := byteUnits[t[n-1:]]; ok {
+			t, unit = t[:n-1], u
+		}
+	}
+	n, err := strconv.ParseFloat(t, 64)
+	if err != nil || n < 0 {
+		return errors.Errorf("%q: size must be a number with an optional K, M, G or T suffix", s)
+	}
+	*b = ByteSize(n * float64(unit))
+	return nil
+}
+
+// canvasBytes is the memory needed by the mosaic image of the plan.
+func (p Plan) canvasBytes() int64 {
+	return int64(p.Cols) * int64(p.TileSize) * int64(p.Rows) * int64(p.TileSize) * 4
+}
+
+// checkMemory refuses the plan if its image would need more than max bytes.
+// Zero max means no limit.
+func checkMemory(p Plan, max ByteSize) error {
+	if need := p.canvasBytes(); max > 0 && need > int64(max) {
+		return errors.Errorf("a %dx%d mosaic of %dpx tiles would need %s of memory, more than -max-mem=%s",
+			p.Cols, p.Rows, p.TileSize, ByteSize(need).human(), max)
+	}
+	return nil
+}
+
+// memoryBudget is the split of -max-memory between the uses of memory.
+type memoryBudget struct {
+	// DB is the estimated memory of the DB entries, with the matcher's candidates.
+	DB int64
+	// Decode sizes the decodeMemory, Cache the composeCache.
+	Decode, Cache int64
+	// Canvas is the memory left for the mosaic image; a larger one is backed by a file.
+	Canvas int64
+}
+
+// splitMemory splits max, after the DB entries of the sources matched with o, between the parallel
+// decoding (half of it), the compose cache (a quarter) and the canvas (the rest). The decode and cache
+// are not changed from decode and cache if they are given (not -1). It refuses a max not enough for the DB entries.
+func splitMemory(max int64, sources int, o MatchOptions, decode, cache int64) (memoryBudget, error) {
+	perEntry := o.entryBytes()
+	b := memoryBudget{DB: int64(sources) * perEntry}
+	if b.DB >= max {
+		var use string
+		if hint := o.entryHint(); hint != "" {
+			use = "use " + hint + ", "
+		}
+		return b, errors.Errorf("-max-memory=%s: the DB entries of the %d sources would need about %s (%s each, mostly their %dx%d FFT coefficients, loaded at full precision whatever the -db-precision): raise -max-memory, %sor mosaic from fewer sources",
+			ByteSize(max), sources, ByteSize(b.DB).human(), ByteSize(perEntry).human(), Width, Width, use)
+	}
+	rest := max - b.DB
+	b.Decode, b.Cache = rest/2, rest/4
+	if decode >= 0 {
+		b.Decode = decode
+	}
+	if cache >= 0 {
+		b.Cache = cache
+	}
+	b.Canvas = rest - b.Decode - b.Cache
+	if b.Canvas < 0 {
+		b.Canvas = 0
+	}
+	return b, nil
+}
+
+// entryBytes estimates the memory of a DB entry loaded for matching with the options,
+// with its candidate in the matcher.
+func (o MatchOptions) entryBytes() int64 {
+	n := int64(16 * Width * Width) // Thumbnail.FFT
+	switch {
+	case o.Metric.usesFFT() && o.extraFeature() != "":
+		p := int64(fftSize(o.size()))
+		n += 4*p*p + 8*p*p // the payload and its spectrum
+	case o.Metric.usesFFT():
+		n += 8 * Width * Width
+	case o.Metric.usesPhase():
+		n += 16 * Width * Width
+	}
+	// the name, the stored pixels and the rest, roughly
+	return n + 8<<10
+}
+
+// entryHint returns the options making the DB entries of o smaller, if there are any.
+func (o MatchOptions) entryHint() string {
+	switch {
+	case o.Metric.usesFFT() && o.extraFeature() != "":
+		return fmt.Sprintf("-size %d without -prefilter, which keeps no spectrum besides the coefficients", Width)
+	case o.Metric.usesPhase():
+		return fmt.Sprintf("-metric %s, which keeps no phase spectrum", MetricFFT)
+	}
+	return ""
+}
+
+// diskCanvases are the canvases backed by a file (see newCanvas), with the functions releasing them.
+var diskCanvases sync.Map
+
+// newCanvas returns a mosaic image of the rectangle: in memory, or backed by a temporary file
+// if it needs more than inMemory (unless that's zero), to be freed by releaseCanvas.
+func newCanvas(r image.Rectangle, inMemory ByteSize) *image.NRGBA {
+	if need := int64(r.Dx()) * int64(r.Dy()) * 4; inMemory > 0 && need > int64(inMemory) {
+		img, release, err := newDiskCanvas(r)
+		if err == nil {
+			diskCanvases.Store(img, release)
+			log.Printf("the mosaic needs %s, more than the %s of -max-memory left for it: keeping it in a temporary file", ByteSize(need).human(), inMemory.human())
+			return img
+		}
+		log.Printf("WARNING: %v - keeping the mosaic in memory", err)
+	}
+	return image.NewNRGBA(r)
+}
+
+// releaseCanvas frees the canvas of newCanvas, if it's backed by a file; it must not be used after.
+func releaseCanvas(img *image.NRGBA) {
+	if release, ok := diskCanvases.LoadAndDelete(img); ok {
+		release.(func())()
+	}
+}
+
+// human returns the size rounded, in the largest unit.
+func (b ByteSize) human() string {
+	for _, u := range []string{"T", "G", "M", "K"} {
+		if unit := byteUnits[u]; b >= unit {
+			return strconv.FormatFloat(float64(b)/float64(unit), 'f', 1, 64) + u + "B"
+		}
+	}
+	return strconv.FormatInt(int64(b), 10) + "B"
+}
+
+// decodeMemory limits the memory of the images decoded concurrently, by their estimated size.
+var decodeMemory = newMemSemaphore(4 << 30)
+
+// memSemaphore is a weighted semaphore of bytes, granting them in the order of the requests.
+type memSemaphore struct {
+	mu         sync.Mutex
+	size, used int64
+	waiters    []memWaiter
+}
+
+type memWaiter struct {
+	n     int64
+	ready chan struct{}
+}
+
+// newMemSemaphore returns a semaphore of size bytes; zero means no limit.
+func newMemSemaphore(size int64) *memSemaphore { return &memSemaphore{size: size} }
+
+// Acquire the estimated memory of decoding the image file, waiting until it's available,
+// and return the function releasing it. The images needing more than the whole size
+// are decoded alone; those without a size in their header (RAW, URLs) are not limited.
+func (s *memSemaphore) Acquire(ctx context.Context, fn string) (func(), error) {
+	var n int64
+	if s.size > 0 && !isURL(fn) && !isRaw(fn) {
+		n = decodedBytes(fn)
+	}
+	if n <= 0 {
+		return func() {}, nil
+	}
+	if n > s.size {
+		log.Printf("%s: decoding needs %s, more than -decode-memory=%s: waiting to decode it alone", fn, ByteSize(n).human(), ByteSize(s.size))
+	}
+	return s.acquire(ctx, n)
+}
+
+// acquire n bytes (at most the whole size), waiting until they are available,
+// and return the function releasing them.
+func (s *memSemaphore) acquire(ctx context.Context, n int64) (func(), error) {
+	if s.size <= 0 || n <= 0 {
+		return func() {}, nil
+	}
+	n = min(n, s.size)
+	release := func() { s.release(n) }
+	s.mu.Lock()
+	if len(s.waiters) == 0 && s.used+n <= s.size {
+		s.used += n
+		s.mu.Unlock()
+		return release, nil
+	}
+	w := memWaiter{n: n, ready: make(chan struct{})}
+	s.waiters = append(s.waiters, w)
+	s.mu.Unlock()
+	select {
+	case <-w.ready:
+		return release, nil
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-w.ready:
+		// granted meanwhile
+		s.used -= n
+		s.notify()
+	default:
+		for i, x := range s.waiters {
+			if x.ready == w.ready {
+				s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+				break
+			}
+		}
+		// the ones after it may fit now
+		s.notify()
+	}
+	return nil, ctx.Err()
+}
+
+func (s *memSemaphore) release(n int64) {
+	s.mu.Lock()
+	s.used -= n
+	s.notify()
+	s.mu.Unlock()
+}
+
+// notify the waiters in order, while they fit.
+func (s *memSemaphore) notify() {
+	for len(s.waiters) != 0 && s.used+s.waiters[0].n <= s.size {
+		w := s.waiters[0]
+		s.waiters = s.waiters[1:]
+		s.used += w.n
+		close(w.ready)
+	}
+}
+
+// decodedBytes estimates the memory of the decoded image file from its header,
+// or returns zero if it can't be read.
+func decodedBytes(fn string) int64 {
+	fh, err := os.Open(fn)
+	if err != nil {
+		return 0
+	}
+	defer fh.Close()
+	cfg, _, err := image.DecodeConfig(bufio.NewReader(fh))
+	if err != nil {
+		return 0
+	}
+	return configBytes(cfg)
+}
+
+// configBytes estimates the memory of the decoded image of the header.
+func configBytes(cfg image.Config) int64 {
+	perPixel := int64(4)
+	switch cfg.ColorModel {
+	case color.RGBA64Model, color.NRGBA64Model, color.Gray16Model:
+		perPixel = 8
+	case color.CMYKModel:
+		// and its NRGBA conversion
+		perPixel = 8
+	}
+	return int64(cfg.Width) * int64(cfg.Height) * perPixel
+}
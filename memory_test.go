@@ -0,0 +1,96 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckMemory(t *testing.T) {
+	for _, tc := range []struct {
+		Name    string
+		Plan    Plan
+		Max     ByteSize
+		WantErr bool
+	}{
+		{Name: "fits", Plan: Plan{Cols: 10, Rows: 10, TileSize: 256}, Max: 4 << 30},
+		{Name: "exactly", Plan: Plan{Cols: 1, Rows: 1, TileSize: 512}, Max: 1 << 20},
+		{Name: "over", Plan: Plan{Cols: 1, Rows: 1, TileSize: 513}, Max: 1 << 20, WantErr: true},
+		{Name: "terabyte", Plan: Plan{Cols: 500, Rows: 500, TileSize: 256}, Max: 4 << 30, WantErr: true},
+		{Name: "unlimited", Plan: Plan{Cols: 500, Rows: 500, TileSize: 256}},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			if err := checkMemory(tc.Plan, tc.Max); (err != nil) != tc.WantErr {
+				t.Errorf("got %v, wanted error %t", err, tc.WantErr)
+			}
+		})
+	}
+}
+
+func TestSplitMemory(t *testing.T) {
+	for _, tc := range []struct {
+		Name    string
+		Metric  Metric
+		Size    int
+		Sources int
+		// Hint is in the refusal, "" for no refusal.
+		Hint string
+	}{
+		{Name: "fits", Metric: MetricFFT, Size: Width, Sources: 100},
+		{Name: "fft", Metric: MetricFFT, Size: Width, Sources: 10000, Hint: "raise -max-memory, or mosaic"},
+		{Name: "size", Metric: MetricFFT, Size: 64, Sources: 10000, Hint: fmt.Sprintf("use -size %d", Width)},
+		{Name: "phase", Metric: MetricPhase, Size: Width, Sources: 10000, Hint: "use -metric fft"},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			o := testOptions().Match
+			o.Metric, o.Size = tc.Metric, tc.Size
+			b, err := splitMemory(64<<20, tc.Sources, o, -1, -1)
+			if tc.Hint == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if b.DB+b.Decode+b.Cache+b.Canvas != 64<<20 {
+					t.Errorf("%+v: does not add up to the maximum", b)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.Hint) {
+				t.Errorf("got %v, wanted the refusal with %q", err, tc.Hint)
+			}
+		})
+	}
+}
+
+func TestOversizedGrid(t *testing.T) {
+	opts := testOptions()
+	opts.Grid = Grid{Cols: 500, Rows: 500}
+	opts.RenderSize = 256
+	// The files don't exist: indexing them would fail differently.
+	dir := t.TempDir()
+	files := []string{filepath.Join(dir, "target.png"), filepath.Join(dir, "source.png")}
+	_, _, err := buildPlan(context.Background(), opts, files, new(Timings))
+	if err == nil || !strings.Contains(err.Error(), "-max-mem") {
+		t.Fatalf("got %v, wanted the -max-mem refusal", err)
+	}
+	// with the estimate
+	if !strings.Contains(err.Error(), "61.0GB") {
+		t.Errorf("%v: no estimate", err)
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"image"
+	"math"
+	"plugin"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// CustomMetric is a distance between the sources and the target cells, registered by name
+// with RegisterMetric, to be selected with -metric.
+//
+// Feature is computed on the source fitted into the tile when indexing (it is stored in the DB
+// under the metric's name, like the builtin phash), and on the target cell when matching.
+type CustomMetric interface {
+	// Feature returns the feature of the image, compared by Distance.
+	Feature(img image.Image) []byte
+	// Distance returns the distance of the features, lower being closer; it must be non-negative.
+	Distance(a, b []byte) float64
+}
+
+// RegisterMetric registers the custom metric by name, from an init (of a file included
+// by a build tag), or of a -metric-plugin. It panics if the name is taken.
+func RegisterMetric(name string, m CustomMetric) {
+	if err := registerMetric(name, m); err != nil {
+		panic(err)
+	}
+}
+
+// registerMetric registers the custom metric, refusing a taken name.
+func registerMetric(name string, m CustomMetric) error {
+	if _, ok := metrics[Metric(name)]; ok || name == "" || strings.HasPrefix(name, sizedPrefix) {
+		return errors.Errorf("metric %q is already registered", name)
+	}
+	if _, ok := extraFeatures[name]; ok {
+		return errors.Errorf("feature %q is already registered", name)
+	}
+	metrics[Metric(name)] = customMeasure{CustomMetric: m, name: name}
+	extraFeatures[name] = m.Feature
+	return nil
+}
+
+// loadMetricPlugin opens the Go plugin (built with -buildmode=plugin) and registers its metric:
+// its exported Metric variable, with a Name() string method besides the CustomMetric ones.
+func loadMetricPlugin(path string) error {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return errors.Wrap(err, path)
+	}
+	sym, err := p.Lookup("Metric")
+	if err != nil {
+		return errors.Wrap(err, path)
+	}
+	m, ok := sym.(interface {
+		Name() string
+		CustomMetric
+	})
+	if !ok {
+		return errors.Errorf("%s: Metric is a %T, without the Name, Feature and Distance methods", path, sym)
+	}
+	return errors.Wrap(registerMetric(m.Name(), m), path)
+}
+
+// metricNames returns the names of the registered metrics, sorted.
+func metricNames() []string {
+	names := make([]string, 0, len(metrics))
+	for m := range metrics {
+		names = append(names, string(m))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// measure computes a metric for the matcher.
+type measure interface {
+	// Entry fills the features of the candidate from its DB entry,
+	// reporting false if the entry lacks them (it was indexed with other options).
+	Entry(c *features, t Thumbnail, opts MatchOptions) bool
+	// Image fills the features of the target cell.
+	Image(f *features, img image.Image, opts MatchOptions)
+	// Distances fills dists with the distances of the pool of candidates from the needle.
+	Distances(dists []float64, needle features, candidates []candidate, pool []int, opts MatchOptions)
+}
+
+// metrics are the registered metrics, the builtin ones and the RegisterMetric ones.
+// The average color (Lab) is filled for all those that use it (see MatchOptions.usesColor),
+// not by the measures.
+var metrics = map[Metric]measure{
+	MetricFFT:      fftMeasure{},
+	MetricColor:    colorMeasure{},
+	MetricFFTColor: fftColorMeasure{},
+	MetricPhase:    phaseMeasure{},
+	MetricPHash:    phashMeasure{},
+	MetricBlocks:   blocksMeasure{},
+	MetricHist:     histMeasure{},
+}
+
+type fftMeasure struct{}
+
+func (fftMeasure) Entry(c *features, t Thumbnail, opts MatchOptions) bool {
+	if name := opts.extraFeature(); name != "" {
+		c.Spectrum = decodeSpectrum(t.Features[name])
+		return len(c.Spectrum) == fftSize(opts.size())*fftSize(opts.size())
+	}
+	c.Spectrum = logPower(t.coeffs())
+	return true
+}
+func (fftMeasure) Image(f *features, img image.Image, opts MatchOptions) {
+	if opts.extraFeature() != "" {
+		f.Spectrum = sizedSpectrum(img, opts.size(), opts.Prefilter)
+	} else {
+		f.Spectrum = logPower(imgFFT(img))
+	}
+}
+func (fftMeasure) Distances(dists []float64, needle features, candidates []candidate, pool []int, opts MatchOptions) {
+	for i, j := range pool {
+		dists[i] = spectrumDistance(needle.Spectrum, candidates[j].Spectrum)
+	}
+}
+
+type colorMeasure struct{}
+
+func (colorMeasure) Entry(*features, Thumbnail, MatchOptions) bool { return true }
+func (colorMeasure) Image(*features, image.Image, MatchOptions)    {}
+func (colorMeasure) Distances(dists []float64, needle features, candidates []candidate, pool []int, opts MatchOptions) {
+	for i, j := range pool {
+		dists[i] = deltaE(needle.Lab, candidates[j].Lab)
+	}
+}
+
+// fftColorMeasure has the spectra of fftMeasure, and the colors.
+type fftColorMeasure struct{ fftMeasure }
+
+func (fftColorMeasure) Distances(dists []float64, needle features, candidates []candidate, pool []int, opts MatchOptions) {
+	// Normalize both distances to [0,1] over the candidates, to make them comparable.
+	colorDists := make([]float64, len(pool))
+	var maxFFT, maxColor float64
+	for i, j := range pool {
+		c := candidates[j]
+		dists[i] = spectrumDistance(needle.Spectrum, c.Spectrum)
+		maxFFT = math.Max(maxFFT, dists[i])
+		colorDists[i] = deltaE(needle.Lab, c.Lab)
+		maxColor = math.Max(maxColor, colorDists[i])
+	}
+	for i := range dists {
+		var d float64
+		if maxFFT > 0 {
+			d = dists[i] / maxFFT
+		}
+		if maxColor > 0 {
+			d += opts.ColorWeight * colorDists[i] / maxColor
+		}
+		dists[i] = d
+	}
+}
+
+type phaseMeasure struct{}
+
+func (phaseMeasure) Entry(c *features, t Thumbnail, opts MatchOptions) bool {
+	c.Coeffs = logCoeffs(t.coeffs())
+	return true
+}
+func (phaseMeasure) Image(f *features, img image.Image, opts MatchOptions) {
+	f.Coeffs = logCoeffs(imgFFT(img))
+}
+func (phaseMeasure) Distances(dists []float64, needle features, candidates []candidate, pool []int, opts MatchOptions) {
+	for i, j := range pool {
+		dists[i] = coeffDistance(needle.Coeffs, candidates[j].Coeffs)
+	}
+}
+
+type phashMeasure struct{}
+
+func (phashMeasure) Entry(c *features, t Thumbnail, opts MatchOptions) bool {
+	payload := t.Features[opts.extraFeature()]
+	if len(payload) != 8 {
+		return false
+	}
+	c.PHash = binary.LittleEndian.Uint64(payload)
+	return true
+}
+func (phashMeasure) Image(f *features, img image.Image, opts MatchOptions) {
+	f.PHash = binary.LittleEndian.Uint64(pHash(img))
+}
+func (phashMeasure) Distances(dists []float64, needle features, candidates []candidate, pool []int, opts MatchOptions) {
+	for i, j := range pool {
+		dists[i] = hashDistance(needle.PHash, candidates[j].PHash)
+	}
+}
+
+type blocksMeasure struct{}
+
+func (blocksMeasure) Entry(c *features, t Thumbnail, opts MatchOptions) bool {
+	payload := t.Features[opts.extraFeature()]
+	if len(payload) != 4*blocksPerSide*blocksPerSide {
+		return false
+	}
+	c.Blocks = blockLabs(payload)
+	return true
+}
+func (blocksMeasure) Image(f *features, img image.Image, opts MatchOptions) {
+	f.Blocks = blockLabs(blockColors(img))
+}
+func (blocksMeasure) Distances(dists []float64, needle features, candidates []candidate, pool []int, opts MatchOptions) {
+	for i, j := range pool {
+		dists[i] = blocksDistance(needle.Blocks, candidates[j].Blocks)
+	}
+}
+
+type histMeasure struct{}
+
+func (histMeasure) Entry(c *features, t Thumbnail, opts MatchOptions) bool {
+	payload := t.Features[opts.extraFeature()]
+	if len(payload) != histBins {
+		return false
+	}
+	c.Hist = histWeights(payload)
+	return true
+}
+func (histMeasure) Image(f *features, img image.Image, opts MatchOptions) {
+	f.Hist = histWeights(hsvHistogram(img))
+}
+func (histMeasure) Distances(dists []float64, needle features, candidates []candidate, pool []int, opts MatchOptions) {
+	for i, j := range pool {
+		dists[i] = histDistance(needle.Hist, candidates[j].Hist)
+	}
+}
+
+// customMeasure is a RegisterMetric one, comparing the stored features as they are.
+type customMeasure struct {
+	CustomMetric
+	name string
+}
+
+func (m customMeasure) Entry(c *features, t Thumbnail, opts MatchOptions) bool {
+	c.Custom = t.Features[m.name]
+	return len(c.Custom) != 0
+}
+func (m customMeasure) Image(f *features, img image.Image, opts MatchOptions) {
+	f.Custom = m.Feature(img)
+}
+func (m customMeasure) Distances(dists []float64, needle features, candidates []candidate, pool []int, opts MatchOptions) {
+	for i, j := range pool {
+		dists[i] = m.Distance(needle.Custom, candidates[j].Custom)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// oppositeMetric is a trivial custom metric: the farther the average colors, the closer.
+type oppositeMetric struct{}
+
+func (oppositeMetric) Feature(img image.Image) []byte {
+	c := avgColor(img)
+	return []byte{c.R, c.G, c.B}
+}
+
+func (oppositeMetric) Distance(a, b []byte) float64 {
+	d := 3 * 255.0
+	for i := range a {
+		d -= float64(absDiff(a[i], b[i]))
+	}
+	return d
+}
+
+func init() { RegisterMetric("test-opposite", oppositeMetric{}) }
+
+func TestCustomMetric(t *testing.T) {
+	if !slices.Contains(metricNames(), "test-opposite") {
+		t.Fatalf("test-opposite is not of %v", metricNames())
+	}
+	var unknown Metric
+	if err := unknown.Set("test-unknown"); err == nil {
+		t.Errorf("an unknown metric got selected: %q", unknown)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("registering a taken name did not panic")
+			}
+		}()
+		RegisterMetric(string(MetricColor), oppositeMetric{})
+	}()
+	// as a plugin's would be
+	for _, name := range []string{string(MetricFFT), "test-opposite", ""} {
+		if err := registerMetric(name, oppositeMetric{}); err == nil {
+			t.Errorf("the taken name %q got registered", name)
+		}
+	}
+
+	dir := t.TempDir()
+	red, cyan := color.NRGBA{R: 250, G: 10, B: 10, A: 255}, color.NRGBA{R: 10, G: 250, B: 250, A: 255}
+	files := []string{
+		writeImage(t, dir, "red.png", solidImage(Width, Width, red)),
+		writeImage(t, dir, "cyan.png", solidImage(Width, Width, cyan)),
+	}
+	for _, tc := range []struct {
+		Metric string
+		Want   string
+	}{
+		{Metric: "color", Want: "red.png"},
+		{Metric: "test-opposite", Want: "cyan.png"},
+	} {
+		t.Run(tc.Metric, func(t *testing.T) {
+			opts := testOptions()
+			opts.Grid = Grid{Cols: 1, Rows: 1}
+			if err := opts.Match.Metric.Set(tc.Metric); err != nil {
+				t.Fatal(err)
+			}
+			b := NewBuilder(opts)
+			ctx := context.Background()
+			if err := b.AddSources(ctx, files); err != nil {
+				t.Fatal(err)
+			}
+			if tc.Metric != "color" {
+				for fn, th := range b.thumbnails {
+					if len(th.Features[tc.Metric]) != 3 {
+						t.Errorf("%s: got the features %v, wanted 3 bytes of %s", fn, th.Features, tc.Metric)
+					}
+				}
+			}
+			plan, err := b.BuildImage(ctx, "target", solidImage(Width, Width, red))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(plan.Tiles) != 1 || filepath.Base(plan.Tiles[0].Source) != tc.Want {
+				t.Errorf("got %v, wanted %s", plan.Tiles, tc.Want)
+			}
+		})
+	}
+}
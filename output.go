@@ -0,0 +1,105 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"io"
+	"math"
+
+	"github.com/disintegration/imaging"
+	"github.com/pkg/errors"
+)
+
+// encodeImage encodes the image in the format, tagged with the given DPI (if positive),
+// as a progressive JPEG if asked so (see writeProgressiveJPEG).
+//
+// The standard library encoders can't write the resolution,
+// so the pHYs chunk (PNG) or the JFIF APP0 segment (JPEG) is inserted into their output.
+func encodeImage(w io.Writer, img image.Image, format imaging.Format, dpi int, progressive bool) error {
+	if progressive && format != imaging.JPEG {
+		return errors.Errorf("-progressive is supported only for JPEG, not %v", format)
+	}
+	if dpi <= 0 && !progressive {
+		return imaging.Encode(w, img, format)
+	}
+	if dpi > 0 && format != imaging.PNG && format != imaging.JPEG {
+		return errors.Errorf("-dpi is supported only for PNG and JPEG, not %v", format)
+	}
+	var buf bytes.Buffer
+	var err error
+	if progressive {
+		err = writeProgressiveJPEG(&buf, img, jpegQuality)
+	} else {
+		err = imaging.Encode(&buf, img, format)
+	}
+	if err != nil {
+		return err
+	}
+	if dpi <= 0 {
+		_, err = w.Write(buf.Bytes())
+		return err
+	}
+	b := buf.Bytes()
+	if format == imaging.PNG {
+		b, err = pngSetDPI(b, dpi)
+	} else {
+		b, err = jpegSetDPI(b, dpi)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// pngSetDPI inserts a pHYs chunk after the IHDR.
+func pngSetDPI(b []byte, dpi int) ([]byte, error) {
+	const ihdrEnd = 8 + 4 + 4 + 13 + 4 // signature, length, type, data, CRC
+	if len(b) < ihdrEnd || string(b[12:16]) != "IHDR" {
+		return nil, errors.New("not a PNG")
+	}
+	ppm := uint32(math.Round(float64(dpi) / 0.0254)) // pixels per metre
+	chunk := make([]byte, 0, 4+4+9+4)
+	chunk = binary.BigEndian.AppendUint32(chunk, 9)
+	chunk = append(chunk, "pHYs"...)
+	chunk = binary.BigEndian.AppendUint32(chunk, ppm)
+	chunk = binary.BigEndian.AppendUint32(chunk, ppm)
+	chunk = append(chunk, 1) // unit is the metre
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+	return append(b[:ihdrEnd:ihdrEnd], append(chunk, b[ihdrEnd:]...)...), nil
+}
+
+// jpegSetDPI inserts a JFIF APP0 segment after the SOI marker.
+func jpegSetDPI(b []byte, dpi int) ([]byte, error) {
+	if len(b) < 4 || b[0] != 0xff || b[1] != 0xd8 {
+		return nil, errors.New("not a JPEG")
+	}
+	if b[2] == 0xff && b[3] == 0xe0 {
+		return nil, errors.New("JPEG already has an APP0 segment")
+	}
+	if dpi > math.MaxUint16 {
+		dpi = math.MaxUint16
+	}
+	seg := []byte{0xff, 0xe0, 0, 16, 'J', 'F', 'I', 'F', 0, 1, 2, 1} // version 1.02, unit is the inch
+	seg = binary.BigEndian.AppendUint16(seg, uint16(dpi))
+	seg = binary.BigEndian.AppendUint16(seg, uint16(dpi))
+	seg = append(seg, 0, 0) // no thumbnail
+	return append(b[:2:2], append(seg, b[2:]...)...), nil
+}
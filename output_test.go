@@ -0,0 +1,126 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/pkg/errors"
+)
+
+// pngDPI returns the resolution of the pHYs chunk of the PNG, rounded to DPI.
+func pngDPI(b []byte) (int, error) {
+	for i := 8; i+12 <= len(b); {
+		n := int(binary.BigEndian.Uint32(b[i:]))
+		if i+12+n > len(b) {
+			break
+		}
+		typ, data := string(b[i+4:i+8]), b[i+8:i+8+n]
+		if crc32.ChecksumIEEE(b[i+4:i+8+n]) != binary.BigEndian.Uint32(b[i+8+n:]) {
+			return 0, errors.Errorf("bad CRC of %s", typ)
+		}
+		if typ == "pHYs" {
+			if n != 9 || data[8] != 1 {
+				return 0, errors.Errorf("bad pHYs %x", data)
+			}
+			x, y := binary.BigEndian.Uint32(data), binary.BigEndian.Uint32(data[4:])
+			if x != y {
+				return 0, errors.Errorf("x %d and y %d differ", x, y)
+			}
+			return int(float64(x)*0.0254 + 0.5), nil
+		}
+		i += 12 + n
+	}
+	return 0, errors.New("no pHYs")
+}
+
+// jpegDPI returns the density of the JFIF APP0 segment of the JPEG.
+func jpegDPI(b []byte) (int, error) {
+	if len(b) < 20 || b[2] != 0xff || b[3] != 0xe0 || string(b[6:11]) != "JFIF\x00" {
+		return 0, errors.New("no JFIF APP0")
+	}
+	if b[13] != 1 {
+		return 0, errors.Errorf("unit %d is not the inch", b[13])
+	}
+	x, y := binary.BigEndian.Uint16(b[14:]), binary.BigEndian.Uint16(b[16:])
+	if x != y {
+		return 0, errors.Errorf("x %d and y %d differ", x, y)
+	}
+	return int(x), nil
+}
+
+func TestEncodeDPI(t *testing.T) {
+	img := synthImage(1, 64, 48)
+	for _, tc := range []struct {
+		Name        string
+		Format      imaging.Format
+		DPI         int
+		Progressive bool
+		WantErr     bool
+	}{
+		{Name: "png", Format: imaging.PNG, DPI: 300},
+		{Name: "png 72", Format: imaging.PNG, DPI: 72},
+		{Name: "jpeg", Format: imaging.JPEG, DPI: 300},
+		{Name: "progressive jpeg", Format: imaging.JPEG, DPI: 600, Progressive: true},
+		{Name: "png without", Format: imaging.PNG},
+		{Name: "gif", Format: imaging.GIF, DPI: 300, WantErr: true},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := encodeImage(&buf, img, tc.Format, tc.DPI, tc.Progressive)
+			if tc.WantErr {
+				if err == nil {
+					t.Error("no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			b := buf.Bytes()
+			var dpi int
+			if tc.Format == imaging.PNG {
+				if _, err = png.Decode(bytes.NewReader(b)); err != nil {
+					t.Fatal(err)
+				}
+				dpi, err = pngDPI(b)
+			} else {
+				if _, err = jpeg.Decode(bytes.NewReader(b)); err != nil {
+					t.Fatal(err)
+				}
+				dpi, err = jpegDPI(b)
+			}
+			if tc.DPI == 0 {
+				if err == nil {
+					t.Errorf("tagged with %d DPI", dpi)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dpi != tc.DPI {
+				t.Errorf("got %d DPI, wanted %d", dpi, tc.DPI)
+			}
+		})
+	}
+}
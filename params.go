@@ -0,0 +1,123 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+
+	"github.com/disintegration/imaging"
+	"github.com/pkg/errors"
+)
+
+// FeatureParams are the parameters the features of an entry were computed with.
+// Entries computed with different parameters can't be compared.
+//
+// The metric is not among them, as all features are computed for all metrics.
+type FeatureParams struct {
+	// Size of the (square) grayscale thumbnail the FFT is computed on.
+	Size int
+	// Colorspace of the thumbnail.
+	Colorspace string
+	// Window function applied before the FFT.
+	Window string
+	// Anchor of fitting the image into the thumbnail: the Fit.
+	Anchor string
+	// Alpha is how the transparency is handled: "ignored" (the color of the transparent pixels
+	// is used), "weighted" (the gray values are weighted by the alpha: over black)
+	// or "mean" (composited over the mean of the visible pixels).
+	Alpha string
+}
+
+// legacyParams are the parameters of entries written before the parameters were recorded.
+var legacyParams = FeatureParams{Size: 128, Colorspace: "gray", Window: "none", Anchor: "stretch", Alpha: "ignored"}
+
+// currentParams returns the parameters the features are computed with now, with the fit.
+func currentParams(fit Fit) FeatureParams {
+	if fit == "" {
+		fit = FitStretch
+	}
+	return FeatureParams{Size: Width, Colorspace: "gray", Window: "none", Anchor: string(fit), Alpha: "mean"}
+}
+
+// orLegacy returns the legacyParams for the unrecorded (zero) parameters.
+func (p FeatureParams) orLegacy() FeatureParams {
+	if p == (FeatureParams{}) {
+		return legacyParams
+	}
+	if p.Alpha == "" {
+		p.Alpha = legacyParams.Alpha // recorded before Alpha
+	}
+	return p
+}
+
+// mismatch returns why an entry computed with stored parameters can't be used
+// with the wanted ones, or "" if it can.
+func (wanted FeatureParams) mismatch(stored FeatureParams) string {
+	wanted, stored = wanted.orLegacy(), stored.orLegacy()
+	switch {
+	case stored.Size != wanted.Size:
+		return fmt.Sprintf("size %d != %d", stored.Size, wanted.Size)
+	case stored.Colorspace != wanted.Colorspace:
+		return fmt.Sprintf("colorspace %s != %s", stored.Colorspace, wanted.Colorspace)
+	case stored.Window != wanted.Window:
+		return fmt.Sprintf("window %s != %s", stored.Window, wanted.Window)
+	case stored.Anchor != wanted.Anchor:
+		return fmt.Sprintf("anchor %s != %s", stored.Anchor, wanted.Anchor)
+	case stored.Alpha != wanted.Alpha:
+		return fmt.Sprintf("alpha %s != %s", stored.Alpha, wanted.Alpha)
+	}
+	return ""
+}
+
+// Fit is how a source is fitted into the square tile.
+type Fit string
+
+const (
+	// FitStretch resizes the source to the tile, distorting it.
+	FitStretch = Fit("stretch")
+	// FitCover crops the center of the source to cover the tile.
+	FitCover = Fit("cover")
+	// FitContain resizes the source to fit in the tile, padding the rest.
+	FitContain = Fit("contain")
+)
+
+func (f Fit) String() string { return string(f) }
+func (f *Fit) Set(s string) error {
+	switch x := Fit(s); x {
+	case FitStretch, FitCover, FitContain:
+		*f = x
+		return nil
+	}
+	return errors.Errorf("unknown fit %q", s)
+}
+
+// Apply fits the image into size*size; the padding of FitContain is pad.
+func (f Fit) Apply(img image.Image, size int, pad color.NRGBA) *image.NRGBA {
+	return f.ApplyFilter(img, size, pad, imaging.Lanczos)
+}
+
+// ApplyFilter is Apply, resampling with the filter.
+func (f Fit) ApplyFilter(img image.Image, size int, pad color.NRGBA, filter imaging.ResampleFilter) *image.NRGBA {
+	switch f {
+	case FitCover:
+		return imaging.Fill(img, size, size, imaging.Center, filter)
+	case FitContain:
+		return imaging.PasteCenter(imaging.New(size, size, pad), imaging.Fit(img, size, size, filter))
+	}
+	return imaging.Resize(img, size, size, filter)
+}
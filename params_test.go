@@ -0,0 +1,94 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParamsMismatch(t *testing.T) {
+	current := currentParams(FitStretch)
+	with := func(f func(*FeatureParams)) FeatureParams {
+		p := current
+		f(&p)
+		return p
+	}
+	for _, tc := range []struct {
+		Name           string
+		Wanted, Stored FeatureParams
+		Want           string // a part of the reason, "" for none
+	}{
+		{Name: "same", Wanted: current, Stored: current},
+		{Name: "size", Wanted: current, Stored: with(func(p *FeatureParams) { p.Size = 64 }), Want: "size 64 != 128"},
+		{Name: "colorspace", Wanted: current, Stored: with(func(p *FeatureParams) { p.Colorspace = "lab" }), Want: "colorspace"},
+		{Name: "window", Wanted: current, Stored: with(func(p *FeatureParams) { p.Window = "hann" }), Want: "window"},
+		{Name: "anchor", Wanted: currentParams(FitCover), Stored: current, Want: "anchor stretch != cover"},
+		{Name: "alpha", Wanted: current, Stored: with(func(p *FeatureParams) { p.Alpha = "ignored" }), Want: "alpha ignored != mean"},
+		{Name: "alpha over black", Wanted: current, Stored: with(func(p *FeatureParams) { p.Alpha = "weighted" }), Want: "alpha weighted != mean"},
+		// the entries before the parameters were recorded
+		{Name: "legacy", Wanted: legacyParams, Stored: FeatureParams{}},
+		{Name: "legacy alpha", Wanted: current, Stored: FeatureParams{}, Want: "alpha ignored != mean"},
+		{Name: "before alpha", Wanted: with(func(p *FeatureParams) { p.Alpha = "ignored" }), Stored: with(func(p *FeatureParams) { p.Alpha = "" })},
+		{Name: "first difference", Wanted: current, Stored: with(func(p *FeatureParams) { p.Size, p.Window = 64, "hann" }), Want: "size"},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			got := tc.Wanted.mismatch(tc.Stored)
+			if tc.Want == "" && got != "" || !strings.Contains(got, tc.Want) {
+				t.Errorf("got %q, wanted %q", got, tc.Want)
+			}
+		})
+	}
+}
+
+func TestParamsInvalidate(t *testing.T) {
+	dir := t.TempDir()
+	files := testLibrary(t, dir, 3)
+	opts := testOptions()
+	opts.DB = filepath.Join(dir, "mosaic.db")
+	ctx := context.Background()
+	if _, indexed, err := prepareThumbnails(ctx, opts, append([]string(nil), files...), new(Timings)); err != nil || indexed != 3 {
+		t.Fatalf("indexed %d: %v", indexed, err)
+	}
+	// an entry of other parameters is recomputed, just that one
+	hdr, thumbnails, err := loadDB(opts.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := thumbnails[files[1]]
+	old.Params.Size = 64
+	thumbnails[files[1]] = old
+	if err := saveDB(opts.DB, hdr, thumbnails); err != nil {
+		t.Fatal(err)
+	}
+	thumbnails, indexed, err := prepareThumbnails(ctx, opts, append([]string(nil), files...), new(Timings))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if indexed != 1 {
+		t.Errorf("indexed %d, wanted just the invalidated one", indexed)
+	}
+	if got := thumbnails[files[1]].Params; got != currentParams(FitStretch) {
+		t.Errorf("got %+v, wanted the current parameters", got)
+	}
+	// another fit invalidates all
+	opts.Render.Fit = FitCover
+	if _, indexed, err := prepareThumbnails(ctx, opts, append([]string(nil), files...), new(Timings)); err != nil || indexed != 3 {
+		t.Errorf("indexed %d of -tile-fit=cover: %v", indexed, err)
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/pkg/errors"
+)
+
+// Plan is the assignment of sources to the cells of the mosaic.
+type Plan struct {
+	Rows, Cols int
+	// TileSize is the width and height of a cell, in pixels.
+	TileSize int
+	Tiles    []Placement
+}
+
+// Placement of one source.
+type Placement struct {
+	Row, Col  int
+	Source    string
+	Transform Transform
+}
+
+// Transform of the source before pasting.
+type Transform struct {
+	// Rotate counter-clockwise, by 0, 90, 180 or 270 degrees.
+	Rotate       int  `json:",omitempty"`
+	FlipH, FlipV bool `json:",omitempty"`
+}
+
+// Apply the transform to the image.
+func (t Transform) Apply(img image.Image) image.Image {
+	switch (t.Rotate%360 + 360) % 360 {
+	case 90:
+		img = imaging.Rotate90(img)
+	case 180:
+		img = imaging.Rotate180(img)
+	case 270:
+		img = imaging.Rotate270(img)
+	}
+	if t.FlipH {
+		img = imaging.FlipH(img)
+	}
+	if t.FlipV {
+		img = imaging.FlipV(img)
+	}
+	return img
+}
+
+// Cell returns the rectangle of the placement on the mosaic.
+func (p Plan) Cell(t Placement) image.Rectangle {
+	return image.Rect(t.Col*p.TileSize, t.Row*p.TileSize, (t.Col+1)*p.TileSize, (t.Row+1)*p.TileSize)
+}
+
+// Grid is the number of columns and rows of the mosaic.
+type Grid struct {
+	Cols, Rows int
+}
+
+func (g Grid) String() string {
+	if g.Cols == 0 && g.Rows == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%dx%d", g.Cols, g.Rows)
+}
+
+// Set parses "COLSxROWS", or a single number for a square grid.
+func (g *Grid) Set(s string) error {
+	if s == "" {
+		*g = Grid{}
+		return nil
+	}
+	cols, rows, err := parseDims(s)
+	if err != nil {
+		return errors.Errorf("%q: grid must be COLSxROWS", s)
+	}
+	*g = Grid{Cols: cols, Rows: rows}
+	return nil
+}
+
+// Pin is a source forced onto a cell of the mosaic, instead of the matched one.
+type Pin struct {
+	Row, Col int
+	Source   string
+}
+
+// pinsFlag is the repeatable -pin flag.
+type pinsFlag []Pin
+
+func (p *pinsFlag) String() string {
+	if p == nil {
+		return ""
+	}
+	ss := make([]string, len(*p))
+	for i, pin := range *p {
+		ss[i] = fmt.Sprintf("%d,%d=%s", pin.Row, pin.Col, pin.Source)
+	}
+	return strings.Join(ss, " ")
+}
+
+// Set parses "ROW,COL=PATH", with the rows and columns numbered from 0.
+func (p *pinsFlag) Set(s string) error {
+	cell, fn, ok := strings.Cut(s, "=")
+	rs, cs, ok2 := strings.Cut(cell, ",")
+	if !ok || !ok2 || fn == "" {
+		return errors.Errorf("%q: pin must be ROW,COL=PATH", s)
+	}
+	row, err := strconv.Atoi(strings.TrimSpace(rs))
+	if err != nil || row < 0 {
+		return errors.Errorf("%q: bad row %q", s, rs)
+	}
+	col, err := strconv.Atoi(strings.TrimSpace(cs))
+	if err != nil || col < 0 {
+		return errors.Errorf("%q: bad column %q", s, cs)
+	}
+	key, err := canonicalKey(fn)
+	if err != nil {
+		return errors.Wrap(err, s)
+	}
+	*p = append(*p, Pin{Row: row, Col: col, Source: key})
+	return nil
+}
+
+// parseDims parses "AxB", or "A" as "AxA", of positive numbers.
+func parseDims(s string) (int, int, error) {
+	as, bs := s, s
+	if i := strings.IndexByte(s, 'x'); i >= 0 {
+		as, bs = s[:i], s[i+1:]
+	}
+	a, err := strconv.Atoi(as)
+	if err == nil && a <= 0 {
+		err = errors.New("not positive")
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	b, err := strconv.Atoi(bs)
+	if err == nil && b <= 0 {
+		err = errors.New("not positive")
+	}
+	return a, b, err
+}
+
+// Layout is the arrangement of several targets' mosaics on one output.
+type Layout struct {
+	Rows, Cols int
+}
+
+func (l Layout) String() string {
+	if l.Cols == 0 && l.Rows == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%dx%d", l.Rows, l.Cols)
+}
+
+// Set parses "ROWSxCOLS".
+func (l *Layout) Set(s string) error {
+	if s == "" {
+		*l = Layout{}
+		return nil
+	}
+	rows, cols, err := parseDims(s)
+	if err != nil {
+		return errors.Errorf("%q: layout must be ROWSxCOLS", s)
+	}
+	*l = Layout{Rows: rows, Cols: cols}
+	return nil
+}
+
+// combinePlans arranges the plans, of the same size, on one plan: the i-th plan
+// goes to the i/Cols row and i%Cols column of the layout.
+func combinePlans(layout Layout, plans []Plan) Plan {
+	if len(plans) == 0 {
+		return Plan{}
+	}
+	p0 := plans[0]
+	combined := Plan{Rows: layout.Rows * p0.Rows, Cols: layout.Cols * p0.Cols, TileSize: p0.TileSize}
+	for i, p := range plans {
+		dRow, dCol := (i/layout.Cols)*p0.Rows, (i%layout.Cols)*p0.Cols
+		for _, t := range p.Tiles {
+			t.Row, t.Col = t.Row+dRow, t.Col+dCol
+			combined.Tiles = append(combined.Tiles, t)
+		}
+	}
+	return combined
+}
+
+// Usage is the statistics of the sources used by a plan.
+type Usage struct {
+	Tiles    int
+	Distinct int // sources used
+	Unused   int // sources not used
+	// Per source uses, of the used ones.
+	Min, Median, Max int
+}
+
+// Usage counts the uses of the sources in the plan.
+func (p Plan) Usage(sources []string) Usage {
+	uses := make(map[string]int, len(sources))
+	for _, t := range p.Tiles {
+		uses[t.Source]++
+	}
+	u := Usage{Tiles: len(p.Tiles), Distinct: len(uses)}
+	for _, s := range sources {
+		if uses[s] == 0 {
+			u.Unused++
+		}
+	}
+	counts := make([]int, 0, len(uses))
+	for _, n := range uses {
+		counts = append(counts, n)
+	}
+	if len(counts) != 0 {
+		sort.Ints(counts)
+		u.Min, u.Median, u.Max = counts[0], counts[len(counts)/2], counts[len(counts)-1]
+	}
+	return u
+}
+
+func (u Usage) String() string {
+	var unique float64
+	if u.Tiles != 0 {
+		unique = 100 * float64(u.Distinct) / float64(u.Tiles)
+	}
+	return fmt.Sprintf("%d tiles from %d distinct sources (%.0f%% unique), %d sources unused; uses per source: min %d, median %d, max %d",
+		u.Tiles, u.Distinct, unique, u.Unused, u.Min, u.Median, u.Max)
+}
+
+// readPlan reads the JSON plan, as written by Plan.WriteFile.
+func readPlan(fn string) (Plan, error) {
+	var p Plan
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return p, errors.Wrap(err, fn)
+	}
+	if err = json.Unmarshal(b, &p); err != nil {
+		return p, errors.Wrap(err, fn)
+	}
+	if p.Rows <= 0 || p.Cols <= 0 || p.TileSize <= 0 {
+		return p, errors.Errorf("%s: bad plan size %dx%d of %dpx tiles", fn, p.Cols, p.Rows, p.TileSize)
+	}
+	for _, t := range p.Tiles {
+		if t.Row < 0 || t.Row >= p.Rows || t.Col < 0 || t.Col >= p.Cols {
+			return p, errors.Errorf("%s: tile %q at %d,%d is out of the %dx%d grid", fn, t.Source, t.Row, t.Col, p.Cols, p.Rows)
+		}
+	}
+	return p, nil
+}
+
+// WriteFile writes the plan as JSON.
+func (p Plan) WriteFile(fn string) error {
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(os.WriteFile(fn, b, 0644), fn)
+}
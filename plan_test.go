@@ -0,0 +1,261 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestPlanRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		Name string
+		Plan Plan
+	}{
+		{Name: "empty", Plan: Plan{Rows: 1, Cols: 1, TileSize: 8}},
+		{Name: "tiles", Plan: Plan{Rows: 2, Cols: 3, TileSize: 64, Tiles: []Placement{
+			{Row: 0, Col: 0, Source: "/a.png"},
+			{Row: 1, Col: 2, Source: "/b.png", Transform: Transform{Rotate: 90}},
+			{Row: 1, Col: 0, Source: "/a.png", Transform: Transform{FlipH: true, FlipV: true}},
+		}}},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "plan.json")
+			if err := tc.Plan.WriteFile(fn); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readPlan(fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.Plan) {
+				t.Errorf("got %+v, wanted %+v", got, tc.Plan)
+			}
+		})
+	}
+}
+
+func TestApplySidecar(t *testing.T) {
+	dir := t.TempDir()
+	target := writeImage(t, dir, "target.png", synthImage(-1, 3*Width, 2*Width))
+	files := append([]string{target}, testLibrary(t, dir, 6)...)
+	opts := testOptions()
+	opts.Grid = Grid{Cols: 3, Rows: 2}
+	opts.Sidecar = filepath.Join(dir, "plan.json")
+	opts.Out = filepath.Join(dir, "built.png")
+	ctx := context.Background()
+	if err := Main(ctx, opts, files); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := readPlan(opts.Sidecar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Tiles) != 6 {
+		t.Fatalf("got %d tiles, wanted 6", len(plan.Tiles))
+	}
+
+	applied := testOptions()
+	applied.Apply = opts.Sidecar
+	applied.Sidecar = filepath.Join(dir, "applied.json")
+	applied.Out = filepath.Join(dir, "applied.png")
+	if err := Main(ctx, applied, nil); err != nil {
+		t.Fatal(err)
+	}
+	again, err := readPlan(applied.Sidecar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(again, plan) {
+		t.Errorf("applied %+v, wanted %+v", again, plan)
+	}
+	built, err := imaging.Open(opts.Out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := imaging.Open(applied.Out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// no source is rendered from the pixels stored in the DB, so they are the same
+	if !reflect.DeepEqual(imaging.Clone(built).Pix, imaging.Clone(out).Pix) {
+		t.Error("the applied mosaic differs from the built one")
+	}
+
+	// a hand-edited plan is rendered as edited
+	plan.Tiles[0].Source = files[1]
+	plan.Tiles[0].Transform = Transform{Rotate: 180}
+	if err := plan.WriteFile(applied.Apply); err != nil {
+		t.Fatal(err)
+	}
+	if err := Main(ctx, applied, nil); err != nil {
+		t.Fatal(err)
+	}
+	out, err = imaging.Open(applied.Out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := imaging.Open(files[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := imaging.Rotate180(imaging.Resize(src, plan.TileSize, plan.TileSize, imaging.Lanczos))
+	cell := imaging.Crop(out, plan.Cell(plan.Tiles[0]))
+	if d := meanAbsDiff(cell, want); d > 2 {
+		t.Errorf("the edited tile differs from its source by %.2f", d)
+	}
+}
+
+// meanAbsDiff returns the mean absolute difference of the RGB channels of the images of the same size.
+func meanAbsDiff(a, b image.Image) float64 {
+	na, nb := imaging.Clone(a), imaging.Clone(b)
+	var sum float64
+	var n int
+	for i := 0; i < len(na.Pix) && i < len(nb.Pix); i++ {
+		if i%4 == 3 {
+			continue
+		}
+		sum += float64(absDiff(na.Pix[i], nb.Pix[i]))
+		n++
+	}
+	return sum / float64(max(n, 1))
+}
+
+func TestUsage(t *testing.T) {
+	tiles := func(sources ...string) []Placement {
+		ps := make([]Placement, len(sources))
+		for i, s := range sources {
+			ps[i] = Placement{Row: i, Source: s}
+		}
+		return ps
+	}
+	for _, tc := range []struct {
+		Name    string
+		Tiles   []Placement
+		Sources []string
+		Want    Usage
+		WantStr string
+	}{
+		{Name: "empty", Sources: []string{"a"}, Want: Usage{Unused: 1}, WantStr: "(0% unique), 1 sources unused"},
+		{Name: "unique", Tiles: tiles("a", "b", "c"), Sources: []string{"a", "b", "c"},
+			Want: Usage{Tiles: 3, Distinct: 3, Min: 1, Median: 1, Max: 1}, WantStr: "(100% unique), 0 sources unused"},
+		{Name: "reused", Tiles: tiles("a", "a", "a", "b"), Sources: []string{"a", "b", "c", "d"},
+			Want: Usage{Tiles: 4, Distinct: 2, Unused: 2, Min: 1, Median: 3, Max: 3}, WantStr: "(50% unique), 2 sources unused; uses per source: min 1, median 3, max 3"},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			got := Plan{Tiles: tc.Tiles}.Usage(tc.Sources)
+			if got != tc.Want {
+				t.Errorf("got %+v, wanted %+v", got, tc.Want)
+			}
+			if s := got.String(); !strings.Contains(s, tc.WantStr) {
+				t.Errorf("got %q, wanted %q in it", s, tc.WantStr)
+			}
+		})
+	}
+}
+
+func TestMaxReuseUnique(t *testing.T) {
+	const n = 9
+	files := testLibrary(t, t.TempDir(), n)
+	opts := testOptions()
+	opts.Grid = Grid{Cols: 3, Rows: 3}
+	opts.Match.MaxReuse = 1
+	b := NewBuilder(opts)
+	ctx := context.Background()
+	if err := b.AddSources(ctx, files); err != nil {
+		t.Fatal(err)
+	}
+	// a target all similar to one source would pick that everywhere, without the limit
+	plan, err := b.BuildImage(ctx, "target", imaging.Resize(synthImage(0, Width, Width), 3*Width, 3*Width, imaging.Box))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := plan.Usage(files)
+	if u.Tiles != n || u.Distinct != n || u.Unused != 0 || u.Max != 1 {
+		t.Errorf("got %+v, wanted each of the %d sources used once", u, n)
+	}
+	if s := u.String(); !strings.Contains(s, "(100% unique)") {
+		t.Errorf("got %q, wanted 100%% unique", s)
+	}
+}
+
+func TestTargetsLayout(t *testing.T) {
+	dir := t.TempDir()
+	red, blue := color.NRGBA{R: 250, G: 10, B: 10, A: 255}, color.NRGBA{R: 10, G: 10, B: 250, A: 255}
+	files := []string{
+		writeImage(t, dir, "red.png", solidImage(Width, Width, red)),
+		writeImage(t, dir, "blue.png", solidImage(Width, Width, blue)),
+		writeImage(t, dir, "gray.png", solidImage(Width, Width, color.NRGBA{R: 128, G: 128, B: 128, A: 255})),
+	}
+	redTarget := writeImage(t, dir, "red-target.png", solidImage(2*Width, 2*Width, red))
+	blueTarget := writeImage(t, dir, "blue-target.png", solidImage(2*Width, 2*Width, blue))
+	for _, tc := range []struct {
+		Layout Layout
+		// Sources of the cells, by rows.
+		Want []string
+	}{
+		{Layout: Layout{Rows: 1, Cols: 2}, Want: []string{
+			"red.png red.png blue.png blue.png",
+			"red.png red.png blue.png blue.png",
+		}},
+		{Layout: Layout{Rows: 2, Cols: 1}, Want: []string{
+			"red.png red.png",
+			"red.png red.png",
+			"blue.png blue.png",
+			"blue.png blue.png",
+		}},
+	} {
+		t.Run(tc.Layout.String(), func(t *testing.T) {
+			opts := testOptions()
+			opts.Grid = Grid{Cols: 2, Rows: 2}
+			opts.Targets = []string{redTarget, blueTarget}
+			opts.Layout = tc.Layout
+			ctx := context.Background()
+			plan, thumbnails, err := buildPlan(ctx, opts, append([]string(nil), files...), new(Timings))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cells := make([][]string, plan.Rows)
+			for i := range cells {
+				cells[i] = make([]string, plan.Cols)
+			}
+			for _, p := range plan.Tiles {
+				cells[p.Row][p.Col] = filepath.Base(p.Source)
+			}
+			got := make([]string, len(cells))
+			for i, row := range cells {
+				got[i] = strings.Join(row, " ")
+			}
+			if !reflect.DeepEqual(got, tc.Want) {
+				t.Errorf("got %q, wanted %q", got, tc.Want)
+			}
+			img, err := renderPlan(ctx, opts, plan, thumbnails)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size, want := img.Bounds().Size(), image.Pt(2*tc.Layout.Cols*Width, 2*tc.Layout.Rows*Width); size != want {
+				t.Errorf("got a %v output, wanted %v", size, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"image"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// Prefilter is applied to the grayscale thumbnails before the FFT, to match by their edges.
+type Prefilter string
+
+const (
+	PrefilterNone = Prefilter("none")
+	// PrefilterSobel is the gradient magnitude of the Sobel operator.
+	PrefilterSobel = Prefilter("sobel")
+	// PrefilterLaplacian is the absolute value of the 4-neighbor Laplacian.
+	PrefilterLaplacian = Prefilter("laplacian")
+)
+
+func (p Prefilter) String() string { return string(p) }
+func (p *Prefilter) Set(s string) error {
+	switch x := Prefilter(s); x {
+	case PrefilterNone, PrefilterSobel, PrefilterLaplacian:
+		*p = x
+		return nil
+	case "":
+		*p = PrefilterNone
+		return nil
+	}
+	return errors.Errorf("unknown prefilter %q", s)
+}
+
+// isNone reports whether the prefilter leaves the thumbnails as they are.
+func (p Prefilter) isNone() bool { return p == "" || p == PrefilterNone }
+
+// Apply the prefilter to the image, returning a new one; the edges are extended.
+func (p Prefilter) Apply(gray *image.Gray) *image.Gray {
+	if p.isNone() {
+		return gray
+	}
+	b := gray.Bounds()
+	at := func(x, y int) float64 {
+		x, y = min(max(x, b.Min.X), b.Max.X-1), min(max(y, b.Min.Y), b.Max.Y-1)
+		return float64(gray.Pix[gray.PixOffset(x, y)])
+	}
+	out := image.NewGray(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			var v float64
+			switch p {
+			case PrefilterSobel:
+				gx := at(x+1, y-1) + 2*at(x+1, y) + at(x+1, y+1) - at(x-1, y-1) - 2*at(x-1, y) - at(x-1, y+1)
+				gy := at(x-1, y+1) + 2*at(x, y+1) + at(x+1, y+1) - at(x-1, y-1) - 2*at(x, y-1) - at(x+1, y-1)
+				// the maximum is 4*255*sqrt(2)
+				v = math.Hypot(gx, gy) / 4
+			case PrefilterLaplacian:
+				v = math.Abs(4*at(x, y) - at(x-1, y) - at(x+1, y) - at(x, y-1) - at(x, y+1))
+			}
+			out.Pix[out.PixOffset(x, y)] = uint8(math.Min(v, 255) + 0.5)
+		}
+	}
+	return out
+}
@@ -0,0 +1,121 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// gridLines returns an image of lines of every period pixels, of fg on bg.
+func gridLines(size, period int, fg, bg color.NRGBA) *image.NRGBA {
+	img := solidImage(size, size, bg)
+	for i := 0; i < size; i += period {
+		draw.Draw(img, image.Rect(i, 0, i+period/4, size), image.NewUniform(fg), image.Point{}, draw.Src)
+		draw.Draw(img, image.Rect(0, i, size, i+period/4), image.NewUniform(fg), image.Point{}, draw.Src)
+	}
+	return img
+}
+
+func TestPrefilterApply(t *testing.T) {
+	flat := image.NewGray(image.Rect(0, 0, 16, 16))
+	for i := range flat.Pix {
+		flat.Pix[i] = 100
+	}
+	step := image.NewGray(image.Rect(0, 0, 16, 16))
+	for y := 0; y < 16; y++ {
+		for x := 8; x < 16; x++ {
+			step.Pix[step.PixOffset(x, y)] = 200
+		}
+	}
+	for _, pf := range []Prefilter{PrefilterSobel, PrefilterLaplacian} {
+		t.Run(pf.String(), func(t *testing.T) {
+			for i, v := range pf.Apply(flat).Pix {
+				if v != 0 {
+					t.Fatalf("flat %d: got %d, wanted 0", i, v)
+				}
+			}
+			edges := pf.Apply(step)
+			for y := 0; y < 16; y++ {
+				for x := 0; x < 16; x++ {
+					v := edges.Pix[edges.PixOffset(x, y)]
+					if onEdge := x == 7 || x == 8; (v != 0) != onEdge {
+						t.Errorf("%d,%d: got %d (edge: %t)", x, y, v, onEdge)
+					}
+				}
+			}
+		})
+	}
+	if got := PrefilterNone.Apply(step); got != step {
+		t.Error("none changed the image")
+	}
+}
+
+func TestPrefilterMatch(t *testing.T) {
+	dir := t.TempDir()
+	gray := func(v uint8) color.NRGBA { return color.NRGBA{R: v, G: v, B: v, A: 255} }
+	// a checkerboard: its edges are grid lines
+	target := image.NewNRGBA(image.Rect(0, 0, 2*Width, 2*Width))
+	for y := 0; y < 2*Width; y++ {
+		for x := 0; x < 2*Width; x++ {
+			c := gray(60)
+			if (x/32+y/32)%2 == 1 {
+				c = gray(140)
+			}
+			target.SetNRGBA(x, y, c)
+		}
+	}
+	files := []string{
+		// the same tone, no edges
+		writeImage(t, dir, "tone.png", solidImage(Width, Width, avgColor(target))),
+		// the edges, of other tones
+		writeImage(t, dir, "edges.png", gridLines(Width, 16, gray(250), gray(20))),
+	}
+	for _, tc := range []struct {
+		Prefilter Prefilter
+		Want      string
+	}{
+		{Prefilter: PrefilterNone, Want: "tone.png"},
+		{Prefilter: PrefilterSobel, Want: "edges.png"},
+		{Prefilter: PrefilterLaplacian, Want: "edges.png"},
+	} {
+		t.Run(tc.Prefilter.String(), func(t *testing.T) {
+			opts := testOptions()
+			opts.Grid = Grid{Cols: 1, Rows: 1}
+			opts.Match.Prefilter = tc.Prefilter
+			if name := opts.Match.extraFeature(); !tc.Prefilter.isNone() && !strings.HasSuffix(name, "+"+tc.Prefilter.String()) {
+				t.Errorf("got the feature %q, wanted one of %s", name, tc.Prefilter)
+			}
+			b := NewBuilder(opts)
+			ctx := context.Background()
+			if err := b.AddSources(ctx, files); err != nil {
+				t.Fatal(err)
+			}
+			plan, err := b.BuildImage(ctx, "target", target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(plan.Tiles) != 1 || filepath.Base(plan.Tiles[0].Source) != tc.Want {
+				t.Errorf("got %v, wanted %s", plan.Tiles, tc.Want)
+			}
+		})
+	}
+}
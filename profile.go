@@ -0,0 +1,184 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	httppprof "net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// profiler writes the profiles of the phases timed by Timings.Start; nil writes none.
+var profiler *phaseProfiler
+
+// phaseProfiler writes a CPU and a heap profile of each phase, and an execution trace
+// of the whole run, with the phases as its regions.
+type phaseProfiler struct {
+	// cpu and mem are the names the phase is added to: cpu.prof is cpu.indexing.prof for the indexing.
+	cpu, mem string
+	trace    *os.File
+
+	mu sync.Mutex
+	// cpuFile is the CPU profile being written, of the phase cpuPhase
+	cpuFile  *os.File
+	cpuPhase string
+	// written counts the profiles by file name, to number a repeated phase's
+	written map[string]int
+}
+
+// newPhaseProfiler starts the execution trace, if traceFn is not empty.
+func newPhaseProfiler(cpuFn, memFn, traceFn string) (*phaseProfiler, error) {
+	if cpuFn == "" && memFn == "" && traceFn == "" {
+		return nil, nil
+	}
+	p := &phaseProfiler{cpu: cpuFn, mem: memFn, written: make(map[string]int)}
+	if traceFn != "" {
+		fh, err := os.Create(traceFn)
+		if err != nil {
+			return nil, err
+		}
+		if err := trace.Start(fh); err != nil {
+			fh.Close()
+			return nil, errors.Wrap(err, traceFn)
+		}
+		p.trace = fh
+	}
+	return p, nil
+}
+
+// Phase starts profiling the phase, returning the function ending it.
+// The CPU profile of a phase starting within another one is of the outer one.
+func (p *phaseProfiler) Phase(name string) func() {
+	if p == nil {
+		return func() {}
+	}
+	region := trace.StartRegion(context.Background(), name)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var cpu bool
+	if p.cpu != "" && p.cpuFile == nil {
+		fn := p.fileName(p.cpu, name)
+		if fh, err := os.Create(fn); err != nil {
+			log.Println(err)
+		} else if err := pprof.StartCPUProfile(fh); err != nil {
+			log.Println(errors.Wrap(err, fn))
+			fh.Close()
+		} else {
+			p.cpuFile, p.cpuPhase, cpu = fh, name, true
+		}
+	}
+	return func() {
+		region.End()
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if cpu {
+			p.stopCPU()
+		}
+		if p.mem != "" {
+			p.writeHeap(p.fileName(p.mem, name))
+		}
+	}
+}
+
+// Task starts a task of the trace, returning the function ending it.
+// Unlike the regions, tasks may end in any order, as the nested phases do.
+func (p *phaseProfiler) Task(name string) func() {
+	if p == nil || p.trace == nil {
+		return func() {}
+	}
+	_, task := trace.NewTask(context.Background(), name)
+	return task.End
+}
+
+// Close stops the profiles being written, and the trace.
+func (p *phaseProfiler) Close() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopCPU()
+	if p.trace != nil {
+		trace.Stop()
+		if err := p.trace.Close(); err != nil {
+			log.Println(err)
+		}
+		p.trace = nil
+	}
+}
+
+func (p *phaseProfiler) stopCPU() {
+	if p.cpuFile == nil {
+		return
+	}
+	pprof.StopCPUProfile()
+	if err := p.cpuFile.Close(); err != nil {
+		log.Println(err)
+	}
+	p.cpuFile, p.cpuPhase = nil, ""
+}
+
+func (p *phaseProfiler) writeHeap(fn string) {
+	fh, err := os.Create(fn)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	runtime.GC() // for the up-to-date live objects
+	if err := pprof.WriteHeapProfile(fh); err != nil {
+		log.Println(errors.Wrap(err, fn))
+	}
+	if err := fh.Close(); err != nil {
+		log.Println(err)
+	}
+}
+
+// fileName returns the name of the profile of the phase: the phase is inserted before
+// the extension of fn, numbered from its second run ("cpu.rendering.2.prof").
+func (p *phaseProfiler) fileName(fn, phase string) string {
+	ext := filepath.Ext(fn)
+	base := strings.TrimSuffix(fn, ext) + "." + strings.ReplaceAll(phase, " ", "-")
+	p.written[base+ext]++
+	if n := p.written[base+ext]; n > 1 {
+		base += "." + strconv.Itoa(n)
+	}
+	return base + ext
+}
+
+// servePprof serves the net/http/pprof handlers on addr, in the background.
+func servePprof(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", httppprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", httppprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", httppprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", httppprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", httppprof.Trace)
+	go func() {
+		log.Println(errors.Wrap(http.ListenAndServe(addr, mux), "-pprof"))
+	}()
+	log.Printf("pprof on http://%s/debug/pprof/", addr)
+}
@@ -0,0 +1,294 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// progress shows the advance of the long phases, if set by main (see -progress).
+var progress *progressMeter
+
+// Timing of the progress display.
+const (
+	progressRedraw      = 200 * time.Millisecond
+	progressLogInterval = 10 * time.Second
+	// progressJSONInterval limits the JSON events to 10 per second.
+	progressJSONInterval = 100 * time.Millisecond
+	// progressSmoothing is the weight of an item's time in the moving average of the ETA.
+	progressSmoothing = 0.05
+)
+
+// The phases shown, with their label on the status line.
+const (
+	phaseIndex   = "index"
+	phaseMatch   = "match"
+	phaseCompose = "compose"
+	phaseSummary = "summary"
+)
+
+var phaseLabels = map[string]string{phaseIndex: "indexing", phaseMatch: "matching row", phaseCompose: "composing"}
+
+// progressEvent is a line of the -progress json output, such as
+//
+//	{"phase":"index","done":3412,"total":20000,"failed":1,"eta":720.5}
+//
+// emitted at the start and the end of each phase, and in between at most every progressJSONInterval;
+// the last line of a run is its summary.
+type progressEvent struct {
+	// Phase is index (the sources), match (the rows of the target), compose (the tiles of the output),
+	// or summary.
+	Phase string `json:"phase"`
+	Done  int    `json:"done"`
+	Total int    `json:"total"`
+	// Skipped and Failed are the sources not indexed: for -since or failing before, and failing now.
+	Skipped int `json:"skipped,omitempty"`
+	Failed  int `json:"failed,omitempty"`
+	// ETA is the estimated seconds left of the phase.
+	ETA float64 `json:"eta,omitempty"`
+
+	// Timings and Stats of the run are in the summary, with the tiles placed as Done of the cells as Total.
+	Timings *timingReport `json:"timings,omitempty"`
+	Stats   *runStats     `json:"stats,omitempty"`
+}
+
+// runStats are the results of a run, for the summary.
+type runStats struct {
+	Rows  int `json:"rows"`
+	Cols  int `json:"cols"`
+	Tiles int `json:"tiles"`
+	// Sources is the number of the distinct sources used.
+	Sources int `json:"sources"`
+	// CacheHits and CacheMisses are of the composeCache: the sources decoded for rendering reused, and read.
+	CacheHits   int    `json:"cache_hits"`
+	CacheMisses int    `json:"cache_misses"`
+	Error       string `json:"error,omitempty"`
+}
+
+// progressMeter shows the advance of a phase: on a terminal as a status line updated in place,
+// with the log output written above it (so it is the log's output, too),
+// else as a plain log line every progressLogInterval - or as JSON lines of progressEvents.
+// The methods of a nil *progressMeter do nothing.
+type progressMeter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	tty bool
+	// enc writes the progressEvents, if set
+	enc *json.Encoder
+
+	ev       progressEvent // of the current phase
+	lastDone int
+	lastTime time.Time
+	perItem  time.Duration // moving average
+	shownAt  time.Time
+	line     string // the status line shown
+}
+
+func newProgressMeter(w io.Writer, tty bool) *progressMeter {
+	return &progressMeter{w: w, tty: tty}
+}
+
+// newJSONProgress returns a progressMeter writing JSON lines to w.
+func newJSONProgress(w io.Writer) *progressMeter {
+	return &progressMeter{w: w, enc: json.NewEncoder(w)}
+}
+
+// Begin a phase of total items, one of the phase constants.
+func (p *progressMeter) Begin(phase string, total int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	p.ev = progressEvent{Phase: phase, Total: total}
+	p.lastDone, p.lastTime, p.perItem, p.shownAt = 0, now, 0, now
+	if p.enc != nil {
+		p.emit()
+	} else if p.tty {
+		p.show(p.status())
+	}
+}
+
+// Update the count of the items done, and of the sources skipped and failed.
+func (p *progressMeter) Update(done, skipped, failed int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	if p.ev.Phase == "" {
+		p.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	if n := done - p.lastDone; n > 0 {
+		// each of the n items took the same time, weighted as if they were added one by one
+		per := now.Sub(p.lastTime) / time.Duration(n)
+		w := 1 - math.Pow(1-progressSmoothing, float64(n))
+		if p.lastDone == 0 {
+			w = 1
+		}
+		p.perItem += time.Duration(w * float64(per-p.perItem))
+		p.lastDone, p.lastTime = done, now
+	}
+	p.ev.Done, p.ev.Skipped, p.ev.Failed = done, skipped, failed
+	var logLine string
+	d := now.Sub(p.shownAt)
+	switch {
+	case p.enc != nil:
+		if d >= progressJSONInterval {
+			p.emit()
+		}
+	case p.tty:
+		if d >= progressRedraw {
+			p.show(p.status())
+		}
+	case d >= progressLogInterval:
+		p.shownAt = now
+		logLine = p.status()
+	}
+	p.mu.Unlock()
+	if logLine != "" {
+		log.Println(logLine)
+	}
+}
+
+// End the phase: emit its last event, or remove its status line.
+func (p *progressMeter) End() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.enc != nil && p.ev.Phase != "" {
+		p.emit()
+	}
+	p.show("")
+	p.ev.Phase = ""
+}
+
+// Summary emits the summary event of the run, in JSON mode only.
+func (p *progressMeter) Summary(tm *Timings, stats runStats) {
+	if p == nil || p.enc == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	report := tm.report()
+	p.ev = progressEvent{Phase: phaseSummary, Done: stats.Tiles, Total: stats.Rows * stats.Cols, Timings: &report, Stats: &stats}
+	p.emit()
+	p.ev = progressEvent{}
+}
+
+// eta is the estimated time left of the phase, zero if unknown.
+func (p *progressMeter) eta() time.Duration {
+	if p.ev.Done <= 0 || p.ev.Done >= p.ev.Total {
+		return 0
+	}
+	return p.perItem * time.Duration(p.ev.Total-p.ev.Done)
+}
+
+// emit the current event.
+func (p *progressMeter) emit() {
+	p.ev.ETA = math.Round(p.eta().Seconds()*10) / 10
+	if err := p.enc.Encode(p.ev); err != nil {
+		log.Println(errors.Wrap(err, "progress"))
+	}
+	p.shownAt = time.Now()
+}
+
+// status is the status line of the phase, such as "indexing 3412/20000 (2 skipped, 1 failed) ETA 12m".
+func (p *progressMeter) status() string {
+	s := fmt.Sprintf("%s %d/%d", phaseLabels[p.ev.Phase], p.ev.Done, p.ev.Total)
+	if p.ev.Skipped != 0 || p.ev.Failed != 0 {
+		s += fmt.Sprintf(" (%d skipped, %d failed)", p.ev.Skipped, p.ev.Failed)
+	}
+	if eta := p.eta(); eta > 0 {
+		s += " ETA " + formatETA(eta)
+	}
+	return s
+}
+
+// show replaces the status line on the terminal.
+func (p *progressMeter) show(line string) {
+	if !p.tty || line == p.line {
+		return
+	}
+	fmt.Fprint(p.w, "\r\x1b[K"+line)
+	p.line, p.shownAt = line, time.Now()
+}
+
+// Write the log output, above the status line.
+func (p *progressMeter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	line := p.line
+	if line != "" {
+		fmt.Fprint(p.w, "\r\x1b[K")
+	}
+	n, err := p.w.Write(b)
+	if line != "" {
+		fmt.Fprint(p.w, line)
+	}
+	return n, err
+}
+
+// formatETA rounds d to the unit people would say: 40s, 12m, 2h05m.
+func formatETA(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Round(time.Second)/time.Second))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Round(time.Minute)/time.Minute))
+	default:
+		d = d.Round(time.Minute)
+		return fmt.Sprintf("%dh%02dm", int(d/time.Hour), int(d%time.Hour/time.Minute))
+	}
+}
+
+// progressMode is the -progress output.
+type progressMode string
+
+const (
+	// progressAuto is a status line on a terminal, periodic log lines otherwise.
+	progressAuto = progressMode("auto")
+	progressJSON = progressMode("json")
+	progressNone = progressMode("none")
+)
+
+func (m *progressMode) String() string {
+	if m == nil {
+		return ""
+	}
+	return string(*m)
+}
+
+func (m *progressMode) Set(s string) error {
+	switch v := progressMode(s); v {
+	case progressAuto, progressJSON, progressNone:
+		*m = v
+		return nil
+	}
+	return errors.Errorf("%q: must be auto, json or none", s)
+}
@@ -0,0 +1,401 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"image"
+	"io"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// jpegQuality is the quality of the JPEG output, the default of imaging.Encode.
+const jpegQuality = 95
+
+// The standard library's JPEG encoder is baseline only, so writeProgressiveJPEG is
+// a minimal progressive encoder of its own: no subsampling (4:4:4), the Huffman tables
+// of section K.3 of the spec, and spectral selection without successive approximation.
+// The scans are the DC of all the components, then the first 5 AC coefficients of each,
+// then the rest of each. The DC scan alone shows a blurred mosaic of 8x8 pixels squares.
+
+// jpegZigzag maps the zig-zag order to the natural order of the coefficients of a block.
+var jpegZigzag = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// jpegQuant are the quantization tables of section K.1 of the spec (luminance, chrominance),
+// in zig-zag order, unscaled.
+var jpegQuant = [2][64]byte{
+	{
+		16, 11, 12, 14, 12, 10, 16, 14,
+		13, 14, 18, 17, 16, 19, 24, 40,
+		26, 24, 22, 22, 24, 49, 35, 37,
+		29, 40, 58, 51, 61, 60, 57, 51,
+		56, 55, 64, 72, 92, 78, 64, 68,
+		87, 69, 55, 56, 80, 109, 81, 87,
+		95, 98, 103, 104, 103, 62, 77, 113,
+		121, 112, 100, 120, 92, 101, 103, 99,
+	},
+	{
+		17, 18, 18, 24, 21, 24, 47, 26,
+		26, 47, 99, 66, 56, 66, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+	},
+}
+
+// huffSpec is a Huffman table as written into the DHT segment:
+// count[i] codes of length i+1 bits, for the values in order.
+type huffSpec struct {
+	count [16]byte
+	value []byte
+}
+
+// jpegHuffman are the Huffman tables of section K.3 of the spec:
+// luminance DC and AC, chrominance DC and AC.
+// The AC tables have the 0|0 symbol, which is EOB in a baseline scan and EOBRUN=1 in a progressive one.
+var jpegHuffman = [4]huffSpec{
+	{
+		[16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125},
+		[]byte{
+			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12,
+			0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+			0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
+			0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+			0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16,
+			0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39,
+			0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+			0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
+			0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+			0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79,
+			0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98,
+			0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+			0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
+			0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+			0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4,
+			0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea,
+			0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+	{
+		[16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119},
+		[]byte{
+			0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21,
+			0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+			0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91,
+			0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+			0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34,
+			0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+			0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38,
+			0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+			0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+			0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+			0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+			0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+			0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96,
+			0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+			0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4,
+			0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+			0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2,
+			0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+			0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9,
+			0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+}
+
+// huffCode is a Huffman code: its bits, right aligned, and its length.
+type huffCode struct {
+	bits uint32
+	n    uint8
+}
+
+// codes of the values of the table, generated as in section C of the spec.
+func (s huffSpec) codes() [256]huffCode {
+	var codes [256]huffCode
+	code, k := uint32(0), 0
+	for i, c := range s.count {
+		for j := 0; j < int(c); j++ {
+			codes[s.value[k]] = huffCode{bits: code, n: uint8(i + 1)}
+			code++
+			k++
+		}
+		code <<= 1
+	}
+	return codes
+}
+
+// jpegDCTCos[u][x] is the (scaled) cosine of the 1-D forward DCT.
+var jpegDCTCos = func() (c [8][8]float64) {
+	for u := 0; u < 8; u++ {
+		s := 0.5
+		if u == 0 {
+			s = math.Sqrt(0.125)
+		}
+		for x := 0; x < 8; x++ {
+			c[u][x] = s * math.Cos(float64((2*x+1)*u)*math.Pi/16)
+		}
+	}
+	return c
+}()
+
+// jpegBlock is a quantized block of coefficients, in zig-zag order.
+type jpegBlock [64]int16
+
+// writeProgressiveJPEG encodes img as a progressive JPEG of the quality (1-100).
+// A gray image is written with one component, anything else as YCbCr.
+//
+// All the quantized blocks are kept in memory, 6 bytes per pixel of a color image.
+func writeProgressiveJPEG(w io.Writer, img image.Image, quality int) error {
+	b := img.Bounds()
+	if b.Dx() <= 0 || b.Dy() <= 0 || b.Dx() > math.MaxUint16 || b.Dy() > math.MaxUint16 {
+		return errors.Errorf("%dx%d: JPEG must be between 1x1 and 65535x65535", b.Dx(), b.Dy())
+	}
+	quality = min(max(quality, 1), 100)
+	scale := 200 - 2*quality
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+	var quant [2][64]byte
+	for i := range quant {
+		for j, q := range jpegQuant[i] {
+			quant[i][j] = byte(min(max((int(q)*scale+50)/100, 1), 255))
+		}
+	}
+
+	gray, isGray := img.(*image.Gray)
+	ncomp := 3
+	if isGray {
+		ncomp = 1
+	}
+	bw, bh := (b.Dx()+7)/8, (b.Dy()+7)/8
+	blocks := make([][]jpegBlock, ncomp)
+	for c := range blocks {
+		blocks[c] = make([]jpegBlock, bw*bh)
+	}
+	var pix [3][64]float64
+	for by := 0; by < bh; by++ {
+		for bx := 0; bx < bw; bx++ {
+			for i := 0; i < 64; i++ {
+				// The pixels beyond the edges repeat the last row and column.
+				x := min(b.Min.X+8*bx+i%8, b.Max.X-1)
+				y := min(b.Min.Y+8*by+i/8, b.Max.Y-1)
+				if isGray {
+					pix[0][i] = float64(gray.GrayAt(x, y).Y)
+					continue
+				}
+				r, g, bl := jpegRGB(img, x, y)
+				pix[0][i] = 0.299*r + 0.587*g + 0.114*bl
+				pix[1][i] = -0.168736*r - 0.331264*g + 0.5*bl + 128
+				pix[2][i] = 0.5*r - 0.418688*g - 0.081312*bl + 128
+			}
+			for c := 0; c < ncomp; c++ {
+				blocks[c][by*bw+bx] = jpegFDCT(&pix[c], &quant[min(c, 1)])
+			}
+		}
+	}
+
+	bw2 := bufio.NewWriter(w)
+	e := jpegWriter{w: bw2}
+	e.marker(0xd8, nil) // SOI
+	for i := 0; i < min(ncomp, 2); i++ {
+		e.marker(0xdb, append([]byte{byte(i)}, quant[i][:]...)) // DQT
+	}
+	sof := binary.BigEndian.AppendUint16([]byte{8}, uint16(b.Dy()))
+	sof = binary.BigEndian.AppendUint16(sof, uint16(b.Dx()))
+	sof = append(sof, byte(ncomp))
+	for c := 0; c < ncomp; c++ {
+		sof = append(sof, byte(c+1), 0x11, byte(min(c, 1)))
+	}
+	e.marker(0xc2, sof) // SOF2, progressive DCT
+	var codes [4][256]huffCode
+	for i := 0; i < 2*min(ncomp, 2); i++ {
+		h := jpegHuffman[i]
+		e.marker(0xc4, append(append([]byte{byte(i/2 | i%2<<4)}, h.count[:]...), h.value...)) // DHT
+		codes[i] = h.codes()
+	}
+
+	// The DC scan interleaves the components, each of a block per MCU.
+	sos := []byte{byte(ncomp)}
+	for c := 0; c < ncomp; c++ {
+		sos = append(sos, byte(c+1), byte(min(c, 1)<<4|min(c, 1)))
+	}
+	e.marker(0xda, append(sos, 0, 0, 0)) // SOS
+	var pred [3]int
+	for i := 0; i < bw*bh; i++ {
+		for c := 0; c < ncomp; c++ {
+			dc := int(blocks[c][i][0])
+			e.value(&codes[2*min(c, 1)], 0, dc-pred[c])
+			pred[c] = dc
+		}
+	}
+	e.flush()
+	for _, band := range [][2]int{{1, 5}, {6, 63}} {
+		for c := 0; c < ncomp; c++ {
+			e.marker(0xda, []byte{1, byte(c + 1), byte(min(c, 1)<<4 | min(c, 1)), byte(band[0]), byte(band[1]), 0})
+			ac := &codes[2*min(c, 1)+1]
+			for i := range blocks[c] {
+				run := 0
+				for _, v := range blocks[c][i][band[0] : band[1]+1] {
+					if v == 0 {
+						run++
+						continue
+					}
+					for ; run > 15; run -= 16 {
+						e.code(ac[0xf0]) // ZRL
+					}
+					e.value(ac, run, int(v))
+					run = 0
+				}
+				if run > 0 {
+					e.code(ac[0x00]) // EOB
+				}
+			}
+			e.flush()
+		}
+	}
+	e.marker(0xd9, nil) // EOI
+	if e.err != nil {
+		return e.err
+	}
+	return bw2.Flush()
+}
+
+// jpegRGB returns the color of the pixel, premultiplied as the standard library's encoder does.
+func jpegRGB(img image.Image, x, y int) (r, g, b float64) {
+	if m, ok := img.(*image.NRGBA); ok {
+		p := m.Pix[m.PixOffset(x, y):]
+		a := float64(p[3]) / 255
+		return float64(p[0]) * a, float64(p[1]) * a, float64(p[2]) * a
+	}
+	r32, g32, b32, _ := img.At(x, y).RGBA()
+	return float64(r32 >> 8), float64(g32 >> 8), float64(b32 >> 8)
+}
+
+// jpegFDCT returns the quantized DCT of the 8x8 samples.
+func jpegFDCT(pix *[64]float64, quant *[64]byte) jpegBlock {
+	var rows [64]float64
+	for y := 0; y < 8; y++ {
+		for u := 0; u < 8; u++ {
+			var s float64
+			for x := 0; x < 8; x++ {
+				s += jpegDCTCos[u][x] * (pix[8*y+x] - 128)
+			}
+			rows[8*y+u] = s
+		}
+	}
+	var blk jpegBlock
+	for i, n := range jpegZigzag {
+		u, v := n%8, n/8
+		var s float64
+		for y := 0; y < 8; y++ {
+			s += jpegDCTCos[v][y] * rows[8*y+u]
+		}
+		// The tables code up to 10 bits of an AC, and 11 bits of the difference of two DCs.
+		blk[i] = int16(min(max(math.Round(s/float64(quant[i])), -1023), 1023))
+	}
+	return blk
+}
+
+// jpegWriter writes the segments and the entropy coded data of a JPEG,
+// remembering the first error.
+type jpegWriter struct {
+	w     *bufio.Writer
+	err   error
+	acc   uint32
+	nBits uint
+}
+
+// marker writes a segment: the marker and its data, if any, with its length.
+func (e *jpegWriter) marker(m byte, data []byte) {
+	if e.err != nil {
+		return
+	}
+	_, e.err = e.w.Write([]byte{0xff, m})
+	if data != nil && e.err == nil {
+		_, e.err = e.w.Write(binary.BigEndian.AppendUint16(nil, uint16(len(data)+2)))
+		if e.err == nil {
+			_, e.err = e.w.Write(data)
+		}
+	}
+}
+
+// bits writes the n low bits of v, stuffing a zero after each 0xff byte.
+func (e *jpegWriter) bits(v uint32, n uint) {
+	e.acc = e.acc<<n | v&(1<<n-1)
+	e.nBits += n
+	for e.nBits >= 8 {
+		e.nBits -= 8
+		c := byte(e.acc >> e.nBits)
+		if e.err == nil {
+			e.err = e.w.WriteByte(c)
+		}
+		if c == 0xff && e.err == nil {
+			e.err = e.w.WriteByte(0)
+		}
+	}
+}
+
+func (e *jpegWriter) code(c huffCode) { e.bits(c.bits, uint(c.n)) }
+
+// value writes the Huffman code of the run and the size of v, then the bits of v.
+func (e *jpegWriter) value(codes *[256]huffCode, run, v int) {
+	a := v
+	if v < 0 {
+		a, v = -v, v-1
+	}
+	n := 0
+	for ; a > 0; a >>= 1 {
+		n++
+	}
+	e.code(codes[run<<4|n])
+	e.bits(uint32(v), uint(n))
+}
+
+// flush pads the last byte of the scan with one bits.
+func (e *jpegWriter) flush() {
+	if e.nBits > 0 {
+		e.bits(1<<(8-e.nBits)-1, 8-e.nBits)
+	}
+	e.acc, e.nBits = 0, 0
+}
@@ -0,0 +1,118 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+func TestProgressiveJPEG(t *testing.T) {
+	for _, tc := range []struct {
+		Name string
+		Img  image.Image
+	}{
+		{Name: "1x1", Img: solidImage(1, 1, color.NRGBA{R: 200, G: 100, B: 50, A: 255})},
+		{Name: "8x8", Img: synthImage(1, 8, 8)},
+		// partial blocks at the right and the bottom
+		{Name: "17x9", Img: synthImage(2, 17, 9)},
+		{Name: "200x130", Img: synthImage(3, 200, 130)},
+		{Name: "gray", Img: imageGray(synthImage(4, 64, 64))},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeProgressiveJPEG(&buf, tc.Img, jpegQuality); err != nil {
+				t.Fatal(err)
+			}
+			markers, err := jpegMarkers(buf.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var sof0, sof2, sos int
+			for _, m := range markers {
+				switch m {
+				case 0xc0:
+					sof0++
+				case 0xc2:
+					sof2++
+				case markerSOS:
+					sos++
+				}
+			}
+			if sof2 != 1 || sof0 != 0 || sos < 2 {
+				t.Errorf("got %d progressive and %d baseline frame headers, %d scans; wanted a progressive frame of several scans (markers % x)",
+					sof2, sof0, sos, markers)
+			}
+			img, err := jpeg.Decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := img.Bounds(), tc.Img.Bounds(); got != want {
+				t.Fatalf("got %v, wanted %v", got, want)
+			}
+			if d := meanAbsDiff(img, tc.Img); d > 4 {
+				t.Errorf("differs from the image by %.1f", d)
+			}
+		})
+	}
+}
+
+// imageGray returns the image as an *image.Gray.
+func imageGray(img image.Image) *image.Gray {
+	gray := image.NewGray(img.Bounds())
+	for y := img.Bounds().Min.Y; y < img.Bounds().Max.Y; y++ {
+		for x := img.Bounds().Min.X; x < img.Bounds().Max.X; x++ {
+			gray.Set(x, y, img.At(x, y))
+		}
+	}
+	return gray
+}
+
+// jpegMarkers returns the markers of the JPEG, up to its EOI, skipping the entropy-coded data.
+func jpegMarkers(b []byte) ([]byte, error) {
+	frame, err := readJPEGFrame(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		return nil, err
+	}
+	if len(frame) != len(b) {
+		return nil, fmt.Errorf("%d bytes after the EOI", len(b)-len(frame))
+	}
+	markers := []byte{markerSOI}
+	for i := 2; i+1 < len(frame); {
+		if frame[i] != 0xff {
+			i++
+			continue
+		}
+		m := frame[i+1]
+		switch {
+		case m == 0 || m == 0xff || m >= 0xd0 && m <= 0xd7:
+			// stuffed byte, fill or restart marker
+			i += 2
+			continue
+		}
+		markers = append(markers, m)
+		if m == markerEOI {
+			break
+		}
+		i += 2 + (int(frame[i+2])<<8 | int(frame[i+3]))
+	}
+	return markers, nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+
+	"github.com/disintegration/imaging"
+	"github.com/pkg/errors"
+)
+
+// proofSize is the longer side of each image of a -proof.
+const proofSize = 1024
+
+// downscale returns the image fitted into size*size, for comparing it: never enlarged.
+func downscale(img image.Image, size int) *image.NRGBA {
+	return imaging.Fit(img, size, size, imaging.Lanczos)
+}
+
+// proofImage returns the mosaic downscaled, and the target resized to the same size, side by side:
+// the target on the left - or on the top, if they are wider than tall.
+func proofImage(target, mosaic image.Image) *image.NRGBA {
+	m := downscale(mosaic, proofSize)
+	w, h := m.Rect.Dx(), m.Rect.Dy()
+	t := imaging.Resize(target, w, h, imaging.Lanczos)
+	if w > h {
+		proof := imaging.New(w, 2*h, color.NRGBA{})
+		return imaging.Paste(imaging.Paste(proof, t, image.Point{}), m, image.Pt(0, h))
+	}
+	proof := imaging.New(2*w, h, color.NRGBA{})
+	return imaging.Paste(imaging.Paste(proof, t, image.Point{}), m, image.Pt(w, 0))
+}
+
+// writeProof writes the proofImage of the target and the mosaic to the file.
+func writeProof(ctx context.Context, opts Options, targetFn string, mosaic image.Image) error {
+	b := mosaic.Bounds()
+	target, err := openTarget(ctx, targetFn, b.Dx(), b.Dy(), opts.RasterizeCmd)
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(imaging.Save(proofImage(target, mosaic), opts.Proof), opts.Proof)
+}
@@ -0,0 +1,93 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"path/filepath"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestProofImage(t *testing.T) {
+	red, blue := color.NRGBA{R: 255, A: 255}, color.NRGBA{B: 255, A: 255}
+	for _, tc := range []struct {
+		Name   string
+		Mosaic image.Point
+		Size   image.Point
+		// TargetEnd is the far corner of the target, MosaicOrigin the near one of the mosaic
+		TargetEnd, MosaicOrigin image.Point
+	}{
+		// downscaled to proofSize wide, stacked
+		{Name: "wide", Mosaic: image.Pt(2048, 1024), Size: image.Pt(1024, 1024), TargetEnd: image.Pt(1024, 512), MosaicOrigin: image.Pt(0, 512)},
+		// not enlarged, side by side
+		{Name: "tall", Mosaic: image.Pt(300, 600), Size: image.Pt(600, 600), TargetEnd: image.Pt(300, 600), MosaicOrigin: image.Pt(300, 0)},
+		{Name: "square", Mosaic: image.Pt(500, 500), Size: image.Pt(1000, 500), TargetEnd: image.Pt(500, 500), MosaicOrigin: image.Pt(500, 0)},
+		{Name: "large square", Mosaic: image.Pt(3000, 3000), Size: image.Pt(2*proofSize, proofSize), TargetEnd: image.Pt(proofSize, proofSize), MosaicOrigin: image.Pt(proofSize, 0)},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			// the target is of another aspect: resized to the mosaic's
+			proof := proofImage(solidImage(77, 33, red), solidImage(tc.Mosaic.X, tc.Mosaic.Y, blue))
+			if got := proof.Rect.Size(); got != tc.Size {
+				t.Fatalf("got %v, wanted %v", got, tc.Size)
+			}
+			for _, p := range []struct {
+				At   image.Point
+				Want color.NRGBA
+			}{
+				{At: image.Pt(1, 1), Want: red},
+				{At: tc.TargetEnd.Sub(image.Pt(2, 2)), Want: red},
+				{At: tc.MosaicOrigin.Add(image.Pt(1, 1)), Want: blue},
+				{At: tc.Size.Sub(image.Pt(2, 2)), Want: blue},
+			} {
+				if got := proof.NRGBAAt(p.At.X, p.At.Y); !isTileColor(got, []color.NRGBA{p.Want}) {
+					t.Errorf("%v: got %v, wanted %v", p.At, got, p.Want)
+				}
+			}
+		})
+	}
+}
+
+func TestProof(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{writeImage(t, dir, "target.png", synthImage(8, 400, 200))}
+	for i := 0; i < 4; i++ {
+		files = append(files, writeImage(t, dir, string(rune('a'+i))+".png", synthImage(int64(i), Width, Width)))
+	}
+	opts := testOptions()
+	opts.Grid = Grid{Cols: 4, Rows: 2}
+	out := t.TempDir()
+	opts.Out, opts.Proof = filepath.Join(out, "out.png"), filepath.Join(out, "proof.png")
+	if err := Main(context.Background(), opts, files); err != nil && !isWarning(err) {
+		t.Fatal(err)
+	}
+	mosaic, err := imaging.Open(opts.Out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := imaging.Open(opts.Proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// wider than tall: stacked
+	m := downscale(mosaic, proofSize).Rect
+	if got, want := proof.Bounds().Size(), image.Pt(m.Dx(), 2*m.Dy()); got != want || m.Dx() <= m.Dy() {
+		t.Errorf("got a proof of %v, wanted %v, of the mosaic of %v", got, want, mosaic.Bounds())
+	}
+}
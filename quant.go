@@ -0,0 +1,136 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"image/color"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Precision of the FFT coefficients stored in the DB.
+//
+// Matching uses only the magnitudes of the coefficients,
+// so the quantized precisions store only those:
+// float32 as is, int16 the logarithm scaled to the entry's maximum.
+type Precision string
+
+const (
+	PrecisionFull    = Precision("full")
+	PrecisionFloat32 = Precision("float32")
+	PrecisionInt16   = Precision("int16")
+)
+
+func (p Precision) String() string { return string(p) }
+func (p *Precision) Set(s string) error {
+	switch x := Precision(s); x {
+	case PrecisionFull, PrecisionFloat32, PrecisionInt16:
+		*p = x
+		return nil
+	}
+	return errors.Errorf("unknown precision %q", s)
+}
+
+// checkPrecision refuses a DB of the precision for the metric comparing the phase,
+// which the quantized precisions don't store.
+func (m Metric) checkPrecision(prec Precision) error {
+	if m.usesPhase() && prec != "" && prec != PrecisionFull {
+		return errors.Errorf("-metric %s needs the phase of the coefficients, which a %s precision DB does not store", m, prec)
+	}
+	return nil
+}
+
+// quantThumbnail is the stored form of a Thumbnail in a quantized DB.
+type quantThumbnail struct {
+	Name    string
+	ModTime time.Time
+	Size    int64
+	Color   color.NRGBA
+	Hash    string
+	Params  FeatureParams
+	Pix     []byte
+	// LastUsed, Features, Exif, Failed and AliasOf are Thumbnail's.
+	LastUsed time.Time
+	Features map[string][]byte
+	Exif     *Exif
+	Failed   string
+	AliasOf  string
+
+	Mag32 []float32
+	Mag16 []int16
+	// Scale of Mag16: the magnitude is exp(Mag16*Scale)-1.
+	Scale float32
+}
+
+func quantize(t Thumbnail, prec Precision) quantThumbnail {
+	q := quantThumbnail{
+		Name: t.Name, ModTime: t.ModTime, Size: t.Size,
+		Color: t.Color, Hash: t.Hash, Params: t.Params, Pix: t.Pix, LastUsed: t.LastUsed, Features: t.Features, Exif: t.Exif, Failed: t.Failed, AliasOf: t.AliasOf,
+	}
+	if t.Failed != "" || t.AliasOf != "" {
+		return q // no coefficients
+	}
+	switch prec {
+	case PrecisionFloat32:
+		q.Mag32 = make([]float32, len(t.FFT))
+		for i, c := range t.coeffs() {
+			q.Mag32[i] = float32(math.Sqrt(R(c)))
+		}
+	case PrecisionInt16:
+		logs := make([]float64, len(t.FFT))
+		var max float64
+		for i, c := range t.coeffs() {
+			logs[i] = math.Log1p(math.Sqrt(R(c)))
+			max = math.Max(max, logs[i])
+		}
+		if max > 0 {
+			q.Scale = float32(max / math.MaxInt16)
+		}
+		q.Mag16 = make([]int16, len(t.FFT))
+		for i, v := range logs {
+			if q.Scale != 0 {
+				q.Mag16[i] = int16(math.Round(v / float64(q.Scale)))
+			}
+		}
+	}
+	return q
+}
+
+// thumbnail returns the in-memory form, with the magnitudes as real coefficients.
+func (q quantThumbnail) thumbnail() (Thumbnail, error) {
+	t := Thumbnail{
+		Name: q.Name, ModTime: q.ModTime, Size: q.Size,
+		Color: q.Color, Hash: q.Hash, Params: q.Params, Pix: q.Pix, LastUsed: q.LastUsed, Features: q.Features, Exif: q.Exif, Failed: q.Failed, AliasOf: q.AliasOf,
+	}
+	switch {
+	case q.Failed != "" || q.AliasOf != "":
+	case len(q.Mag32) == len(t.FFT):
+		t.FFT = new([Width * Width]complex128)
+		for i, m := range q.Mag32 {
+			t.FFT[i] = complex(float64(m), 0)
+		}
+	case len(q.Mag16) == len(t.FFT):
+		t.FFT = new([Width * Width]complex128)
+		for i, m := range q.Mag16 {
+			t.FFT[i] = complex(math.Expm1(float64(m)*float64(q.Scale)), 0)
+		}
+	default:
+		return t, errors.Errorf("got %d/%d coefficients, wanted %d", len(q.Mag32), len(q.Mag16), len(t.FFT))
+	}
+	return t, nil
+}
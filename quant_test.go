@@ -0,0 +1,167 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestQuantizeRoundTrip(t *testing.T) {
+	lib := synthLibrary(8)
+	for _, tc := range []struct {
+		Precision Precision
+		// Tolerance of the relative error of 1+magnitude.
+		Tolerance float64
+	}{
+		{Precision: PrecisionFloat32, Tolerance: 1e-6},
+		{Precision: PrecisionInt16, Tolerance: 1e-3},
+	} {
+		t.Run(tc.Precision.String(), func(t *testing.T) {
+			for k, want := range lib {
+				got, err := quantize(want, tc.Precision).thumbnail()
+				if err != nil {
+					t.Fatalf("%s: %+v", k, err)
+				}
+				if got.Name != want.Name || got.Color != want.Color || got.Params != want.Params {
+					t.Errorf("%s: got %+v, wanted %+v", k, got, want)
+				}
+				for i, c := range want.FFT {
+					w, g := 1+math.Sqrt(R(c)), 1+math.Sqrt(R(got.FFT[i]))
+					if d := math.Abs(g-w) / w; d > tc.Tolerance {
+						t.Fatalf("%s[%d]: got %g, wanted %g", k, i, g-1, w-1)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestQuantizeFailed(t *testing.T) {
+	for _, prec := range []Precision{PrecisionFloat32, PrecisionInt16} {
+		if got, err := quantize(Thumbnail{Name: "x.png", Failed: "broken"}, prec).thumbnail(); err != nil {
+			t.Errorf("%s: %+v", prec, err)
+		} else if got.Failed != "broken" || got.FFT != nil {
+			t.Errorf("%s: got %+v", prec, got)
+		}
+	}
+}
+
+// quantPlacements returns the ratio of the targets placing another source
+// by the quantized library than by the full precision one.
+func quantPlacements(lib map[string]Thumbnail, prec Precision, targets int) float64 {
+	files := make([]string, 0, len(lib))
+	quantized := make(map[string]Thumbnail, len(lib))
+	for k, t := range lib {
+		files = append(files, k)
+		quantized[k], _ = quantize(t, prec).thumbnail()
+	}
+	opts := MatchOptions{Metric: MetricFFT, ColorWeight: 1, TopM: 1}
+	full, quant := newMatcher(lib, files, opts), newMatcher(quantized, files, opts)
+	var changed int
+	for i := 0; i < targets; i++ {
+		img := synthImage(int64(len(lib)+i), Width, Width)
+		if full.Nearest(img) != quant.Nearest(img) {
+			changed++
+		}
+	}
+	return float64(changed) / float64(targets)
+}
+
+func TestQuantizedPlacements(t *testing.T) {
+	lib := synthLibrary(50)
+	for _, tc := range []struct {
+		Precision Precision
+		Max       float64
+	}{
+		{Precision: PrecisionFloat32, Max: 0},
+		{Precision: PrecisionInt16, Max: 0.01},
+	} {
+		if got := quantPlacements(lib, tc.Precision, 100); got > tc.Max {
+			t.Errorf("%s changed %.2f%% of the placements, wanted at most %.2f%%", tc.Precision, 100*got, 100*tc.Max)
+		}
+	}
+}
+
+func BenchmarkQuantizedPlacements(b *testing.B) {
+	lib := synthLibrary(200)
+	for _, prec := range []Precision{PrecisionFloat32, PrecisionInt16} {
+		b.Run(prec.String(), func(b *testing.B) {
+			b.ReportAllocs()
+			var changed float64
+			for i := 0; i < b.N; i++ {
+				changed = quantPlacements(lib, prec, 500)
+			}
+			b.ReportMetric(100*changed, "changed-%")
+		})
+	}
+}
+
+func TestPhasePrecision(t *testing.T) {
+	for _, tc := range []struct {
+		Stored, Converted Precision
+		WantErr           bool
+	}{
+		{Stored: PrecisionFull},
+		{Stored: PrecisionFloat32, WantErr: true},
+		{Stored: PrecisionInt16, WantErr: true},
+		{Stored: PrecisionFull, Converted: PrecisionInt16, WantErr: true},
+		// the stored entries have no phase to convert back
+		{Stored: PrecisionInt16, Converted: PrecisionFull, WantErr: true},
+	} {
+		name := tc.Stored.String()
+		if tc.Converted != "" {
+			name += " to " + tc.Converted.String()
+		}
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			files := testLibrary(t, dir, 3)
+			opts := testOptions()
+			opts.DB = filepath.Join(dir, "mosaic.db")
+			opts.DBPrecision = tc.Stored
+			ctx := context.Background()
+			if _, _, err := prepareThumbnails(ctx, opts, append([]string(nil), files...), new(Timings)); err != nil {
+				t.Fatal(err)
+			}
+			opts.DBPrecision = tc.Converted
+			opts.Match.Metric = MetricPhase
+			b := NewBuilder(opts)
+			err := b.AddSources(ctx, files)
+			if tc.WantErr {
+				if err == nil || !strings.Contains(err.Error(), "phase") {
+					t.Errorf("got %v, wanted the DB refused", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the same match as of the sources computed now
+			target := synthImage(1, Width, Width)
+			fresh := NewBuilder(opts)
+			fresh.opts.DB = ""
+			if err := fresh.AddSources(ctx, files); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := b.getMatcher().Nearest(target), fresh.getMatcher().Nearest(target); got != want || got != files[1] {
+				t.Errorf("got %q, wanted %q", got, want)
+			}
+		})
+	}
+}
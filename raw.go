@@ -0,0 +1,101 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/pkg/errors"
+)
+
+// rawDecodeFunc decodes a camera RAW file.
+type rawDecodeFunc func(ctx context.Context, fn string) (image.Image, error)
+
+// rawDecoders by lowercase file extension, registered by the optional (build tagged) decoders.
+var rawDecoders = make(map[string]rawDecodeFunc)
+
+// rawExts are the extensions of the camera RAW formats -raw-cmd is used for.
+var rawExts = map[string]bool{
+	".cr2": true, ".cr3": true, ".nef": true, ".nrw": true, ".arw": true, ".srf": true, ".sr2": true,
+	".dng": true, ".orf": true, ".rw2": true, ".raf": true, ".pef": true, ".srw": true, ".raw": true,
+}
+
+// rawCmd is the command decoding a RAW file to a TIFF, PNG or JPEG (see decodeRawCmd).
+var rawCmd string
+
+// isRaw reports whether the file is a camera RAW, by its extension.
+func isRaw(fn string) bool { return rawExts[strings.ToLower(filepath.Ext(fn))] }
+
+// openRaw decodes the camera RAW file, by the command if given, or by a built-in decoder.
+func openRaw(ctx context.Context, fn string) (image.Image, error) {
+	if rawCmd != "" {
+		return decodeRawCmd(ctx, rawCmd, fn)
+	}
+	ext := strings.ToLower(filepath.Ext(fn))
+	if decode := rawDecoders[ext]; decode != nil {
+		return decode(ctx, fn)
+	}
+	return nil, errors.Wrapf(errNoRawDecoder, "%s: use -raw-cmd or build with -tags libraw", ext)
+}
+
+// errNoRawDecoder is returned by openRaw without a decoder: that's not a failure of the file.
+var errNoRawDecoder = errors.New("no RAW decoder")
+
+// decodeRawCmd runs the command, after replacing {in} in its arguments with the RAW file,
+// and decodes the image it writes to its standard output - or to {out}, if that's in the arguments.
+func decodeRawCmd(ctx context.Context, cmd, fn string) (image.Image, error) {
+	args := strings.Fields(cmd)
+	if len(args) == 0 {
+		return nil, errors.New("empty -raw-cmd")
+	}
+	var out string
+	for _, a := range args {
+		if strings.Contains(a, "{out}") {
+			fh, err := os.CreateTemp("", "mosaic-raw-*.tif")
+			if err != nil {
+				return nil, err
+			}
+			out = fh.Name()
+			fh.Close()
+			defer os.Remove(out)
+			break
+		}
+	}
+	r := strings.NewReplacer("{in}", fn, "{out}", out)
+	for i, a := range args {
+		args[i] = r.Replace(a)
+	}
+	c := exec.CommandContext(ctx, args[0], args[1:]...)
+	c.Stderr = os.Stderr
+	var stdout bytes.Buffer
+	if out == "" {
+		c.Stdout = &stdout
+	}
+	if err := c.Run(); err != nil {
+		return nil, errors.Wrapf(err, "%q", args)
+	}
+	if out != "" {
+		return imaging.Open(out)
+	}
+	return imaging.Decode(&stdout)
+}
@@ -0,0 +1,86 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+//go:build libraw
+// +build libraw
+
+package main
+
+/*
+#cgo LDFLAGS: -lraw
+#include <stdlib.h>
+#include <libraw/libraw.h>
+*/
+import "C"
+
+import (
+	"context"
+	"image"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	for ext := range rawExts {
+		rawDecoders[ext] = decodeLibRaw
+	}
+}
+
+// decodeLibRaw develops the RAW file with LibRaw, with the camera's white balance, to 8 bits RGB.
+//
+// LibRaw can't be interrupted, so ctx is checked only before starting.
+func decodeLibRaw(ctx context.Context, fn string) (image.Image, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	lr := C.libraw_init(0)
+	if lr == nil {
+		return nil, errors.New("libraw_init failed")
+	}
+	defer C.libraw_close(lr)
+	cfn := C.CString(fn)
+	defer C.free(unsafe.Pointer(cfn))
+	lrErr := func(what string, rc C.int) error {
+		return errors.Errorf("%s: %s", what, C.GoString(C.libraw_strerror(rc)))
+	}
+	if rc := C.libraw_open_file(lr, cfn); rc != C.LIBRAW_SUCCESS {
+		return nil, lrErr("open", rc)
+	}
+	lr.params.use_camera_wb = 1
+	lr.params.output_bps = 8
+	if rc := C.libraw_unpack(lr); rc != C.LIBRAW_SUCCESS {
+		return nil, lrErr("unpack", rc)
+	}
+	if rc := C.libraw_dcraw_process(lr); rc != C.LIBRAW_SUCCESS {
+		return nil, lrErr("process", rc)
+	}
+	var rc C.int
+	mem := C.libraw_dcraw_make_mem_image(lr, &rc)
+	if mem == nil {
+		return nil, lrErr("make image", rc)
+	}
+	defer C.libraw_dcraw_clear_mem(mem)
+	if mem._type != C.LIBRAW_IMAGE_BITMAP || mem.colors != 3 || mem.bits != 8 {
+		return nil, errors.Errorf("unsupported image: type %d, %d colors of %d bits", mem._type, mem.colors, mem.bits)
+	}
+	w, h := int(mem.width), int(mem.height)
+	rgb := unsafe.Slice((*byte)(unsafe.Pointer(&mem.data[0])), w*h*3)
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for i, j := 0, 0; i < len(rgb); i, j = i+3, j+4 {
+		img.Pix[j], img.Pix[j+1], img.Pix[j+2], img.Pix[j+3] = rgb[i], rgb[i+1], rgb[i+2], 0xff
+	}
+	return img, nil
+}
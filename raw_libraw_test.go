@@ -0,0 +1,172 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+//go:build libraw
+// +build libraw
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestLibRaw(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{filepath.Join(dir, "linear.dng")}
+	if err := os.WriteFile(files[0], linearDNG(2*Width, Width), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// a real camera RAW can be given, too
+	if fn := os.Getenv("MOSAIC_RAW_SAMPLE"); fn != "" {
+		files = append(files, fn)
+	}
+	ctx := context.Background()
+	for _, fn := range files {
+		t.Run(filepath.Base(fn), func(t *testing.T) {
+			img, err := decodeLibRaw(ctx, fn)
+			if err != nil {
+				t.Fatalf("%+v", err)
+			}
+			b := img.Bounds()
+			if b.Dx() < Width || b.Dy() < Width {
+				t.Fatalf("got %v", b.Size())
+			}
+			if fn == files[0] {
+				// dark on the left, light on the right
+				gray := func(x int) uint32 {
+					r, g, bl, _ := img.At(x, b.Dy()/2).RGBA()
+					return (r + g + bl) / 3
+				}
+				if left, right := gray(b.Dx()/4), gray(b.Dx()*3/4); left >= right {
+					t.Errorf("got %d on the left, %d on the right, wanted it lighter", left, right)
+				}
+			}
+			thumbnails, _, err := prepareThumbnails(ctx, testOptions(), []string{fn}, new(Timings))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e, ok := thumbnails[fn]; !ok || e.Failed != "" || len(e.FFT) == 0 {
+				t.Errorf("got %+v, wanted an indexed entry", e)
+			}
+		})
+	}
+}
+
+// linearDNG returns a minimal uncompressed, linear (demosaiced) 16 bits RGB DNG
+// of the size, dark on the left half, light on the right.
+func linearDNG(width, height int) []byte {
+	type entry struct {
+		tag, typ uint16
+		count    uint32
+		data     []byte
+	}
+	le := binary.LittleEndian
+	shorts := func(vs ...uint16) []byte {
+		b := make([]byte, 2*len(vs))
+		for i, v := range vs {
+			le.PutUint16(b[2*i:], v)
+		}
+		return b
+	}
+	longs := func(vs ...uint32) []byte {
+		b := make([]byte, 4*len(vs))
+		for i, v := range vs {
+			le.PutUint32(b[4*i:], v)
+		}
+		return b
+	}
+	const (
+		typeByte, typeASCII, typeShort, typeLong, typeRational, typeSRational = 1, 2, 3, 4, 5, 10
+	)
+	pix := make([]byte, 0, width*height*6)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := uint16(0x1000)
+			if x >= width/2 {
+				v = 0xc000
+			}
+			pix = append(pix, shorts(v, v, v)...)
+		}
+	}
+	identity := longs(1, 1, 0, 1, 0, 1, 0, 1, 1, 1, 0, 1, 0, 1, 0, 1, 1, 1)
+	entries := []entry{
+		{254, typeLong, 1, longs(0)},                        // NewSubFileType: the main image
+		{256, typeLong, 1, longs(uint32(width))},            // ImageWidth
+		{257, typeLong, 1, longs(uint32(height))},           // ImageLength
+		{258, typeShort, 3, shorts(16, 16, 16)},             // BitsPerSample
+		{259, typeShort, 1, shorts(1)},                      // Compression: none
+		{262, typeShort, 1, shorts(34892)},                  // PhotometricInterpretation: LinearRaw
+		{271, typeASCII, 5, []byte("Test\x00")},             // Make
+		{272, typeASCII, 5, []byte("Test\x00")},             // Model
+		{273, typeLong, 1, nil},                             // StripOffsets, set below
+		{274, typeShort, 1, shorts(1)},                      // Orientation
+		{277, typeShort, 1, shorts(3)},                      // SamplesPerPixel
+		{278, typeLong, 1, longs(uint32(height))},           // RowsPerStrip
+		{279, typeLong, 1, longs(uint32(len(pix)))},         // StripByteCounts
+		{284, typeShort, 1, shorts(1)},                      // PlanarConfiguration: chunky
+		{50706, typeByte, 4, []byte{1, 4, 0, 0}},            // DNGVersion
+		{50707, typeByte, 4, []byte{1, 1, 0, 0}},            // DNGBackwardVersion
+		{50708, typeASCII, 10, []byte("Test Test\x00")},     // UniqueCameraModel
+		{50717, typeLong, 3, longs(0xffff, 0xffff, 0xffff)}, // WhiteLevel
+		{50721, typeSRational, 9, identity},                 // ColorMatrix1
+		{50728, typeRational, 3, longs(1, 1, 1, 1, 1, 1)},   // AsShotNeutral
+		{50778, typeShort, 1, shorts(21)},                   // CalibrationIlluminant1: D65
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+	// the header, the IFD, then the values not fitting into the entries, then the pixels
+	ifdEnd := 8 + 2 + 12*len(entries) + 4
+	var extra bytes.Buffer
+	offsets := make([]int, len(entries))
+	for i, e := range entries {
+		offsets[i] = -1
+		if len(e.data) > 4 {
+			offsets[i] = ifdEnd + extra.Len()
+			extra.Write(e.data)
+			if extra.Len()%2 != 0 {
+				extra.WriteByte(0)
+			}
+		}
+	}
+	pixOffset := ifdEnd + extra.Len()
+	var buf bytes.Buffer
+	buf.Write([]byte("II"))
+	buf.Write(shorts(42))
+	buf.Write(longs(8))
+	buf.Write(shorts(uint16(len(entries))))
+	for i, e := range entries {
+		if e.tag == 273 {
+			e.data = longs(uint32(pixOffset))
+		}
+		buf.Write(shorts(e.tag, e.typ))
+		buf.Write(longs(e.count))
+		if offsets[i] >= 0 {
+			buf.Write(longs(uint32(offsets[i])))
+		} else {
+			var v [4]byte
+			copy(v[:], e.data)
+			buf.Write(v[:])
+		}
+	}
+	buf.Write(longs(0)) // no next IFD
+	buf.Write(extra.Bytes())
+	buf.Write(pix)
+	return buf.Bytes()
+}
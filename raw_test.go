@@ -0,0 +1,91 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestRawCmd(t *testing.T) {
+	dir := t.TempDir()
+	// a PNG named as a RAW: the command "develops" it by copying
+	fn := filepath.Join(dir, "photo.nef")
+	fh, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = png.Encode(fh, synthImage(1, Width, Width))
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(cmd string) { rawCmd = cmd }(rawCmd)
+	for _, tc := range []struct {
+		Name, Cmd string
+		WantErr   bool
+	}{
+		{Name: "stdout", Cmd: "cat {in}"},
+		{Name: "out file", Cmd: "cp {in} {out}"},
+		{Name: "failing", Cmd: "false {in}", WantErr: true},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			rawCmd = tc.Cmd
+			img, err := openRaw(context.Background(), fn)
+			if tc.WantErr {
+				if err == nil {
+					t.Error("no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size := img.Bounds().Size(); size != image.Pt(Width, Width) {
+				t.Errorf("got %v, wanted %dx%d", size, Width, Width)
+			}
+		})
+	}
+
+	t.Run("indexed", func(t *testing.T) {
+		rawCmd = "cat {in}"
+		thumbnails, _, err := prepareThumbnails(context.Background(), testOptions(), []string{fn}, new(Timings))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e := thumbnails[fn]; e.Failed != "" || len(e.FFT) == 0 {
+			t.Errorf("got %+v, wanted an indexed entry", e)
+		}
+	})
+
+	t.Run("no decoder", func(t *testing.T) {
+		if rawDecoders[".nef"] != nil {
+			t.Skip("built with a RAW decoder")
+		}
+		rawCmd = ""
+		if _, err := openRaw(context.Background(), fn); !errors.Is(err, errNoRawDecoder) {
+			t.Errorf("got %v, wanted %v", err, errNoRawDecoder)
+		}
+	})
+}
@@ -0,0 +1,96 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/pkg/errors"
+)
+
+// Region is the rectangle of the target to mosaic, in its pixels; the zero value is all of it.
+type Region image.Rectangle
+
+func (r Region) String() string {
+	if image.Rectangle(r).Empty() {
+		return ""
+	}
+	return fmt.Sprintf("%d,%d,%d,%d", r.Min.X, r.Min.Y, r.Max.X-r.Min.X, r.Max.Y-r.Min.Y)
+}
+
+// Set parses "X,Y,W,H": the top left corner, the width and the height.
+func (r *Region) Set(s string) error {
+	if s == "" {
+		*r = Region{}
+		return nil
+	}
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return errors.Errorf("%q: region must be X,Y,W,H", s)
+	}
+	var v [4]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil || n < 0 || i >= 2 && n == 0 {
+			return errors.Errorf("%q: bad %s %q", s, [...]string{"x", "y", "width", "height"}[i], p)
+		}
+		v[i] = n
+	}
+	*r = Region(image.Rect(v[0], v[1], v[0]+v[2], v[1]+v[3]))
+	return nil
+}
+
+func (r Region) isZero() bool { return image.Rectangle(r).Empty() }
+
+// crop the target to the region.
+func (r Region) crop(targetFn string, target image.Image) (image.Image, error) {
+	if r.isZero() {
+		return target, nil
+	}
+	if b := target.Bounds(); !image.Rectangle(r).Add(b.Min).In(b) {
+		return nil, errors.Errorf("%s: region %s is outside of the %dx%d image", targetFn, r, b.Dx(), b.Dy())
+	}
+	return imaging.Crop(target, image.Rectangle(r).Add(target.Bounds().Min)), nil
+}
+
+// compositeRegion pastes the mosaic of the region onto the target, resampled to the size of the region,
+// so the rest of the target is left as it was: the output is of the target's size.
+func compositeRegion(ctx context.Context, opts Options, targetFn string, plan Plan, mosaic *image.NRGBA) (*image.NRGBA, error) {
+	target, err := openTarget(ctx, targetFn, plan.Cols*Width, plan.Rows*Width, opts.RasterizeCmd)
+	if err != nil {
+		return nil, err
+	}
+	b := target.Bounds()
+	if need := int64(b.Dx()) * int64(b.Dy()) * 4; opts.MaxMem > 0 && need > int64(opts.MaxMem) {
+		return nil, errors.Errorf("the %dx%d output around the region would need %s of memory, more than -max-mem=%s",
+			b.Dx(), b.Dy(), ByteSize(need).human(), opts.MaxMem)
+	}
+	canvas := imaging.Clone(target)
+	r := image.Rectangle(opts.Region)
+	tiles := mosaic
+	if r.Size() != mosaic.Rect.Size() {
+		tiles = imaging.Resize(mosaic, r.Dx(), r.Dy(), imaging.Lanczos)
+	}
+	// over, so the target shows where there's no tile
+	draw.Draw(canvas, r.Intersect(canvas.Rect), tiles, image.Point{}, draw.Over)
+	return canvas, nil
+}
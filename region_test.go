@@ -0,0 +1,106 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"path/filepath"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestRegion(t *testing.T) {
+	dir := t.TempDir()
+	target := synthImage(-1, 300, 200)
+	files := []string{writeImage(t, dir, "target.png", target)}
+	colors := []color.NRGBA{{R: 250, G: 10, B: 10, A: 255}, {R: 10, G: 250, B: 10, A: 255}, {R: 10, G: 10, B: 250, A: 255}, {R: 128, G: 128, B: 128, A: 255}}
+	for i, c := range colors {
+		files = append(files, writeImage(t, dir, "src"+string(rune('a'+i))+".png", solidImage(Width, Width, c)))
+	}
+	for _, tc := range []struct {
+		Name   string
+		Region string
+		Grid   Grid
+	}{
+		{Name: "inside", Region: "60,40,120,80", Grid: Grid{Cols: 3, Rows: 2}},
+		// the cells of the mosaic are not the cells of the region: resampled non-uniformly
+		{Name: "stretched", Region: "10,20,200,50", Grid: Grid{Cols: 2, Rows: 2}},
+		{Name: "corner", Region: "200,100,100,100", Grid: Grid{Cols: 2, Rows: 2}},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			opts := testOptions()
+			opts.Grid = tc.Grid
+			opts.Match.Metric = MetricColor
+			if err := opts.Region.Set(tc.Region); err != nil {
+				t.Fatal(err)
+			}
+			opts.Out = filepath.Join(t.TempDir(), "out.png")
+			if err := Main(context.Background(), opts, append([]string(nil), files...)); err != nil && !isWarning(err) {
+				t.Fatal(err)
+			}
+			out, err := imaging.Open(opts.Out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := out.Bounds(); got != target.Bounds() {
+				t.Fatalf("got %v, wanted the size of the target, %v", got, target.Bounds())
+			}
+			got := imaging.Clone(out)
+			r := image.Rectangle(opts.Region)
+			for y := 0; y < target.Rect.Dy(); y++ {
+				for x := 0; x < target.Rect.Dx(); x++ {
+					if image.Pt(x, y).In(r) {
+						continue
+					}
+					if g, w := got.NRGBAAt(x, y), target.NRGBAAt(x, y); g != w {
+						t.Fatalf("%d,%d outside of the region: got %v, wanted the target's %v", x, y, g, w)
+					}
+				}
+			}
+			// each cell of the region is a tile: of one of the solid colors
+			cw, ch := r.Dx()/tc.Grid.Cols, r.Dy()/tc.Grid.Rows
+			for row := 0; row < tc.Grid.Rows; row++ {
+				for col := 0; col < tc.Grid.Cols; col++ {
+					cell := image.Rect(r.Min.X+col*cw, r.Min.Y+row*ch, r.Min.X+(col+1)*cw, r.Min.Y+(row+1)*ch).Inset(2)
+					c := got.NRGBAAt(cell.Min.X, cell.Min.Y)
+					if !isTileColor(c, colors) {
+						t.Errorf("r%d_c%d: got %v, wanted the color of a source", row, col, c)
+					}
+					for y := cell.Min.Y; y < cell.Max.Y; y++ {
+						for x := cell.Min.X; x < cell.Max.X; x++ {
+							if g := got.NRGBAAt(x, y); absDiff(g.R, c.R) > 2 || absDiff(g.G, c.G) > 2 || absDiff(g.B, c.B) > 2 {
+								t.Fatalf("r%d_c%d: %d,%d is %v, not %v: not a tile", row, col, x, y, g, c)
+							}
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+// isTileColor reports whether c is one of the colors, nearly.
+func isTileColor(c color.NRGBA, colors []color.NRGBA) bool {
+	for _, w := range colors {
+		if absDiff(c.R, w.R) <= 2 && absDiff(c.G, w.G) <= 2 && absDiff(c.B, w.B) <= 2 {
+			return true
+		}
+	}
+	return false
+}
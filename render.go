@@ -0,0 +1,357 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/pkg/errors"
+)
+
+// RenderOptions tune how the tiles are pasted onto the mosaic.
+type RenderOptions struct {
+	// Border is the width of the frame drawn on the tile edges, in pixels.
+	Border      int
+	BorderColor color.NRGBA
+	// Vignette darkens the tile towards its corners, 0 means none, 1 black corners.
+	Vignette float64
+	// Tint shifts the colors of each tile towards the average color of its cell of the target,
+	// 0 means not at all, 1 to have that average.
+	Tint float64
+	// Overlay is the opacity of the target blended over the mosaic, 0 means none, 1 only the target.
+	Overlay float64
+	// Background of the mosaic, where there's no tile.
+	Background color.NRGBA
+	// HiRes renders from the original sources, not the pixels stored in the DB.
+	HiRes bool
+	// Fit of the sources into the tiles; the features are computed on the same fit.
+	Fit Fit
+	// Supersample renders the tiles this many times larger, to downsample the mosaic; 0 and 1 mean not.
+	Supersample int
+	// Fast resamples the tiles with a box filter instead of Lanczos, for a preview.
+	Fast bool
+}
+
+// previewTileSize is the size of the tiles of a -preview.
+const previewTileSize = 16
+
+// preview returns the plan and the options rendering it quickly, as a thumbnail:
+// with previewTileSize tiles from the stored pixels, the borders scaled down.
+func (opts Options) preview(plan Plan) (Options, Plan) {
+	if b := opts.Render.Border; b > 0 {
+		opts.Render.Border = max(1, b*previewTileSize/plan.TileSize)
+	}
+	plan.TileSize = previewTileSize
+	opts.Render.HiRes, opts.Render.Supersample, opts.Render.Fast = false, 1, true
+	return opts, plan
+}
+
+// renderer prepares the tiles for pasting.
+// It remembers only the last tile, so the placements should come grouped by source.
+type renderer struct {
+	ctx        context.Context
+	opts       RenderOptions
+	size       int
+	thumbnails map[string]Thumbnail
+
+	lastKey  Placement
+	lastTile *image.NRGBA
+	// reads counts the original sources opened, cached the ones found in the composeCache.
+	reads, cached int
+}
+
+func newRenderer(ctx context.Context, opts Options, size int, thumbnails map[string]Thumbnail) *renderer {
+	return &renderer{ctx: ctx, opts: opts.Render, size: size, thumbnails: thumbnails}
+}
+
+// Tile returns the transformed and decorated tile of the placement.
+func (r *renderer) Tile(p Placement) (*image.NRGBA, error) {
+	key := p
+	key.Row, key.Col = 0, 0
+	if r.lastTile != nil && key == r.lastKey {
+		return r.lastTile, nil
+	}
+	img, err := r.source(p.Source)
+	if err != nil {
+		return nil, err
+	}
+	filter := imaging.Lanczos
+	if r.opts.Fast {
+		filter = imaging.Box
+	}
+	tile := r.opts.Fit.ApplyFilter(p.Transform.Apply(img), r.size, r.opts.Background, filter)
+	r.opts.decorate(tile)
+	r.lastKey, r.lastTile = key, tile
+	return tile, nil
+}
+
+// source returns the image of the source: the stored pixels if possible, or the original
+// (through the composeCache).
+func (r *renderer) source(path string) (image.Image, error) {
+	if t, ok := resolveAlias(r.thumbnails, path); ok && len(t.Pix) != 0 && !r.opts.HiRes {
+		img, err := jpeg.Decode(bytes.NewReader(t.Pix))
+		if err == nil {
+			return img, nil
+		}
+		log.Println(errors.Wrapf(err, "%s: stored pixels", path))
+	}
+	read := false
+	img, err := composeCache.Get(path, func() (image.Image, error) {
+		read = true
+		r.reads++
+		return openImage(r.ctx, path)
+	})
+	if err == nil && !read {
+		r.cached++
+	}
+	return img, err
+}
+
+// readStats tells the sources read for the tiles, for the logs: "from 12 source reads".
+func (r *renderer) readStats() string {
+	if r.cached == 0 {
+		return fmt.Sprintf("from %d source reads", r.reads)
+	}
+	return fmt.Sprintf("from %d source reads (and %d from the compose cache)", r.reads, r.cached)
+}
+
+// tilesLayout is the layout.json written by writeTiles.
+type tilesLayout struct {
+	Rows, Cols int
+	// TileSize is the width and height of a tile, in pixels.
+	TileSize int
+	Tiles    []layoutTile
+}
+
+// layoutTile is a tile file, with its position on the mosaic.
+type layoutTile struct {
+	Placement
+	X, Y int
+	File string
+}
+
+// writeTiles renders each tile of the plan into its own PNG in dir,
+// named by its row and column, and writes their layout.json.
+// A tile failing to render is left out, like from the mosaic.
+func writeTiles(ctx context.Context, opts Options, plan Plan, thumbnails map[string]Thumbnail, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, dir)
+	}
+	layout := tilesLayout{Rows: plan.Rows, Cols: plan.Cols, TileSize: plan.TileSize, Tiles: make([]layoutTile, 0, len(plan.Tiles))}
+	rnd := newRenderer(ctx, opts, plan.TileSize, thumbnails)
+	for _, p := range bySource(plan.Tiles) {
+		if err := ctx.Err(); err != nil {
+			return errors.Wrap(err, "rendering")
+		}
+		tile, err := rnd.Tile(p)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		name := fmt.Sprintf("r%03d_c%03d.png", p.Row, p.Col)
+		if err := imaging.Save(tile, filepath.Join(dir, name)); err != nil {
+			return errors.Wrap(err, name)
+		}
+		cell := plan.Cell(p)
+		layout.Tiles = append(layout.Tiles, layoutTile{Placement: p, X: cell.Min.X, Y: cell.Min.Y, File: name})
+	}
+	sort.Slice(layout.Tiles, func(i, j int) bool {
+		a, b := layout.Tiles[i], layout.Tiles[j]
+		return a.Row < b.Row || a.Row == b.Row && a.Col < b.Col
+	})
+	b, err := json.MarshalIndent(layout, "", "  ")
+	if err != nil {
+		return err
+	}
+	fn := filepath.Join(dir, "layout.json")
+	if err := os.WriteFile(fn, b, 0644); err != nil {
+		return errors.Wrap(err, fn)
+	}
+	log.Printf("wrote %d tiles to %q %s", len(layout.Tiles), dir, rnd.readStats())
+	return nil
+}
+
+// bySource returns the placements ordered by source and transform,
+// so each source is read only once by the renderer.
+// The cells don't overlap, so the order of pasting does not change the output.
+func bySource(tiles []Placement) []Placement {
+	sorted := append([]Placement(nil), tiles...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		if a.Transform.Rotate != b.Transform.Rotate {
+			return a.Transform.Rotate < b.Transform.Rotate
+		}
+		if a.Transform.FlipH != b.Transform.FlipH {
+			return !a.Transform.FlipH
+		}
+		return !a.Transform.FlipV && b.Transform.FlipV
+	})
+	return sorted
+}
+
+// decorate the tile in place.
+func (o RenderOptions) decorate(tile *image.NRGBA) {
+	b := tile.Bounds()
+	if o.Vignette > 0 {
+		cx, cy := float64(b.Min.X+b.Max.X-1)/2, float64(b.Min.Y+b.Max.Y-1)/2
+		maxD := math.Hypot(cx-float64(b.Min.X), cy-float64(b.Min.Y))
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				d := math.Hypot(float64(x)-cx, float64(y)-cy) / maxD
+				f := 1 - o.Vignette*d*d
+				if f < 0 {
+					f = 0
+				}
+				i := tile.PixOffset(x, y)
+				for j := i; j < i+3; j++ {
+					tile.Pix[j] = uint8(float64(tile.Pix[j])*f + 0.5)
+				}
+			}
+		}
+	}
+	if o.Border > 0 {
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if x-b.Min.X < o.Border || b.Max.X-x <= o.Border ||
+					y-b.Min.Y < o.Border || b.Max.Y-y <= o.Border {
+					tile.SetNRGBA(x, y, o.BorderColor)
+				}
+			}
+		}
+	}
+}
+
+// needsTarget reports whether the mosaic is blended with the target, by Tint or Overlay.
+func (o RenderOptions) needsTarget() bool { return o.Tint > 0 || o.Overlay > 0 }
+
+// checkFraction refuses the value of the option if it is not between 0 and 1.
+func checkFraction(name string, v float64) error {
+	if v < 0 || v > 1 || math.IsNaN(v) {
+		return errors.Errorf("-%s must be between 0 and 1, got %g", name, v)
+	}
+	return nil
+}
+
+// blendTarget opens the target (of the Region, if given) as Build does, and blends it into the mosaic.
+func blendTarget(ctx context.Context, opts Options, targetFn string, plan Plan, mosaic *image.NRGBA) error {
+	if need := 2 * plan.canvasBytes(); opts.Render.Overlay > 0 && opts.MaxMem > 0 && need > int64(opts.MaxMem) {
+		return errors.Errorf("the -overlay of a %dx%d mosaic of %dpx tiles would need %s of memory, more than -max-mem=%s",
+			plan.Cols, plan.Rows, plan.TileSize, ByteSize(need).human(), opts.MaxMem)
+	}
+	target, err := openTarget(ctx, targetFn, plan.Cols*Width, plan.Rows*Width, opts.RasterizeCmd)
+	if err != nil {
+		return err
+	}
+	if target, err = opts.Region.crop(targetFn, target); err != nil {
+		return err
+	}
+	opts.Render.blend(mosaic, plan, target)
+	return nil
+}
+
+// blend the target into the mosaic of the plan, in place: the colors of each tile (inside its border)
+// are shifted by Tint of the difference of its average color from its cell's, then the target,
+// resized to the mosaic, is mixed over it by Overlay.
+func (o RenderOptions) blend(mosaic *image.NRGBA, plan Plan, target image.Image) {
+	if o.Tint > 0 {
+		// the average colors of the cells
+		cells := imaging.Resize(target, plan.Cols, plan.Rows, imaging.Box)
+		for _, p := range plan.Tiles {
+			r := plan.Cell(p).Inset(o.Border).Intersect(mosaic.Rect)
+			if r.Empty() {
+				continue
+			}
+			want, got := cells.NRGBAAt(p.Col, p.Row), avgColor(mosaic.SubImage(r))
+			var shift [3]float64
+			for j, d := range [3][2]uint8{{got.R, want.R}, {got.G, want.G}, {got.B, want.B}} {
+				shift[j] = o.Tint * (float64(d[1]) - float64(d[0]))
+			}
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				i := mosaic.PixOffset(r.Min.X, y)
+				for x := r.Min.X; x < r.Max.X; x, i = x+1, i+4 {
+					for j := 0; j < 3; j++ {
+						mosaic.Pix[i+j] = uint8(math.Max(0, math.Min(255, float64(mosaic.Pix[i+j])+shift[j]+0.5)))
+					}
+				}
+			}
+		}
+	}
+	if o.Overlay > 0 {
+		b := mosaic.Rect
+		over := imaging.Resize(target, b.Dx(), b.Dy(), imaging.Linear)
+		for y := 0; y < b.Dy(); y++ {
+			i, k := mosaic.PixOffset(b.Min.X, b.Min.Y+y), over.PixOffset(0, y)
+			for x := 0; x < 4*b.Dx(); x++ {
+				a, t := float64(mosaic.Pix[i+x]), float64(over.Pix[k+x])
+				mosaic.Pix[i+x] = uint8(a + (t-a)*o.Overlay + 0.5)
+			}
+		}
+	}
+}
+
+// colorFlag is a flag.Value parsing #rgb, #rrggbb or #rrggbbaa.
+type colorFlag color.NRGBA
+
+func (c *colorFlag) String() string {
+	if c == nil {
+		return ""
+	}
+	return fmt.Sprintf("#%02x%02x%02x%02x", c.R, c.G, c.B, c.A)
+}
+
+func (c *colorFlag) Set(s string) error {
+	col, err := parseColor(s)
+	if err != nil {
+		return err
+	}
+	*c = colorFlag(col)
+	return nil
+}
+
+func parseColor(s string) (color.NRGBA, error) {
+	h := strings.TrimPrefix(s, "#")
+	if len(h) == 3 {
+		h = string([]byte{h[0], h[0], h[1], h[1], h[2], h[2]})
+	}
+	if len(h) == 6 {
+		h += "ff"
+	}
+	if len(h) != 8 {
+		return color.NRGBA{}, errors.Errorf("%q: color must be #rgb, #rrggbb or #rrggbbaa", s)
+	}
+	v, err := strconv.ParseUint(h, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, errors.Wrap(err, s)
+	}
+	return color.NRGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}, nil
+}
@@ -0,0 +1,499 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestTileBorder(t *testing.T) {
+	red := color.NRGBA{R: 255, A: 255}
+	blue := color.NRGBA{B: 255, A: 255}
+	for _, tc := range []struct {
+		Name         string
+		Size, Border int
+	}{
+		{Name: "none", Size: 16, Border: 0},
+		{Name: "1px", Size: 16, Border: 1},
+		{Name: "3px", Size: 16, Border: 3},
+		{Name: "odd size", Size: 15, Border: 2},
+		{Name: "all border", Size: 4, Border: 2},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			tile := solidImage(tc.Size, tc.Size, red)
+			RenderOptions{Border: tc.Border, BorderColor: blue}.decorate(tile)
+			for y := 0; y < tc.Size; y++ {
+				for x := 0; x < tc.Size; x++ {
+					edge := min(x, y, tc.Size-1-x, tc.Size-1-y) < tc.Border
+					want := red
+					if edge {
+						want = blue
+					}
+					if got := tile.NRGBAAt(x, y); got != want {
+						t.Fatalf("%d,%d: got %v, wanted %v", x, y, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRenderBorder(t *testing.T) {
+	pix, err := encodePixels(solidImage(Width, Width, color.NRGBA{R: 200, G: 100, B: 50, A: 255}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumbnails := map[string]Thumbnail{"a.png": {Name: "a.png", Pix: pix}}
+	plan := Plan{Rows: 2, Cols: 2, TileSize: 32}
+	for row := 0; row < 2; row++ {
+		for col := 0; col < 2; col++ {
+			plan.Tiles = append(plan.Tiles, Placement{Row: row, Col: col, Source: "a.png"})
+		}
+	}
+	border := color.NRGBA{G: 255, A: 255}
+	opts := testOptions()
+	opts.Render.Border, opts.Render.BorderColor = 2, border
+	canvas, err := renderPlan(context.Background(), opts, plan, thumbnails)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range plan.Tiles {
+		cell := plan.Cell(p)
+		for _, pt := range []image.Point{
+			cell.Min, cell.Max.Sub(image.Pt(1, 1)), image.Pt(cell.Min.X+1, cell.Max.Y-2), image.Pt(cell.Max.X-2, cell.Min.Y+16),
+		} {
+			if got := canvas.NRGBAAt(pt.X, pt.Y); got != border {
+				t.Errorf("%v of %v: got %v, wanted the border %v", pt, cell, got, border)
+			}
+		}
+		if got := canvas.NRGBAAt(cell.Min.X+16, cell.Min.Y+16); got == border {
+			t.Errorf("the center of %v is the border color", cell)
+		}
+	}
+}
+
+// scatteredPlan returns a rows*cols plan of the sources, placed randomly (by the seed).
+func scatteredPlan(rows, cols, tileSize int, sources []string, seed int64) Plan {
+	rng := rand.New(rand.NewSource(seed))
+	plan := Plan{Rows: rows, Cols: cols, TileSize: tileSize}
+	for row := 0; row < rows; row++ {
+		for col := 0; col < cols; col++ {
+			plan.Tiles = append(plan.Tiles, Placement{Row: row, Col: col, Source: sources[rng.Intn(len(sources))]})
+		}
+	}
+	return plan
+}
+
+// renderReads renders the tiles of the plan in the order, returning the sources read.
+func renderReads(tb testing.TB, plan Plan, order func([]Placement) []Placement) int {
+	rnd := newRenderer(context.Background(), testOptions(), plan.TileSize, nil)
+	for _, p := range order(plan.Tiles) {
+		if _, err := rnd.Tile(p); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return rnd.reads
+}
+
+func byCell(tiles []Placement) []Placement { return tiles }
+
+func TestBySource(t *testing.T) {
+	defer func(c *imageCache) { composeCache = c }(composeCache)
+	composeCache = nil
+	dir := t.TempDir()
+	sources := testLibrary(t, dir, 4)
+	for _, tc := range []struct {
+		Name       string
+		Rows, Cols int
+	}{
+		{Name: "1x1", Rows: 1, Cols: 1},
+		{Name: "4x4", Rows: 4, Cols: 4},
+		{Name: "8x6", Rows: 8, Cols: 6},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			plan := scatteredPlan(tc.Rows, tc.Cols, 16, sources, 1)
+			used := make(map[string]bool)
+			for _, p := range plan.Tiles {
+				used[p.Source] = true
+			}
+			if reads := renderReads(t, plan, bySource); reads != len(used) {
+				t.Errorf("read %d sources, wanted each of the %d once", reads, len(used))
+			}
+			// the same output, whatever the order
+			opts := testOptions()
+			canvas, err := renderPlan(context.Background(), opts, plan, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rnd := newRenderer(context.Background(), opts, plan.TileSize, nil)
+			for _, p := range plan.Tiles {
+				tile, err := rnd.Tile(p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if d := meanAbsDiff(imaging.Crop(canvas, plan.Cell(p)), tile); d != 0 {
+					t.Errorf("%d,%d differs by %g", p.Row, p.Col, d)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkRenderOrder(b *testing.B) {
+	defer func(c *imageCache) { composeCache = c }(composeCache)
+	composeCache = nil
+	plan := scatteredPlan(8, 8, 32, testLibrary(b, b.TempDir(), 4), 1)
+	for _, bm := range []struct {
+		Name  string
+		Order func([]Placement) []Placement
+	}{
+		{Name: "cell", Order: byCell},
+		{Name: "source", Order: bySource},
+	} {
+		b.Run(bm.Name, func(b *testing.B) {
+			b.ReportAllocs()
+			var reads int
+			for i := 0; i < b.N; i++ {
+				reads += renderReads(b, plan, bm.Order)
+			}
+			b.ReportMetric(float64(reads)/float64(b.N), "reads/op")
+		})
+	}
+}
+
+func TestTileFit(t *testing.T) {
+	const size = 64
+	red, green, blue := color.NRGBA{R: 255, A: 255}, color.NRGBA{G: 255, A: 255}, color.NRGBA{B: 255, A: 255}
+	pad := color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+	// a portrait source of three squares: red, green, blue from the top
+	portrait := image.NewNRGBA(image.Rect(0, 0, size, 3*size))
+	for i, c := range []color.NRGBA{red, green, blue} {
+		draw.Draw(portrait, image.Rect(0, i*size, size, (i+1)*size), image.NewUniform(c), image.Point{}, draw.Src)
+	}
+	fn := filepath.Join(t.TempDir(), "portrait.png")
+	if err := imaging.Save(portrait, fn); err != nil {
+		t.Fatal(err)
+	}
+	type sample struct {
+		X, Y int
+		Want color.NRGBA
+	}
+	for _, tc := range []struct {
+		Fit     Fit
+		Samples []sample
+	}{
+		// squished: all three squares
+		{Fit: FitStretch, Samples: []sample{{size / 2, 2, red}, {size / 2, size / 2, green}, {size / 2, size - 3, blue}, {2, size / 2, green}}},
+		// center-cropped: only the middle square, undistorted
+		{Fit: FitCover, Samples: []sample{{size / 2, 2, green}, {size / 2, size / 2, green}, {size / 2, size - 3, green}, {2, 2, green}, {size - 3, size - 3, green}}},
+		// fitted: all three, narrow, padded by the background
+		{Fit: FitContain, Samples: []sample{{size / 2, 2, red}, {size / 2, size / 2, green}, {size / 2, size - 3, blue}, {2, size / 2, pad}, {size - 3, size / 2, pad}}},
+	} {
+		t.Run(tc.Fit.String(), func(t *testing.T) {
+			opts := testOptions()
+			opts.Render.Fit = tc.Fit
+			opts.Render.Background = pad
+			tile, err := newRenderer(context.Background(), opts, size, nil).Tile(Placement{Source: fn})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tile.Bounds().Size(); got != image.Pt(size, size) {
+				t.Fatalf("got a %v tile", got)
+			}
+			for _, s := range tc.Samples {
+				if got := tile.NRGBAAt(s.X, s.Y); absDiff(got.R, s.Want.R) > 8 || absDiff(got.G, s.Want.G) > 8 || absDiff(got.B, s.Want.B) > 8 {
+					t.Errorf("%d,%d: got %v, wanted %v", s.X, s.Y, got, s.Want)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteTiles(t *testing.T) {
+	dir := t.TempDir()
+	files := append([]string{writeImage(t, dir, "target.png", synthImage(-1, 3*Width, 2*Width))}, testLibrary(t, dir, 6)...)
+	opts := testOptions()
+	opts.Grid = Grid{Cols: 3, Rows: 2}
+	ctx := context.Background()
+	plan, thumbnails, err := buildPlan(ctx, opts, files, new(Timings))
+	if err != nil && !isWarning(err) {
+		t.Fatal(err)
+	}
+	tilesDir := filepath.Join(dir, "tiles")
+	if err := writeTiles(ctx, opts, plan, thumbnails, tilesDir); err != nil {
+		t.Fatal(err)
+	}
+	pngs, err := filepath.Glob(filepath.Join(tilesDir, "*.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pngs) != 6 {
+		t.Errorf("got %d tile files, wanted 6", len(pngs))
+	}
+
+	b, err := os.ReadFile(filepath.Join(tilesDir, "layout.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var layout tilesLayout
+	if err := json.Unmarshal(b, &layout); err != nil {
+		t.Fatal(err)
+	}
+	if layout.Rows != 2 || layout.Cols != 3 || layout.TileSize != plan.TileSize || len(layout.Tiles) != 6 {
+		t.Fatalf("got a %dx%d layout of %d tiles of %d, wanted 3x2 of 6 of %d",
+			layout.Cols, layout.Rows, len(layout.Tiles), layout.TileSize, plan.TileSize)
+	}
+	// the tiles are the cells of the mosaic
+	canvas, err := renderPlan(ctx, opts, plan, thumbnails)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer releaseCanvas(canvas)
+	for i, tile := range layout.Tiles {
+		if want := fmt.Sprintf("r%03d_c%03d.png", tile.Row, tile.Col); tile.File != want {
+			t.Errorf("%d. got %q, wanted %q", i, tile.File, want)
+		}
+		if want := plan.Cell(tile.Placement).Min; image.Pt(tile.X, tile.Y) != want {
+			t.Errorf("%s: at %d,%d, wanted %v", tile.File, tile.X, tile.Y, want)
+		}
+		if tile.Source != plan.Tiles[i].Source {
+			t.Errorf("%s: got source %q, wanted %q", tile.File, tile.Source, plan.Tiles[i].Source)
+		}
+		img, err := imaging.Open(filepath.Join(tilesDir, tile.File))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := img.Bounds().Size(); size != image.Pt(plan.TileSize, plan.TileSize) {
+			t.Errorf("%s: got %v, wanted %dx%d", tile.File, size, plan.TileSize, plan.TileSize)
+		}
+		cell := imaging.Crop(canvas, plan.Cell(tile.Placement))
+		if d := meanAbsDiff(img, cell); d > 1 {
+			t.Errorf("%s: differs from its cell by %.1f", tile.File, d)
+		}
+	}
+}
+
+func TestSupersample(t *testing.T) {
+	// a white disc on black: high contrast edges at all angles
+	const size = 512
+	src := solidImage(size, size, color.NRGBA{A: 255})
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			dx, dy := float64(x)-size/2+0.5, float64(y)-size/2+0.5
+			if dx*dx+dy*dy < (size*0.37)*(size*0.37) {
+				src.SetNRGBA(x, y, color.NRGBA{R: 255, G: 255, B: 255, A: 255})
+			}
+		}
+	}
+	fn := writeImage(t, t.TempDir(), "disc.png", src)
+	plan := Plan{Rows: 2, Cols: 2, TileSize: 24}
+	for row := 0; row < plan.Rows; row++ {
+		for col := 0; col < plan.Cols; col++ {
+			plan.Tiles = append(plan.Tiles, Placement{Row: row, Col: col, Source: fn})
+		}
+	}
+	render := func(n int) *image.NRGBA {
+		opts := testOptions()
+		opts.Render.Supersample = n
+		opts.Render.Border, opts.Render.BorderColor = 1, color.NRGBA{R: 255, A: 255}
+		canvas, err := renderPlan(context.Background(), opts, plan, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := canvas.Bounds().Size(), image.Pt(plan.Cols*plan.TileSize, plan.Rows*plan.TileSize); got != want {
+			t.Fatalf("%dx: got %v, wanted %v", n, got, want)
+		}
+		return canvas
+	}
+	// the steepest step of the green (the white disc) between horizontal neighbors
+	sharpness := func(img *image.NRGBA) int {
+		var steepest int
+		b := img.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X + 1; x < b.Max.X; x++ {
+				d := int(img.Pix[img.PixOffset(x, y)+1]) - int(img.Pix[img.PixOffset(x-1, y)+1])
+				steepest = max(steepest, d, -d)
+			}
+		}
+		return steepest
+	}
+	// the reference is rendered at a much higher resolution
+	ref := render(8)
+	one, two := render(1), render(2)
+	if d1, d2 := meanAbsDiff(one, ref), meanAbsDiff(two, ref); d2 > d1/2 {
+		t.Errorf("2x differs from the reference by %.2f, 1x by %.2f: wanted less aliasing", d2, d1)
+	}
+	if s1, s2 := sharpness(one), sharpness(two); 10*s2 < 9*s1 {
+		t.Errorf("2x has edges of %d, 1x of %d: wanted them nearly as sharp", s2, s1)
+	}
+}
+
+func TestPreview(t *testing.T) {
+	dir := t.TempDir()
+	colors := []color.NRGBA{{R: 250, G: 10, B: 10, A: 255}, {R: 10, G: 250, B: 10, A: 255}, {R: 10, G: 10, B: 250, A: 255}, {R: 128, G: 128, B: 128, A: 255}}
+	grid := Grid{Cols: 4, Rows: 3}
+	// each cell of the target is of another color
+	target := image.NewNRGBA(image.Rect(0, 0, 100*grid.Cols, 100*grid.Rows))
+	for row := 0; row < grid.Rows; row++ {
+		for col := 0; col < grid.Cols; col++ {
+			draw.Draw(target, image.Rect(100*col, 100*row, 100*(col+1), 100*(row+1)), image.NewUniform(colors[(row+col)%len(colors)]), image.Point{}, draw.Src)
+		}
+	}
+	files := []string{writeImage(t, dir, "target.png", target)}
+	for i, c := range colors {
+		files = append(files, writeImage(t, dir, fmt.Sprintf("src%d.png", i), solidImage(Width, Width, c)))
+	}
+	type result struct {
+		img  *image.NRGBA
+		plan Plan
+	}
+	render := func(t *testing.T, preview bool) result {
+		t.Helper()
+		opts := testOptions()
+		opts.Grid = grid
+		opts.Match.Metric = MetricColor
+		opts.Preview = preview
+		out := t.TempDir()
+		opts.Out, opts.Sidecar = filepath.Join(out, "out.png"), filepath.Join(out, "plan.json")
+		if err := Main(context.Background(), opts, append([]string(nil), files...)); err != nil && !isWarning(err) {
+			t.Fatal(err)
+		}
+		img, err := imaging.Open(opts.Out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plan, err := readPlan(opts.Sidecar)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result{img: imaging.Clone(img), plan: plan}
+	}
+	full, preview := render(t, false), render(t, true)
+	if w, h := grid.Cols*previewTileSize, grid.Rows*previewTileSize; preview.img.Rect.Dx() != w || preview.img.Rect.Dy() != h {
+		t.Errorf("the preview is %v, wanted %dx%d", preview.img.Rect, w, h)
+	}
+	if full.img.Rect.Dx() <= preview.img.Rect.Dx() {
+		t.Errorf("the full render is %v, not larger than the preview", full.img.Rect)
+	}
+	if len(preview.plan.Tiles) != grid.Cols*grid.Rows || len(preview.plan.Tiles) != len(full.plan.Tiles) {
+		t.Fatalf("got %d tiles in the preview, %d in the full render", len(preview.plan.Tiles), len(full.plan.Tiles))
+	}
+	for i, p := range preview.plan.Tiles {
+		if f := full.plan.Tiles[i]; p != f {
+			t.Errorf("tile %d: got %+v in the preview, %+v in the full render", i, p, f)
+		}
+		// and the pixels agree
+		x, y := p.Col*previewTileSize+previewTileSize/2, p.Row*previewTileSize+previewTileSize/2
+		fs := full.img.Rect.Dx() / grid.Cols
+		if g, w := preview.img.NRGBAAt(x, y), full.img.NRGBAAt(p.Col*fs+fs/2, p.Row*fs+fs/2); !isTileColor(g, []color.NRGBA{w}) {
+			t.Errorf("r%d_c%d: got %v in the preview, %v in the full render", p.Row, p.Col, g, w)
+		}
+	}
+}
+
+func TestBlend(t *testing.T) {
+	const size = 16
+	dark, light := color.NRGBA{R: 60, G: 60, B: 60, A: 255}, color.NRGBA{R: 100, G: 100, B: 100, A: 255}
+	green, gray := color.NRGBA{R: 40, G: 160, B: 40, A: 255}, color.NRGBA{R: 128, G: 128, B: 128, A: 255}
+	plan := Plan{Rows: 1, Cols: 2, TileSize: size, Tiles: []Placement{{Row: 0, Col: 0}, {Row: 0, Col: 1}}}
+	// the tiles are stripes of dark and light, averaging 80
+	mosaic := func() *image.NRGBA { return stripes(2*size, size, 4, dark, light) }
+	// the cells of the target are green and gray
+	target := solidImage(200, 100, green)
+	draw.Draw(target, image.Rect(100, 0, 200, 100), image.NewUniform(gray), image.Point{}, draw.Src)
+	for _, tc := range []struct {
+		Name   string
+		Opts   RenderOptions
+		At     image.Point
+		Want   color.NRGBA
+		Within uint8
+	}{
+		{Name: "none", At: image.Pt(0, 0), Want: dark},
+		// the average of the tile becomes the cell's, the stripes are kept
+		{Name: "tint", Opts: RenderOptions{Tint: 1}, At: image.Pt(0, 0), Want: color.NRGBA{R: 40 - 20, G: 160 - 20, B: 40 - 20, A: 255}},
+		{Name: "tint light", Opts: RenderOptions{Tint: 1}, At: image.Pt(size+2, 0), Want: color.NRGBA{R: 128 + 20, G: 128 + 20, B: 128 + 20, A: 255}},
+		{Name: "half tint", Opts: RenderOptions{Tint: 0.5}, At: image.Pt(0, 0), Want: color.NRGBA{R: 60 - 20, G: 60 + 40, B: 60 - 20, A: 255}},
+		// the border is not of the tile
+		{Name: "tint border", Opts: RenderOptions{Tint: 1, Border: 1}, At: image.Pt(0, 0), Want: dark},
+		{Name: "tint inside border", Opts: RenderOptions{Tint: 1, Border: 1}, At: image.Pt(1, 1), Want: color.NRGBA{R: 40 - 20, G: 160 - 20, B: 40 - 20, A: 255}, Within: 2},
+		{Name: "overlay", Opts: RenderOptions{Overlay: 1}, At: image.Pt(0, 0), Want: green},
+		{Name: "half overlay", Opts: RenderOptions{Overlay: 0.5}, At: image.Pt(size+2, 0), Want: color.NRGBA{R: 114, G: 114, B: 114, A: 255}, Within: 1},
+		// tinted, then the target over it
+		{Name: "tint and overlay", Opts: RenderOptions{Tint: 1, Overlay: 0.5}, At: image.Pt(0, 0), Want: color.NRGBA{R: 30, G: 150, B: 30, A: 255}, Within: 1},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			img := mosaic()
+			if tc.Opts.needsTarget() {
+				tc.Opts.blend(img, plan, target)
+			}
+			if got := img.NRGBAAt(tc.At.X, tc.At.Y); absDiff(got.R, tc.Want.R) > tc.Within || absDiff(got.G, tc.Want.G) > tc.Within ||
+				absDiff(got.B, tc.Want.B) > tc.Within || got.A != tc.Want.A {
+				t.Errorf("%v: got %v, wanted %v", tc.At, got, tc.Want)
+			}
+		})
+	}
+}
+
+func TestTintFlag(t *testing.T) {
+	dir := t.TempDir()
+	colors := []color.NRGBA{{R: 200, G: 60, B: 60, A: 255}, {R: 60, G: 200, B: 60, A: 255}}
+	grid := Grid{Cols: 3, Rows: 2}
+	target := synthImage(4, 3*Width, 2*Width)
+	files := []string{writeImage(t, dir, "target.png", target)}
+	for i, c := range colors {
+		files = append(files, writeImage(t, dir, fmt.Sprintf("src%d.png", i), solidImage(Width, Width, c)))
+	}
+	cells := imaging.Resize(target, grid.Cols, grid.Rows, imaging.Box)
+	for _, tc := range []struct {
+		Tint, Overlay float64
+	}{{Tint: 1}, {Overlay: 1}} {
+		t.Run(fmt.Sprintf("tint=%g overlay=%g", tc.Tint, tc.Overlay), func(t *testing.T) {
+			opts := testOptions()
+			opts.Grid = grid
+			opts.Match.Metric = MetricColor
+			opts.Render.Tint, opts.Render.Overlay = tc.Tint, tc.Overlay
+			opts.Out = filepath.Join(t.TempDir(), "out.png")
+			if err := Main(context.Background(), opts, append([]string(nil), files...)); err != nil && !isWarning(err) {
+				t.Fatal(err)
+			}
+			img, err := imaging.Open(opts.Out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := imaging.Clone(img)
+			// each cell is of the average color of the target's
+			for row := 0; row < grid.Rows; row++ {
+				for col := 0; col < grid.Cols; col++ {
+					got := avgColor(out.SubImage(image.Rect(col*Width, row*Width, (col+1)*Width, (row+1)*Width)))
+					if want := cells.NRGBAAt(col, row); !isTileColor(got, []color.NRGBA{want}) {
+						t.Errorf("r%d_c%d: got %v, wanted the target's %v", row, col, got, want)
+					}
+				}
+			}
+		})
+	}
+}
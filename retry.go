@@ -0,0 +1,69 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// retryBackoff is the wait before the first retry of a transient error, doubled for each next one.
+const retryBackoff = 200 * time.Millisecond
+
+// transientErrnos are the errors of reading a file which may go away by themselves,
+// as of a network filesystem.
+var transientErrnos = []syscall.Errno{
+	syscall.EIO, syscall.EAGAIN, syscall.EINTR, syscall.EBUSY, syscall.ESTALE, syscall.ETIMEDOUT,
+	syscall.ECONNRESET, syscall.ECONNREFUSED, syscall.EHOSTUNREACH, syscall.ENETUNREACH,
+}
+
+// isTransient tells whether reading the source may succeed when retried,
+// unlike after a decoding error, a missing file, or the -decode-timeout.
+func isTransient(err error) bool {
+	if err == nil || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	for _, errno := range transientErrnos {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// retryTransient calls f until it succeeds, or returns a permanent error,
+// at most retries times more, waiting more and more between them.
+func retryTransient(ctx context.Context, retries int, f func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if attempt >= retries || !isTransient(err) {
+			return err
+		}
+		wait := retryBackoff << attempt
+		log.Printf("%v: retrying in %v (%d/%d)", err, wait, attempt+1, retries)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
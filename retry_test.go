@@ -0,0 +1,129 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"image"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// timeoutError is a net.Error timing out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestIsTransient(t *testing.T) {
+	for _, tc := range []struct {
+		Name string
+		Err  error
+		Want bool
+	}{
+		{Name: "EIO", Err: &fs.PathError{Op: "read", Path: "x.jpg", Err: syscall.EIO}, Want: true},
+		{Name: "stale NFS handle", Err: errors.Wrap(&fs.PathError{Op: "open", Path: "x.jpg", Err: syscall.ESTALE}, "x.jpg"), Want: true},
+		{Name: "net timeout", Err: errors.Wrap(timeoutError{}, "GET"), Want: true},
+		{Name: "missing", Err: &fs.PathError{Op: "open", Path: "x.jpg", Err: fs.ErrNotExist}},
+		{Name: "permission", Err: &fs.PathError{Op: "open", Path: "x.jpg", Err: fs.ErrPermission}},
+		{Name: "decoding", Err: errors.Wrap(image.ErrFormat, "x.jpg")},
+		{Name: "decode timeout", Err: errors.Wrap(context.DeadlineExceeded, "x.jpg")},
+		{Name: "nil"},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			if got := isTransient(tc.Err); got != tc.Want {
+				t.Errorf("got %t, wanted %t", got, tc.Want)
+			}
+		})
+	}
+}
+
+func TestRetryTransient(t *testing.T) {
+	eio := &fs.PathError{Op: "read", Path: "x.jpg", Err: syscall.EIO}
+	for _, tc := range []struct {
+		Name         string
+		Retries      int
+		Errs         []error // of the attempts, the rest succeed
+		WantAttempts int
+		WantErr      bool
+	}{
+		{Name: "second attempt", Retries: 2, Errs: []error{eio}, WantAttempts: 2},
+		{Name: "no retries", Errs: []error{eio}, WantAttempts: 1, WantErr: true},
+		{Name: "too many", Retries: 1, Errs: []error{eio, eio, eio}, WantAttempts: 2, WantErr: true},
+		{Name: "permanent", Retries: 2, Errs: []error{image.ErrFormat}, WantAttempts: 1, WantErr: true},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			var attempts int
+			err := retryTransient(context.Background(), tc.Retries, func() error {
+				attempts++
+				if attempts <= len(tc.Errs) {
+					return tc.Errs[attempts-1]
+				}
+				return nil
+			})
+			if attempts != tc.WantAttempts || (err != nil) != tc.WantErr {
+				t.Errorf("got %v after %d attempts, wanted %d (error: %t)", err, attempts, tc.WantAttempts, tc.WantErr)
+			}
+		})
+	}
+}
+
+func TestFlakyIndexing(t *testing.T) {
+	for _, tc := range []struct {
+		Name    string
+		Retries int
+		Want    bool
+	}{
+		{Name: "retried", Retries: 2, Want: true},
+		{Name: "not retried", Retries: 0},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			// fails the first read, as a network filesystem may
+			var reads atomic.Int32
+			fakeRawDecoder(t, func(ctx context.Context, fn string) (image.Image, error) {
+				if reads.Add(1) == 1 {
+					return nil, &fs.PathError{Op: "read", Path: fn, Err: syscall.EIO}
+				}
+				return synthImage(1, Width, Width), nil
+			})
+			fn := filepath.Join(t.TempDir(), "flaky.raw")
+			if err := os.WriteFile(fn, []byte("raw"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			opts := testOptions()
+			opts.Retries = tc.Retries
+			thumbnails, indexed, err := prepareThumbnails(context.Background(), opts, []string{fn}, new(Timings))
+			if err != nil && !isWarning(err) {
+				t.Fatal(err)
+			}
+			e, ok := thumbnails[fn]
+			if got := ok && e.Failed == "" && indexed == 1; got != tc.Want {
+				t.Errorf("indexed: got %t (%+v), wanted %t", got, e, tc.Want)
+			}
+			// a transient failure is not recorded, to be retried on the next run
+			if !tc.Want && ok {
+				t.Errorf("recorded the failure %q", e.Failed)
+			}
+		})
+	}
+}
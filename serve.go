@@ -0,0 +1,624 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"image"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/pkg/errors"
+)
+
+// maxFrame is the largest message of the serve protocol.
+const maxFrame = 1 << 30
+
+// serveRequest is a request of the serve protocol: a target to build a mosaic of,
+// with the options which don't change the index.
+type serveRequest struct {
+	// Target is the path of the target, readable by the server; or Image is its encoded bytes.
+	Target string `json:",omitempty"`
+	Image  []byte `json:",omitempty"`
+	// Output is "plan" for the plan (the default), or "png" or "jpeg" for the mosaic.
+	Output string `json:",omitempty"`
+	// Metric, Grid, TileSize (the RenderSize), MaxReuse, Jitter, Seed, Border, Vignette,
+	// Tint and Overlay override those of the server.
+	Metric   Metric  `json:",omitempty"`
+	Grid     Grid    `json:",omitempty"`
+	TileSize int     `json:",omitempty"`
+	MaxReuse int     `json:",omitempty"`
+	Jitter   float64 `json:",omitempty"`
+	Seed     int64   `json:",omitempty"`
+	Border   int     `json:",omitempty"`
+	Vignette float64 `json:",omitempty"`
+	Tint     float64 `json:",omitempty"`
+	Overlay  float64 `json:",omitempty"`
+	Preview  bool    `json:",omitempty"`
+}
+
+// serveResponse is the answer to a serveRequest: its Error, or the Plan or the Image requested.
+type serveResponse struct {
+	Error string `json:",omitempty"`
+	Plan  *Plan  `json:",omitempty"`
+	Image []byte `json:",omitempty"`
+}
+
+// writeFrame writes v as a message of the serve protocol: its JSON after its big endian uint32 length.
+func writeFrame(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(b) > maxFrame {
+		return errors.Errorf("message of %d bytes is larger than %d", len(b), maxFrame)
+	}
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(b)))
+	if _, err = w.Write(length[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// readFrame reads a message of the serve protocol into v. It returns io.EOF if there are no more.
+func readFrame(r io.Reader, v interface{}) error {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n > maxFrame {
+		return errors.Errorf("message of %d bytes is larger than %d", n, maxFrame)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// defaultSocket is the address mosaic serve listens on, and mosaic client connects to, by default.
+func defaultSocket() string { return filepath.Join(os.TempDir(), "mosaic.sock") }
+
+// listenNetwork returns the network of the address: "tcp" for a host:port on the loopback
+// (the server reads any path it is asked for, so it is not to be reached from outside), else "unix".
+func listenNetwork(addr string) (string, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || strings.ContainsRune(addr, filepath.Separator) {
+		return "unix", nil
+	}
+	if host == "localhost" {
+		return "tcp", nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return "", errors.Errorf("%s: only a unix socket or a localhost address can be served", addr)
+	}
+	return "tcp", nil
+}
+
+// ServeOptions are the options of mosaic serve.
+type ServeOptions struct {
+	// Listen is the unix socket or localhost host:port of the serve protocol; empty: none.
+	Listen string
+	// HTTP is the address of the HTTP API, as Listen unless HTTPPublic; empty: none.
+	HTTP string
+	// HTTPPublic allows an HTTP address reachable from other hosts.
+	HTTPPublic bool
+	// MaxBody is the limit of the size of an HTTP request.
+	MaxBody ByteSize
+	// MaxRequests is the number of the mosaics built at once; the others wait.
+	MaxRequests int
+}
+
+// httpNetwork returns the network of the HTTP address, as listenNetwork - but any TCP
+// address is allowed with HTTPPublic.
+func (sopts ServeOptions) httpNetwork() (string, error) {
+	network, err := listenNetwork(sopts.HTTP)
+	if err != nil {
+		if !sopts.HTTPPublic {
+			return "", errors.Wrap(err, "-http (with -http-public, it may be served to other hosts)")
+		}
+		network = "tcp"
+	}
+	return network, nil
+}
+
+// server builds the mosaics of the requests, from the index loaded once.
+type server struct {
+	builder *Builder
+	// memory limits the estimated memory of the requests processed in parallel,
+	// slots their number.
+	memory *memSemaphore
+	slots  chan struct{}
+	wg     sync.WaitGroup
+
+	mu sync.Mutex
+	// matchers of the metrics other than the builder's, built on their first request
+	matchers map[Metric]*matcher
+
+	started                 time.Time
+	served, failed, running atomic.Int64
+}
+
+// serveMain runs "mosaic serve": it loads the index of the sources (all the DB's entries
+// without any), and then answers the requests until ctx is canceled.
+func serveMain(ctx context.Context, opts Options, sopts ServeOptions, files []string) error {
+	if sopts.Listen == "" && sopts.HTTP == "" {
+		return errors.New("mosaic serve needs a -listen or a -http address")
+	}
+	if sopts.MaxRequests < 1 {
+		return errors.Errorf("-max-requests must be at least 1, got %d", sopts.MaxRequests)
+	}
+	var network, httpNetwork string
+	if sopts.Listen != "" {
+		var err error
+		if network, err = listenNetwork(sopts.Listen); err != nil {
+			return err
+		}
+	}
+	if sopts.HTTP != "" {
+		var err error
+		if httpNetwork, err = sopts.httpNetwork(); err != nil {
+			return err
+		}
+	}
+	// the progress of the requests in parallel would be mixed up
+	if progress != nil {
+		log.SetOutput(os.Stderr)
+		progress = nil
+	}
+	b := NewBuilder(opts)
+	if len(files) != 0 {
+		if err := b.AddSources(ctx, files); err != nil {
+			if !isWarning(err) {
+				return err
+			}
+			log.Println(err)
+		}
+	} else {
+		st := opts.store()
+		_, thumbnails, err := st.Load(nil)
+		if err != nil {
+			return err
+		}
+		loadAliased(st, thumbnails)
+		for k, t := range thumbnails {
+			b.thumbnails[k] = t
+			if t.Failed == "" {
+				b.files = append(b.files, k)
+				b.added[k] = true
+			}
+		}
+		sort.Strings(b.files)
+	}
+	start := time.Now()
+	if n := len(b.getMatcher().candidates); n == 0 {
+		return ErrNoSources
+	} else {
+		log.Printf("index of %d sources ready in %s", n, time.Since(start).Round(time.Millisecond))
+	}
+
+	s := &server{builder: b, memory: newMemSemaphore(int64(opts.CanvasMemory)),
+		slots: make(chan struct{}, sopts.MaxRequests), started: time.Now()}
+	if sopts.HTTP != "" {
+		ln, err := net.Listen(httpNetwork, sopts.HTTP)
+		if err != nil {
+			return err
+		}
+		log.Printf("serving the HTTP API and the UI on http://%s/", ln.Addr())
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serveHTTP(ctx, ln, int64(sopts.MaxBody))
+		}()
+	}
+	if sopts.Listen != "" {
+		if network == "unix" {
+			// a socket left by a server which is not running anymore
+			if conn, err := net.Dial(network, sopts.Listen); err == nil {
+				conn.Close()
+				return errors.Errorf("%s: already served", sopts.Listen)
+			}
+			if fi, err := os.Lstat(sopts.Listen); err == nil && fi.Mode()&os.ModeSocket != 0 {
+				os.Remove(sopts.Listen)
+			}
+		}
+		ln, err := net.Listen(network, sopts.Listen)
+		if err != nil {
+			return err
+		}
+		log.Printf("serving on %s %s", network, ln.Addr())
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.accept(ctx, ln)
+		}()
+	}
+	<-ctx.Done()
+	log.Println("waiting for the requests in progress")
+	s.wg.Wait()
+	return nil
+}
+
+// accept the connections of the serve protocol, until ctx is canceled.
+func (s *server) accept(ctx context.Context, ln net.Listener) {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Println(err)
+			continue
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer conn.Close()
+			s.serveConn(ctx, conn)
+		}()
+	}
+}
+
+// serveConn answers the requests of the connection, one after the other, until it is closed.
+func (s *server) serveConn(ctx context.Context, conn net.Conn) {
+	go func() {
+		<-ctx.Done()
+		// unblock the reading of the next request
+		conn.SetReadDeadline(time.Now())
+	}()
+	br, bw := bufio.NewReader(conn), bufio.NewWriter(conn)
+	for {
+		var req serveRequest
+		if err := readFrame(br, &req); err != nil {
+			if err != io.EOF && ctx.Err() == nil {
+				log.Println(errors.Wrap(err, "reading the request"))
+			}
+			return
+		}
+		var resp serveResponse
+		if err := s.serve(ctx, req, &resp); err != nil {
+			resp = serveResponse{Error: err.Error()}
+		}
+		if err := writeFrame(bw, resp); err != nil {
+			log.Println(errors.Wrap(err, "writing the response"))
+			return
+		}
+		if err := bw.Flush(); err != nil {
+			log.Println(errors.Wrap(err, "writing the response"))
+			return
+		}
+	}
+}
+
+// name of the request's target, for the messages.
+func (req serveRequest) name() string {
+	if req.Target != "" {
+		return req.Target
+	}
+	return "target image"
+}
+
+func (req serveRequest) output() string {
+	if req.Output == "" {
+		return "plan"
+	}
+	return req.Output
+}
+
+// ErrTargetTooLarge is returned for a target image which would need more memory to decode than allowed.
+var ErrTargetTooLarge = errors.New("target image too large")
+
+// serve builds the mosaic of the request, with a Builder of its own sharing the index,
+// once there's a slot and the memory for it.
+func (s *server) serve(ctx context.Context, req serveRequest, resp *serveResponse) (err error) {
+	start := time.Now()
+	defer func() {
+		if err != nil {
+			s.failed.Add(1)
+			log.Printf("%s: %v", req.name(), err)
+		} else {
+			s.served.Add(1)
+			log.Printf("%s: %s served in %s", req.name(), req.output(), time.Since(start).Round(time.Millisecond))
+		}
+	}()
+	if req.Target == "" && len(req.Image) == 0 {
+		return errors.New("no target")
+	} else if req.Target != "" && len(req.Image) != 0 {
+		return errors.New("both a target path and image given")
+	}
+	output := req.output()
+	if output != "plan" && output != "png" && output != "jpeg" {
+		return errors.Errorf("unknown output %q (plan, png or jpeg)", output)
+	}
+	opts := s.builder.opts
+	if req.Metric != "" {
+		if err := opts.Match.Metric.Set(string(req.Metric)); err != nil {
+			return err
+		}
+	}
+	if req.Grid != (Grid{}) {
+		opts.Grid = req.Grid
+	}
+	if req.TileSize > 0 {
+		opts.RenderSize = req.TileSize
+	}
+	if req.MaxReuse != 0 {
+		opts.Match.MaxReuse = req.MaxReuse
+	}
+	if req.Jitter != 0 {
+		opts.Match.Jitter = req.Jitter
+		if opts.Match.Seed = req.Seed; opts.Match.Seed == 0 {
+			opts.Match.Seed = time.Now().UnixNano()
+		}
+	}
+	if req.Border != 0 {
+		opts.Render.Border = req.Border
+	}
+	if req.Vignette != 0 {
+		opts.Render.Vignette = req.Vignette
+	}
+	if req.Tint != 0 {
+		if err := checkFraction("tint", req.Tint); err != nil {
+			return err
+		}
+		opts.Render.Tint = req.Tint
+	}
+	if req.Overlay != 0 {
+		if err := checkFraction("overlay", req.Overlay); err != nil {
+			return err
+		}
+		opts.Render.Overlay = req.Overlay
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-s.slots }()
+	s.running.Add(1)
+	defer s.running.Add(-1)
+	m, err := s.matcher(opts)
+	if err != nil {
+		return err
+	}
+	b := s.builder.fork(opts, m)
+
+	plan := b.emptyPlan(len(b.files))
+	if err := checkMemory(plan, opts.MaxMem); err != nil {
+		return err
+	}
+	// the resized target, and the mosaic
+	need := int64(plan.Cols*Width) * int64(plan.Rows*Width) * 4
+	if output != "plan" {
+		need += plan.canvasBytes()
+		if opts.Render.Overlay > 0 {
+			// the target resized to it
+			need += plan.canvasBytes()
+		}
+	}
+	if len(req.Image) != 0 {
+		// and the decoded target, before decoding it
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(req.Image))
+		if err != nil {
+			return errors.Wrap(err, req.name())
+		}
+		n := configBytes(cfg)
+		if opts.MaxMem > 0 && n > int64(opts.MaxMem) {
+			return errors.Wrapf(ErrTargetTooLarge, "a %dx%d target would need %s of memory, more than -max-mem=%s",
+				cfg.Width, cfg.Height, ByteSize(n).human(), opts.MaxMem)
+		}
+		need += n
+	}
+	release, err := s.memory.acquire(ctx, need)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	var target image.Image
+	if req.Target != "" {
+		plan, err = b.Build(ctx, req.Target)
+	} else {
+		if target, _, err = image.Decode(bytes.NewReader(req.Image)); err == nil {
+			plan, err = b.BuildImage(ctx, req.name(), target)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if output == "plan" {
+		resp.Plan = &plan
+		return nil
+	}
+	if req.Preview {
+		opts, plan = opts.preview(plan)
+	}
+	canvas, err := renderPlan(ctx, opts, plan, b.thumbnails)
+	if err != nil {
+		return err
+	}
+	defer releaseCanvas(canvas)
+	if opts.Render.needsTarget() {
+		if target == nil {
+			err = blendTarget(ctx, opts, req.Target, plan, canvas)
+		} else {
+			opts.Render.blend(canvas, plan, target)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	format := imaging.PNG
+	if output == "jpeg" {
+		format = imaging.JPEG
+	}
+	var buf bytes.Buffer
+	if err := encodeImage(&buf, canvas, format, opts.DPI, false); err != nil {
+		return err
+	}
+	resp.Image = buf.Bytes()
+	return nil
+}
+
+// matcher returns the matcher of the options' metric: the builder's, or one built
+// on the first request of another metric (from the features in the DB entries).
+func (s *server) matcher(opts Options) (*matcher, error) {
+	if opts.Match.Metric == s.builder.opts.Match.Metric {
+		return s.builder.matcher, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m, ok := s.matchers[opts.Match.Metric]; ok {
+		return m, nil
+	}
+	if err := opts.Match.Metric.checkPrecision(s.builder.hdr.Precision); err != nil {
+		return nil, err
+	}
+	// the match index file is of the builder's metric
+	opts.MatchIndex = false
+	b := s.builder.fork(opts, nil)
+	m := b.getMatcher()
+	if len(m.candidates) == 0 {
+		return nil, errors.Wrapf(ErrNoSources, "-metric %s", opts.Match.Metric)
+	}
+	log.Printf("index of %d sources for -metric %s ready", len(m.candidates), opts.Match.Metric)
+	if s.matchers == nil {
+		s.matchers = make(map[Metric]*matcher)
+	}
+	s.matchers[opts.Match.Metric] = m
+	return m, nil
+}
+
+// fork returns a Builder with the options for a build in parallel with the others,
+// sharing the sources and the index m (which is built by getMatcher if nil).
+// The options must not change the index.
+func (b *Builder) fork(opts Options, m *matcher) *Builder {
+	f := &Builder{opts: opts, Timings: new(Timings), files: b.files, added: b.added, thumbnails: b.thumbnails, hdr: b.hdr, mask: b.mask}
+	if m != nil {
+		f.matcher = m.fork(opts.Match)
+	}
+	return f
+}
+
+// clientMain runs "mosaic client": it sends the target to a mosaic serve, and writes the
+// plan or the mosaic it answers.
+func clientMain(args []string) error {
+	fs := flag.NewFlagSet("client", flag.ContinueOnError)
+	flagConnect := fs.String("connect", defaultSocket(), "address of the mosaic serve: a unix socket, or a localhost host:port")
+	flagOut := fs.String("o", "-", "output: the mosaic (PNG, or JPEG by its extension), or the plan (JSON) with -plan")
+	flagPlan := fs.Bool("plan", false, "write the plan instead of the mosaic")
+	flagSend := fs.Bool("send", false, "send the target's bytes, not its path (for a server which can't read it)")
+	var req serveRequest
+	fs.StringVar((*string)(&req.Metric), "metric", "", "distance metric, of those registered in the server (default: the server's)")
+	fs.Var(&req.Grid, "grid", "grid of the mosaic, as COLSxROWS (default: the server's)")
+	fs.IntVar(&req.TileSize, "render-size", 0, "size of the tiles in the output (default: the server's)")
+	fs.IntVar(&req.MaxReuse, "max-reuse", 0, "use each source at most this many times (default: the server's)")
+	fs.Float64Var(&req.Jitter, "jitter", 0, "choose randomly among the sources within this distance of the best match (default: the server's)")
+	fs.Int64Var(&req.Seed, "seed", 0, "seed of the -jitter (default: random)")
+	fs.IntVar(&req.Border, "tile-border", 0, "border width of each tile, in pixels (default: the server's)")
+	fs.Float64Var(&req.Vignette, "tile-vignette", 0, "darken the corners of each tile by this factor, 0-1 (default: the server's)")
+	fs.Float64Var(&req.Tint, "tint", 0, "shift the colors of each tile towards the average color of its cell by this factor, 0-1 (default: the server's)")
+	fs.Float64Var(&req.Overlay, "overlay", 0, "blend the target over the mosaic with this opacity, 0-1 (default: the server's)")
+	fs.BoolVar(&req.Preview, "preview", false, "render the mosaic quickly, with small tiles")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: mosaic client [flags] target")
+	}
+	target := fs.Arg(0)
+	if *flagSend {
+		b, err := os.ReadFile(target)
+		if err != nil {
+			return err
+		}
+		req.Image = b
+	} else if req.Target = target; !isURL(target) {
+		// the server's working directory is not ours
+		abs, err := filepath.Abs(target)
+		if err != nil {
+			return err
+		}
+		req.Target = abs
+	}
+	switch ext := strings.ToLower(filepath.Ext(*flagOut)); {
+	case *flagPlan:
+		req.Output = "plan"
+	case ext == ".jpg" || ext == ".jpeg":
+		req.Output = "jpeg"
+	default:
+		req.Output = "png"
+	}
+
+	network, err := listenNetwork(*flagConnect)
+	if err != nil {
+		return err
+	}
+	conn, err := net.Dial(network, *flagConnect)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := writeFrame(conn, req); err != nil {
+		return err
+	}
+	var resp serveResponse
+	if err := readFrame(bufio.NewReader(conn), &resp); err != nil {
+		return errors.Wrap(err, "reading the response")
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	out := resp.Image
+	if *flagPlan {
+		if resp.Plan == nil {
+			return errors.New("no plan in the response")
+		}
+		if out, err = json.MarshalIndent(resp.Plan, "", "  "); err != nil {
+			return err
+		}
+	}
+	if *flagOut == "" || *flagOut == "-" {
+		_, err = os.Stdout.Write(out)
+		return err
+	}
+	return errors.Wrap(os.WriteFile(*flagOut, out, 0644), *flagOut)
+}
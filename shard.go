@@ -0,0 +1,199 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// shardFile is the DB of a source directory, with -db-shard-by-dir.
+const shardFile = ".mosaic.db"
+
+// shardStore is the DB split by source directory: a shardFile in each directory,
+// with the keys relative to it, so a directory is backed up and moved with its own DB.
+type shardStore struct {
+	// shards ordered by descending directory length, so the first containing a key is its deepest
+	shards []relStore
+}
+
+// newShardStore returns the store of the shards in dirs.
+func newShardStore(dirs []string) shardStore {
+	s := shardStore{shards: make([]relStore, 0, len(dirs))}
+	for _, dir := range dirs {
+		s.shards = append(s.shards, relStore{fileStore: fileStore(filepath.Join(dir, shardFile)), dir: dir})
+	}
+	sort.SliceStable(s.shards, func(i, j int) bool { return len(s.shards[i].dir) > len(s.shards[j].dir) })
+	return s
+}
+
+// shardDirs returns the shards of the files, as canonical keys: the directory given as a source
+// which a file was found under (by expandSources), or else the directory of the file.
+func shardDirs(files []string) []string {
+	seen := make(map[string]bool)
+	var dirs []string
+	for _, fn := range files {
+		if isURL(fn) {
+			continue
+		}
+		dir := filepath.Dir(fn)
+		if key, err := canonicalKey(fn); err == nil {
+			// not a link out of it
+			if root, ok := walkedRoot(key); ok && inDir(root, key) {
+				dir = root
+			} else {
+				dir = filepath.Dir(key)
+			}
+		}
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// discoverShards returns the shards found under the dirs, recursively.
+func discoverShards(dirs []string) (shardStore, error) {
+	var found []string
+	for _, root := range dirs {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() && d.Name() == shardFile {
+				dir := filepath.Dir(path)
+				if key, err := canonicalKey(dir); err == nil {
+					dir = key
+				}
+				found = append(found, dir)
+			}
+			return nil
+		})
+		if err != nil {
+			return shardStore{}, errors.Wrap(err, root)
+		}
+	}
+	if len(found) == 0 {
+		return shardStore{}, errors.Errorf("no %s under %s", shardFile, strings.Join(dirs, ", "))
+	}
+	return newShardStore(found), nil
+}
+
+// shardOf returns the index of the deepest shard containing the key, or -1.
+func (s shardStore) shardOf(key string) int {
+	for i, sh := range s.shards {
+		if inDir(sh.dir, key) {
+			return i
+		}
+	}
+	return -1
+}
+
+// inDir reports whether the path is in the directory, or under it.
+func inDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Load merges the shards. The header is the first shard's; shards with different
+// precisions or feature parameters are reported, as their entries are not comparable
+// (the mismatching ones are reindexed).
+func (s shardStore) Load(keep func(key string) bool) (dbHeader, map[string]Thumbnail, error) {
+	hdr := newDBHeader()
+	thumbnails := make(map[string]Thumbnail)
+	var first *relStore
+	var firstParams FeatureParams
+	for i, sh := range s.shards {
+		if _, err := os.Stat(string(sh.fileStore)); err != nil && os.IsNotExist(err) {
+			continue
+		}
+		h, stored, err := sh.Load(keep)
+		if err != nil {
+			return hdr, nil, err
+		}
+		var params FeatureParams
+		for _, t := range stored {
+			if t.Failed == "" {
+				params = t.Params
+				break
+			}
+		}
+		if first == nil {
+			first, hdr, firstParams = &s.shards[i], h, params
+		} else {
+			if h.Precision != hdr.Precision {
+				log.Printf("shard %s: precision %s, unlike %s of %s", sh, h.Precision, hdr.Precision, first)
+			}
+			if len(stored) != 0 {
+				if reason := firstParams.mismatch(params); reason != "" {
+					log.Printf("shard %s: incompatible with %s: %s", sh, first, reason)
+				}
+			}
+		}
+		for k, t := range stored {
+			// a nested shard's entry wins over the containing one's
+			if _, ok := thumbnails[k]; !ok || s.shardOf(k) == i {
+				thumbnails[k] = t
+			}
+		}
+	}
+	return hdr, thumbnails, nil
+}
+
+// Save writes each entry into the shard of its directory; those in no shard are dropped.
+func (s shardStore) Save(ctx context.Context, hdr dbHeader, thumbnails map[string]Thumbnail, loaded func(key string) bool) error {
+	parts := make([]map[string]Thumbnail, len(s.shards))
+	for k, t := range thumbnails {
+		i := s.shardOf(k)
+		if i < 0 {
+			log.Printf("%s: not in any shard, not stored", k)
+			continue
+		}
+		if parts[i] == nil {
+			parts[i] = make(map[string]Thumbnail)
+		}
+		parts[i][k] = t
+	}
+	var firstErr error
+	for i, sh := range s.shards {
+		if parts[i] == nil {
+			if _, err := os.Stat(string(sh.fileStore)); err != nil && os.IsNotExist(err) {
+				continue // don't litter the directories with empty shards
+			}
+		}
+		if err := sh.Save(ctx, hdr, parts[i], loaded); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (s shardStore) String() string {
+	if len(s.shards) == 1 {
+		return s.shards[0].String()
+	}
+	return strconv.Itoa(len(s.shards)) + " " + shardFile + " shards"
+}
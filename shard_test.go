@@ -0,0 +1,69 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestShardByDir(t *testing.T) {
+	dir := t.TempDir()
+	lib, loose := filepath.Join(dir, "lib"), filepath.Join(dir, "loose")
+	for _, d := range []string{filepath.Join(lib, "a"), filepath.Join(lib, "b", "c"), loose} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeImage(t, filepath.Join(lib, "a"), "x.png", synthImage(1, Width, Width))
+	writeImage(t, filepath.Join(lib, "b", "c"), "y.png", synthImage(2, Width, Width))
+	writeImage(t, lib, "z.png", synthImage(3, Width, Width))
+	single := writeImage(t, loose, "single.png", synthImage(4, Width, Width))
+
+	// as "mosaic -db-shard-by-dir loose/single.png lib"
+	files, err := expandSources([]string{single, lib})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := testOptions()
+	opts.DBShardByDir = true
+	for i, want := range []int{4, 0} {
+		_, indexed, err := prepareThumbnails(context.Background(), opts, files, new(Timings))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if indexed != want {
+			t.Errorf("run %d: indexed %d, wanted %d", i+1, indexed, want)
+		}
+	}
+	// a shard of each argument, not of each directory of the sources
+	for _, tc := range []struct {
+		Dir   string
+		Shard bool
+	}{
+		{Dir: lib, Shard: true},
+		{Dir: loose, Shard: true},
+		{Dir: filepath.Join(lib, "a")},
+		{Dir: filepath.Join(lib, "b")},
+		{Dir: filepath.Join(lib, "b", "c")},
+	} {
+		if _, err := os.Stat(filepath.Join(tc.Dir, shardFile)); (err == nil) != tc.Shard {
+			t.Errorf("%s: a shard: %t, wanted %t", tc.Dir, err == nil, tc.Shard)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// legacyDB is the DB file used without -db before defaultDB.
+const legacyDB = "mosaic.db"
+
+// defaultDB returns the DB file used without -db: mosaic/thumbs.db in the user's cache directory,
+// or legacyDB in the current directory if there is no cache directory.
+func defaultDB() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return legacyDB
+	}
+	return filepath.Join(dir, "mosaic", "thumbs.db")
+}
+
+// store is where the thumbnails persist between runs.
+type store interface {
+	// Load the entries for which keep returns true (all for a nil keep).
+	Load(keep func(key string) bool) (dbHeader, map[string]Thumbnail, error)
+	// Save the thumbnails loaded with the loaded func, keeping the others (see saveDBSubset).
+	// A save canceled by ctx leaves the store as it was.
+	Save(ctx context.Context, hdr dbHeader, thumbnails map[string]Thumbnail, loaded func(key string) bool) error
+	// String is the name of the store in messages.
+	String() string
+}
+
+// openStore returns the store of the -db flag: "" and "none" mean no persistence,
+// an http(s) URL a read-only remote DB.
+// With a non-empty relativeTo, the keys are stored relative to that directory.
+func openStore(db, relativeTo string) store {
+	if db == "" || db == "none" {
+		return nullStore{}
+	}
+	if isURL(db) {
+		return httpStore(db)
+	}
+	if relativeTo == "" {
+		return fileStore(db)
+	}
+	if key, err := canonicalKey(relativeTo); err == nil {
+		relativeTo = key
+	}
+	return relStore{fileStore: fileStore(db), dir: relativeTo}
+}
+
+// fileStore is the DB file.
+type fileStore string
+
+func (s fileStore) Load(keep func(key string) bool) (dbHeader, map[string]Thumbnail, error) {
+	return loadDBSubset(string(s), keep)
+}
+func (s fileStore) Save(ctx context.Context, hdr dbHeader, thumbnails map[string]Thumbnail, loaded func(key string) bool) error {
+	return saveDBSubset(ctx, string(s), hdr, thumbnails, loaded)
+}
+func (s fileStore) String() string { return string(s) }
+
+// relStore is a fileStore with the keys relative to dir,
+// so the DB can be used wherever dir is moved (mounted).
+type relStore struct {
+	fileStore
+	dir string
+}
+
+// abs returns the path of the stored key.
+func (s relStore) abs(key string) string {
+	if filepath.IsAbs(key) || isURL(key) {
+		return key
+	}
+	return filepath.Join(s.dir, key)
+}
+
+func (s relStore) Load(keep func(key string) bool) (dbHeader, map[string]Thumbnail, error) {
+	hdr, stored, err := s.fileStore.Load(func(k string) bool { return keep == nil || keep(s.abs(k)) })
+	if err != nil {
+		return hdr, nil, err
+	}
+	thumbnails := make(map[string]Thumbnail, len(stored))
+	for k, t := range stored {
+		if t.AliasOf != "" {
+			t.AliasOf = s.abs(t.AliasOf)
+		}
+		thumbnails[s.abs(k)] = t
+	}
+	return hdr, thumbnails, nil
+}
+
+// rel returns the stored key of the path, if it is under dir.
+func (s relStore) rel(key string) (string, bool) {
+	rel, err := filepath.Rel(s.dir, key)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+func (s relStore) Save(ctx context.Context, hdr dbHeader, thumbnails map[string]Thumbnail, loaded func(key string) bool) error {
+	stored := make(map[string]Thumbnail, len(thumbnails))
+	for k, t := range thumbnails {
+		rel, ok := s.rel(k)
+		if !ok {
+			// such as the target
+			log.Printf("%s: not under %s, not stored", k, s.dir)
+			continue
+		}
+		if alias, ok := s.rel(t.AliasOf); ok && t.AliasOf != "" {
+			t.AliasOf = alias
+		}
+		stored[rel] = t
+	}
+	var storedLoaded func(string) bool
+	if loaded != nil {
+		storedLoaded = func(k string) bool { return loaded(s.abs(k)) }
+	}
+	return s.fileStore.Save(ctx, hdr, stored, storedLoaded)
+}
+
+// prober is a store which can check before indexing that it could be saved.
+type prober interface {
+	Probe() error
+}
+
+func (s fileStore) Probe() error { return probeDB(string(s)) }
+
+func (s shardStore) Probe() error {
+	for _, sh := range s.shards {
+		if err := sh.Probe(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchIndexFile returns the file of the persisted match index of the store, if it can have one.
+func matchIndexFile(st store) string {
+	switch st := st.(type) {
+	case fileStore:
+		return string(st) + ".idx"
+	case relStore:
+		return string(st.fileStore) + ".idx"
+	case *layerStore:
+		return matchIndexFile(st.primary)
+	}
+	return ""
+}
+
+// nullStore is empty, and forgets everything saved to it.
+type nullStore struct{}
+
+func (nullStore) Load(func(string) bool) (dbHeader, map[string]Thumbnail, error) {
+	return newDBHeader(), make(map[string]Thumbnail), nil
+}
+func (nullStore) Save(context.Context, dbHeader, map[string]Thumbnail, func(string) bool) error {
+	return nil
+}
+func (nullStore) String() string { return "none" }
@@ -0,0 +1,180 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"log"
+
+	"github.com/disintegration/imaging"
+	"github.com/pkg/errors"
+)
+
+// streamMosaics indexes the sources, and then writes a mosaic to w of each JPEG frame read from r.
+//
+// A *NotPersistedError or *SourcesFailedError is returned after all the frames are written.
+func streamMosaics(ctx context.Context, opts Options, files []string, r io.Reader, w io.Writer, tm *Timings) error {
+	if len(files) == 0 {
+		return errors.New("usage: mosaic [flags] -stream=frames source...")
+	}
+	b := NewBuilder(opts)
+	b.Timings = tm
+	warning := b.AddSources(ctx, files)
+	if warning != nil && !isWarning(warning) {
+		return warning
+	}
+	n, err := b.Stream(ctx, r, w)
+	log.Printf("%d mosaic frames written", n)
+	if err != nil {
+		return err
+	}
+	return warning
+}
+
+// Stream reads a stream of JPEG frames (such as MJPEG) from r, and writes the mosaic
+// of each, as a JPEG, to w - until r ends. Anything between the frames is skipped,
+// so a multipart stream can be read, too; a malformed frame is skipped.
+//
+// It returns the number of mosaics written.
+func (b *Builder) Stream(ctx context.Context, r io.Reader, w io.Writer) (int, error) {
+	br := bufio.NewReader(r)
+	var written int
+	for i := 0; ; i++ {
+		if err := ctx.Err(); err != nil {
+			return written, errors.Wrap(err, "streaming")
+		}
+		frame, err := readJPEGFrame(br)
+		if err == io.EOF {
+			return written, nil
+		}
+		name := fmt.Sprintf("frame %d", i)
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			log.Printf("%s: truncated, skipped", name)
+			return written, nil
+		} else if errors.Is(err, errMalformedFrame) {
+			// resync on the next frame
+			log.Println(errors.Wrap(err, name))
+			continue
+		} else if err != nil {
+			return written, errors.Wrap(err, name)
+		}
+		target, err := jpeg.Decode(bytes.NewReader(frame))
+		if err != nil {
+			log.Println(errors.Wrap(err, name))
+			continue
+		}
+		plan, err := b.BuildImage(ctx, name, target)
+		if err != nil {
+			return written, err
+		}
+		stop := b.Timings.Start("rendering")
+		canvas, err := renderPlan(ctx, b.opts, plan, b.thumbnails)
+		stop(len(plan.Tiles))
+		if err != nil {
+			return written, err
+		}
+		err = encodeImage(w, canvas, imaging.JPEG, b.opts.DPI, b.opts.Progressive)
+		releaseCanvas(canvas)
+		if err != nil {
+			return written, errors.Wrap(err, name)
+		}
+		written++
+	}
+}
+
+// errMalformedFrame is returned by readJPEGFrame for a frame it can't find the end of.
+var errMalformedFrame = errors.New("malformed JPEG frame")
+
+// JPEG markers used by readJPEGFrame.
+const (
+	markerSOI = 0xd8 // start of image
+	markerEOI = 0xd9 // end of image
+	markerSOS = 0xda // start of scan, followed by the entropy-coded data
+)
+
+// readJPEGFrame returns the next JPEG image of the stream, from its SOI to its EOI marker,
+// skipping anything before the SOI. It returns io.EOF if there are no more images.
+//
+// The segments are skipped by their length, so an embedded thumbnail doesn't end the frame.
+func readJPEGFrame(br *bufio.Reader) ([]byte, error) {
+	var prev byte
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil, err // io.EOF: no more frames
+		}
+		if prev == 0xff && c == markerSOI {
+			break
+		}
+		prev = c
+	}
+	frame := []byte{0xff, markerSOI}
+	readByte := func() (byte, error) {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return c, err
+	}
+	var scan bool // in entropy-coded data
+	for {
+		c, err := readByte()
+		if err != nil {
+			return frame, err
+		}
+		if c != 0xff {
+			if !scan {
+				return frame, errors.Wrapf(errMalformedFrame, "marker expected, got %#02x", c)
+			}
+			frame = append(frame, c)
+			continue
+		}
+		m := byte(0xff)
+		for m == 0xff { // fill bytes
+			if m, err = readByte(); err != nil {
+				return frame, err
+			}
+		}
+		frame = append(frame, 0xff, m)
+		switch {
+		case m == markerEOI:
+			return frame, nil
+		case m == 0 || m >= 0xd0 && m <= 0xd7 || m == 0x01:
+			// stuffed byte, restart marker or TEM: no length
+			continue
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(br, length[:]); err != nil {
+			return frame, io.ErrUnexpectedEOF
+		}
+		n := int(length[0])<<8 | int(length[1])
+		if n < 2 {
+			return frame, errors.Wrapf(errMalformedFrame, "segment %#02x: bad length %d", m, n)
+		}
+		frame = append(frame, length[:]...)
+		start := len(frame)
+		frame = append(frame, make([]byte, n-2)...)
+		if _, err := io.ReadFull(br, frame[start:]); err != nil {
+			return frame, io.ErrUnexpectedEOF
+		}
+		scan = m == markerSOS
+	}
+}
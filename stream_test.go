@@ -0,0 +1,104 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestStream(t *testing.T) {
+	red, blue := color.NRGBA{R: 250, G: 10, B: 10, A: 255}, color.NRGBA{R: 10, G: 10, B: 250, A: 255}
+	sources := map[string]color.NRGBA{"red.raw": red, "blue.raw": blue}
+	// the sources must be decoded once, not per frame
+	defer func(c *imageCache) { composeCache = c }(composeCache)
+	composeCache = newImageCache(1 << 20)
+	var decoded atomic.Int32
+	fakeRawDecoder(t, func(ctx context.Context, fn string) (image.Image, error) {
+		decoded.Add(1)
+		return solidImage(Width, Width, sources[filepath.Base(fn)]), nil
+	})
+	dir := t.TempDir()
+	var files []string
+	for name := range sources {
+		fn := filepath.Join(dir, name)
+		if err := os.WriteFile(fn, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, fn)
+	}
+
+	// an MJPEG stream: the frames within multipart headers
+	frames := []color.NRGBA{red, blue, red}
+	var in bytes.Buffer
+	for i, c := range frames {
+		fmt.Fprintf(&in, "--frame\r\nContent-Type: image/jpeg\r\nX-Frame: %d\r\n\r\n", i)
+		if err := jpeg.Encode(&in, solidImage(2*Width, 2*Width, c), nil); err != nil {
+			t.Fatal(err)
+		}
+		in.WriteString("\r\n")
+	}
+
+	opts := testOptions()
+	opts.Grid = Grid{Cols: 2, Rows: 2}
+	opts.Match.Metric = MetricColor
+	b := NewBuilder(opts)
+	ctx := context.Background()
+	if err := b.AddSources(ctx, files); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	n, err := b.Stream(ctx, &in, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(frames) {
+		t.Errorf("got %d mosaics, wanted %d", n, len(frames))
+	}
+	// indexed, then rendered
+	if got := decoded.Load(); got != 2*int32(len(sources)) {
+		t.Errorf("the sources are decoded %d times, wanted %d", got, 2*len(sources))
+	}
+
+	br := bufio.NewReader(&out)
+	for i, want := range frames {
+		frame, err := readJPEGFrame(br)
+		if err != nil {
+			t.Fatalf("mosaic %d: %+v", i, err)
+		}
+		img, err := jpeg.Decode(bytes.NewReader(frame))
+		if err != nil {
+			t.Fatalf("mosaic %d: %+v", i, err)
+		}
+		bounds := img.Bounds()
+		got := color.NRGBAModel.Convert(img.At(bounds.Dx()/4, bounds.Dy()/4)).(color.NRGBA)
+		if absDiff(got.R, want.R) > 16 || absDiff(got.B, want.B) > 16 {
+			t.Errorf("mosaic %d: got %v, wanted %v", i, got, want)
+		}
+	}
+	if _, err := readJPEGFrame(br); err == nil {
+		t.Error("more mosaics than frames")
+	}
+}
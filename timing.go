@@ -0,0 +1,126 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// Timings of the phases of a run.
+type Timings struct {
+	Phases []Phase
+}
+
+// Phase is the wall-clock duration of a phase, and the number of items processed.
+type Phase struct {
+	Name     string
+	Duration time.Duration
+	Items    int
+	// Nested phases run within another one, so they are not added to the total.
+	Nested bool
+}
+
+// Start the timing of a phase; call the returned function at its end.
+// The phase is profiled by the profiler, too.
+func (t *Timings) Start(name string) func(items int) {
+	start, end := time.Now(), profiler.Phase(name)
+	return func(items int) {
+		t.Phases = append(t.Phases, Phase{Name: name, Duration: time.Since(start), Items: items})
+		end()
+	}
+}
+
+// StartNested is Start of a phase within another one; it is just a task of the profiler's trace.
+func (t *Timings) StartNested(name string) func(items int) {
+	start, end := time.Now(), profiler.Task(name)
+	return func(items int) {
+		t.Phases = append(t.Phases, Phase{Name: name, Duration: time.Since(start), Items: items, Nested: true})
+		end()
+	}
+}
+
+// Print the summary of the phases, with the phase names in bold if colorize is true.
+func (t *Timings) Print(w io.Writer, colorize bool) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', tabwriter.AlignRight)
+	var total time.Duration
+	for _, p := range t.Phases {
+		name := p.Name
+		if p.Nested {
+			name = "  " + name
+		} else {
+			total += p.Duration
+		}
+		if colorize {
+			name = "\x1b[1;36m" + name + "\x1b[0m"
+		}
+		var rate string
+		if p.Items > 0 && p.Duration > 0 {
+			rate = fmt.Sprintf("%.1f/s", float64(p.Items)/p.Duration.Seconds())
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t\n", name, p.Duration.Round(time.Millisecond), p.Items, rate)
+	}
+	fmt.Fprintf(tw, "total\t%s\t\t\t\n", total.Round(time.Millisecond))
+	return tw.Flush()
+}
+
+// timingReport is the JSON of the Timings.
+type timingReport struct {
+	Phases []phaseReport
+	// Seconds is the total of the not nested phases.
+	Seconds float64
+}
+
+// phaseReport is a Phase, with its throughput in items per second.
+type phaseReport struct {
+	Name      string
+	Seconds   float64
+	Items     int
+	PerSecond float64 `json:",omitempty"`
+	Nested    bool    `json:",omitempty"`
+}
+
+func (t *Timings) report() timingReport {
+	var report timingReport
+	for _, p := range t.Phases {
+		ph := phaseReport{Name: p.Name, Seconds: p.Duration.Seconds(), Items: p.Items, Nested: p.Nested}
+		if p.Items > 0 && p.Duration > 0 {
+			ph.PerSecond = float64(p.Items) / p.Duration.Seconds()
+		}
+		report.Phases = append(report.Phases, ph)
+		if !p.Nested {
+			report.Seconds += ph.Seconds
+		}
+	}
+	return report
+}
+
+// WriteReport writes the phases as JSON (see timingReport).
+func (t *Timings) WriteReport(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(t.report())
+}
+
+// isTerminal reports whether the file is a character device, such as a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,102 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimingSummary(t *testing.T) {
+	dir := t.TempDir()
+	target := writeImage(t, dir, "target.png", synthImage(-1, 2*Width, 2*Width))
+	opts := testOptions()
+	opts.Grid = Grid{Cols: 2, Rows: 2}
+	opts.Out = filepath.Join(dir, "out.png")
+	opts.BenchReport = filepath.Join(dir, "report.json")
+	if err := Main(context.Background(), opts, append([]string{target}, testLibrary(t, dir, 3)...)); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(opts.BenchReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report timingReport
+	if err := json.Unmarshal(b, &report); err != nil {
+		t.Fatal(err)
+	}
+	phases := make(map[string]phaseReport)
+	for _, p := range report.Phases {
+		if p.Seconds < 0 {
+			t.Errorf("%s took %g seconds", p.Name, p.Seconds)
+		}
+		phases[p.Name] = p
+	}
+	for _, tc := range []struct {
+		Name  string
+		Items int
+	}{
+		{Name: "indexing", Items: 4},
+		{Name: "matching", Items: 4},
+		{Name: "encoding", Items: 1},
+	} {
+		p, ok := phases[tc.Name]
+		if !ok {
+			t.Errorf("no %s phase in %s", tc.Name, b)
+		} else if p.Items != tc.Items {
+			t.Errorf("%s: %d items, wanted %d", tc.Name, p.Items, tc.Items)
+		}
+	}
+	if report.Seconds < 0 {
+		t.Errorf("the total is %g seconds", report.Seconds)
+	}
+}
+
+func TestTimingsPrint(t *testing.T) {
+	tm := Timings{Phases: []Phase{
+		{Name: "indexing", Duration: 2 * time.Second, Items: 10},
+		{Name: "matching", Duration: time.Second, Items: 4},
+		{Name: "distances", Duration: time.Second, Items: 100, Nested: true},
+		{Name: "encoding", Duration: 0, Items: 1},
+	}}
+	for _, tc := range []struct {
+		Name     string
+		Colorize bool
+		Want     []string
+	}{
+		{Name: "plain", Want: []string{"indexing 2s 10 5.0/s", "matching 1s 4 4.0/s", "distances 1s 100 100.0/s", "encoding 0s 1", "total 3s"}},
+		{Name: "color", Colorize: true, Want: []string{"\x1b[1;36mindexing\x1b[0m", "\x1b[1;36m distances\x1b[0m"}},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := tm.Print(&buf, tc.Colorize); err != nil {
+				t.Fatal(err)
+			}
+			got := strings.Join(strings.Fields(buf.String()), " ")
+			for _, want := range tc.Want {
+				if !strings.Contains(got, want) {
+					t.Errorf("%q is missing from %q", want, got)
+				}
+			}
+		})
+	}
+}
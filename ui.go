@@ -0,0 +1,61 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// uiFiles are the assets of the web UI: a single page, using the HTTP API.
+//
+//go:embed ui
+var uiFiles embed.FS
+
+// defaultUIAddr is the address of the HTTP API of mosaic ui, without a -http.
+const defaultUIAddr = "localhost:8080"
+
+// uiHandler serves the web UI.
+func uiHandler() http.Handler {
+	sub, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServerFS(sub)
+}
+
+// handleSources answers the sources with the q of the query in their path (case insensitive),
+// at most limit (50 by default) of them, to be picked as a target.
+func (api *httpAPI) handleSources(w http.ResponseWriter, r *http.Request) {
+	q := strings.ToLower(r.URL.Query().Get("q"))
+	limit := 50
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+		limit = n
+	}
+	sources := make([]string, 0, limit)
+	for _, fn := range api.builder.files {
+		if len(sources) == limit {
+			break
+		}
+		if strings.Contains(strings.ToLower(fn), q) {
+			sources = append(sources, fn)
+		}
+	}
+	writeJSON(w, http.StatusOK, sources)
+}
@@ -0,0 +1,220 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"image"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/pkg/errors"
+)
+
+// urlSources configures the fetching of the sources and targets given as http(s) URLs,
+// which are the DB keys of them.
+var urlSources = struct {
+	// CacheDir keeps the fetched images, revalidated on each fetch; empty means no cache.
+	CacheDir string
+	// StatTimeout limits each HEAD request of statSource, like -decode-timeout
+	// does the fetches; 0 means no limit.
+	StatTimeout time.Duration
+	// sem limits the concurrent fetches
+	sem chan struct{}
+}{sem: make(chan struct{}, 4)}
+
+// errCacheGone is returned by fetchURLOnce for a 304 whose cached content is missing.
+var errCacheGone = errors.New("the cached content is gone")
+
+// setURLFetches sets the limit of the concurrent fetches.
+func setURLFetches(n int) {
+	if n < 1 {
+		n = 1
+	}
+	urlSources.sem = make(chan struct{}, n)
+}
+
+// acquireFetch waits for a free fetch slot, or for ctx to be done.
+// The returned function releases the slot.
+func acquireFetch(ctx context.Context) (func(), error) {
+	sem := urlSources.sem
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// urlInfo is the os.FileInfo of a URL, from the response headers.
+type urlInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi urlInfo) Name() string       { return fi.name }
+func (fi urlInfo) Size() int64        { return fi.size }
+func (fi urlInfo) Mode() fs.FileMode  { return 0444 }
+func (fi urlInfo) ModTime() time.Time { return fi.modTime }
+func (fi urlInfo) IsDir() bool        { return false }
+func (fi urlInfo) Sys() interface{}   { return nil }
+
+func newURLInfo(u string, h http.Header) urlInfo {
+	fi := urlInfo{name: u}
+	if pu, err := url.Parse(u); err == nil && path.Base(pu.Path) != "/" && path.Base(pu.Path) != "." {
+		fi.name = path.Base(pu.Path)
+	}
+	fi.size, _ = strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	fi.modTime, _ = http.ParseTime(h.Get("Last-Modified"))
+	return fi
+}
+
+// statSource is os.Stat for a file, a HEAD request for a URL.
+func statSource(ctx context.Context, fn string) (os.FileInfo, error) {
+	if !isURL(fn) {
+		return os.Stat(fn)
+	}
+	if urlSources.StatTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, urlSources.StatTimeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, "HEAD", fn, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, fn)
+	}
+	release, err := acquireFetch(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, fn)
+	}
+	defer release()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, fn)
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return newURLInfo(fn, resp.Header), nil
+	case http.StatusNotFound, http.StatusGone:
+		return nil, &fs.PathError{Op: "HEAD", Path: fn, Err: fs.ErrNotExist}
+	}
+	return nil, errors.Errorf("%s: %s", fn, resp.Status)
+}
+
+// fetchURL returns the content of the URL: from the cache, if it is still valid.
+// The errors are not wrapped by the URL.
+func fetchURL(ctx context.Context, u string) ([]byte, error) {
+	b, err := fetchURLOnce(ctx, u, true)
+	if err == errCacheGone {
+		// fetch again, unconditionally, after releasing the slot
+		return fetchURLOnce(ctx, u, false)
+	}
+	return b, err
+}
+
+// fetchURLOnce does one request of fetchURL, a conditional one if cached.
+func fetchURLOnce(ctx context.Context, u string, conditional bool) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	var fn, metaFn string
+	var meta httpMeta
+	if urlSources.CacheDir != "" {
+		h := sha256.Sum256([]byte(u))
+		fn = filepath.Join(urlSources.CacheDir, hex.EncodeToString(h[:8]))
+		metaFn = fn + ".json"
+		if b, err := os.ReadFile(metaFn); conditional && err == nil {
+			_ = json.Unmarshal(b, &meta)
+			if meta.ETag != "" {
+				req.Header.Set("If-None-Match", meta.ETag)
+			}
+			if meta.LastModified != "" {
+				req.Header.Set("If-Modified-Since", meta.LastModified)
+			}
+		}
+	}
+	release, err := acquireFetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		if b, err := os.ReadFile(fn); err == nil {
+			return b, nil
+		}
+		os.Remove(metaFn)
+		return nil, errCacheGone
+	case http.StatusOK:
+	default:
+		return nil, errors.New(resp.Status)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if fn != "" {
+		meta = httpMeta{ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+		if err := cacheURL(fn, metaFn, b, meta); err != nil {
+			return b, nil // just not cached
+		}
+	}
+	return b, nil
+}
+
+// cacheURL writes the content and its meta to the cache.
+func cacheURL(fn, metaFn string, b []byte, meta httpMeta) error {
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(fn, b, 0644); err != nil {
+		return err
+	}
+	mb, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(metaFn, mb, 0644)
+}
+
+// openURL fetches and decodes the image of the URL, like openImage, with unwrapped errors.
+func openURL(ctx context.Context, u string) (image.Image, error) {
+	b, err := fetchURL(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	return imaging.Decode(bytes.NewReader(b))
+}
@@ -0,0 +1,187 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+// pngServer serves the image as /tile.png, counting the full (200) responses.
+func pngServer(t *testing.T) (*httptest.Server, *atomic.Int32, []byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := imaging.Encode(&buf, synthImage(3, Width, Width), imaging.PNG); err != nil {
+		t.Fatal(err)
+	}
+	content := buf.Bytes()
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	var full atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/tile.png" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("ETag", `"tile-1"`)
+		if r.Header.Get("If-None-Match") == `"tile-1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if r.Method == "GET" {
+			full.Add(1)
+		}
+		http.ServeContent(w, r, "tile.png", modTime, bytes.NewReader(content))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &full, content
+}
+
+func TestIndexURL(t *testing.T) {
+	srv, _, _ := pngServer(t)
+	u := srv.URL + "/tile.png"
+	opts := testOptions()
+	thumbnails, indexed, err := prepareThumbnails(context.Background(), opts, []string{u}, new(Timings))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if indexed != 1 {
+		t.Errorf("indexed %d, wanted 1", indexed)
+	}
+	got, ok := thumbnails[u]
+	if !ok {
+		t.Fatalf("no entry of %q, got %v", u, thumbnails)
+	}
+	if got.Name != "tile.png" || got.ModTime.IsZero() {
+		t.Errorf("got %q of %s", got.Name, got.ModTime)
+	}
+	if want := testEntry(synthImage(3, Width, Width)); *got.FFT != *want.FFT || got.Color != want.Color {
+		t.Error("got other features than of the image served")
+	}
+
+	// a missing one fails, like a missing file
+	if _, err := openURL(context.Background(), srv.URL+"/missing.png"); err == nil {
+		t.Error("opened a missing URL")
+	}
+}
+
+func TestURLCache(t *testing.T) {
+	defer func(dir string) { urlSources.CacheDir = dir }(urlSources.CacheDir)
+	for _, tc := range []struct {
+		Name     string
+		CacheDir bool
+		WantFull int32
+	}{
+		{Name: "no cache", WantFull: 2},
+		{Name: "cache", CacheDir: true, WantFull: 1},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			srv, full, content := pngServer(t)
+			urlSources.CacheDir = ""
+			if tc.CacheDir {
+				urlSources.CacheDir = t.TempDir()
+			}
+			for i := 0; i < 2; i++ {
+				b, err := fetchURL(context.Background(), srv.URL+"/tile.png")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(b, content) {
+					t.Errorf("fetch %d: got %d bytes, wanted the %d served", i, len(b), len(content))
+				}
+			}
+			if got := full.Load(); got != tc.WantFull {
+				t.Errorf("got %d full responses, wanted %d", got, tc.WantFull)
+			}
+		})
+	}
+}
+
+func TestURLFetchSlots(t *testing.T) {
+	defer func(dir string) { urlSources.CacheDir = dir }(urlSources.CacheDir)
+	defer func(sem chan struct{}) { urlSources.sem = sem }(urlSources.sem)
+	defer func(d time.Duration) { urlSources.StatTimeout = d }(urlSources.StatTimeout)
+	setURLFetches(1)
+	srv, full, content := pngServer(t)
+	urlSources.CacheDir = t.TempDir()
+
+	// a 304 whose cached content is gone is fetched again, in the only slot
+	if _, err := fetchURL(context.Background(), srv.URL+"/tile.png"); err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.Sum256([]byte(srv.URL + "/tile.png"))
+	if err := os.Remove(filepath.Join(urlSources.CacheDir, hex.EncodeToString(h[:8]))); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		b, err := fetchURL(context.Background(), srv.URL+"/tile.png")
+		if err == nil && !bytes.Equal(b, content) {
+			err = fmt.Errorf("got %d bytes, wanted the %d served", len(b), len(content))
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the refetch of the missing cache is stuck")
+	}
+	if got := full.Load(); got != 2 {
+		t.Errorf("got %d full responses, wanted 2", got)
+	}
+
+	// waiting for a slot ends with the context
+	urlSources.sem <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := fetchURL(ctx, srv.URL+"/tile.png"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("fetch waiting for a slot: got %v, wanted %v", err, context.DeadlineExceeded)
+	}
+	if _, err := statSource(ctx, srv.URL+"/tile.png"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("stat waiting for a slot: got %v, wanted %v", err, context.DeadlineExceeded)
+	}
+	<-urlSources.sem
+
+	// the HEAD request is limited by -decode-timeout
+	block := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-block:
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	defer close(block)
+	urlSources.StatTimeout = 50 * time.Millisecond
+	if _, err := statSource(context.Background(), slow.URL+"/tile.png"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("stat of a stuck server: got %v, wanted %v", err, context.DeadlineExceeded)
+	}
+}
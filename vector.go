@@ -0,0 +1,80 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"image"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// rasterizeFunc renders a vector image to a w*h bitmap.
+type rasterizeFunc func(ctx context.Context, fn string, w, h int) (image.Image, error)
+
+// rasterizers by lowercase file extension, registered by the optional (build tagged) renderers.
+var rasterizers = make(map[string]rasterizeFunc)
+
+// vectorExts are the extensions of the vector formats -rasterize-cmd is used for.
+var vectorExts = map[string]bool{".svg": true, ".pdf": true}
+
+// openTarget opens the target image: a vector target is rasterized to w*h,
+// by a built-in renderer, or by the command (see Options.RasterizeCmd).
+func openTarget(ctx context.Context, fn string, w, h int, cmd string) (image.Image, error) {
+	ext := strings.ToLower(filepath.Ext(fn))
+	if cmd != "" && vectorExts[ext] {
+		return rasterizeCmd(ctx, cmd, fn, w, h)
+	}
+	if rasterize := rasterizers[ext]; rasterize != nil {
+		img, err := rasterize(ctx, fn, w, h)
+		return img, errors.Wrap(err, fn)
+	}
+	if vectorExts[ext] {
+		return nil, errors.Errorf("%s: no renderer for %s, use -rasterize-cmd or build with -tags svg", fn, ext)
+	}
+	return openImage(ctx, fn)
+}
+
+// rasterizeCmd runs the command, after replacing {in}, {out}, {w} and {h} in its arguments
+// with the vector file, the temporary bitmap to write, and its size, and opens the bitmap.
+func rasterizeCmd(ctx context.Context, cmd, fn string, w, h int) (image.Image, error) {
+	fh, err := os.CreateTemp("", "mosaic-target-*.png")
+	if err != nil {
+		return nil, err
+	}
+	out := fh.Name()
+	fh.Close()
+	defer os.Remove(out)
+	r := strings.NewReplacer("{in}", fn, "{out}", out, "{w}", strconv.Itoa(w), "{h}", strconv.Itoa(h))
+	args := strings.Fields(cmd)
+	for i, a := range args {
+		args[i] = r.Replace(a)
+	}
+	if len(args) == 0 {
+		return nil, errors.New("empty -rasterize-cmd")
+	}
+	c := exec.CommandContext(ctx, args[0], args[1:]...)
+	c.Stderr = os.Stderr
+	if err := c.Run(); err != nil {
+		return nil, errors.Wrapf(err, "%s: %q", fn, args)
+	}
+	return openImage(ctx, out)
+}
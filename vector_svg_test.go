@@ -0,0 +1,67 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+//go:build svg
+// +build svg
+
+package main
+
+import (
+	"context"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSVGTarget(t *testing.T) {
+	dir := t.TempDir()
+	files := testLibrary(t, dir, 4)
+	target := filepath.Join(dir, "target.svg")
+	const svg = `<svg xmlns="http://www.w3.org/2000/svg" width="100" height="100" viewBox="0 0 100 100">
+<rect width="100" height="100" fill="white"/>
+<circle cx="50" cy="50" r="30" fill="black"/>
+</svg>`
+	if err := os.WriteFile(target, []byte(svg), 0644); err != nil {
+		t.Fatal(err)
+	}
+	img, err := rasterizeSVG(context.Background(), target, 2*Width, 2*Width)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grayLevel := func(c color.Color) uint8 { return color.GrayModel.Convert(c).(color.Gray).Y }
+	// black in the middle, white in the corner
+	if c := img.At(Width, Width); grayLevel(c) > 10 {
+		t.Errorf("center is %v, wanted black", c)
+	}
+	if c := img.At(2, 2); grayLevel(c) < 245 {
+		t.Errorf("corner is %v, wanted white", c)
+	}
+
+	opts := testOptions()
+	opts.Grid = Grid{Cols: 2, Rows: 2}
+	b := NewBuilder(opts)
+	ctx := context.Background()
+	if err := b.AddSources(ctx, files); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := b.Build(ctx, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Tiles) != 4 {
+		t.Errorf("got %d tiles, wanted 4", len(plan.Tiles))
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOpenTargetVector(t *testing.T) {
+	dir := t.TempDir()
+	// The "vector" target is a PNG: the command just copies it, to test the placeholders.
+	png := writeImage(t, dir, "target.png", synthImage(1, 3*Width, 2*Width))
+	svg := filepath.Join(dir, "target.svg")
+	if err := os.Rename(png, svg); err != nil {
+		t.Fatal(err)
+	}
+	// even with -tags svg
+	if r, ok := rasterizers[".svg"]; ok {
+		delete(rasterizers, ".svg")
+		defer func() { rasterizers[".svg"] = r }()
+	}
+	for _, tc := range []struct {
+		Name    string
+		Cmd     string
+		WantErr string
+	}{
+		{Name: "command", Cmd: "cp {in} {out}"},
+		{Name: "failing command", Cmd: "false {in} {out} {w} {h}", WantErr: "exit status 1"},
+		{Name: "no renderer", WantErr: "no renderer for .svg"},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			img, err := openTarget(context.Background(), svg, 3*Width, 2*Width, tc.Cmd)
+			if tc.WantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.WantErr) {
+					t.Fatalf("got %v, wanted %q", err, tc.WantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size := img.Bounds().Size(); size != image.Pt(3*Width, 2*Width) {
+				t.Errorf("got %v", size)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/disintegration/imaging"
+	"github.com/pkg/errors"
+)
+
+// walkedInfos are the file infos of the sources found by expandSources, by key,
+// recorded while walking, so -since can skip the old ones without stat-ing them again.
+// sourceInfo consumes them.
+var walkedInfos = struct {
+	sync.Mutex
+	m map[string]fs.FileInfo
+}{m: make(map[string]fs.FileInfo)}
+
+// walkedRoots are the directories given as sources, by the keys of the files found under them
+// by expandSources: the shards of those files (see shardDirs).
+var walkedRoots = struct {
+	sync.Mutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+// expandSources returns the sources with the directories among them replaced by the images under them,
+// recursively, in lexical order: the files of an image format (by their extension), or RAWs.
+func expandSources(files []string) ([]string, error) {
+	expanded := make([]string, 0, len(files))
+	for _, fn := range files {
+		if isURL(fn) {
+			expanded = append(expanded, fn)
+			continue
+		}
+		// a missing source fails when it is indexed
+		if fi, err := os.Stat(fn); err != nil || !fi.IsDir() {
+			expanded = append(expanded, fn)
+			continue
+		}
+		root := fn
+		if key, err := canonicalKey(fn); err == nil {
+			root = key
+		}
+		err := filepath.WalkDir(fn, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			if _, err := imaging.FormatFromFilename(path); err != nil && !isRaw(path) {
+				return nil
+			}
+			expanded = append(expanded, path)
+			key, keyErr := canonicalKey(path)
+			if keyErr == nil {
+				walkedRoots.Lock()
+				walkedRoots.m[key] = root
+				walkedRoots.Unlock()
+			}
+			// a symbolic link is stat-ed as the file it points to
+			if d.Type().IsRegular() {
+				fi, err := d.Info()
+				if err != nil {
+					return err
+				}
+				if keyErr == nil {
+					walkedInfos.Lock()
+					walkedInfos.m[key] = fi
+					walkedInfos.Unlock()
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return expanded, errors.Wrap(err, fn)
+		}
+	}
+	return expanded, nil
+}
+
+// walkedRoot returns the directory given as a source which the file was found under by expandSources.
+func walkedRoot(key string) (string, bool) {
+	walkedRoots.Lock()
+	defer walkedRoots.Unlock()
+	root, ok := walkedRoots.m[key]
+	return root, ok
+}
+
+// sourceInfo returns the file info of the source recorded by expandSources,
+// or stats it (see statSource).
+func sourceInfo(ctx context.Context, key string) (fs.FileInfo, error) {
+	walkedInfos.Lock()
+	fi, ok := walkedInfos.m[key]
+	delete(walkedInfos.m, key)
+	walkedInfos.Unlock()
+	if ok {
+		return fi, nil
+	}
+	return statSource(ctx, key)
+}
@@ -0,0 +1,71 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSince(t *testing.T) {
+	dir := t.TempDir()
+	old := writeImage(t, dir, "old.png", synthImage(1, Width, Width))
+	writeImage(t, dir, "new.png", synthImage(2, Width, Width))
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeImage(t, filepath.Join(dir, "sub"), "deep.png", synthImage(3, Width, Width))
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not an image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	yesterday := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(old, yesterday, yesterday); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := expandSources([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(dir, "new.png"), old, filepath.Join(dir, "sub", "deep.png")}
+	if !reflect.DeepEqual(files, want) {
+		t.Fatalf("got %q, wanted %q", files, want)
+	}
+	// -since filters by the modification time recorded while walking, not stat-ing the file again
+	now := time.Now()
+	if err := os.Chtimes(old, now, now); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := testOptions()
+	opts.Since = time.Now().Add(-24 * time.Hour)
+	thumbnails, indexed, err := prepareThumbnails(context.Background(), opts, files, new(Timings))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if indexed != 2 {
+		t.Errorf("indexed %d, wanted 2", indexed)
+	}
+	for _, fn := range files {
+		if _, ok := thumbnails[fn]; ok == (fn == old) {
+			t.Errorf("%s: indexed %t", fn, ok)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"os"
+	"sync"
+)
+
+// indexJob is a source for the indexPool to decode and compute the features of.
+type indexJob struct {
+	seq  int
+	fn   string
+	fi   os.FileInfo
+	hash string
+	// isForced is whether the entry was up to date, but -reindex forced it
+	isForced bool
+}
+
+// indexResult is the entry computed by the indexPool for the job, or its error.
+type indexResult struct {
+	indexJob
+	thumb Thumbnail
+	err   error
+}
+
+// indexPool indexes the sources on its workers, handing the results to collect
+// in the order of their Submit, on the goroutine calling Submit, WaitFor and Close:
+// so collect may update the thumbnails without locking, and logs in the order of the files.
+type indexPool struct {
+	jobs    chan indexJob
+	results chan *indexResult
+	collect func(*indexResult)
+	wg      sync.WaitGroup
+
+	submitted, collected int
+	// pending are the results received ahead of their turn
+	pending map[int]*indexResult
+}
+
+// newIndexPool starts n workers calling index on the submitted jobs.
+func newIndexPool(n int, index func(indexJob) (Thumbnail, error), collect func(*indexResult)) *indexPool {
+	if n < 1 {
+		n = 1
+	}
+	p := &indexPool{
+		jobs: make(chan indexJob), results: make(chan *indexResult),
+		collect: collect, pending: make(map[int]*indexResult, n),
+	}
+	p.wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer p.wg.Done()
+			for job := range p.jobs {
+				thumb, err := index(job)
+				p.results <- &indexResult{indexJob: job, thumb: thumb, err: err}
+			}
+		}()
+	}
+	return p
+}
+
+// Submit the job to a worker, collecting the results while all of them are busy.
+// It returns the sequence number of the job, for WaitFor.
+func (p *indexPool) Submit(job indexJob) int {
+	job.seq = p.submitted
+	p.submitted++
+	for {
+		select {
+		case p.jobs <- job:
+			return job.seq
+		case r := <-p.results:
+			p.receive(r)
+		}
+	}
+}
+
+// WaitFor collects the results until the one of the job seq is collected.
+func (p *indexPool) WaitFor(seq int) {
+	for p.collected <= seq {
+		p.receive(<-p.results)
+	}
+}
+
+// Close collects the results of all the jobs submitted, and stops the workers.
+func (p *indexPool) Close() {
+	close(p.jobs)
+	p.WaitFor(p.submitted - 1)
+	p.wg.Wait()
+}
+
+// InFlight is the number of the jobs submitted, but not collected yet.
+func (p *indexPool) InFlight() int { return p.submitted - p.collected }
+
+// receive the result, collecting it and the pending ones following it, if it's their turn.
+func (p *indexPool) receive(r *indexResult) {
+	p.pending[r.seq] = r
+	for {
+		r, ok := p.pending[p.collected]
+		if !ok {
+			return
+		}
+		delete(p.pending, p.collected)
+		p.collected++
+		p.collect(r)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// concurrencyMetric is the average color compared as a custom metric,
+// counting the most calls of Feature running at the same time.
+type concurrencyMetric struct {
+	running, max atomic.Int32
+}
+
+func (m *concurrencyMetric) Feature(img image.Image) []byte {
+	n := m.running.Add(1)
+	defer m.running.Add(-1)
+	for {
+		if old := m.max.Load(); n <= old || m.max.CompareAndSwap(old, n) {
+			break
+		}
+	}
+	// long enough for the other workers to start theirs
+	time.Sleep(5 * time.Millisecond)
+	c := avgColor(img)
+	return []byte{c.R, c.G, c.B}
+}
+
+func (m *concurrencyMetric) Distance(a, b []byte) float64 {
+	var d float64
+	for i := range a {
+		d += float64(absDiff(a[i], b[i]))
+	}
+	return d
+}
+
+var testConcurrency = new(concurrencyMetric)
+
+func init() { RegisterMetric("test-concurrency", testConcurrency) }
+
+func TestJobs(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for i := 0; i < 8; i++ {
+		c := color.NRGBA{R: uint8(30 * i), G: 100, B: uint8(255 - 30*i), A: 255}
+		files = append(files, writeImage(t, dir, fmt.Sprintf("%d.png", i), solidImage(16, 16, c)))
+	}
+	target := synthImage(1, 4*Width, 4*Width)
+	for _, tc := range []struct {
+		Jobs int
+		// Parallel is whether more than one call is expected at the same time
+		Parallel bool
+	}{
+		{Jobs: 1},
+		{Jobs: 4, Parallel: true},
+	} {
+		t.Run(fmt.Sprintf("jobs=%d", tc.Jobs), func(t *testing.T) {
+			opts := testOptions()
+			opts.Workers = tc.Jobs
+			opts.Grid = Grid{Cols: 4, Rows: 4}
+			opts.Match.Metric = Metric("test-concurrency")
+			b := NewBuilder(opts)
+			ctx := context.Background()
+			check := func(phase string) {
+				t.Helper()
+				if got := testConcurrency.max.Swap(0); (got > 1) != tc.Parallel || got > int32(tc.Jobs) {
+					t.Errorf("%s: at most %d at the same time with -jobs %d", phase, got, tc.Jobs)
+				}
+			}
+			testConcurrency.max.Store(0)
+			if err := b.AddSources(ctx, files); err != nil {
+				t.Fatal(err)
+			}
+			check("indexing")
+			if _, err := b.BuildImage(ctx, "target", target); err != nil {
+				t.Fatal(err)
+			}
+			check("matching")
+		})
+	}
+}